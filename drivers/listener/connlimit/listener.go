@@ -0,0 +1,396 @@
+// Package connlimit provides a net.Listener which limits the rate of new connections, and the number of concurrent
+// open connections, of each source IP address, before any TLS handshake or request parsing.
+//
+// It works with every server accepting connections from a net.Listener, such as net/http and fasthttp.
+package connlimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+)
+
+// ErrListenerClosed is returned by Accept once the listener has been closed.
+var ErrListenerClosed = errors.New("connlimit: listener is closed")
+
+// DefaultTimeout is the default timeout of a check of the limiter.
+const DefaultTimeout = time.Second
+
+// DefaultMaxPending is the default maximum number of connections being checked at once.
+const DefaultMaxPending = 1024
+
+// Reason is the reason why a connection has been rejected.
+type Reason int
+
+const (
+	// ReasonRate is the reason of a connection rejected because its source has opened too many connections.
+	ReasonRate Reason = iota + 1
+	// ReasonConcurrency is the reason of a connection rejected because its source has too many open connections.
+	ReasonConcurrency
+	// ReasonDenied is the reason of a connection rejected because its source is in the denylist of the limiter.
+	ReasonDenied
+	// ReasonOverload is the reason of a connection rejected because too many connections are being checked.
+	ReasonOverload
+)
+
+// String returns the name of the reason.
+func (reason Reason) String() string {
+	switch reason {
+	case ReasonRate:
+		return "rate"
+	case ReasonConcurrency:
+		return "concurrency"
+	case ReasonDenied:
+		return "denied"
+	case ReasonOverload:
+		return "overload"
+	default:
+		return "unknown"
+	}
+}
+
+// Options are options for the connection limiting listener.
+type Options struct {
+	// MaxConnsPerIP is the maximum number of concurrent open connections of each source, whose IP address is masked
+	// like the rate. Concurrent connections are not limited if zero.
+	MaxConnsPerIP int
+	// Timeout is the timeout of a check of the limiter. DefaultTimeout is used if zero.
+	Timeout time.Duration
+	// MaxPending is the maximum number of connections being checked at once. New connections are closed as soon as
+	// they are accepted while it's reached, so a flood can't exhaust memory. DefaultMaxPending is used if zero.
+	MaxPending int
+	// OnRejected is called with a rejected connection, before it's closed.
+	OnRejected func(conn net.Conn, reason Reason)
+	// OnError is called when the limiter returns an error. The connection is accepted, so that an unavailable
+	// store doesn't reject every client.
+	OnError func(conn net.Conn, err error)
+}
+
+// Stats are the metrics of a listener.
+type Stats struct {
+	// Accepted is the number of accepted connections.
+	Accepted int64
+	// Rejected is the number of rejected connections, for each reason.
+	Rejected map[Reason]int64
+	// Errors is the number of errors returned by the limiter.
+	Errors int64
+	// Open is the number of open connections which are tracked for concurrency.
+	Open int64
+}
+
+// Listener is a net.Listener which closes connections exceeding the limits of their source, as soon as they are
+// accepted.
+// Connections are accepted by a goroutine, and each one is checked in its own goroutine: a slow store, or a slow
+// client behind a PROXY protocol listener, doesn't block other connections. At most MaxPending connections are
+// checked at once: excess connections are rejected with ReasonOverload.
+type Listener struct {
+	net.Listener
+	// limiter limits the rate of new connections. Its rate, prefix levels and lists are used.
+	limiter *limiter.Limiter
+	// options are the options of the listener.
+	options Options
+	// accepted, rejected and errors are the counters of the metrics.
+	accepted int64
+	rejected [ReasonOverload + 1]int64
+	errors   int64
+	// mutex protects conns and pending.
+	mutex sync.Mutex
+	// conns is the number of open connections of each source.
+	conns map[string]int
+	// pending contains the connections being checked, which are closed with the listener.
+	pending map[net.Conn]struct{}
+	// slots is a semaphore bounding the number of connections being checked.
+	slots chan struct{}
+	// ready receives the connections which have passed the checks, and failures the temporary errors of the
+	// wrapped listener.
+	ready    chan net.Conn
+	failures chan error
+	// stopped is closed when the wrapped listener has returned err, which isn't temporary.
+	stopped chan struct{}
+	err     error
+	// done is closed when the listener is closed.
+	done chan struct{}
+	// startOnce is used to start the accept goroutine on the first call to Accept.
+	startOnce sync.Once
+	// closeOnce is used to close the listener only once.
+	closeOnce sync.Once
+}
+
+// NewListener returns a listener which limits the connections accepted by given listener, with given limiter.
+// A limiter dedicated to connections should be used, since its keys are the same as the ones of HTTP middlewares.
+//
+// The remote address of connections is used: with a PROXY protocol listener, it should wrap this listener to limit
+// clients. Their header is then read by the goroutine checking the connection, before it's returned by Accept.
+func NewListener(listener net.Listener, limiter *limiter.Limiter, options Options) *Listener {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.MaxPending <= 0 {
+		options.MaxPending = DefaultMaxPending
+	}
+
+	return &Listener{
+		Listener: listener,
+		limiter:  limiter,
+		options:  options,
+		conns:    map[string]int{},
+		pending:  map[net.Conn]struct{}{},
+		slots:    make(chan struct{}, options.MaxPending),
+		ready:    make(chan net.Conn),
+		failures: make(chan error),
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection which doesn't exceed the limits of its source.
+// Connections exceeding them are closed as soon as they have been checked.
+func (listener *Listener) Accept() (net.Conn, error) {
+	listener.startOnce.Do(func() {
+		go listener.run()
+	})
+
+	select {
+	case conn := <-listener.ready:
+		return conn, nil
+	case err := <-listener.failures:
+		return nil, err
+	case <-listener.stopped:
+		return nil, listener.err
+	case <-listener.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the listener. Connections which are still being checked are closed.
+func (listener *Listener) Close() error {
+	err := listener.Listener.Close()
+	listener.closeOnce.Do(func() {
+		listener.mutex.Lock()
+		close(listener.done)
+		for conn := range listener.pending {
+			_ = conn.Close()
+		}
+		listener.mutex.Unlock()
+	})
+	return err
+}
+
+// run accepts connections from the wrapped listener, and checks each one in its own goroutine, until it returns an
+// error which isn't temporary. Errors of the wrapped listener are returned by Accept.
+// Connections accepted while MaxPending connections are being checked are rejected immediately.
+func (listener *Listener) run() {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				select {
+				case listener.failures <- err:
+					continue
+				case <-listener.done:
+					return
+				}
+			}
+
+			listener.err = err
+			close(listener.stopped)
+			return
+		}
+
+		select {
+		case listener.slots <- struct{}{}:
+			go listener.handle(conn)
+		default:
+			listener.reject(conn, ReasonOverload)
+		}
+	}
+}
+
+// handle checks given connection, and hands it to Accept if it's accepted.
+// It releases the slot acquired by run for the connection once it's done.
+func (listener *Listener) handle(conn net.Conn) {
+	defer func() {
+		<-listener.slots
+	}()
+
+	if !listener.track(conn) {
+		_ = conn.Close()
+		return
+	}
+
+	checked, reason := listener.check(conn)
+	listener.untrack(conn)
+
+	if reason != 0 {
+		listener.reject(checked, reason)
+		return
+	}
+
+	atomic.AddInt64(&listener.accepted, 1)
+	select {
+	case listener.ready <- checked:
+	case <-listener.done:
+		atomic.AddInt64(&listener.accepted, -1)
+		_ = checked.Close()
+	}
+}
+
+// reject closes given connection, rejected for given reason.
+func (listener *Listener) reject(conn net.Conn, reason Reason) {
+	atomic.AddInt64(&listener.rejected[reason], 1)
+	if listener.options.OnRejected != nil {
+		listener.options.OnRejected(conn, reason)
+	}
+	_ = conn.Close()
+}
+
+// Stats returns the metrics of the listener.
+func (listener *Listener) Stats() Stats {
+	stats := Stats{
+		Accepted: atomic.LoadInt64(&listener.accepted),
+		Rejected: map[Reason]int64{},
+		Errors:   atomic.LoadInt64(&listener.errors),
+	}
+	for reason := ReasonRate; reason <= ReasonOverload; reason++ {
+		stats.Rejected[reason] = atomic.LoadInt64(&listener.rejected[reason])
+	}
+
+	listener.mutex.Lock()
+	for _, count := range listener.conns {
+		stats.Open += int64(count)
+	}
+	listener.mutex.Unlock()
+
+	return stats
+}
+
+// check returns the connection to use if given connection is accepted, or the reason why it's rejected.
+// Connections without IP address, and connections of the allowlist of the limiter, are always accepted.
+// Concurrency is checked first, so a connection rejected for concurrency doesn't use the rate of its source.
+func (listener *Listener) check(conn net.Conn) (net.Conn, Reason) {
+	ip := remoteIP(conn.RemoteAddr())
+	if ip == nil {
+		return conn, 0
+	}
+
+	switch listener.limiter.CheckIP(ip) {
+	case limiter.IPDenied:
+		return conn, ReasonDenied
+	case limiter.IPAllowed:
+		return conn, 0
+	}
+
+	key := ""
+	if listener.options.MaxConnsPerIP > 0 {
+		key = listener.limiter.MaskIP(ip).String()
+		if !listener.acquire(key) {
+			return conn, ReasonConcurrency
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), listener.options.Timeout)
+	lctx, err := listener.limiter.GetIPPrefixes(ctx, ip)
+	cancel()
+
+	switch {
+	case err != nil:
+		atomic.AddInt64(&listener.errors, 1)
+		if listener.options.OnError != nil {
+			listener.options.OnError(conn, err)
+		}
+	case lctx.Reached:
+		if key != "" {
+			listener.release(key)
+		}
+		return conn, ReasonRate
+	}
+
+	if key == "" {
+		return conn, 0
+	}
+
+	return &trackedConn{Conn: conn, listener: listener, key: key}, 0
+}
+
+// track adds given connection to the pending connections, unless the listener is closed.
+func (listener *Listener) track(conn net.Conn) bool {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	select {
+	case <-listener.done:
+		return false
+	default:
+		listener.pending[conn] = struct{}{}
+		return true
+	}
+}
+
+// untrack removes given connection from the pending connections.
+func (listener *Listener) untrack(conn net.Conn) {
+	listener.mutex.Lock()
+	delete(listener.pending, conn)
+	listener.mutex.Unlock()
+}
+
+// acquire increments the number of open connections of given source, unless it has reached the maximum.
+func (listener *Listener) acquire(key string) bool {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.conns[key] >= listener.options.MaxConnsPerIP {
+		return false
+	}
+	listener.conns[key]++
+	return true
+}
+
+// release decrements the number of open connections of given source.
+func (listener *Listener) release(key string) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	listener.conns[key]--
+	if listener.conns[key] <= 0 {
+		delete(listener.conns, key)
+	}
+}
+
+// remoteIP returns the IP address of given remote address, or nil if it hasn't one.
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	if addr == nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// trackedConn is a connection counted in the open connections of its source until it's closed.
+type trackedConn struct {
+	net.Conn
+	listener *Listener
+	key      string
+	once     sync.Once
+}
+
+// Close closes the connection, and releases its slot.
+func (conn *trackedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.once.Do(func() {
+		conn.listener.release(conn.key)
+	})
+	return err
+}
@@ -0,0 +1,341 @@
+package connlimit_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	libfasthttp "github.com/valyala/fasthttp"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/listener/connlimit"
+	"github.com/panii/limiter/v3/drivers/listener/proxyproto"
+	"github.com/panii/limiter/v3/drivers/store/memory"
+)
+
+func TestListenerRate(t *testing.T) {
+	is := require.New(t)
+
+	rejected := []connlimit.Reason{}
+	mutex := sync.Mutex{}
+
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 2, Period: time.Minute})
+	listener, conns := listen(is, instance, connlimit.Options{
+		OnRejected: func(conn net.Conn, reason connlimit.Reason) {
+			mutex.Lock()
+			rejected = append(rejected, reason)
+			mutex.Unlock()
+		},
+	})
+	defer listener.Close()
+
+	for i := 0; i < 2; i++ {
+		client := dial(is, listener)
+		defer client.Close()
+		is.NotNil(<-conns)
+	}
+
+	// Excess connections are closed immediately.
+	client := dial(is, listener)
+	defer client.Close()
+	is.True(closed(client))
+
+	mutex.Lock()
+	is.Equal([]connlimit.Reason{connlimit.ReasonRate}, rejected)
+	mutex.Unlock()
+
+	stats := listener.Stats()
+	is.Equal(int64(2), stats.Accepted)
+	is.Equal(int64(1), stats.Rejected[connlimit.ReasonRate])
+	is.Equal(int64(0), stats.Rejected[connlimit.ReasonConcurrency])
+	is.Equal(int64(0), stats.Open)
+}
+
+func TestListenerConcurrency(t *testing.T) {
+	is := require.New(t)
+
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 100, Period: time.Minute})
+	listener, conns := listen(is, instance, connlimit.Options{MaxConnsPerIP: 2})
+	defer listener.Close()
+
+	accepted := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		client := dial(is, listener)
+		defer client.Close()
+		accepted = append(accepted, <-conns)
+	}
+	is.Equal(int64(2), listener.Stats().Open)
+
+	client := dial(is, listener)
+	defer client.Close()
+	is.True(closed(client))
+
+	// Closing a connection releases its slot, once.
+	is.NoError(accepted[0].Close())
+	_ = accepted[0].Close()
+	is.Equal(int64(1), listener.Stats().Open)
+
+	client = dial(is, listener)
+	defer client.Close()
+	is.NotNil(<-conns)
+
+	stats := listener.Stats()
+	is.Equal(int64(3), stats.Accepted)
+	is.Equal(int64(1), stats.Rejected[connlimit.ReasonConcurrency])
+	is.Equal(int64(2), stats.Open)
+}
+
+func TestListenerConcurrencyBeforeRate(t *testing.T) {
+	is := require.New(t)
+
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 2, Period: time.Minute})
+	listener, conns := listen(is, instance, connlimit.Options{MaxConnsPerIP: 1})
+	defer listener.Close()
+
+	client := dial(is, listener)
+	defer client.Close()
+	conn := <-conns
+
+	// A connection rejected for concurrency doesn't use the rate of its source.
+	client = dial(is, listener)
+	defer client.Close()
+	is.True(closed(client))
+
+	is.NoError(conn.Close())
+	client = dial(is, listener)
+	defer client.Close()
+	is.NotNil(<-conns)
+
+	stats := listener.Stats()
+	is.Equal(int64(2), stats.Accepted)
+	is.Equal(int64(1), stats.Rejected[connlimit.ReasonConcurrency])
+	is.Equal(int64(0), stats.Rejected[connlimit.ReasonRate])
+}
+
+func TestListenerOverload(t *testing.T) {
+	is := require.New(t)
+
+	store := &blockingStore{Store: memory.NewStore(), release: make(chan struct{})}
+	instance := limiter.New(store, limiter.Rate{Limit: 100, Period: time.Minute})
+	listener, conns := listen(is, instance, connlimit.Options{MaxPending: 1})
+	defer listener.Close()
+
+	client := dial(is, listener)
+	defer client.Close()
+
+	// The first connection is being checked: the next one is rejected without any check.
+	overloaded := dial(is, listener)
+	defer overloaded.Close()
+	is.True(closed(overloaded))
+	is.Equal(int64(1), listener.Stats().Rejected[connlimit.ReasonOverload])
+
+	close(store.release)
+	is.NotNil(<-conns)
+	is.Equal(int64(1), listener.Stats().Accepted)
+}
+
+func TestListenerLists(t *testing.T) {
+	is := require.New(t)
+
+	_, network, err := net.ParseCIDR("127.0.0.0/8")
+	is.NoError(err)
+	list, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	// Sources of the allowlist are never limited.
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 1, Period: time.Minute}, limiter.WithAllowlist(list))
+	listener, conns := listen(is, instance, connlimit.Options{MaxConnsPerIP: 1})
+
+	for i := 0; i < 3; i++ {
+		client := dial(is, listener)
+		defer client.Close()
+		is.NotNil(<-conns)
+	}
+	is.NoError(listener.Close())
+
+	// Sources of the denylist are always rejected.
+	instance = limiter.New(memory.NewStore(), limiter.Rate{Limit: 1, Period: time.Minute}, limiter.WithDenylist(list))
+	listener, _ = listen(is, instance, connlimit.Options{})
+	defer listener.Close()
+
+	client := dial(is, listener)
+	defer client.Close()
+	is.True(closed(client))
+	is.Equal(int64(1), listener.Stats().Rejected[connlimit.ReasonDenied])
+}
+
+func TestListenerError(t *testing.T) {
+	is := require.New(t)
+
+	errs := make(chan error, 1)
+	instance := limiter.New(failingStore{}, limiter.Rate{Limit: 1, Period: time.Minute})
+	listener, conns := listen(is, instance, connlimit.Options{
+		OnError: func(conn net.Conn, err error) {
+			errs <- err
+		},
+	})
+	defer listener.Close()
+
+	// Connections are accepted when the store is unavailable.
+	client := dial(is, listener)
+	defer client.Close()
+	is.NotNil(<-conns)
+	is.Error(<-errs)
+	is.Equal(int64(1), listener.Stats().Errors)
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	is := require.New(t)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 10, Period: time.Minute})
+	loopback := []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+	listener := connlimit.NewListener(proxyproto.NewListener(inner, proxyproto.Options{TrustedSources: loopback}),
+		instance, connlimit.Options{})
+	defer listener.Close()
+
+	// A client which hasn't sent its header yet doesn't block the others.
+	slow := dial(is, listener)
+	defer slow.Close()
+
+	client := dial(is, listener)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	is.NoError(err)
+
+	conn, err := listener.Accept()
+	is.NoError(err)
+	defer conn.Close()
+	is.Equal("192.0.2.1:56324", conn.RemoteAddr().String())
+
+	// Closing the listener releases the connections being checked.
+	is.NoError(listener.Close())
+	_, err = listener.Accept()
+	is.Error(err)
+	is.True(closed(slow))
+}
+
+func TestListenerHTTP(t *testing.T) {
+	is := require.New(t)
+
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 2, Period: time.Minute})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() {
+		_ = server.Serve(connlimit.NewListener(listener, instance, connlimit.Options{}))
+	}()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 1; i <= 3; i++ {
+		resp, err := client.Get("http://" + listener.Addr().String())
+		if i <= 2 {
+			is.NoError(err)
+			is.Equal(http.StatusOK, resp.StatusCode)
+			is.NoError(resp.Body.Close())
+		} else {
+			is.Error(err)
+		}
+	}
+}
+
+func TestListenerFasthttp(t *testing.T) {
+	is := require.New(t)
+
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 100, Period: time.Minute})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	limited := connlimit.NewListener(listener, instance, connlimit.Options{MaxConnsPerIP: 1})
+	server := &libfasthttp.Server{Handler: func(ctx *libfasthttp.RequestCtx) {}}
+	go func() {
+		_ = server.Serve(limited)
+	}()
+	defer listener.Close()
+
+	// A keep-alive connection holds the only slot of the client.
+	client := &libfasthttp.Client{MaxConnsPerHost: 2}
+	status, _, err := client.Get(nil, "http://"+listener.Addr().String())
+	is.NoError(err)
+	is.Equal(libfasthttp.StatusOK, status)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	is.NoError(err)
+	defer conn.Close()
+	is.True(closed(conn))
+
+	is.Equal(int64(1), limited.Stats().Rejected[connlimit.ReasonConcurrency])
+}
+
+// listen returns a limiting listener, and a channel of the connections it accepts.
+func listen(is *require.Assertions, instance *limiter.Limiter,
+	options connlimit.Options) (*connlimit.Listener, chan net.Conn) {
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	listener := connlimit.NewListener(inner, instance, options)
+	conns := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	return listener, conns
+}
+
+// dial returns a client connected to given listener.
+func dial(is *require.Assertions, listener net.Listener) net.Conn {
+	client, err := net.Dial("tcp", listener.Addr().String())
+	is.NoError(err)
+	return client
+}
+
+// closed returns true if the server closes given connection.
+func closed(conn net.Conn) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := ioutil.ReadAll(conn)
+	return err == nil
+}
+
+// failingStore is a store which always returns an error.
+type failingStore struct{}
+
+func (failingStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return limiter.Context{}, errors.New("store is unavailable")
+}
+
+func (failingStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return limiter.Context{}, errors.New("store is unavailable")
+}
+
+func (failingStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return limiter.Context{}, errors.New("store is unavailable")
+}
+
+// blockingStore is a store whose Get waits until release is closed.
+type blockingStore struct {
+	limiter.Store
+	release chan struct{}
+}
+
+func (store *blockingStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	<-store.release
+	return store.Store.Get(ctx, key, rate)
+}
@@ -0,0 +1,186 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// v1Signature is the signature of a version 1 header.
+	v1Signature = "PROXY "
+	// v1MaxLength is the maximum length of a version 1 header, including its CRLF.
+	v1MaxLength = 107
+
+	// v2Signature is the signature of a version 2 header.
+	v2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+	// v2HeaderLength is the length of a version 2 header, without its addresses.
+	v2HeaderLength = 16
+)
+
+// Commands and families of a version 2 header.
+const (
+	v2CommandLocal = 0x0
+	v2CommandProxy = 0x1
+	v2FamilyInet   = 0x1
+	v2FamilyInet6  = 0x2
+	v2TransportTCP = 0x1
+)
+
+// readHeader reads the PROXY header at the beginning of given reader, and returns the addresses of the client and of
+// the server. Addresses are nil if there is no header, or if the header doesn't have them (e.g. health checks of
+// the load balancer).
+func readHeader(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	ok, err := hasSignature(reader, v1Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		return readHeaderV1(reader)
+	}
+
+	ok, err = hasSignature(reader, v2Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		return readHeaderV2(reader)
+	}
+
+	return nil, nil, nil
+}
+
+// hasSignature returns true if the buffered data starts with given signature.
+// Bytes are peeked one by one, so data shorter than the signature isn't waited for if it doesn't match.
+func hasSignature(reader *bufio.Reader, signature string) (bool, error) {
+	for i := 1; i <= len(signature); i++ {
+		data, err := reader.Peek(i)
+		if err != nil {
+			return false, err
+		}
+		if data[i-1] != signature[i-1] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// readHeaderV1 reads a human-readable header, such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength {
+			return nil, nil, errors.New("version 1 header is too long")
+		}
+
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[len(v1Signature):len(line)-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		// The rest of the line must be ignored.
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errors.Errorf("unsupported protocol %q", fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, nil, errors.New("invalid version 1 header")
+	}
+
+	remoteAddr, err := parseAddrV1(fields[1], fields[3], fields[0] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	localAddr, err := parseAddrV1(fields[2], fields[4], fields[0] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return remoteAddr, localAddr, nil
+}
+
+// parseAddrV1 parses an address and a port of a version 1 header.
+func parseAddrV1(host string, port string, v4 bool) (*net.TCPAddr, error) {
+	// Addresses of TCP4 are dotted, and addresses of TCP6 have colons.
+	ip := net.ParseIP(host)
+	if ip == nil || v4 != (strings.IndexByte(host, ':') < 0) {
+		return nil, errors.Errorf("invalid address %q", host)
+	}
+	if v4 {
+		ip = ip.To4()
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, errors.Errorf("invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(number)}, nil
+}
+
+// readHeaderV2 reads a binary header, whose addresses are followed by optional TLVs, which are skipped.
+func readHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, v2HeaderLength)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0xf
+	family, transport := header[13]>>4, header[13]&0xf
+	length := int(binary.BigEndian.Uint16(header[14:]))
+
+	if version != 2 {
+		return nil, nil, errors.Errorf("unsupported version %d", version)
+	}
+	if command != v2CommandLocal && command != v2CommandProxy {
+		return nil, nil, errors.Errorf("unsupported command %d", command)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Connections established by the load balancer itself, and unsupported families, keep their own addresses.
+	if command == v2CommandLocal || transport != v2TransportTCP {
+		return nil, nil, nil
+	}
+
+	size := 0
+	switch family {
+	case v2FamilyInet:
+		size = net.IPv4len
+	case v2FamilyInet6:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if length < 2*size+4 {
+		return nil, nil, errors.New("version 2 header is too short")
+	}
+
+	remoteAddr := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	localAddr := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+
+	return remoteAddr, localAddr, nil
+}
@@ -0,0 +1,182 @@
+// Package proxyproto provides a net.Listener which reads HAProxy PROXY protocol headers, version 1 and 2, sent by
+// TCP load balancers.
+//
+// Connections report the address of the original client as their remote address, so the IP address returned by
+// limiter.GetIP, limiter.GetIPWithMask and the DefaultKeyGetter of fasthttp middleware is the one of the client,
+// instead of the one of the load balancer.
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHeaderTimeout is the default timeout to read the PROXY header of a connection.
+const DefaultHeaderTimeout = 5 * time.Second
+
+// Options are options for the PROXY protocol listener.
+type Options struct {
+	// TrustedSources are the networks of the load balancers allowed to send a PROXY header.
+	// Connections from other sources are left untouched, so their header (if any) is never trusted.
+	// It's required: if empty, no source is trusted. Every source can be trusted explicitly with 0.0.0.0/0 and ::/0,
+	// if the listener is only reachable by load balancers.
+	TrustedSources []*net.IPNet
+	// HeaderTimeout is the timeout to read the PROXY header of a connection. DefaultHeaderTimeout is used if zero.
+	HeaderTimeout time.Duration
+}
+
+// Listener is a net.Listener which reads the PROXY header of the connections from trusted sources.
+type Listener struct {
+	net.Listener
+	options Options
+}
+
+// NewListener returns a listener which reads the PROXY header of connections accepted by given listener.
+func NewListener(listener net.Listener, options Options) *Listener {
+	if options.HeaderTimeout <= 0 {
+		options.HeaderTimeout = DefaultHeaderTimeout
+	}
+
+	return &Listener{
+		Listener: listener,
+		options:  options,
+	}
+}
+
+// Accept waits for and returns the next connection.
+// The PROXY header is read lazily, on the first call to Read, RemoteAddr or LocalAddr of the connection, so a slow
+// client can't block the accept loop: these calls block until the header has been read, for at most HeaderTimeout.
+func (listener *Listener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !listener.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: listener.options.HeaderTimeout,
+	}, nil
+}
+
+// trusted returns true if given address belongs to a trusted source.
+func (listener *Listener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range listener.options.TrustedSources {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted source, which may start with a PROXY header.
+type Conn struct {
+	net.Conn
+	// reader buffers the data read after the header.
+	reader *bufio.Reader
+	// timeout is the timeout to read the header.
+	timeout time.Duration
+	// once is used to read the header only once.
+	once sync.Once
+	// remoteAddr and localAddr are the addresses of the header, or nil if it has none.
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	// err is the error which has occurred while reading the header.
+	err error
+	// mutex protects deadline.
+	mutex sync.Mutex
+	// deadline is the read deadline set by the application, which is restored after the header has been read.
+	deadline time.Time
+}
+
+// Read reads data after the PROXY header.
+func (conn *Conn) Read(data []byte) (int, error) {
+	err := conn.init()
+	if err != nil {
+		return 0, err
+	}
+	return conn.reader.Read(data)
+}
+
+// RemoteAddr returns the address of the client given by the PROXY header, or the address of the peer if the
+// connection has no header, or if it can't be read.
+// WARNING: unlike the RemoteAddr of a net.Conn, it blocks until the header has been read, for at most HeaderTimeout,
+// if it hasn't been read by a previous call.
+func (conn *Conn) RemoteAddr() net.Addr {
+	_ = conn.init()
+	if conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address of the server given by the PROXY header, or the local address if the connection
+// has no header, or if it can't be read.
+// Like RemoteAddr, it blocks until the header has been read.
+func (conn *Conn) LocalAddr() net.Addr {
+	_ = conn.init()
+	if conn.localAddr != nil {
+		return conn.localAddr
+	}
+	return conn.Conn.LocalAddr()
+}
+
+// SourceAddr returns the address of the peer, which is the load balancer if the connection has a PROXY header.
+func (conn *Conn) SourceAddr() net.Addr {
+	return conn.Conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines.
+func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	conn.deadline = t
+	conn.mutex.Unlock()
+
+	return conn.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline.
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	conn.deadline = t
+	conn.mutex.Unlock()
+
+	return conn.Conn.SetReadDeadline(t)
+}
+
+// init reads the PROXY header once, and returns the error which has occurred if it's invalid.
+// The connection is closed if its header is invalid, or if it can't be read before the timeout.
+func (conn *Conn) init() error {
+	conn.once.Do(func() {
+		err := conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+		if err == nil {
+			conn.remoteAddr, conn.localAddr, err = readHeader(conn.reader)
+		}
+
+		conn.mutex.Lock()
+		deadline := conn.deadline
+		conn.mutex.Unlock()
+
+		if err == nil {
+			err = conn.Conn.SetReadDeadline(deadline)
+		}
+		if err != nil {
+			conn.err = errors.Wrap(err, "proxyproto: cannot read header")
+			_ = conn.Conn.Close()
+		}
+	})
+	return conn.err
+}
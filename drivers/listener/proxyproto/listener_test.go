@@ -0,0 +1,315 @@
+package proxyproto_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	libfasthttp "github.com/valyala/fasthttp"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/listener/proxyproto"
+	"github.com/panii/limiter/v3/drivers/middleware/fasthttp"
+)
+
+func TestListenerHeaders(t *testing.T) {
+	is := require.New(t)
+
+	scenarios := []struct {
+		header     []byte
+		remoteAddr string
+		localAddr  string
+	}{
+		{
+			//
+			// Scenario #1 : Connection without header.
+			//
+			header: nil,
+		},
+		{
+			//
+			// Scenario #2 : Version 1 header with IPv4 addresses.
+			//
+			header:     []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			remoteAddr: "192.0.2.1:56324",
+			localAddr:  "198.51.100.1:443",
+		},
+		{
+			//
+			// Scenario #3 : Version 1 header with IPv6 addresses.
+			//
+			header:     []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			remoteAddr: "[2001:db8::1]:56324",
+			localAddr:  "[2001:db8::2]:443",
+		},
+		{
+			//
+			// Scenario #4 : Version 1 header with unknown protocol.
+			//
+			header: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+		},
+		{
+			//
+			// Scenario #5 : Version 2 header with IPv4 addresses and a TLV.
+			//
+			header: headerV2(0x21, 0x11,
+				[]byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb},
+				[]byte{0x04, 0x00, 0x01, 0x00}),
+			remoteAddr: "192.0.2.1:56324",
+			localAddr:  "198.51.100.1:443",
+		},
+		{
+			//
+			// Scenario #6 : Version 2 header with IPv6 addresses.
+			//
+			header: headerV2(0x21, 0x21,
+				net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), []byte{0xdc, 0x04, 0x01, 0xbb}),
+			remoteAddr: "[2001:db8::1]:56324",
+			localAddr:  "[2001:db8::2]:443",
+		},
+		{
+			//
+			// Scenario #7 : Version 2 header of a health check.
+			//
+			header: headerV2(0x20, 0x00),
+		},
+	}
+
+	for i, scenario := range scenarios {
+		message := func(name string) string {
+			return fmt.Sprintf("Scenario #%d: %s", i+1, name)
+		}
+
+		listener, client := dial(is, proxyproto.Options{TrustedSources: loopback})
+
+		_, err := client.Write(append(scenario.header, "hello"...))
+		is.NoError(err)
+		is.NoError(client.Close())
+
+		conn, err := listener.Accept()
+		is.NoError(err)
+
+		data, err := ioutil.ReadAll(conn)
+		is.NoError(err, message("data"))
+		is.Equal("hello", string(data), message("data"))
+
+		if scenario.remoteAddr == "" {
+			is.Equal(client.LocalAddr().String(), conn.RemoteAddr().String(), message("remote address"))
+			is.Equal(client.RemoteAddr().String(), conn.LocalAddr().String(), message("local address"))
+		} else {
+			is.Equal(scenario.remoteAddr, conn.RemoteAddr().String(), message("remote address"))
+			is.Equal(scenario.localAddr, conn.LocalAddr().String(), message("local address"))
+		}
+		is.Equal(client.LocalAddr().String(), conn.(*proxyproto.Conn).SourceAddr().String(), message("source"))
+
+		is.NoError(conn.Close())
+		is.NoError(listener.Close())
+	}
+}
+
+func TestListenerInvalidHeaders(t *testing.T) {
+	is := require.New(t)
+
+	headers := [][]byte{
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"),
+		[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n"),
+		[]byte("PROXY TCP6 192.0.2.1 2001:db8::2 56324 443\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"),
+		[]byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+		append([]byte("PROXY TCP4 "), make([]byte, 120)...),
+		headerV2(0x11, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}),
+		headerV2(0x21, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1}),
+	}
+
+	for _, header := range headers {
+		listener, client := dial(is, proxyproto.Options{TrustedSources: loopback})
+
+		_, err := client.Write(append(header, "hello"...))
+		is.NoError(err)
+
+		conn, err := listener.Accept()
+		is.NoError(err)
+
+		_, err = conn.Read(make([]byte, 16))
+		is.Error(err, "%q", header)
+
+		// The address of the peer is kept.
+		is.Equal(client.LocalAddr().String(), conn.RemoteAddr().String())
+
+		is.NoError(client.Close())
+		is.NoError(listener.Close())
+	}
+}
+
+func TestListenerTrustedSources(t *testing.T) {
+	is := require.New(t)
+
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	is.NoError(err)
+
+	for _, sources := range [][]*net.IPNet{{network}, nil} {
+		testListenerUntrusted(is, sources)
+	}
+}
+
+// testListenerUntrusted verifies that the header of a client which isn't in given trusted sources is ignored.
+func testListenerUntrusted(is *require.Assertions, sources []*net.IPNet) {
+	listener, client := dial(is, proxyproto.Options{TrustedSources: sources})
+	defer listener.Close()
+	defer client.Close()
+
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+	_, err := client.Write([]byte(header))
+	is.NoError(err)
+
+	conn, err := listener.Accept()
+	is.NoError(err)
+	defer conn.Close()
+
+	// The header of an untrusted source is left untouched, and no source is trusted without TrustedSources.
+	_, ok := conn.(*proxyproto.Conn)
+	is.False(ok)
+	is.Equal(client.LocalAddr().String(), conn.RemoteAddr().String())
+
+	data := make([]byte, len(header))
+	_, err = conn.Read(data)
+	is.NoError(err)
+	is.Equal(header, string(data))
+}
+
+func TestListenerHeaderTimeout(t *testing.T) {
+	is := require.New(t)
+
+	listener, client := dial(is, proxyproto.Options{TrustedSources: loopback, HeaderTimeout: 50 * time.Millisecond})
+	defer listener.Close()
+	defer client.Close()
+
+	// An incomplete header.
+	_, err := client.Write([]byte("PROXY TCP4 192.0.2.1"))
+	is.NoError(err)
+
+	conn, err := listener.Accept()
+	is.NoError(err)
+
+	start := time.Now()
+	is.Equal(client.LocalAddr().String(), conn.RemoteAddr().String())
+	is.True(time.Since(start) < time.Second)
+
+	_, err = conn.Read(make([]byte, 16))
+	is.Error(err)
+
+	// The deadline of the application is restored once the header has been read.
+	listener2, client2 := dial(is, proxyproto.Options{TrustedSources: loopback, HeaderTimeout: 50 * time.Millisecond})
+	defer listener2.Close()
+	defer client2.Close()
+
+	_, err = client2.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	is.NoError(err)
+
+	conn2, err := listener2.Accept()
+	is.NoError(err)
+	defer conn2.Close()
+
+	is.NoError(conn2.SetReadDeadline(time.Time{}))
+	is.Equal("192.0.2.1:56324", conn2.RemoteAddr().String())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = client2.Write([]byte("hello"))
+	}()
+
+	data := make([]byte, 5)
+	_, err = conn2.Read(data)
+	is.NoError(err)
+	is.Equal("hello", string(data))
+}
+
+func TestListenerHTTP(t *testing.T) {
+	is := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	instance := limiter.New(nil, limiter.Rate{}, limiter.WithIPv4Mask(net.CIDRMask(24, 32)))
+	ips := make(chan string, 2)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ips <- limiter.GetIP(r).String()
+		ips <- instance.GetIPWithMask(r).String()
+	})}
+	go func() {
+		_ = server.Serve(proxyproto.NewListener(listener, proxyproto.Options{TrustedSources: loopback}))
+	}()
+	defer server.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	is.NoError(err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.0\r\n\r\n"))
+	is.NoError(err)
+
+	_, err = ioutil.ReadAll(client)
+	is.NoError(err)
+	is.Equal("192.0.2.1", <-ips)
+	is.Equal("192.0.2.0", <-ips)
+}
+
+func TestListenerFasthttp(t *testing.T) {
+	is := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	keys := make(chan string, 1)
+	server := &libfasthttp.Server{Handler: func(ctx *libfasthttp.RequestCtx) {
+		keys <- fasthttp.DefaultKeyGetter(ctx)
+	}}
+	go func() {
+		_ = server.Serve(proxyproto.NewListener(listener, proxyproto.Options{TrustedSources: loopback}))
+	}()
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	is.NoError(err)
+	defer client.Close()
+
+	_, err = client.Write(append(headerV2(0x21, 0x21,
+		net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), []byte{0xdc, 0x04, 0x01, 0xbb}),
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"...))
+	is.NoError(err)
+
+	_, err = ioutil.ReadAll(client)
+	is.NoError(err)
+	is.Equal("2001:db8::1", <-keys)
+}
+
+// dial returns a PROXY protocol listener, and a client connected to it.
+func dial(is *require.Assertions, options proxyproto.Options) (net.Listener, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	is.NoError(err)
+
+	return proxyproto.NewListener(listener, options), client
+}
+
+// headerV2 returns a version 2 header with given version and command, family and transport, and payload.
+func headerV2(command byte, family byte, payload ...[]byte) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, command, family, 0, 0)
+	for _, data := range payload {
+		header = append(header, data...)
+	}
+	binary.BigEndian.PutUint16(header[14:], uint16(len(header)-16))
+	return header
+}
+
+// loopback trusts the clients of the tests.
+var loopback = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
@@ -1,6 +1,8 @@
 package fasthttp
 
 import (
+	"bytes"
+	"net"
 	"strconv"
 
 	"github.com/panii/limiter/v3"
@@ -12,8 +14,16 @@ type Middleware struct {
 	Limiter        *limiter.Limiter
 	OnError        ErrorHandler
 	OnLimitReached LimitReachedHandler
+	OnDenied       DeniedHandler
 	KeyGetter      KeyGetter
 	ExcludedKey    func(string) bool
+
+	// prefixes is true if the key is the IP address of the client, so the prefix levels of the limiter can be
+	// used instead: a custom KeyGetter disables them.
+	prefixes bool
+	// resolved is true if the key is the IP address of the client resolved from trusted proxies, so it's
+	// shared with the allow and deny lists and the prefix levels instead of being resolved again.
+	resolved bool
 }
 
 // NewMiddleware return a new instance of a fasthttp middleware.
@@ -22,7 +32,8 @@ func NewMiddleware(limiter *limiter.Limiter, options ...Option) *Middleware {
 		Limiter:        limiter,
 		OnError:        DefaultErrorHandler,
 		OnLimitReached: DefaultLimitReachedHandler,
-		KeyGetter:      DefaultKeyGetter,
+		OnDenied:       DefaultDeniedHandler,
+		KeyGetter:      nil,
 		ExcludedKey:    nil,
 	}
 
@@ -30,27 +41,66 @@ func NewMiddleware(limiter *limiter.Limiter, options ...Option) *Middleware {
 		option.apply(middleware)
 	}
 
+	if middleware.KeyGetter == nil {
+		middleware.KeyGetter = DefaultKeyGetter
+		middleware.prefixes = true
+		// The leftmost hop of a forwarding header can be spoofed by the client: the default key only uses the
+		// client IP address if it's resolved from trusted proxies.
+		if len(limiter.Options.TrustedProxies) > 0 {
+			middleware.KeyGetter = func(ctx *fasthttp.RequestCtx) string {
+				return middleware.clientIP(ctx).String()
+			}
+			middleware.resolved = true
+		}
+	}
+
 	return middleware
 }
 
 // Handle fasthttp request.
 func (middleware *Middleware) Handle(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
-		key := middleware.KeyGetter(ctx)
+		// The IP address of the client is only resolved if it's needed, and at most once per request.
+		var ip net.IP
+
+		options := middleware.Limiter.Options
+		if options.Allowlist != nil || options.Denylist != nil {
+			ip = middleware.clientIP(ctx)
+			switch middleware.Limiter.CheckIP(ip) {
+			case limiter.IPDenied:
+				middleware.OnDenied(ctx)
+				return
+			case limiter.IPAllowed:
+				next(ctx)
+				return
+			}
+		}
+
+		var key string
+		if middleware.resolved {
+			if ip == nil {
+				ip = middleware.clientIP(ctx)
+			}
+			key = ip.String()
+		} else {
+			key = middleware.KeyGetter(ctx)
+		}
 		if middleware.ExcludedKey != nil && middleware.ExcludedKey(key) {
 			next(ctx)
 			return
 		}
 
-		context, err := middleware.Limiter.Get(ctx, key)
+		context, err := middleware.get(ctx, key, ip)
 		if err != nil {
 			middleware.OnError(ctx, err)
 			return
 		}
 
-		ctx.Response.Header.Set("X-RateLimit-Limit", strconv.FormatInt(context.Limit, 10))
-		ctx.Response.Header.Set("X-RateLimit-Remaining", strconv.FormatInt(context.Remaining, 10))
-		ctx.Response.Header.Set("X-RateLimit-Reset", strconv.FormatInt(context.Reset, 10))
+		// Header values are copied by fasthttp, so they can be formatted in a buffer on the stack.
+		var scratch [20]byte
+		ctx.Response.Header.SetBytesV("X-RateLimit-Limit", strconv.AppendInt(scratch[:0], context.Limit, 10))
+		ctx.Response.Header.SetBytesV("X-RateLimit-Remaining", strconv.AppendInt(scratch[:0], context.Remaining, 10))
+		ctx.Response.Header.SetBytesV("X-RateLimit-Reset", strconv.AppendInt(scratch[:0], context.Reset, 10))
 
 		if context.Reached {
 			middleware.OnLimitReached(ctx)
@@ -60,3 +110,44 @@ func (middleware *Middleware) Handle(next fasthttp.RequestHandler) fasthttp.Requ
 		next(ctx)
 	}
 }
+
+// get returns the limit for given key, or for every prefix level of the IP address of the client if the limiter
+// defines them for its family, and the middleware uses the default KeyGetter.
+// The IP address of the client is resolved if given one is nil.
+func (middleware *Middleware) get(ctx *fasthttp.RequestCtx, key string, ip net.IP) (limiter.Context, error) {
+	options := middleware.Limiter.Options
+	if middleware.prefixes && (len(options.IPv4Prefixes) > 0 || len(options.IPv6Prefixes) > 0) {
+		if ip == nil {
+			ip = middleware.clientIP(ctx)
+		}
+		if middleware.Limiter.HasPrefixes(ip) {
+			return middleware.Limiter.GetIPPrefixes(ctx, ip)
+		}
+	}
+
+	return middleware.Limiter.Get(ctx, key)
+}
+
+// clientIP returns the IP address of the client, resolved from the forwarding headers like limiter.GetIP if the
+// limiter trusts them, or the IP address of the peer otherwise.
+func (middleware *Middleware) clientIP(ctx *fasthttp.RequestCtx) net.IP {
+	if !trustsHeaders(middleware.Limiter.Options) {
+		return ctx.RemoteIP()
+	}
+
+	return middleware.Limiter.GetIPFromHeaders(ctx.RemoteIP(), func(name string) []string {
+		var values []string
+		target := []byte(name)
+		ctx.Request.Header.VisitAll(func(key []byte, value []byte) {
+			if bytes.EqualFold(key, target) {
+				values = append(values, string(value))
+			}
+		})
+		return values
+	})
+}
+
+// trustsHeaders returns true if given options allow to resolve the client IP address from forwarding headers.
+func trustsHeaders(options limiter.Options) bool {
+	return options.TrustForwardHeader || len(options.TrustedProxies) > 0
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	libfasthttp "github.com/valyala/fasthttp"
@@ -14,6 +15,7 @@ import (
 	"github.com/panii/limiter/v3"
 	"github.com/panii/limiter/v3/drivers/middleware/fasthttp"
 	"github.com/panii/limiter/v3/drivers/store/memory"
+	"github.com/panii/limiter/v3/internal/race"
 )
 
 // nolint: gocyclo
@@ -179,6 +181,183 @@ func TestFasthttpMiddleware(t *testing.T) {
 	}
 }
 
+func TestFasthttpMiddlewareIPLists(t *testing.T) {
+	is := require.New(t)
+
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	is.NoError(err)
+	allowlist, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	_, network, err = net.ParseCIDR("203.0.113.0/24")
+	is.NoError(err)
+	denylist, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	rate := limiter.Rate{Limit: 1, Period: time.Hour}
+	instance := limiter.New(memory.NewStore(), rate, limiter.WithAllowlist(allowlist), limiter.WithDenylist(denylist))
+	handler := fasthttp.NewMiddleware(instance).Handle(func(ctx *libfasthttp.RequestCtx) {
+		ctx.SetStatusCode(libfasthttp.StatusOK)
+	})
+
+	scenarios := []struct {
+		ip       string
+		expected []int
+	}{
+		{ip: "8.8.8.8", expected: []int{libfasthttp.StatusOK, libfasthttp.StatusTooManyRequests}},
+		{ip: "10.0.0.1", expected: []int{libfasthttp.StatusOK, libfasthttp.StatusOK}},
+		{ip: "203.0.113.7", expected: []int{libfasthttp.StatusForbidden, libfasthttp.StatusForbidden}},
+	}
+
+	for _, scenario := range scenarios {
+		for _, expected := range scenario.expected {
+			ctx := &libfasthttp.RequestCtx{}
+			ctx.Init(&libfasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(scenario.ip), Port: 8888}, nil)
+
+			handler(ctx)
+			is.Equal(expected, ctx.Response.StatusCode(), scenario.ip)
+		}
+	}
+}
+
+func TestFasthttpMiddlewareTrustedProxies(t *testing.T) {
+	is := require.New(t)
+
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	is.NoError(err)
+
+	_, network, err := net.ParseCIDR("203.0.113.0/24")
+	is.NoError(err)
+	denylist, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	rate := limiter.Rate{Limit: 1, Period: time.Hour}
+	instance := limiter.New(memory.NewStore(), rate,
+		limiter.WithTrustedProxies([]*net.IPNet{proxies}), limiter.WithDenylist(denylist))
+	handler := fasthttp.NewMiddleware(instance).Handle(func(ctx *libfasthttp.RequestCtx) {
+		ctx.SetStatusCode(libfasthttp.StatusOK)
+	})
+
+	scenarios := []struct {
+		ip        string
+		forwarded []string
+		expected  int
+	}{
+		// Clients behind a trusted proxy are limited and checked against the lists.
+		{ip: "10.0.0.1", forwarded: []string{"203.0.113.7"}, expected: libfasthttp.StatusForbidden},
+		{ip: "10.0.0.1", forwarded: []string{"198.51.100.1"}, expected: libfasthttp.StatusOK},
+		{ip: "10.0.0.2", forwarded: []string{"198.51.100.1"}, expected: libfasthttp.StatusTooManyRequests},
+		{ip: "10.0.0.1", forwarded: []string{"1.2.3.4, 198.51.100.2", "10.0.0.3"}, expected: libfasthttp.StatusOK},
+		// Headers of untrusted peers are ignored.
+		{ip: "8.8.8.8", forwarded: []string{"203.0.113.7"}, expected: libfasthttp.StatusOK},
+		{ip: "8.8.8.8", forwarded: []string{"198.51.100.3"}, expected: libfasthttp.StatusTooManyRequests},
+	}
+
+	for i, scenario := range scenarios {
+		request := &libfasthttp.Request{}
+		for _, value := range scenario.forwarded {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+
+		ctx := &libfasthttp.RequestCtx{}
+		ctx.Init(request, &net.TCPAddr{IP: net.ParseIP(scenario.ip), Port: 8888}, nil)
+
+		handler(ctx)
+		is.Equal(scenario.expected, ctx.Response.StatusCode(), "Scenario #%d", i+1)
+	}
+}
+
+func TestFasthttpMiddlewareTrustForwardHeader(t *testing.T) {
+	is := require.New(t)
+
+	rate := limiter.Rate{Limit: 1, Period: time.Hour}
+	instance := limiter.New(memory.NewStore(), rate, limiter.WithTrustForwardHeader(true))
+
+	keys := []string{}
+	handler := fasthttp.NewMiddleware(instance, fasthttp.WithExcludedKey(func(key string) bool {
+		keys = append(keys, key)
+		return false
+	})).Handle(func(ctx *libfasthttp.RequestCtx) {
+		ctx.SetStatusCode(libfasthttp.StatusOK)
+	})
+
+	// Without trusted proxies, the key is still the IP address of the peer: a spoofed header doesn't change it.
+	scenarios := []struct {
+		forwarded string
+		expected  int
+	}{
+		{forwarded: "198.51.100.1", expected: libfasthttp.StatusOK},
+		{forwarded: "198.51.100.2", expected: libfasthttp.StatusTooManyRequests},
+	}
+
+	for i, scenario := range scenarios {
+		request := &libfasthttp.Request{}
+		request.Header.Set("X-Forwarded-For", scenario.forwarded)
+
+		ctx := &libfasthttp.RequestCtx{}
+		ctx.Init(request, &net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 8888}, nil)
+
+		handler(ctx)
+		is.Equal(scenario.expected, ctx.Response.StatusCode(), "Scenario #%d", i+1)
+	}
+
+	is.Equal([]string{"8.8.8.8", "8.8.8.8"}, keys)
+}
+
+func TestFasthttpMiddlewarePrefixes(t *testing.T) {
+	is := require.New(t)
+
+	rate := limiter.Rate{Limit: 100, Period: time.Hour}
+	instance := limiter.New(memory.NewStore(), rate, limiter.WithIPv6Prefixes(
+		limiter.PrefixRate{Bits: 64, Rate: limiter.Rate{Limit: 2, Period: time.Hour}},
+	))
+
+	request := func(handler libfasthttp.RequestHandler) *libfasthttp.RequestCtx {
+		ctx := &libfasthttp.RequestCtx{}
+		ctx.Init(&libfasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("2001:db8:cafe:1::1"), Port: 8888}, nil)
+		handler(ctx)
+		return ctx
+	}
+
+	// The IP address of the client is limited by every prefix level.
+	handler := fasthttp.NewMiddleware(instance).Handle(func(ctx *libfasthttp.RequestCtx) {})
+	ctx := request(handler)
+	is.Equal(libfasthttp.StatusOK, ctx.Response.StatusCode())
+	is.Equal("2", string(ctx.Response.Header.Peek("X-RateLimit-Limit")))
+
+	// A custom KeyGetter disables prefix levels, so its key is limited.
+	handler = fasthttp.NewMiddleware(instance, fasthttp.WithKeyGetter(func(ctx *libfasthttp.RequestCtx) string {
+		return "tenant-42"
+	})).Handle(func(ctx *libfasthttp.RequestCtx) {})
+	ctx = request(handler)
+	is.Equal(libfasthttp.StatusOK, ctx.Response.StatusCode())
+	is.Equal("100", string(ctx.Response.Header.Peek("X-RateLimit-Limit")))
+	is.Equal("99", string(ctx.Response.Header.Peek("X-RateLimit-Remaining")))
+}
+
+func TestFasthttpMiddlewareAllocations(t *testing.T) {
+	if race.Enabled {
+		t.Skip("allocations are not reliable with the race detector")
+	}
+	is := require.New(t)
+
+	rate := limiter.Rate{Limit: 1000000, Period: time.Hour}
+	middleware := fasthttp.NewMiddleware(limiter.New(memory.NewStore(), rate),
+		fasthttp.WithKeyGetter(func(ctx *libfasthttp.RequestCtx) string {
+			return "foo"
+		}))
+	handler := middleware.Handle(func(ctx *libfasthttp.RequestCtx) {})
+
+	ctx := &libfasthttp.RequestCtx{}
+	handler(ctx)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		handler(ctx)
+	})
+	is.Zero(allocs)
+	is.Equal("1000000", string(ctx.Response.Header.Peek("X-RateLimit-Limit")))
+}
+
 func serve(handler libfasthttp.RequestHandler, req *libfasthttp.Request, res *libfasthttp.Response) error {
 	ln := fasthttputil.NewInmemoryListener()
 	defer func() {
@@ -46,6 +46,22 @@ func DefaultLimitReachedHandler(ctx *fasthttp.RequestCtx) {
 	ctx.Response.SetBodyString("deny")
 }
 
+// DeniedHandler is an handler used to inform when the IP address is in the denylist of the limiter.
+type DeniedHandler func(ctx *fasthttp.RequestCtx)
+
+// WithDeniedHandler will configure the Middleware to use the given DeniedHandler.
+func WithDeniedHandler(handler DeniedHandler) Option {
+	return option(func(middleware *Middleware) {
+		middleware.OnDenied = handler
+	})
+}
+
+// DefaultDeniedHandler is the default DeniedHandler used by a new Middleware.
+func DefaultDeniedHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(fasthttp.StatusForbidden)
+	ctx.Response.SetBodyString("forbidden")
+}
+
 // KeyGetter will define the rate limiter key given the fasthttp Context.
 type KeyGetter func(ctx *fasthttp.RequestCtx) string
 
@@ -57,7 +73,9 @@ func WithKeyGetter(KeyGetter KeyGetter) Option {
 }
 
 // DefaultKeyGetter is the default KeyGetter used by a new Middleware.
-// It returns the Client IP address.
+// It returns the IP address of the peer. If the limiter defines TrustedProxies, a new Middleware uses the IP address
+// of the client instead, resolved like limiter.GetIP. TrustForwardHeader alone doesn't change the key, since the
+// leftmost hop of a forwarding header can be spoofed by the client.
 func DefaultKeyGetter(ctx *fasthttp.RequestCtx) string {
 	return ctx.RemoteIP().String()
 }
@@ -1,20 +1,27 @@
 package gin
 
 import (
-	"strconv"
-
 	"github.com/gin-gonic/gin"
 
 	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/internal/headers"
 )
 
+// rateHeaders are the names of the headers of the context.
+var rateHeaders = headers.NewNames("X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset")
+
 // Middleware is the middleware for gin.
 type Middleware struct {
 	Limiter        *limiter.Limiter
 	OnError        ErrorHandler
 	OnLimitReached LimitReachedHandler
+	OnDenied       DeniedHandler
 	KeyGetter      KeyGetter
 	ExcludedKey    func(string) bool
+
+	// prefixes is true if the key is the IP address of the client, so the prefix levels of the limiter can be
+	// used instead: a custom KeyGetter disables them.
+	prefixes bool
 }
 
 // NewMiddleware return a new instance of a gin middleware.
@@ -23,7 +30,8 @@ func NewMiddleware(limiter *limiter.Limiter, options ...Option) gin.HandlerFunc
 		Limiter:        limiter,
 		OnError:        DefaultErrorHandler,
 		OnLimitReached: DefaultLimitReachedHandler,
-		KeyGetter:      DefaultKeyGetter,
+		OnDenied:       DefaultDeniedHandler,
+		KeyGetter:      nil,
 		ExcludedKey:    nil,
 	}
 
@@ -31,6 +39,11 @@ func NewMiddleware(limiter *limiter.Limiter, options ...Option) gin.HandlerFunc
 		option.apply(middleware)
 	}
 
+	if middleware.KeyGetter == nil {
+		middleware.KeyGetter = DefaultKeyGetter
+		middleware.prefixes = true
+	}
+
 	return func(ctx *gin.Context) {
 		middleware.Handle(ctx)
 	}
@@ -38,22 +51,30 @@ func NewMiddleware(limiter *limiter.Limiter, options ...Option) gin.HandlerFunc
 
 // Handle gin request.
 func (middleware *Middleware) Handle(c *gin.Context) {
+	switch middleware.Limiter.CheckRequest(c.Request) {
+	case limiter.IPDenied:
+		middleware.OnDenied(c)
+		c.Abort()
+		return
+	case limiter.IPAllowed:
+		c.Next()
+		return
+	}
+
 	key := middleware.KeyGetter(c)
 	if middleware.ExcludedKey != nil && middleware.ExcludedKey(key) {
 		c.Next()
 		return
 	}
 
-	context, err := middleware.Limiter.Get(c, key)
+	context, err := middleware.get(c, key)
 	if err != nil {
 		middleware.OnError(c, err)
 		c.Abort()
 		return
 	}
 
-	c.Header("X-RateLimit-Limit", strconv.FormatInt(context.Limit, 10))
-	c.Header("X-RateLimit-Remaining", strconv.FormatInt(context.Remaining, 10))
-	c.Header("X-RateLimit-Reset", strconv.FormatInt(context.Reset, 10))
+	headers.Set(c.Writer.Header(), rateHeaders, context)
 
 	if context.Reached {
 		middleware.OnLimitReached(c)
@@ -63,3 +84,17 @@ func (middleware *Middleware) Handle(c *gin.Context) {
 
 	c.Next()
 }
+
+// get returns the limit for given key, or for every prefix level of the IP address of the request if the limiter
+// defines them for its family, and the middleware uses the default KeyGetter.
+func (middleware *Middleware) get(c *gin.Context, key string) (limiter.Context, error) {
+	options := middleware.Limiter.Options
+	if middleware.prefixes && (len(options.IPv4Prefixes) > 0 || len(options.IPv6Prefixes) > 0) {
+		ip := middleware.Limiter.GetIP(c.Request)
+		if middleware.Limiter.HasPrefixes(ip) {
+			return middleware.Limiter.GetIPPrefixes(c, ip)
+		}
+	}
+
+	return middleware.Limiter.Get(c, key)
+}
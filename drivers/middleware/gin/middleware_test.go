@@ -1,12 +1,14 @@
 package gin_test
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	libgin "github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
@@ -14,6 +16,7 @@ import (
 	"github.com/panii/limiter/v3"
 	"github.com/panii/limiter/v3/drivers/middleware/gin"
 	"github.com/panii/limiter/v3/drivers/store/memory"
+	"github.com/panii/limiter/v3/internal/race"
 )
 
 func TestHTTPMiddleware(t *testing.T) {
@@ -159,3 +162,127 @@ func TestHTTPMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPMiddlewareIPLists(t *testing.T) {
+	is := require.New(t)
+	libgin.SetMode(libgin.TestMode)
+
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	is.NoError(err)
+	allowlist, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	_, network, err = net.ParseCIDR("203.0.113.0/24")
+	is.NoError(err)
+	denylist, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	rate := limiter.Rate{Limit: 1, Period: time.Hour}
+	instance := limiter.New(memory.NewStore(), rate, limiter.WithAllowlist(allowlist), limiter.WithDenylist(denylist))
+
+	router := libgin.New()
+	router.Use(gin.NewMiddleware(instance))
+	router.GET("/", func(c *libgin.Context) {
+		c.String(http.StatusOK, "hello")
+	})
+
+	scenarios := []struct {
+		remoteAddr string
+		expected   []int
+	}{
+		{remoteAddr: "8.8.8.8:8888", expected: []int{http.StatusOK, http.StatusTooManyRequests}},
+		{remoteAddr: "10.0.0.1:8888", expected: []int{http.StatusOK, http.StatusOK}},
+		{remoteAddr: "203.0.113.7:8888", expected: []int{http.StatusForbidden, http.StatusForbidden}},
+	}
+
+	for _, scenario := range scenarios {
+		for _, expected := range scenario.expected {
+			request := httptest.NewRequest("GET", "/", nil)
+			request.RemoteAddr = scenario.remoteAddr
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, request)
+			is.Equal(expected, resp.Code, scenario.remoteAddr)
+		}
+	}
+}
+
+func TestHTTPMiddlewarePrefixes(t *testing.T) {
+	is := require.New(t)
+	libgin.SetMode(libgin.TestMode)
+
+	rate := limiter.Rate{Limit: 100, Period: time.Hour}
+	instance := limiter.New(memory.NewStore(), rate, limiter.WithIPv6Prefixes(
+		limiter.PrefixRate{Bits: 64, Rate: limiter.Rate{Limit: 2, Period: time.Hour}},
+		limiter.PrefixRate{Bits: 48, Rate: limiter.Rate{Limit: 3, Period: time.Hour}},
+	))
+
+	router := libgin.New()
+	router.Use(gin.NewMiddleware(instance))
+	router.GET("/", func(c *libgin.Context) {
+		c.String(http.StatusOK, "hello")
+	})
+
+	scenarios := []struct {
+		remoteAddr string
+		expected   int
+		limit      string
+	}{
+		{remoteAddr: "[2001:db8:cafe:1::1]:8888", expected: http.StatusOK, limit: "2"},
+		{remoteAddr: "[2001:db8:cafe:1::2]:8888", expected: http.StatusOK, limit: "2"},
+		{remoteAddr: "[2001:db8:cafe:1::3]:8888", expected: http.StatusTooManyRequests, limit: "2"},
+		{remoteAddr: "[2001:db8:cafe:2::1]:8888", expected: http.StatusTooManyRequests, limit: "3"},
+		{remoteAddr: "192.0.2.1:8888", expected: http.StatusOK, limit: "100"},
+	}
+
+	for _, scenario := range scenarios {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = scenario.remoteAddr
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, request)
+		is.Equal(scenario.expected, resp.Code, scenario.remoteAddr)
+		is.Equal(scenario.limit, resp.Header().Get("X-RateLimit-Limit"), scenario.remoteAddr)
+	}
+
+	// A custom KeyGetter disables prefix levels, so its key is limited.
+	router = libgin.New()
+	router.Use(gin.NewMiddleware(instance, gin.WithKeyGetter(func(c *libgin.Context) string {
+		return "tenant-42"
+	})))
+	router.GET("/", func(c *libgin.Context) {
+		c.String(http.StatusOK, "hello")
+	})
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "[2001:db8:cafe:1::1]:8888"
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, request)
+	is.Equal(http.StatusOK, resp.Code)
+	is.Equal("100", resp.Header().Get("X-RateLimit-Limit"))
+	is.Equal("99", resp.Header().Get("X-RateLimit-Remaining"))
+}
+
+func TestHTTPMiddlewareAllocations(t *testing.T) {
+	if race.Enabled {
+		t.Skip("allocations are not reliable with the race detector")
+	}
+	is := require.New(t)
+	libgin.SetMode(libgin.TestMode)
+
+	rate := limiter.Rate{Limit: 1000000, Period: time.Hour}
+	middleware := gin.NewMiddleware(limiter.New(memory.NewStore(), rate), gin.WithKeyGetter(func(c *libgin.Context) string {
+		return "foo"
+	}))
+
+	ctx, _ := libgin.CreateTestContext(httptest.NewRecorder())
+	middleware(ctx)
+
+	// The header values and their array are the only allocations.
+	allocs := testing.AllocsPerRun(100, func() {
+		middleware(ctx)
+	})
+	is.Equal(float64(2), allocs)
+	is.Equal("1000000", ctx.Writer.Header().Get("X-RateLimit-Limit"))
+}
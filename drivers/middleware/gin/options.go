@@ -47,6 +47,21 @@ func DefaultLimitReachedHandler(c *gin.Context) {
 	c.String(http.StatusTooManyRequests, "deny")
 }
 
+// DeniedHandler is an handler used to inform when the IP address is in the denylist of the limiter.
+type DeniedHandler func(c *gin.Context)
+
+// WithDeniedHandler will configure the Middleware to use the given DeniedHandler.
+func WithDeniedHandler(handler DeniedHandler) Option {
+	return option(func(middleware *Middleware) {
+		middleware.OnDenied = handler
+	})
+}
+
+// DefaultDeniedHandler is the default DeniedHandler used by a new Middleware.
+func DefaultDeniedHandler(c *gin.Context) {
+	c.String(http.StatusForbidden, "forbidden")
+}
+
 // KeyGetter will define the rate limiter key given the gin Context.
 type KeyGetter func(c *gin.Context) string
 
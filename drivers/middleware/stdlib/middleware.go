@@ -1,23 +1,67 @@
 package stdlib
 
 import (
-	bigcontext "context"
 	"crypto/md5"
 	"encoding/hex"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+	"github.com/panii/limiter/v3/internal/headers"
 )
 
 var Secret string
 
+// rateQuery describes the query parameters of a rate, and the headers of its context.
+type rateQuery struct {
+	// limit is the query parameter of the limit.
+	limit string
+	// period is the query parameter of the period, as a number of units.
+	period string
+	// unit is the unit of the period, which is also the default period.
+	unit time.Duration
+	// headers are the names of the headers of the context.
+	headers headers.Names
+}
+
+// rateQueries are the query parameters of each rate identifier.
+var rateQueries = map[string]rateQuery{
+	"second": {
+		limit:   "limitSecond",
+		period:  "periodSecond",
+		unit:    time.Second,
+		headers: headers.NewNames("X-RateLimit-Limit-Second", "X-RateLimit-Remaining-Second", "X-RateLimit-Reset-Second"),
+	},
+	"minute": {
+		limit:   "limitMinute",
+		period:  "periodMinute",
+		unit:    time.Minute,
+		headers: headers.NewNames("X-RateLimit-Limit-Minute", "X-RateLimit-Remaining-Minute", "X-RateLimit-Reset-Minute"),
+	},
+	"hour": {
+		limit:   "limitHour",
+		period:  "periodHour",
+		unit:    time.Hour,
+		headers: headers.NewNames("X-RateLimit-Limit-Hour", "X-RateLimit-Remaining-Hour", "X-RateLimit-Reset-Hour"),
+	},
+	"day": {
+		limit:   "limitDay",
+		period:  "periodDay",
+		unit:    24 * time.Hour,
+		headers: headers.NewNames("X-RateLimit-Limit-Day", "X-RateLimit-Remaining-Day", "X-RateLimit-Reset-Day"),
+	},
+}
+
 // Middleware is the middleware for basic http.Handler.
 type Middleware struct {
 	Limiter        *limiter.Limiter
 	OnError        ErrorHandler
 	OnLimitReached LimitReachedHandler
+	OnDenied       DeniedHandler
 	ExcludedKey    func(string) bool
 }
 
@@ -27,6 +71,7 @@ func NewMiddleware(limiter *limiter.Limiter, options ...Option) *Middleware {
 		Limiter:        limiter,
 		OnError:        DefaultErrorHandler,
 		OnLimitReached: DefaultLimitReachedHandler,
+		OnDenied:       DefaultDeniedHandler,
 		ExcludedKey:    nil,
 	}
 
@@ -40,189 +85,81 @@ func NewMiddleware(limiter *limiter.Limiter, options ...Option) *Middleware {
 // Handler handles a HTTP request.
 func (middleware *Middleware) Handler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query()
-		keys, ok := query["key"]
-		var key string
-		if !ok || len(keys[0]) < 1 {
+		// Requests of the allowlist are still authenticated, and only skip the store.
+		access := middleware.Limiter.CheckRequest(r)
+		if access == limiter.IPDenied {
+			middleware.OnDenied(w, r)
+			return
+		}
+
+		// The raw query is scanned instead of being parsed in a map, since only a few parameters are used.
+		query := r.URL.RawQuery
+
+		value := queryValue(query, "key")
+		if value == "" {
 			middleware.OnLimitReached(w, r)
 			return
 		}
-		hash := md5.Sum([]byte(keys[0]))
-		key = hex.EncodeToString(hash[:])
 
-		signs, ok := query["sign"]
-		var sign string
-		if !ok || len(signs[0]) < 1 {
+		sign := queryValue(query, "sign")
+		if sign == "" {
 			middleware.OnLimitReached(w, r)
 			return
 		}
-		hash2 := md5.Sum([]byte(keys[0] + Secret))
-		sign = hex.EncodeToString(hash2[:])
 
-		if sign != signs[0] {
+		// Digests are computed in a pooled buffer, and compared without building a string.
+		var digest [2 * md5.Size]byte
+		buffer := bytebuffer.New()
+		buffer.Concat(value, Secret)
+		hash := md5.Sum(buffer.Bytes())
+		hex.Encode(digest[:], hash[:])
+		if string(digest[:]) != sign {
+			buffer.Close()
 			middleware.OnLimitReached(w, r)
 			return
 		}
 
+		hash = md5.Sum(buffer.Bytes()[:len(value)])
+		buffer.Close()
+		hex.Encode(digest[:], hash[:])
+		key := string(digest[:])
+
 		//key := middleware.Limiter.GetIPKey(r)
 		if middleware.ExcludedKey != nil && middleware.ExcludedKey(key) {
 			h.ServeHTTP(w, r)
 			return
 		}
-		ctx := r.Context()
-		var err error
-
-		rateId := middleware.Limiter.Rate.Id
-
-		rateTemp := limiter.Rate{}
-
-		// Add limit to context
-		if rateId == "second" {
-			limit1, ok := query["limitSecond"] // second limit
-			var limit1Int int64
-			if !ok || len(limit1[0]) < 1 {
-				limit1Int = 0
-			} else {
-				limit1Int, err = strconv.ParseInt(limit1[0], 10, 64)
-				if err != nil {
-					limit1Int = 0
-				}
-			}
-			rateTemp.Limit = limit1Int
-		}
-
-		if rateId == "minute" {
-			limit2, ok := query["limitMinute"] // minute limit
-			var limit2Int int64
-			if !ok || len(limit2[0]) < 1 {
-				limit2Int = 0
-			} else {
-				limit2Int, err = strconv.ParseInt(limit2[0], 10, 64)
-				if err != nil {
-					limit2Int = 0
-				}
-			}
-			rateTemp.Limit = limit2Int
-		}
-
-		if rateId == "hour" {
-			limit3, ok := query["limitHour"] // hour limit
-			var limit3Int int64
-			if !ok || len(limit3[0]) < 1 {
-				limit3Int = 0
-			} else {
-				limit3Int, err = strconv.ParseInt(limit3[0], 10, 64)
-				if err != nil {
-					limit3Int = 0
-				}
-			}
-			rateTemp.Limit = limit3Int
-		}
-
-		if rateId == "day" {
-			limit4, ok := query["limitDay"] // day limit
-			var limit4Int int64
-			if !ok || len(limit4[0]) < 1 {
-				limit4Int = 0
-			} else {
-				limit4Int, err = strconv.ParseInt(limit4[0], 10, 64)
-				if err != nil {
-					limit4Int = 0
-				}
-			}
-			rateTemp.Limit = limit4Int
-		}
-
-		// Add time to context
-		if rateId == "second" {
-			time1, ok := query["periodSecond"] // second
-			var time1Int int64
-			if !ok || len(time1[0]) < 1 {
-				rateTemp.Period = time.Second * 1
-			} else {
-				time1Int, err = strconv.ParseInt(time1[0], 10, 64)
-				if err != nil {
-					time1Int = 0
-				}
-				rateTemp.Period = time.Second * time.Duration(time1Int)
-			}
-		}
 
-		if rateId == "minute" {
-			time2, ok := query["periodMinute"] // minute
-			var time2Int int64
-			if !ok || len(time2[0]) < 1 {
-				rateTemp.Period = time.Minute * 1
-			} else {
-				time2Int, err = strconv.ParseInt(time2[0], 10, 64)
-				if err != nil {
-					time2Int = 0
-				}
-				rateTemp.Period = time.Minute * time.Duration(time2Int)
-			}
+		params, ok := rateQueries[middleware.Limiter.Rate.Id]
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
 		}
 
-		if rateId == "hour" {
-			time3, ok := query["periodHour"] // hour
-			var time3Int int64
-			if !ok || len(time3[0]) < 1 {
-				rateTemp.Period = time.Hour * 1
-			} else {
-				time3Int, err = strconv.ParseInt(time3[0], 10, 64)
-				if err != nil {
-					time3Int = 0
-				}
-				rateTemp.Period = time.Hour * time.Duration(time3Int)
-			}
+		rateTemp := limiter.Rate{
+			Limit:  queryInt(query, params.limit, 0),
+			Period: params.unit * time.Duration(queryInt(query, params.period, 1)),
 		}
 
-		if rateId == "day" {
-			time4, ok := query["periodDay"] // day
-			var time4Int int64
-			if !ok || len(time4[0]) < 1 {
-				rateTemp.Period = time.Hour * 24 * 1
-			} else {
-				time4Int, err = strconv.ParseInt(time4[0], 10, 64)
-				if err != nil {
-					time4Int = 0
-				}
-				rateTemp.Period = time.Hour * 24 * time.Duration(time4Int)
-			}
-		}
 		// do not check
 		if rateTemp.Limit == 0 || rateTemp.Period == 0 {
 			h.ServeHTTP(w, r)
 			return
 		}
 
-		//fmt.Println("rateId", rateId)
-		//fmt.Println("rateTemp.Limit", rateTemp.Limit)
-		//fmt.Println("rateTemp.Period", rateTemp.Period)
-		ctx = bigcontext.WithValue(ctx, "rateTemp", rateTemp)
+		if access == limiter.IPAllowed {
+			h.ServeHTTP(w, r)
+			return
+		}
 
-		context, err := middleware.Limiter.Get(ctx, key)
+		// The rate is given to the store, instead of a context value which would require two allocations.
+		context, err := middleware.Limiter.Store.Get(r.Context(), key, rateTemp)
 		if err != nil {
 			middleware.OnError(w, r, err)
 			return
 		}
 
-		if rateId == "second" {
-			w.Header().Add("X-RateLimit-Limit-Second", strconv.FormatInt(context.Limit, 10))
-			w.Header().Add("X-RateLimit-Remaining-Second", strconv.FormatInt(context.Remaining, 10))
-			w.Header().Add("X-RateLimit-Reset-Second", strconv.FormatInt(context.Reset, 10))
-		} else if rateId == "minute" {
-			w.Header().Add("X-RateLimit-Limit-Minute", strconv.FormatInt(context.Limit, 10))
-			w.Header().Add("X-RateLimit-Remaining-Minute", strconv.FormatInt(context.Remaining, 10))
-			w.Header().Add("X-RateLimit-Reset-Minute", strconv.FormatInt(context.Reset, 10))
-		} else if rateId == "hour" {
-			w.Header().Add("X-RateLimit-Limit-Hour", strconv.FormatInt(context.Limit, 10))
-			w.Header().Add("X-RateLimit-Remaining-Hour", strconv.FormatInt(context.Remaining, 10))
-			w.Header().Add("X-RateLimit-Reset-Hour", strconv.FormatInt(context.Reset, 10))
-		} else if rateId == "day" {
-			w.Header().Add("X-RateLimit-Limit-Day", strconv.FormatInt(context.Limit, 10))
-			w.Header().Add("X-RateLimit-Remaining-Day", strconv.FormatInt(context.Remaining, 10))
-			w.Header().Add("X-RateLimit-Reset-Day", strconv.FormatInt(context.Reset, 10))
-		}
+		headers.Set(w.Header(), params.headers, context)
 
 		if context.Reached {
 			middleware.OnLimitReached(w, r)
@@ -232,3 +169,58 @@ func (middleware *Middleware) Handler(h http.Handler) http.Handler {
 		h.ServeHTTP(w, r)
 	})
 }
+
+// queryInt returns the integer value of given query parameter, the fallback if it's missing, or zero if it's invalid.
+func queryInt(query string, name string, fallback int64) int64 {
+	value := queryValue(query, name)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+// queryValue returns the first value of given parameter in a raw query, like url.Values.Get.
+// Values are unescaped only if they contain escaped characters, so most lookups don't allocate.
+// Parameters that can't be unescaped are skipped, like url.ParseQuery does.
+func queryValue(query string, name string) string {
+	for query != "" {
+		pair := query
+		if i := strings.IndexByte(query, '&'); i >= 0 {
+			pair, query = query[:i], query[i+1:]
+		} else {
+			query = ""
+		}
+
+		key, value := pair, ""
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			key, value = pair[:i], pair[i+1:]
+		}
+
+		if strings.ContainsAny(key, "%+") {
+			unescaped, err := url.QueryUnescape(key)
+			if err != nil {
+				continue
+			}
+			key = unescaped
+		}
+		if key != name {
+			continue
+		}
+
+		if strings.ContainsAny(value, "%+") {
+			unescaped, err := url.QueryUnescape(value)
+			if err != nil {
+				continue
+			}
+			value = unescaped
+		}
+		return value
+	}
+
+	return ""
+}
@@ -1,17 +1,22 @@
 package stdlib_test
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/panii/limiter/v3"
 	"github.com/panii/limiter/v3/drivers/middleware/stdlib"
 	"github.com/panii/limiter/v3/drivers/store/memory"
+	"github.com/panii/limiter/v3/internal/race"
 )
 
 func TestHTTPMiddleware(t *testing.T) {
@@ -89,3 +94,131 @@ func TestHTTPMiddleware(t *testing.T) {
 	is.Equal(success, atomic.LoadInt64(&counter))
 
 }
+
+func TestHTTPMiddlewareQuery(t *testing.T) {
+	is := require.New(t)
+
+	stdlib.Secret = "secret"
+	defer func() { stdlib.Secret = "" }()
+
+	rate := limiter.Rate{Limit: 1000, Period: time.Hour, Id: "minute"}
+	middleware := stdlib.NewMiddleware(limiter.New(memory.NewStore(), rate)).Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	hash := md5.Sum([]byte("a b" + "secret"))
+	sign := hex.EncodeToString(hash[:])
+
+	// Values are unescaped, and the rate is read from the query.
+	for i := 1; i <= 3; i++ {
+		resp := httptest.NewRecorder()
+		middleware.ServeHTTP(resp, httptest.NewRequest("GET", "/?key=a+b&sign="+sign+"&limitMinute=2&periodMinute=5", nil))
+
+		if i <= 2 {
+			is.Equal(http.StatusOK, resp.Code)
+		} else {
+			is.Equal(http.StatusTooManyRequests, resp.Code)
+		}
+		is.Equal("2", resp.Header().Get("X-RateLimit-Limit-Minute"))
+	}
+
+	resp := httptest.NewRecorder()
+	middleware.ServeHTTP(resp, httptest.NewRequest("GET", "/?key=a+b&sign=invalid&limitMinute=2", nil))
+	is.Equal(http.StatusTooManyRequests, resp.Code)
+
+	// Requests without limit are not checked.
+	resp = httptest.NewRecorder()
+	middleware.ServeHTTP(resp, httptest.NewRequest("GET", "/?key=a%20b&sign="+sign, nil))
+	is.Equal(http.StatusOK, resp.Code)
+	is.Empty(resp.Header().Get("X-RateLimit-Limit-Minute"))
+}
+
+func TestHTTPMiddlewareIPLists(t *testing.T) {
+	is := require.New(t)
+
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	is.NoError(err)
+	allowlist, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	_, network, err = net.ParseCIDR("203.0.113.0/24")
+	is.NoError(err)
+	denylist, err := limiter.NewIPList([]*net.IPNet{network})
+	is.NoError(err)
+
+	stdlib.Secret = "secret"
+	defer func() { stdlib.Secret = "" }()
+
+	rate := limiter.Rate{Limit: 1, Period: time.Hour, Id: "minute"}
+	instance := limiter.New(memory.NewStore(), rate, limiter.WithAllowlist(allowlist), limiter.WithDenylist(denylist))
+	middleware := stdlib.NewMiddleware(instance).Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	hash := md5.Sum([]byte("foo" + "secret"))
+	signed := "/?key=foo&sign=" + hex.EncodeToString(hash[:]) + "&limitMinute=1"
+
+	scenarios := []struct {
+		remoteAddr string
+		target     string
+		expected   int
+	}{
+		// Requests without key are rejected, even if they are allowed.
+		{remoteAddr: "8.8.8.8:8888", target: "/", expected: http.StatusTooManyRequests},
+		{remoteAddr: "10.0.0.1:8888", target: "/", expected: http.StatusTooManyRequests},
+		{remoteAddr: "203.0.113.7:8888", target: signed, expected: http.StatusForbidden},
+		// Allowed requests with a valid key are never limited.
+		{remoteAddr: "10.0.0.1:8888", target: signed, expected: http.StatusOK},
+		{remoteAddr: "10.0.0.1:8888", target: signed, expected: http.StatusOK},
+		{remoteAddr: "8.8.8.8:8888", target: signed, expected: http.StatusOK},
+		{remoteAddr: "8.8.8.8:8888", target: signed, expected: http.StatusTooManyRequests},
+	}
+
+	for i, scenario := range scenarios {
+		request := httptest.NewRequest("GET", scenario.target, nil)
+		request.RemoteAddr = scenario.remoteAddr
+
+		resp := httptest.NewRecorder()
+		middleware.ServeHTTP(resp, request)
+		is.Equal(scenario.expected, resp.Code, "Scenario #%d", i+1)
+	}
+}
+
+func TestHTTPMiddlewareAllocations(t *testing.T) {
+	if race.Enabled {
+		t.Skip("allocations are not reliable with the race detector")
+	}
+	is := require.New(t)
+
+	stdlib.Secret = "secret"
+	defer func() { stdlib.Secret = "" }()
+
+	rate := limiter.Rate{Limit: 1000, Period: time.Hour, Id: "minute"}
+	middleware := stdlib.NewMiddleware(limiter.New(memory.NewStore(), rate)).Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	hash := md5.Sum([]byte("foo" + "secret"))
+	request := httptest.NewRequest("GET", "/?key=foo&sign="+hex.EncodeToString(hash[:])+
+		"&limitMinute=1000000&periodMinute=1", nil)
+	writer := &headerWriter{header: http.Header{}}
+
+	// The hashed key, the header values and their array are the only allocations.
+	allocs := testing.AllocsPerRun(100, func() {
+		middleware.ServeHTTP(writer, request)
+	})
+	is.Equal(float64(3), allocs)
+	is.Equal("1000000", writer.header.Get("X-RateLimit-Limit-Minute"))
+}
+
+// headerWriter is a http.ResponseWriter which discards everything but headers.
+type headerWriter struct {
+	header http.Header
+}
+
+func (writer *headerWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *headerWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (writer *headerWriter) WriteHeader(code int) {}
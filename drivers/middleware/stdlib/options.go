@@ -45,6 +45,21 @@ func DefaultLimitReachedHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "deny", http.StatusTooManyRequests)
 }
 
+// DeniedHandler is an handler used to inform when the IP address is in the denylist of the limiter.
+type DeniedHandler func(w http.ResponseWriter, r *http.Request)
+
+// WithDeniedHandler will configure the Middleware to use the given DeniedHandler.
+func WithDeniedHandler(handler DeniedHandler) Option {
+	return option(func(middleware *Middleware) {
+		middleware.OnDenied = handler
+	})
+}
+
+// DefaultDeniedHandler is the default DeniedHandler used by a new Middleware.
+func DefaultDeniedHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
+
 // WithExcludedKey will configure the Middleware to ignore key(s) using the given function.
 func WithExcludedKey(handler func(string) bool) Option {
 	return option(func(middleware *Middleware) {
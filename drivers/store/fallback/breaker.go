@@ -0,0 +1,149 @@
+package fallback
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of the circuit breaker.
+type State int
+
+const (
+	// StateClosed means the primary store is healthy: every request is sent to it.
+	StateClosed State = iota
+	// StateOpen means the primary store is unavailable: every request is served by the local store.
+	StateOpen
+	// StateHalfOpen means a probe request is sent to the primary store, to check if it has recovered.
+	StateHalfOpen
+)
+
+// String returns the name of the state.
+func (state State) String() string {
+	switch state {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker is a circuit breaker, which stops sending requests to the primary store after consecutive failures.
+type breaker struct {
+	failureThreshold int
+	successThreshold int
+	openTimeout      time.Duration
+	onStateChange    func(from State, to State)
+
+	mutex     sync.Mutex
+	state     State
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+}
+
+// Allow returns true if a request should be sent to the primary store.
+// In half-open state, a single probe request is allowed at a time.
+func (breaker *breaker) Allow(now time.Time) bool {
+	breaker.mutex.Lock()
+
+	switch breaker.state {
+	case StateClosed:
+		breaker.mutex.Unlock()
+		return true
+
+	case StateOpen:
+		if now.Sub(breaker.openedAt) < breaker.openTimeout {
+			breaker.mutex.Unlock()
+			return false
+		}
+		breaker.probing = true
+		breaker.successes = 0
+		breaker.transition(StateHalfOpen)
+		return true
+
+	default:
+		if breaker.probing {
+			breaker.mutex.Unlock()
+			return false
+		}
+		breaker.probing = true
+		breaker.mutex.Unlock()
+		return true
+	}
+}
+
+// Success records a successful request on the primary store.
+func (breaker *breaker) Success() {
+	breaker.mutex.Lock()
+
+	switch breaker.state {
+	case StateHalfOpen:
+		breaker.probing = false
+		breaker.successes++
+		if breaker.successes >= breaker.successThreshold {
+			breaker.failures = 0
+			breaker.transition(StateClosed)
+			return
+		}
+	default:
+		breaker.failures = 0
+	}
+
+	breaker.mutex.Unlock()
+}
+
+// Failure records a failed request on the primary store.
+func (breaker *breaker) Failure(now time.Time) {
+	breaker.mutex.Lock()
+
+	switch breaker.state {
+	case StateHalfOpen:
+		breaker.probing = false
+		breaker.openedAt = now
+		breaker.transition(StateOpen)
+		return
+	case StateClosed:
+		breaker.failures++
+		if breaker.failures >= breaker.failureThreshold {
+			breaker.openedAt = now
+			breaker.transition(StateOpen)
+			return
+		}
+	}
+
+	breaker.mutex.Unlock()
+}
+
+// Cancel releases a probe request whose result is unknown, such as a request canceled by its caller.
+func (breaker *breaker) Cancel() {
+	breaker.mutex.Lock()
+	if breaker.state == StateHalfOpen {
+		breaker.probing = false
+	}
+	breaker.mutex.Unlock()
+}
+
+// State returns the current state.
+func (breaker *breaker) State() State {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	return breaker.state
+}
+
+// transition changes the state, releases the mutex, then notifies the hook.
+// WARNING: mutex must be held by the caller, and it's released by this function.
+func (breaker *breaker) transition(to State) {
+	from := breaker.state
+	breaker.state = to
+	breaker.mutex.Unlock()
+
+	if breaker.onStateChange != nil && from != to {
+		breaker.onStateChange(from, to)
+	}
+}
@@ -0,0 +1,202 @@
+// Package fallback provides a store wrapper which serves requests from local memory while its primary store,
+// such as redis, is unavailable.
+//
+// Failures are tracked by a circuit breaker: after consecutive failures, requests are no longer sent to the primary
+// store, so an outage doesn't add latency to every request. After a while, a probe request is sent to the primary
+// store, and the circuit is closed again once it has recovered.
+package fallback
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/memory"
+)
+
+const (
+	// DefaultFailureThreshold is the default number of consecutive failures which opens the circuit.
+	DefaultFailureThreshold = 5
+	// DefaultSuccessThreshold is the default number of successful probes which closes the circuit.
+	DefaultSuccessThreshold = 1
+	// DefaultOpenTimeout is the default duration of the open state, before the primary store is probed.
+	DefaultOpenTimeout = 5 * time.Second
+	// DefaultTimeout is the default timeout of a request to the primary store.
+	DefaultTimeout = 100 * time.Millisecond
+)
+
+// Options are options for fallback store.
+type Options struct {
+	// FailureThreshold is the number of consecutive failures of the primary store which opens the circuit.
+	FailureThreshold int
+	// SuccessThreshold is the number of successful probes of the primary store which closes the circuit.
+	SuccessThreshold int
+	// OpenTimeout is the duration of the open state, before the primary store is probed.
+	OpenTimeout time.Duration
+	// Timeout is the timeout of every request to the primary store. A timeout is a failure.
+	Timeout time.Duration
+	// Instances is the number of instances sharing the primary store.
+	// While the circuit is open, the limit of each local store is divided by this number, so the cluster roughly
+	// keeps its global limit.
+	Instances int
+	// OnStateChange is called after every change of the circuit state.
+	// It's called synchronously, possibly by concurrent requests.
+	OnStateChange func(from State, to State)
+	// StoreOptions are the options of the local memory store.
+	StoreOptions limiter.StoreOptions
+}
+
+// Store is the fallback store.
+type Store struct {
+	// errors is the number of failed requests on the primary store.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// primary is the store used while the circuit is closed.
+	primary limiter.Store
+	// local is the store used while the circuit is open.
+	local limiter.Store
+	// instances is the number of instances sharing the primary store.
+	instances int64
+	// timeout is the timeout of every request to the primary store.
+	timeout time.Duration
+	// breaker tracks failures of the primary store.
+	breaker *breaker
+	// closeOnce is used to close the store only once.
+	closeOnce sync.Once
+}
+
+// NewStore returns an instance of fallback store with defaults, wrapping given primary store.
+func NewStore(primary limiter.Store) limiter.Store {
+	return NewStoreWithOptions(primary, Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix:          limiter.DefaultPrefix,
+			CleanUpInterval: limiter.DefaultCleanUpInterval,
+		},
+	})
+}
+
+// NewStoreWithOptions returns an instance of fallback store with options, wrapping given primary store.
+// Zero values use the defaults.
+func NewStoreWithOptions(primary limiter.Store, options Options) limiter.Store {
+	if options.FailureThreshold <= 0 {
+		options.FailureThreshold = DefaultFailureThreshold
+	}
+	if options.SuccessThreshold <= 0 {
+		options.SuccessThreshold = DefaultSuccessThreshold
+	}
+	if options.OpenTimeout <= 0 {
+		options.OpenTimeout = DefaultOpenTimeout
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Instances <= 0 {
+		options.Instances = 1
+	}
+
+	return &Store{
+		primary:   primary,
+		local:     memory.NewStoreWithOptions(options.StoreOptions),
+		instances: int64(options.Instances),
+		timeout:   options.Timeout,
+		breaker: &breaker{
+			failureThreshold: options.FailureThreshold,
+			successThreshold: options.SuccessThreshold,
+			openTimeout:      options.OpenTimeout,
+			onStateChange:    options.OnStateChange,
+		},
+	}
+}
+
+// Get returns the limit for given identifier.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.do(ctx, key, rate, limiter.Store.Get)
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.do(ctx, key, rate, limiter.Store.Peek)
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.do(ctx, key, rate, limiter.Store.Reset)
+}
+
+// State returns the state of the circuit.
+func (store *Store) State() State {
+	return store.breaker.State()
+}
+
+// Close closes the local store, and the primary store if it implements io.Closer.
+func (store *Store) Close() error {
+	var err error
+
+	store.closeOnce.Do(func() {
+		if closer, ok := store.primary.(io.Closer); ok {
+			err = closer.Close()
+		}
+		_ = store.local.(io.Closer).Close()
+	})
+
+	return err
+}
+
+// Ping returns an error if the local store has been closed.
+// An unavailable primary store is not an error, since requests are still served by the local store: use State
+// to know which store is used.
+func (store *Store) Ping(ctx context.Context) error {
+	return store.local.(limiter.Pinger).Ping(ctx)
+}
+
+// Stats returns the number of failed requests on the primary store.
+func (store *Store) Stats() limiter.StoreStats {
+	return limiter.StoreStats{
+		Keys:    -1,
+		Evicted: -1,
+		Errors:  atomic.LoadInt64(&store.errors),
+	}
+}
+
+// do executes given operation on the primary store if the circuit allows it, or on the local store otherwise.
+func (store *Store) do(ctx context.Context, key string, rate limiter.Rate,
+	operation func(limiter.Store, context.Context, string, limiter.Rate) (limiter.Context, error)) (limiter.Context, error) {
+
+	if store.breaker.Allow(time.Now()) {
+		primaryCtx, cancel := context.WithTimeout(ctx, store.timeout)
+		lctx, err := operation(store.primary, primaryCtx, key, rate)
+		cancel()
+
+		if err == nil {
+			store.breaker.Success()
+			return lctx, nil
+		}
+
+		if ctx.Err() != nil {
+			// The request has been canceled by the caller: it says nothing about the primary store.
+			store.breaker.Cancel()
+			return limiter.Context{}, ctx.Err()
+		}
+
+		atomic.AddInt64(&store.errors, 1)
+		store.breaker.Failure(time.Now())
+	}
+
+	return operation(store.local, ctx, key, store.localRate(rate))
+}
+
+// localRate returns the rate used by the local store, which is a share of the global limit.
+func (store *Store) localRate(rate limiter.Rate) limiter.Rate {
+	if store.instances <= 1 {
+		return rate
+	}
+
+	rate.Limit /= store.instances
+	if rate.Limit < 1 {
+		rate.Limit = 1
+	}
+	return rate
+}
@@ -0,0 +1,273 @@
+package fallback_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/fallback"
+	"github.com/panii/limiter/v3/drivers/store/memory"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestFallbackStoreSequentialAccess(t *testing.T) {
+	store := fallback.NewStoreWithOptions(newFakePrimary(), fallback.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix:          "limiter:fallback:sequential-test",
+			CleanUpInterval: 30 * time.Second,
+		},
+	})
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestFallbackStoreConcurrentAccess(t *testing.T) {
+	store := fallback.NewStoreWithOptions(newFakePrimary(), fallback.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix:          "limiter:fallback:concurrent-test",
+			CleanUpInterval: 30 * time.Second,
+		},
+	})
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestFallbackStoreCircuit(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 100, Period: time.Minute}
+
+	transitions := &transitionRecorder{}
+	primary := newFakePrimary()
+	store := fallback.NewStoreWithOptions(primary, fallback.Options{
+		FailureThreshold: 3,
+		SuccessThreshold: 2,
+		OpenTimeout:      50 * time.Millisecond,
+		OnStateChange:    transitions.Record,
+	})
+	defer tests.CloseStore(t, store)
+	circuit := store.(*fallback.Store)
+
+	_, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(1, primary.Calls())
+
+	// Failures are served by the local store, until the circuit opens.
+	primary.Fail(true)
+	for i := 0; i < 10; i++ {
+		lctx, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+		is.Equal(int64(100-i-1), lctx.Remaining)
+	}
+	is.Equal(4, primary.Calls())
+	is.Equal(fallback.StateOpen, circuit.State())
+	is.Equal(int64(3), store.(limiter.StatsReporter).Stats().Errors)
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+
+	// A failed probe opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(5, primary.Calls())
+	is.Equal(fallback.StateOpen, circuit.State())
+
+	// Successful probes close the circuit.
+	primary.Fail(false)
+	time.Sleep(60 * time.Millisecond)
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(fallback.StateHalfOpen, circuit.State())
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(fallback.StateClosed, circuit.State())
+	is.Equal(7, primary.Calls())
+	is.Equal(int64(97), lctx.Remaining)
+
+	is.Equal([]string{
+		"closed->open",
+		"open->half-open",
+		"half-open->open",
+		"open->half-open",
+		"half-open->closed",
+	}, transitions.Transitions())
+}
+
+func TestFallbackStoreTimeout(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	primary := newFakePrimary()
+	primary.Delay(time.Second)
+
+	store := fallback.NewStoreWithOptions(primary, fallback.Options{
+		FailureThreshold: 2,
+		Timeout:          20 * time.Millisecond,
+	})
+	defer tests.CloseStore(t, store)
+
+	// A slow primary store is a failure: only the first requests wait for it.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	is.True(time.Since(start) < 500*time.Millisecond)
+	is.Equal(2, primary.Calls())
+	is.Equal(fallback.StateOpen, store.(*fallback.Store).State())
+}
+
+func TestFallbackStoreInstances(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	primary := newFakePrimary()
+	primary.Fail(true)
+
+	store := fallback.NewStoreWithOptions(primary, fallback.Options{
+		Instances: 4,
+	})
+	defer tests.CloseStore(t, store)
+
+	// The local store enforces a share of the limit.
+	for i := 1; i <= 3; i++ {
+		lctx, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+		is.Equal(int64(2), lctx.Limit)
+		is.Equal(i > 2, lctx.Reached)
+	}
+}
+
+func TestFallbackStoreCanceledRequest(t *testing.T) {
+	is := require.New(t)
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	primary := newFakePrimary()
+	primary.Delay(time.Second)
+
+	store := fallback.NewStoreWithOptions(primary, fallback.Options{
+		FailureThreshold: 1,
+		Timeout:          time.Second,
+	})
+	defer tests.CloseStore(t, store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := store.Get(ctx, "foo", rate)
+	is.Equal(context.DeadlineExceeded, errors.Cause(err))
+	is.Equal(fallback.StateClosed, store.(*fallback.Store).State())
+	is.Equal(int64(0), store.(limiter.StatsReporter).Stats().Errors)
+}
+
+// fakePrimary is a primary store which can be made slow or unavailable.
+type fakePrimary struct {
+	store limiter.Store
+	calls int64
+	fail  int32
+	delay int64
+}
+
+func newFakePrimary() *fakePrimary {
+	return &fakePrimary{
+		store: memory.NewStoreWithOptions(limiter.StoreOptions{
+			Prefix:          "limiter:fallback:primary",
+			CleanUpInterval: 30 * time.Second,
+		}),
+	}
+}
+
+func (primary *fakePrimary) Fail(fail bool) {
+	value := int32(0)
+	if fail {
+		value = 1
+	}
+	atomic.StoreInt32(&primary.fail, value)
+}
+
+func (primary *fakePrimary) Delay(delay time.Duration) {
+	atomic.StoreInt64(&primary.delay, int64(delay))
+}
+
+func (primary *fakePrimary) Calls() int {
+	return int(atomic.LoadInt64(&primary.calls))
+}
+
+func (primary *fakePrimary) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	err := primary.wait(ctx)
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	return primary.store.Get(ctx, key, rate)
+}
+
+func (primary *fakePrimary) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	err := primary.wait(ctx)
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	return primary.store.Peek(ctx, key, rate)
+}
+
+func (primary *fakePrimary) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	err := primary.wait(ctx)
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	return primary.store.Reset(ctx, key, rate)
+}
+
+func (primary *fakePrimary) Close() error {
+	return primary.store.(io.Closer).Close()
+}
+
+// wait simulates a request to a remote server.
+func (primary *fakePrimary) wait(ctx context.Context) error {
+	atomic.AddInt64(&primary.calls, 1)
+
+	if delay := time.Duration(atomic.LoadInt64(&primary.delay)); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "fake primary")
+		}
+	}
+
+	if atomic.LoadInt32(&primary.fail) != 0 {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// transitionRecorder records state changes of a circuit.
+type transitionRecorder struct {
+	mutex       sync.Mutex
+	transitions []string
+}
+
+func (recorder *transitionRecorder) Record(from fallback.State, to fallback.State) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.transitions = append(recorder.transitions, from.String()+"->"+to.String())
+}
+
+func (recorder *transitionRecorder) Transitions() []string {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	return append([]string(nil), recorder.transitions...)
+}
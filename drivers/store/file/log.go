@@ -0,0 +1,210 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Log format:
+//
+//	header   [8]byte "LMTWAL" followed by version uint16, big endian
+//	records  repeated {
+//	             length   uint32, big endian length of payload
+//	             checksum uint32, big endian CRC-32 (IEEE) of payload
+//	             payload  {
+//	                 op         uint8
+//	                 key        uvarint length, followed by bytes
+//	                 value      varint (only for set operation)
+//	                 expiration varint, in nanoseconds since Unix epoch (only for set operation)
+//	             }
+//	         }
+//
+// A set operation records the state of a counter after a change, so replaying a log is idempotent.
+const (
+	logMagic   = "LMTWAL"
+	logVersion = 1
+	logHeader  = 8
+
+	opSet    = 1
+	opDelete = 2
+
+	// recordHeader is the size of a record header.
+	recordHeader = 8
+	// maxRecordSize is the maximum size of a record payload, to protect against corrupted logs.
+	maxRecordSize = 1 << 20
+)
+
+// errCorruptedRecord is returned when a record is incomplete or its checksum doesn't match.
+var errCorruptedRecord = errors.New("file: corrupted record")
+
+// record is a single operation on a counter.
+type record struct {
+	op         byte
+	key        string
+	value      int64
+	expiration int64
+}
+
+// encoder appends records to a log.
+type encoder struct {
+	writer  *bufio.Writer
+	scratch []byte
+}
+
+// newEncoder returns an encoder writing to given writer.
+func newEncoder(w io.Writer) *encoder {
+	return &encoder{
+		writer:  bufio.NewWriter(w),
+		scratch: make([]byte, 0, 256),
+	}
+}
+
+// WriteHeader writes the log header.
+func (encoder *encoder) WriteHeader() error {
+	header := make([]byte, logHeader)
+	copy(header, logMagic)
+	binary.BigEndian.PutUint16(header[len(logMagic):], logVersion)
+
+	_, err := encoder.writer.Write(header)
+	return err
+}
+
+// Write appends given record and returns the number of bytes written.
+func (encoder *encoder) Write(entry record) (int, error) {
+	payload := encoder.scratch[:recordHeader]
+	payload = append(payload, entry.op)
+	payload = appendUvarint(payload, uint64(len(entry.key)))
+	payload = append(payload, entry.key...)
+	if entry.op == opSet {
+		payload = appendVarint(payload, entry.value)
+		payload = appendVarint(payload, entry.expiration)
+	}
+
+	binary.BigEndian.PutUint32(payload[0:], uint32(len(payload)-recordHeader))
+	binary.BigEndian.PutUint32(payload[4:], crc32.ChecksumIEEE(payload[recordHeader:]))
+	encoder.scratch = payload[:0]
+
+	return encoder.writer.Write(payload)
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (encoder *encoder) Flush() error {
+	return encoder.writer.Flush()
+}
+
+// decoder reads records from a log.
+type decoder struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+// newDecoder returns a decoder reading from given reader.
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// ReadHeader reads and validates the log header.
+func (decoder *decoder) ReadHeader() error {
+	header := make([]byte, logHeader)
+	_, err := io.ReadFull(decoder.reader, header)
+	if err != nil {
+		return errors.Wrap(err, "file: cannot read log header")
+	}
+	if string(header[:len(logMagic)]) != logMagic {
+		return errors.New("file: not a limiter log")
+	}
+	if binary.BigEndian.Uint16(header[len(logMagic):]) != logVersion {
+		return errors.New("file: unsupported log version")
+	}
+
+	decoder.offset = logHeader
+	return nil
+}
+
+// Read returns the next record.
+// It returns io.EOF at the end of the log, or errCorruptedRecord if the next record is incomplete or corrupted,
+// which happens when a process has crashed while writing it.
+func (decoder *decoder) Read() (record, error) {
+	header := make([]byte, recordHeader)
+	n, err := io.ReadFull(decoder.reader, header)
+	if err == io.EOF {
+		return record{}, io.EOF
+	}
+	if err != nil || n != recordHeader {
+		return record{}, errCorruptedRecord
+	}
+
+	length := binary.BigEndian.Uint32(header[0:])
+	if length == 0 || length > maxRecordSize {
+		return record{}, errCorruptedRecord
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(decoder.reader, payload)
+	if err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return record{}, errCorruptedRecord
+	}
+
+	entry, ok := decodeRecord(payload)
+	if !ok {
+		return record{}, errCorruptedRecord
+	}
+
+	decoder.offset += int64(recordHeader + length)
+	return entry, nil
+}
+
+// Offset returns the offset of the end of the last valid record.
+func (decoder *decoder) Offset() int64 {
+	return decoder.offset
+}
+
+// decodeRecord decodes a record payload.
+func decodeRecord(payload []byte) (record, bool) {
+	entry := record{op: payload[0]}
+	payload = payload[1:]
+
+	length, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < length {
+		return record{}, false
+	}
+	entry.key = string(payload[n : n+int(length)])
+	payload = payload[n+int(length):]
+
+	switch entry.op {
+	case opDelete:
+		return entry, len(payload) == 0
+	case opSet:
+		entry.value, n = binary.Varint(payload)
+		if n <= 0 {
+			return record{}, false
+		}
+		payload = payload[n:]
+
+		entry.expiration, n = binary.Varint(payload)
+		if n <= 0 {
+			return record{}, false
+		}
+		return entry, len(payload) == n
+	default:
+		return record{}, false
+	}
+}
+
+// appendUvarint appends given value to buffer, using uvarint encoding.
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buffer, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
+
+// appendVarint appends given value to buffer, using varint encoding.
+func appendVarint(buffer []byte, value int64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buffer, scratch[:binary.PutVarint(scratch[:], value)]...)
+}
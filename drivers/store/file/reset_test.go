@@ -0,0 +1,115 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+)
+
+func TestStoreWriteError(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	directory, err := ioutil.TempDir("", "limiter-file")
+	is.NoError(err)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "limiter.log")
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	instance, err := NewStoreWithOptions(path, limiter.StoreOptions{Prefix: "limiter:file:write-error-test"})
+	is.NoError(err)
+	store := instance.(*Store)
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	// A failed write may leave an incomplete record: it's discarded, and the log is rewritten by the next write.
+	store.mutex.Lock()
+	_, err = store.file.Write([]byte("incomplete"))
+	is.NoError(err)
+	store.encoder = newEncoder(failingWriter{})
+	store.mutex.Unlock()
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.Error(err)
+	is.Equal(int64(1), store.Stats().Errors)
+
+	_, err = store.Get(ctx, "bar", rate)
+	is.NoError(err)
+	is.NoError(store.Close())
+
+	instance, err = NewStoreWithOptions(path, limiter.StoreOptions{Prefix: "limiter:file:write-error-test"})
+	is.NoError(err)
+	defer instance.(*Store).Close()
+
+	lctx, err := instance.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+
+	lctx, err = instance.Peek(ctx, "bar", rate)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+}
+
+func TestStoreCompactionBackoff(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	directory, err := ioutil.TempDir("", "limiter-file")
+	is.NoError(err)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "limiter.log")
+	rate := limiter.Rate{Limit: 100, Period: time.Minute}
+
+	instance, err := NewStoreWithOptions(path, limiter.StoreOptions{Prefix: "limiter:file:backoff-test"})
+	is.NoError(err)
+	store := instance.(*Store)
+	defer store.Close()
+
+	// A directory in place of the compacted log makes every compaction fail.
+	is.NoError(os.Mkdir(store.compactionPath(), 0700))
+
+	store.mutex.Lock()
+	store.encoder = newEncoder(failingWriter{})
+	store.mutex.Unlock()
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.Error(err)
+
+	// The first write after the error fails to compact the log, and next writes back off.
+	for i := 0; i < 10; i++ {
+		_, err = store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	is.Equal(int64(2), store.Stats().Errors)
+
+	// Once the backoff has elapsed, a write compacts the log again.
+	is.NoError(os.Remove(store.compactionPath()))
+	store.mutex.Lock()
+	store.retry = time.Time{}
+	store.mutex.Unlock()
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	store.mutex.Lock()
+	is.False(store.stale)
+	store.mutex.Unlock()
+}
+
+// failingWriter is a writer which always returns an error.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk is unavailable")
+}
@@ -0,0 +1,589 @@
+// Package file provides an embedded and durable store, which persists counters in an append-only log, so they
+// survive restarts on single-node deployments.
+package file
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+)
+
+// DefaultSyncInterval is the default interval between two flushes of the log to disk.
+const DefaultSyncInterval = time.Second
+
+// compactionRatio is the minimum ratio between the number of records in the log and the number of live counters
+// required to compact the log.
+const compactionRatio = 2
+
+// compactionMinRecords is the minimum number of records in the log required to compact it on a write, so a log with
+// a few counters isn't rewritten on every change.
+const compactionMinRecords = 1024
+
+// compactionBackoff is the delay before a write compacts the log again, after a compaction has failed, so a failing
+// disk doesn't make every write rewrite the whole log.
+const compactionBackoff = time.Second
+
+// counter is a counter with an expiration, in nanoseconds since Unix epoch.
+type counter struct {
+	value      int64
+	expiration int64
+}
+
+// Store is the file store.
+// Counters are held in memory, and every change is written to a log before the call returns. It's flushed to disk
+// right away if SyncInterval is zero. Otherwise, it's buffered and flushed every SyncInterval: the changes of the last
+// interval may be lost on a crash.
+// The log is compacted periodically, and once it has grown enough, by rewriting it with counters that have not
+// expired yet.
+type Store struct {
+	// Prefix used for the key.
+	Prefix string
+	// path is the log file path.
+	path string
+	// syncInterval is the interval between two flushes of the log to disk.
+	syncInterval time.Duration
+	// mutex protects every following field.
+	mutex sync.Mutex
+	// counters contains the state of every counter.
+	counters map[string]*counter
+	// file is the log file.
+	file *os.File
+	// encoder is used to append records to the log.
+	encoder *encoder
+	// records is the number of records in the log.
+	records int
+	// offset is the size of the log, up to the last record which has been flushed successfully.
+	offset int64
+	// pending is the size of the records which have not been flushed yet.
+	pending int64
+	// dirty is true if there are records which have not been flushed to disk yet.
+	dirty bool
+	// stale is true if records have been discarded after a write error, so the log must be rewritten.
+	stale bool
+	// retry is the time after which a write can compact the log again, after a compaction has failed.
+	retry time.Time
+	// evicted is the number of expired counters removed by compaction.
+	evicted int64
+	// errors is the number of operations that failed on the log.
+	errors int64
+	// closed is true when the store has been closed.
+	closed bool
+	// stop is used to stop background goroutines.
+	stop chan struct{}
+	// done is used to wait for background goroutines.
+	done sync.WaitGroup
+}
+
+// NewStore returns an instance of file store with defaults, using given log file.
+func NewStore(path string) (limiter.Store, error) {
+	return NewStoreWithOptions(path, limiter.StoreOptions{
+		Prefix:          limiter.DefaultPrefix,
+		CleanUpInterval: limiter.DefaultCleanUpInterval,
+		SyncInterval:    DefaultSyncInterval,
+	})
+}
+
+// NewStoreWithOptions returns an instance of file store with options, using given log file.
+// The log is replayed on startup: an incomplete record, written by a process that has crashed, is discarded.
+func NewStoreWithOptions(path string, options limiter.StoreOptions) (limiter.Store, error) {
+	store := &Store{
+		Prefix:       options.Prefix,
+		path:         path,
+		syncInterval: options.SyncInterval,
+		counters:     map[string]*counter{},
+		stop:         make(chan struct{}),
+	}
+
+	// Remove any compaction that has been interrupted.
+	_ = os.Remove(store.compactionPath())
+
+	err := store.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if store.syncInterval > 0 {
+		store.done.Add(1)
+		go store.run(store.syncInterval, store.Sync)
+	}
+	if options.CleanUpInterval > 0 {
+		store.done.Add(1)
+		go store.run(options.CleanUpInterval, store.compact)
+	}
+
+	return store, nil
+}
+
+// open replays the log file, or creates it, and prepares it for new records.
+func (store *Store) open() error {
+	file, err := os.OpenFile(store.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "file: cannot open log")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, "file: cannot stat log")
+	}
+
+	store.file = file
+	store.encoder = newEncoder(file)
+
+	if info.Size() < logHeader {
+		// Either a new log, or a log whose creation has been interrupted.
+		err = file.Truncate(0)
+		if err == nil {
+			err = store.encoder.WriteHeader()
+		}
+		if err == nil {
+			err = store.encoder.Flush()
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			_ = file.Close()
+			return errors.Wrap(err, "file: cannot write log header")
+		}
+		store.offset = logHeader
+		return nil
+	}
+
+	err = store.replay()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return nil
+}
+
+// replay loads every record of the log, and truncates the log after the last valid record.
+func (store *Store) replay() error {
+	decoder := newDecoder(store.file)
+	err := decoder.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	for {
+		entry, err := decoder.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == errCorruptedRecord {
+			// The process has crashed while writing this record: discard it, and anything after.
+			err = store.file.Truncate(decoder.Offset())
+			if err != nil {
+				return errors.Wrap(err, "file: cannot truncate corrupted log")
+			}
+			break
+		}
+
+		store.apply(entry)
+		store.records++
+	}
+
+	_, err = store.file.Seek(decoder.Offset(), io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "file: cannot seek log")
+	}
+
+	store.offset = decoder.Offset()
+	return nil
+}
+
+// apply updates counters with given record.
+func (store *Store) apply(entry record) {
+	switch entry.op {
+	case opSet:
+		store.counters[entry.key] = &counter{
+			value:      entry.value,
+			expiration: entry.expiration,
+		}
+	case opDelete:
+		delete(store.counters, entry.key)
+	}
+}
+
+// Get returns the limit for given identifier.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	buffer.Concat(store.Prefix, ":", key)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	now := time.Now()
+	value := int64(1)
+	expiration := now.Add(rate.Period).UnixNano()
+
+	entry, ok := store.counters[buffer.String()]
+	if ok && now.UnixNano() <= entry.expiration {
+		value = entry.value + 1
+		expiration = entry.expiration
+	}
+
+	err := store.append(record{
+		op:         opSet,
+		key:        buffer.String(),
+		value:      value,
+		expiration: expiration,
+	})
+	if err != nil {
+		return limiter.Context{}, err
+	}
+
+	if !ok {
+		// Since the key is retained, we copy it: it's backed by a reusable buffer.
+		entry = &counter{}
+		store.counters[string(buffer.Bytes())] = entry
+	}
+	entry.value = value
+	entry.expiration = expiration
+
+	store.compactOnWrite()
+
+	return common.GetContextFromState(now, rate, time.Unix(0, entry.expiration), entry.value), nil
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	buffer.Concat(store.Prefix, ":", key)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	now := time.Now()
+	count := int64(0)
+	expiration := now.Add(rate.Period)
+
+	entry, ok := store.counters[buffer.String()]
+	if ok && now.UnixNano() <= entry.expiration {
+		count = entry.value
+		expiration = time.Unix(0, entry.expiration)
+	}
+
+	return common.GetContextFromState(now, rate, expiration, count), nil
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	buffer.Concat(store.Prefix, ":", key)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	_, ok := store.counters[buffer.String()]
+	if ok {
+		err := store.append(record{
+			op:  opDelete,
+			key: buffer.String(),
+		})
+		if err != nil {
+			return limiter.Context{}, err
+		}
+		delete(store.counters, buffer.String())
+		store.compactOnWrite()
+	}
+
+	now := time.Now()
+	return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+}
+
+// Sync flushes every pending record to disk.
+func (store *Store) Sync() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.sync()
+}
+
+// Close flushes every pending record to disk, stops background goroutines and closes the log.
+func (store *Store) Close() error {
+	store.mutex.Lock()
+	if store.closed {
+		store.mutex.Unlock()
+		return nil
+	}
+	store.closed = true
+	close(store.stop)
+	store.mutex.Unlock()
+
+	store.done.Wait()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.sync()
+	if err != nil {
+		_ = store.file.Close()
+		return err
+	}
+
+	return store.file.Close()
+}
+
+// Ping returns an error if the store has been closed.
+func (store *Store) Ping(ctx context.Context) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return limiter.ErrStoreClosed
+	}
+	return nil
+}
+
+// Stats returns the number of counters held by the store, the number of expired counters removed by compaction and
+// the number of operations that failed on the log.
+func (store *Store) Stats() limiter.StoreStats {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return limiter.StoreStats{
+		Keys:    int64(len(store.counters)),
+		Evicted: store.evicted,
+		Errors:  store.errors,
+	}
+}
+
+// append writes given record to the log.
+// If the store has no sync interval, the record is flushed to disk right away.
+// WARNING: mutex must be held by the caller.
+func (store *Store) append(entry record) error {
+	n, err := store.encoder.Write(entry)
+	if err != nil {
+		store.errors++
+		store.reset()
+		return errors.Wrap(err, "file: cannot append to log")
+	}
+
+	store.records++
+	store.pending += int64(n)
+	store.dirty = true
+
+	if store.syncInterval <= 0 {
+		return store.sync()
+	}
+	return nil
+}
+
+// sync flushes every pending record to disk.
+// WARNING: mutex must be held by the caller.
+func (store *Store) sync() error {
+	if !store.dirty {
+		return nil
+	}
+
+	err := store.encoder.Flush()
+	if err != nil {
+		store.errors++
+		store.reset()
+		return errors.Wrap(err, "file: cannot sync log")
+	}
+
+	store.offset += store.pending
+	store.pending = 0
+	store.dirty = false
+
+	err = store.file.Sync()
+	if err != nil {
+		store.errors++
+		return errors.Wrap(err, "file: cannot sync log")
+	}
+
+	return nil
+}
+
+// reset discards the records which have not been flushed, and resumes writing after the last record which has been
+// flushed successfully: once a write has failed, the buffered writer keeps failing, and an incomplete record may
+// have been written. Discarded changes are kept in memory, and written back by the next compaction.
+// WARNING: mutex must be held by the caller.
+func (store *Store) reset() {
+	err := store.file.Truncate(store.offset)
+	if err == nil {
+		_, err = store.file.Seek(store.offset, io.SeekStart)
+	}
+	if err != nil {
+		store.errors++
+	}
+
+	store.encoder = newEncoder(store.file)
+	store.pending = 0
+	store.dirty = false
+	store.stale = true
+}
+
+// compact rewrites the log with counters that have not expired yet, if it's worth it.
+// The new log is written next to the current one, then renamed: a crash during compaction leaves the current log
+// untouched.
+func (store *Store) compact() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.evict()
+
+	if !store.stale && (store.records < compactionRatio*len(store.counters) || store.records == 0) {
+		return nil
+	}
+
+	err := store.rewrite()
+	if err != nil {
+		store.errors++
+		return err
+	}
+
+	return nil
+}
+
+// compactOnWrite compacts the log after a change, if it has grown enough since the last compaction, or if records
+// have been discarded after a write error. Unlike compact, it doesn't wait for the next cleanup, so the log is
+// bounded when the cleanup is disabled or too infrequent. Once a compaction has failed, writes don't compact the log
+// again for compactionBackoff.
+// WARNING: mutex must be held by the caller.
+func (store *Store) compactOnWrite() {
+	if !store.stale && (store.records < compactionMinRecords || store.records < compactionRatio*len(store.counters)) {
+		return
+	}
+
+	// After a failure, writes back off: the log is still compacted by the cleanup in the meantime.
+	now := time.Now()
+	if now.Before(store.retry) {
+		return
+	}
+
+	store.evict()
+
+	err := store.rewrite()
+	if err != nil {
+		store.errors++
+		store.retry = now.Add(compactionBackoff)
+	}
+}
+
+// evict removes expired counters.
+// WARNING: mutex must be held by the caller.
+func (store *Store) evict() {
+	now := time.Now().UnixNano()
+	for key, entry := range store.counters {
+		if now > entry.expiration {
+			delete(store.counters, key)
+			store.evicted++
+		}
+	}
+}
+
+// rewrite writes counters to a new log, then replaces the current log.
+// WARNING: mutex must be held by the caller.
+func (store *Store) rewrite() error {
+	path := store.compactionPath()
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "file: cannot create compacted log")
+	}
+
+	encoder := newEncoder(file)
+	err = encoder.WriteHeader()
+	offset := int64(logHeader)
+	for key, entry := range store.counters {
+		if err != nil {
+			break
+		}
+		var n int
+		n, err = encoder.Write(record{
+			op:         opSet,
+			key:        key,
+			value:      entry.value,
+			expiration: entry.expiration,
+		})
+		offset += int64(n)
+	}
+	if err == nil {
+		err = encoder.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(path, store.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return errors.Wrap(err, "file: cannot write compacted log")
+	}
+
+	syncDirectory(filepath.Dir(store.path))
+
+	// Pending records of the previous log are part of the compacted log.
+	_ = store.file.Close()
+	store.file = file
+	store.encoder = encoder
+	store.records = len(store.counters)
+	store.offset = offset
+	store.pending = 0
+	store.dirty = false
+	store.stale = false
+
+	return nil
+}
+
+// compactionPath returns the path of the log written during compaction.
+func (store *Store) compactionPath() string {
+	return store.path + ".compact"
+}
+
+// run calls given handler periodically until the store is closed.
+func (store *Store) run(interval time.Duration, handler func() error) {
+	defer store.done.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = handler()
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+// syncDirectory flushes given directory to disk, so a rename is durable.
+func syncDirectory(path string) {
+	directory, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	_ = directory.Sync()
+	_ = directory.Close()
+}
@@ -0,0 +1,285 @@
+package file_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/file"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestFileStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := file.NewStoreWithOptions(path, limiter.StoreOptions{
+		Prefix:          "limiter:file:sequential-test",
+		CleanUpInterval: 30 * time.Second,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestFileStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := file.NewStoreWithOptions(path, limiter.StoreOptions{
+		Prefix:          "limiter:file:concurrent-test",
+		CleanUpInterval: 30 * time.Second,
+		SyncInterval:    10 * time.Millisecond,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestFileStorePersistence(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+	options := limiter.StoreOptions{
+		Prefix: "limiter:file:persistence-test",
+	}
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := file.NewStoreWithOptions(path, options)
+	is.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		_, err = store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	_, err = store.Get(ctx, "bar", rate)
+	is.NoError(err)
+	_, err = store.Reset(ctx, "bar", rate)
+	is.NoError(err)
+	tests.CloseStore(t, store)
+
+	store, err = file.NewStoreWithOptions(path, options)
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	lctx, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(7), lctx.Remaining)
+
+	lctx, err = store.Peek(ctx, "bar", rate)
+	is.NoError(err)
+	is.Equal(int64(10), lctx.Remaining)
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+	options := limiter.StoreOptions{
+		Prefix: "limiter:file:recovery-test",
+	}
+
+	tails := map[string]func(content []byte) []byte{
+		"truncated": func(content []byte) []byte {
+			return content[:len(content)-3]
+		},
+		"garbage": func(content []byte) []byte {
+			return append(content, 0x00, 0x00, 0x01, 0x00, 0xde, 0xad)
+		},
+	}
+
+	for name, tail := range tails {
+		path := tempFile(t)
+
+		store, err := file.NewStoreWithOptions(path, options)
+		is.NoError(err, name)
+		for i := 0; i < 4; i++ {
+			_, err = store.Get(ctx, "foo", rate)
+			is.NoError(err, name)
+		}
+		tests.CloseStore(t, store)
+
+		// Simulate a crash while the last record was written.
+		content, err := ioutil.ReadFile(path)
+		is.NoError(err, name)
+		is.NoError(ioutil.WriteFile(path, tail(content), 0600), name)
+
+		store, err = file.NewStoreWithOptions(path, options)
+		is.NoError(err, name)
+
+		lctx, err := store.Peek(ctx, "foo", rate)
+		is.NoError(err, name)
+		if name == "truncated" {
+			is.Equal(int64(7), lctx.Remaining, name)
+		} else {
+			is.Equal(int64(6), lctx.Remaining, name)
+		}
+
+		// New records are appended after the last valid record.
+		_, err = store.Get(ctx, "foo", rate)
+		is.NoError(err, name)
+		tests.CloseStore(t, store)
+
+		store, err = file.NewStoreWithOptions(path, options)
+		is.NoError(err, name)
+		lctx, err = store.Peek(ctx, "foo", rate)
+		is.NoError(err, name)
+		if name == "truncated" {
+			is.Equal(int64(6), lctx.Remaining, name)
+		} else {
+			is.Equal(int64(5), lctx.Remaining, name)
+		}
+		tests.CloseStore(t, store)
+
+		removeTempFile(path)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := file.NewStoreWithOptions(path, limiter.StoreOptions{
+		Prefix:          "limiter:file:compaction-test",
+		CleanUpInterval: 50 * time.Millisecond,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	short := limiter.Rate{Limit: 1000, Period: 10 * time.Millisecond}
+	long := limiter.Rate{Limit: 1000, Period: time.Minute}
+	for i := 0; i < 100; i++ {
+		_, err = store.Get(ctx, "short", short)
+		is.NoError(err)
+		_, err = store.Get(ctx, "long", long)
+		is.NoError(err)
+	}
+
+	before, err := os.Stat(path)
+	is.NoError(err)
+
+	is.Eventually(func() bool {
+		after, err := os.Stat(path)
+		return err == nil && after.Size() < before.Size()
+	}, 2*time.Second, 10*time.Millisecond)
+
+	stats := store.(limiter.StatsReporter).Stats()
+	is.Equal(int64(1), stats.Keys)
+	is.Equal(int64(1), stats.Evicted)
+	is.Equal(int64(0), stats.Errors)
+
+	lctx, err := store.Peek(ctx, "long", long)
+	is.NoError(err)
+	is.Equal(int64(900), lctx.Remaining)
+}
+
+func TestFileStoreCompactionOnWrite(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	// Without cleanup, the log is compacted by writes.
+	store, err := file.NewStoreWithOptions(path, limiter.StoreOptions{
+		Prefix: "limiter:file:compaction-on-write-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	rate := limiter.Rate{Limit: 100000, Period: time.Minute}
+	for i := 0; i < 10000; i++ {
+		_, err = store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+
+	info, err := os.Stat(path)
+	is.NoError(err)
+	is.True(info.Size() < 64*1024, "log size is %d", info.Size())
+
+	lctx, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(90000), lctx.Remaining)
+	is.Equal(int64(0), store.(limiter.StatsReporter).Stats().Errors)
+}
+
+func TestFileStoreLifecycle(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := file.NewStore(path)
+	is.NoError(err)
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+
+	tests.CloseStore(t, store)
+	is.Equal(limiter.ErrStoreClosed, store.(limiter.Pinger).Ping(ctx))
+
+	_, err = store.Get(ctx, "foo", limiter.Rate{Limit: 10, Period: time.Minute})
+	is.Equal(limiter.ErrStoreClosed, err)
+}
+
+func BenchmarkFileStoreSequentialAccess(b *testing.B) {
+	is := require.New(b)
+
+	path := tempFile(b)
+	defer removeTempFile(path)
+
+	store, err := file.NewStoreWithOptions(path, limiter.StoreOptions{
+		Prefix:          "limiter:file:sequential-benchmark",
+		CleanUpInterval: 30 * time.Second,
+		SyncInterval:    file.DefaultSyncInterval,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(b, store)
+
+	tests.BenchmarkStoreSequentialAccess(b, store)
+}
+
+func BenchmarkFileStoreConcurrentAccess(b *testing.B) {
+	is := require.New(b)
+
+	path := tempFile(b)
+	defer removeTempFile(path)
+
+	store, err := file.NewStoreWithOptions(path, limiter.StoreOptions{
+		Prefix:          "limiter:file:concurrent-benchmark",
+		CleanUpInterval: 30 * time.Second,
+		SyncInterval:    file.DefaultSyncInterval,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(b, store)
+
+	tests.BenchmarkStoreConcurrentAccess(b, store)
+}
+
+func tempFile(tb testing.TB) string {
+	directory, err := ioutil.TempDir("", "limiter-file")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return filepath.Join(directory, "limiter.log")
+}
+
+func removeTempFile(path string) {
+	_ = os.RemoveAll(filepath.Dir(path))
+}
@@ -0,0 +1,287 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader is the header holding the hex-encoded HMAC-SHA256 of a gossip message, signed with the secret.
+const SignatureHeader = "X-Limiter-Signature"
+
+// maxMessageSize is the maximum size of a gossip message accepted from a peer.
+const maxMessageSize = 8 << 20
+
+// message is sent by a node to its peers, with every window updated since its last round.
+type message struct {
+	Node    string         `json:"node"`
+	Entries []messageEntry `json:"entries"`
+}
+
+// messageEntry contains the counters of a window.
+// Counters are absolute values, rather than increments, so merging a message twice is harmless.
+type messageEntry struct {
+	Key    string            `json:"key"`
+	Start  int64             `json:"start"`
+	Period int64             `json:"period"`
+	Counts map[string]uint64 `json:"counts"`
+	Floors map[string]uint64 `json:"floors,omitempty"`
+}
+
+// ServeHTTP receives gossip from a peer, and merges its counters.
+func (store *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "invalid gossip message", http.StatusBadRequest)
+		return
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil || !hmac.Equal(signature, store.sign(body)) {
+		atomic.AddInt64(&store.errors, 1)
+		http.Error(w, "invalid gossip signature", http.StatusUnauthorized)
+		return
+	}
+
+	received := message{}
+	err = json.Unmarshal(body, &received)
+	if err != nil {
+		http.Error(w, "invalid gossip message", http.StatusBadRequest)
+		return
+	}
+
+	if store.merge(received, time.Now()) > 0 {
+		atomic.AddInt64(&store.errors, 1)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sign returns the HMAC-SHA256 of given message body.
+func (store *Store) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, store.config.Secret)
+	_, _ = mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// merge updates counters with the highest value of every node, between ours and given message.
+// Expired windows are ignored, and so are the windows beyond MaxNewKeys that would be created.
+// It returns the number of windows ignored because of MaxNewKeys.
+func (store *Store) merge(received message, now time.Time) int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	created := 0
+	ignored := 0
+	for i := range received.Entries {
+		source := &received.Entries[i]
+		current := window{
+			key:    source.Key,
+			start:  source.Start,
+			period: source.Period,
+		}
+		if current.period <= 0 || current.expiration() < now.UnixNano() {
+			continue
+		}
+
+		if _, ok := store.entries[current]; !ok {
+			if created >= store.config.MaxNewKeys {
+				ignored++
+				continue
+			}
+			created++
+		}
+
+		target := store.entry(current)
+		for node, count := range source.Counts {
+			if count > target.counts[node] {
+				target.counts[node] = count
+			}
+		}
+		for node, floor := range source.Floors {
+			if floor > target.floors[node] {
+				target.floors[node] = floor
+			}
+		}
+	}
+
+	return ignored
+}
+
+// gossip sends every window updated since the last round to every peer, in messages of at most MaxNewKeys windows.
+// Windows are sent again on the next round if a peer could not be reached.
+func (store *Store) gossip() {
+	outgoing, windows := store.collect()
+	if len(windows) == 0 {
+		return
+	}
+
+	peers := store.lookup()
+	if len(peers) == 0 {
+		return
+	}
+
+	bodies := [][]byte{}
+	for start := 0; start < len(outgoing.Entries); start += store.config.MaxNewKeys {
+		end := start + store.config.MaxNewKeys
+		if end > len(outgoing.Entries) {
+			end = len(outgoing.Entries)
+		}
+
+		body, err := json.Marshal(message{Node: outgoing.Node, Entries: outgoing.Entries[start:end]})
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return
+		}
+		bodies = append(bodies, body)
+	}
+
+	failed := int32(0)
+	wg := &sync.WaitGroup{}
+	wg.Add(len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			defer wg.Done()
+
+			for _, body := range bodies {
+				err := store.push(peer, body)
+				if err != nil {
+					atomic.AddInt64(&store.errors, 1)
+					atomic.StoreInt32(&failed, 1)
+					return
+				}
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		store.mutex.Lock()
+		for _, current := range windows {
+			if _, ok := store.entries[current]; ok {
+				store.dirty[current] = struct{}{}
+			}
+		}
+		store.mutex.Unlock()
+	}
+}
+
+// collect returns a message with every window updated since the last round, and clears them.
+func (store *Store) collect() (message, []window) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	outgoing := message{
+		Node:    store.config.Node,
+		Entries: make([]messageEntry, 0, len(store.dirty)),
+	}
+	windows := make([]window, 0, len(store.dirty))
+
+	for current := range store.dirty {
+		entry, ok := store.entries[current]
+		if !ok {
+			continue
+		}
+
+		source := messageEntry{
+			Key:    current.key,
+			Start:  current.start,
+			Period: current.period,
+			Counts: make(map[string]uint64, len(entry.counts)),
+		}
+		for node, count := range entry.counts {
+			source.Counts[node] = count
+		}
+		if len(entry.floors) > 0 {
+			source.Floors = make(map[string]uint64, len(entry.floors))
+			for node, floor := range entry.floors {
+				source.Floors[node] = floor
+			}
+		}
+
+		outgoing.Entries = append(outgoing.Entries, source)
+		windows = append(windows, current)
+	}
+
+	store.dirty = map[window]struct{}{}
+
+	return outgoing, windows
+}
+
+// lookup returns the addresses of every peer, except this node.
+// Addresses are looked up again every refresh interval: the previous addresses are kept if it fails.
+func (store *Store) lookup() []string {
+	store.mutex.Lock()
+	if store.refreshed.IsZero() || time.Since(store.refreshed) >= store.config.RefreshInterval {
+		store.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		addresses, err := store.config.Peers.Peers(ctx)
+		cancel()
+
+		store.mutex.Lock()
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+		} else {
+			store.peers = store.peers[:0]
+			for _, address := range addresses {
+				if address != store.config.Advertise {
+					store.peers = append(store.peers, address)
+				}
+			}
+			store.refreshed = time.Now()
+		}
+	}
+
+	peers := append([]string(nil), store.peers...)
+	store.mutex.Unlock()
+
+	return peers
+}
+
+// push sends given message to a peer.
+func (store *Store) push(peer string, body []byte) error {
+	url := peer
+	if !strings.Contains(peer, "://") {
+		url = "http://" + peer + store.config.Path
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "gossip: invalid peer %s", peer)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, hex.EncodeToString(store.sign(body)))
+
+	response, err := store.config.Client.Do(request)
+	if err != nil {
+		return errors.Wrapf(err, "gossip: cannot reach peer %s", peer)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode/100 != 2 {
+		return errors.Errorf("gossip: peer %s has responded with status %d", peer, response.StatusCode)
+	}
+
+	return nil
+}
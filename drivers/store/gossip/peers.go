@@ -0,0 +1,57 @@
+package gossip
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Peers provides the addresses of the nodes of a cluster.
+// An address is either "host:port", or a URL of the gossip endpoint of a node.
+type Peers interface {
+	// Peers returns the addresses of every node of the cluster, which may include the current node.
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// StaticPeers is a fixed list of peer addresses.
+type StaticPeers []string
+
+// Peers returns the list of addresses.
+func (peers StaticPeers) Peers(ctx context.Context) ([]string, error) {
+	return peers, nil
+}
+
+// DNSPeers resolves peer addresses from a DNS name, such as a headless Kubernetes service.
+// Every address returned by the lookup is a node, listening on the same port.
+type DNSPeers struct {
+	// Name is the DNS name to resolve.
+	Name string
+	// Port is the gossip port of every node.
+	Port int
+	// Resolver is used to resolve Name. If it's nil, the default resolver is used.
+	Resolver *net.Resolver
+}
+
+// Peers resolves the DNS name, and returns the address of every node.
+func (peers DNSPeers) Peers(ctx context.Context) ([]string, error) {
+	resolver := peers.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	hosts, err := resolver.LookupHost(ctx, peers.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gossip: cannot resolve peers from %s", peers.Name)
+	}
+
+	addresses := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(peers.Port)))
+	}
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
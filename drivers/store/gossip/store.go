@@ -0,0 +1,418 @@
+// Package gossip provides a store for clusters without any shared datastore.
+//
+// Each node keeps its own counters, and periodically sends the counters updated since its last round to its peers
+// over HTTP. Counters are grow-only per node, so they are merged by keeping the highest value seen for each node:
+// messages can be lost, duplicated or reordered without corrupting any counter.
+//
+// Limits are approximately global: a node is not aware of requests admitted by its peers until their next round,
+// so a cluster of N nodes may over-admit, for each window, at most the requests admitted by N-1 nodes during one
+// gossip interval (plus network latency).
+//
+// Since nodes don't agree on the first request of a window, windows are aligned on the rate period, since Unix
+// epoch, instead of starting with the first request.
+//
+// Messages are authenticated with an HMAC of their body, using a secret shared by every node: the endpoint must not
+// accept counters from anyone else.
+package gossip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+)
+
+const (
+	// DefaultPath is the default path of the gossip endpoint.
+	DefaultPath = "/limiter/gossip"
+	// DefaultInterval is the default interval between two gossip rounds.
+	DefaultInterval = 100 * time.Millisecond
+	// DefaultRefreshInterval is the default interval between two lookups of the peers addresses.
+	DefaultRefreshInterval = 30 * time.Second
+	// DefaultTimeout is the default timeout of a gossip request.
+	DefaultTimeout = time.Second
+	// DefaultMaxNewKeys is the default maximum number of windows created by a gossip message.
+	DefaultMaxNewKeys = 10000
+)
+
+// Config configures the cluster membership of a gossip store.
+type Config struct {
+	// Node is the unique identifier of this node in the cluster. A random identifier is used if it's empty.
+	Node string
+	// Address is the address used to listen for gossip from peers, such as ":7946".
+	// If it's empty, no listener is started: the store must be mounted on an existing server, as an http.Handler.
+	Address string
+	// Advertise is the address used by peers to reach this node, so it's skipped in the peers list: it must be
+	// written as returned by Peers. It defaults to the listener address, but it's required if Address has no host
+	// (e.g. ":7946"), since the listener address is then unspecified (e.g. "[::]:7946").
+	Advertise string
+	// Peers provides the addresses of the cluster nodes.
+	Peers Peers
+	// Path is the path of the gossip endpoint on every node. It defaults to DefaultPath.
+	Path string
+	// Interval is the interval between two gossip rounds. It defaults to DefaultInterval.
+	Interval time.Duration
+	// RefreshInterval is the interval between two lookups of the peers addresses.
+	// It defaults to DefaultRefreshInterval.
+	RefreshInterval time.Duration
+	// Client is used to send gossip to peers. A client with DefaultTimeout is used if it's nil.
+	Client *http.Client
+	// Secret is shared by every node to sign gossip messages with HMAC-SHA256. It's required.
+	Secret []byte
+	// MaxNewKeys is the maximum number of windows created by a gossip message: windows beyond it are ignored.
+	// Messages sent to peers are split accordingly. It defaults to DefaultMaxNewKeys.
+	MaxNewKeys int
+}
+
+// window identifies a counter of a key for a window of time.
+type window struct {
+	key    string
+	start  int64
+	period int64
+}
+
+// expiration returns the end of the window, in nanoseconds since Unix epoch.
+func (window window) expiration() int64 {
+	return window.start + window.period
+}
+
+// entry contains the count of every node for a window, and the count of every node when it was last reset.
+type entry struct {
+	counts map[string]uint64
+	floors map[string]uint64
+}
+
+// total returns the number of requests counted by every node since the last reset.
+func (entry *entry) total() int64 {
+	total := int64(0)
+	for node, count := range entry.counts {
+		if floor := entry.floors[node]; count > floor {
+			total += int64(count - floor)
+		}
+	}
+	return total
+}
+
+// Store is the gossip store.
+type Store struct {
+	// errors is the number of gossip requests that have failed, sent or received.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// evicted is the number of expired windows removed.
+	evicted int64
+	// closed is set to one when the store has been closed.
+	closed uint32
+	// Prefix used for the key.
+	Prefix string
+	// config is the cluster configuration, with defaults.
+	config Config
+	// cleanUpInterval is the interval between two removals of expired windows.
+	cleanUpInterval time.Duration
+	// mutex protects entries, dirty and peers.
+	mutex sync.Mutex
+	// entries contains the counters of every window.
+	entries map[window]*entry
+	// dirty contains the windows updated since the last gossip round.
+	dirty map[window]struct{}
+	// peers contains the addresses of the other nodes.
+	peers []string
+	// refreshed is the last time peers have been looked up.
+	refreshed time.Time
+	// server receives gossip from peers, if the store listens on its own address.
+	server *http.Server
+	// stop is used to stop the gossip goroutine.
+	stop chan struct{}
+	// done is closed when the gossip goroutine has returned.
+	done chan struct{}
+	// closeOnce is used to close the store only once.
+	closeOnce sync.Once
+}
+
+// NewStore returns an instance of gossip store with defaults.
+func NewStore(config Config) (limiter.Store, error) {
+	return NewStoreWithOptions(config, limiter.StoreOptions{
+		Prefix:          limiter.DefaultPrefix,
+		CleanUpInterval: limiter.DefaultCleanUpInterval,
+	})
+}
+
+// NewStoreWithOptions returns an instance of gossip store with options.
+// Expired windows are removed every CleanUpInterval.
+func NewStoreWithOptions(config Config, options limiter.StoreOptions) (limiter.Store, error) {
+	if config.Peers == nil {
+		return nil, errors.New("gossip: peers are required")
+	}
+	if len(config.Secret) == 0 {
+		return nil, errors.New("gossip: secret is required")
+	}
+	if config.Node == "" {
+		node, err := randomNode()
+		if err != nil {
+			return nil, err
+		}
+		config.Node = node
+	}
+	if config.Path == "" {
+		config.Path = DefaultPath
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if config.MaxNewKeys <= 0 {
+		config.MaxNewKeys = DefaultMaxNewKeys
+	}
+
+	cleanUpInterval := options.CleanUpInterval
+	if cleanUpInterval <= 0 {
+		cleanUpInterval = limiter.DefaultCleanUpInterval
+	}
+
+	store := &Store{
+		Prefix:          options.Prefix,
+		config:          config,
+		cleanUpInterval: cleanUpInterval,
+		entries:         map[window]*entry{},
+		dirty:           map[window]struct{}{},
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	if config.Address != "" {
+		listener, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			return nil, errors.Wrap(err, "gossip: cannot listen")
+		}
+		if store.config.Advertise == "" {
+			addr, ok := listener.Addr().(*net.TCPAddr)
+			if !ok || addr.IP.IsUnspecified() {
+				_ = listener.Close()
+				return nil, errors.New("gossip: advertise address is required when listening on every interface")
+			}
+			store.config.Advertise = addr.String()
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(config.Path, store)
+		store.server = &http.Server{Handler: mux}
+		go func() {
+			_ = store.server.Serve(listener)
+		}()
+	}
+
+	go store.run()
+
+	return store, nil
+}
+
+// Node returns the identifier of this node.
+func (store *Store) Node() string {
+	return store.config.Node
+}
+
+// Addr returns the address used by peers to reach this node.
+func (store *Store) Addr() string {
+	return store.config.Advertise
+}
+
+// Get returns the limit for given identifier.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+	if rate.Period <= 0 {
+		return limiter.Context{}, errors.New("gossip: rate period must be positive")
+	}
+
+	now := time.Now()
+	current := store.window(key, rate, now)
+
+	store.mutex.Lock()
+	entry := store.entry(current)
+	entry.counts[store.config.Node]++
+	store.dirty[current] = struct{}{}
+	count := entry.total()
+	store.mutex.Unlock()
+
+	return common.GetContextFromState(now, rate, time.Unix(0, current.expiration()), count), nil
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+	if rate.Period <= 0 {
+		return limiter.Context{}, errors.New("gossip: rate period must be positive")
+	}
+
+	now := time.Now()
+	current := store.window(key, rate, now)
+	count := int64(0)
+
+	store.mutex.Lock()
+	entry, ok := store.entries[current]
+	if ok {
+		count = entry.total()
+	}
+	store.mutex.Unlock()
+
+	return common.GetContextFromState(now, rate, time.Unix(0, current.expiration()), count), nil
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+// The reset is propagated to peers: requests counted by any node before the reset are discarded.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+	if rate.Period <= 0 {
+		return limiter.Context{}, errors.New("gossip: rate period must be positive")
+	}
+
+	now := time.Now()
+	current := store.window(key, rate, now)
+
+	store.mutex.Lock()
+	entry, ok := store.entries[current]
+	if ok {
+		for node, count := range entry.counts {
+			if count > entry.floors[node] {
+				entry.floors[node] = count
+			}
+		}
+		store.dirty[current] = struct{}{}
+	}
+	store.mutex.Unlock()
+
+	return common.GetContextFromState(now, rate, time.Unix(0, current.expiration()), 0), nil
+}
+
+// Close sends a last gossip round to peers, and stops receiving gossip.
+func (store *Store) Close() error {
+	store.closeOnce.Do(func() {
+		atomic.StoreUint32(&store.closed, 1)
+		close(store.stop)
+		<-store.done
+
+		if store.server != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+			defer cancel()
+			_ = store.server.Shutdown(ctx)
+		}
+	})
+	return nil
+}
+
+// Closed returns true if the store has been closed.
+func (store *Store) Closed() bool {
+	return atomic.LoadUint32(&store.closed) != 0
+}
+
+// Ping returns an error if the store has been closed.
+// Peers are not checked: the store keeps serving requests with local counters while they are unreachable.
+func (store *Store) Ping(ctx context.Context) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+	return nil
+}
+
+// Stats returns the number of windows held by the store, the number of expired windows removed and the number of
+// gossip requests that have failed, sent or received.
+func (store *Store) Stats() limiter.StoreStats {
+	store.mutex.Lock()
+	keys := int64(len(store.entries))
+	store.mutex.Unlock()
+
+	return limiter.StoreStats{
+		Keys:    keys,
+		Evicted: atomic.LoadInt64(&store.evicted),
+		Errors:  atomic.LoadInt64(&store.errors),
+	}
+}
+
+// window returns the window of given identifier at given time.
+func (store *Store) window(key string, rate limiter.Rate, now time.Time) window {
+	period := int64(rate.Period)
+	return window{
+		key:    store.Prefix + ":" + key,
+		start:  now.UnixNano() / period * period,
+		period: period,
+	}
+}
+
+// entry returns the counters of given window, and creates them if required.
+// WARNING: mutex must be held by the caller.
+func (store *Store) entry(current window) *entry {
+	value, ok := store.entries[current]
+	if !ok {
+		value = &entry{
+			counts: map[string]uint64{},
+			floors: map[string]uint64{},
+		}
+		store.entries[current] = value
+	}
+	return value
+}
+
+// clean removes expired windows.
+func (store *Store) clean(now time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for current := range store.entries {
+		if current.expiration() < now.UnixNano() {
+			delete(store.entries, current)
+			delete(store.dirty, current)
+			atomic.AddInt64(&store.evicted, 1)
+		}
+	}
+}
+
+// run sends gossip to peers, and removes expired windows, periodically until the store is closed.
+func (store *Store) run() {
+	defer close(store.done)
+
+	ticker := time.NewTicker(store.config.Interval)
+	defer ticker.Stop()
+
+	cleaned := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			store.gossip()
+			if now.Sub(cleaned) >= store.cleanUpInterval {
+				store.clean(now)
+				cleaned = now
+			}
+		case <-store.stop:
+			store.gossip()
+			return
+		}
+	}
+}
+
+// randomNode returns a random node identifier.
+func randomNode() (string, error) {
+	buffer := make([]byte, 8)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", errors.Wrap(err, "gossip: cannot generate node identifier")
+	}
+	return hex.EncodeToString(buffer), nil
+}
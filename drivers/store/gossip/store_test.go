@@ -0,0 +1,391 @@
+package gossip_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/gossip"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+// secret is shared by the nodes of every test.
+var secret = []byte("secret")
+
+func TestGossipStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := gossip.NewStoreWithOptions(gossip.Config{
+		Peers:  gossip.StaticPeers{},
+		Secret: secret,
+	}, limiter.StoreOptions{
+		Prefix:          "limiter:gossip:sequential-test",
+		CleanUpInterval: 30 * time.Second,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestGossipStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := gossip.NewStoreWithOptions(gossip.Config{
+		Peers:  gossip.StaticPeers{},
+		Secret: secret,
+	}, limiter.StoreOptions{
+		Prefix:          "limiter:gossip:concurrent-test",
+		CleanUpInterval: 30 * time.Second,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestGossipStoreConvergence(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 100, Period: 1000 * time.Hour}
+
+	nodes := newCluster(t, 3, 10*time.Millisecond)
+	defer closeCluster(t, nodes)
+
+	for i := 0; i < 5; i++ {
+		_, err := nodes[0].Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	_, err := nodes[1].Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	for _, node := range nodes {
+		node := node
+		is.Eventually(func() bool {
+			lctx, err := node.Peek(ctx, "foo", rate)
+			return err == nil && lctx.Remaining == 94
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	// A reset on any node discards requests counted by every node.
+	_, err = nodes[2].Reset(ctx, "foo", rate)
+	is.NoError(err)
+
+	for _, node := range nodes {
+		node := node
+		is.Eventually(func() bool {
+			lctx, err := node.Peek(ctx, "foo", rate)
+			return err == nil && lctx.Remaining == 100
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	lctx, err := nodes[0].Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(99), lctx.Remaining)
+}
+
+// TestGossipStoreOverAdmission measures how many requests a cluster admits beyond its limit, when every node
+// receives requests at the same pace.
+func TestGossipStoreOverAdmission(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 150, Period: 1000 * time.Hour}
+
+	interval := 10 * time.Millisecond
+	nodes := newCluster(t, 3, interval)
+	defer closeCluster(t, nodes)
+
+	attempts := 200
+	admitted := make([]int, len(nodes))
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(nodes))
+	for i := range nodes {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < attempts; j++ {
+				lctx, err := nodes[i].Get(ctx, "foo", rate)
+				is.NoError(err)
+				if !lctx.Reached {
+					admitted[i]++
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for i := range admitted {
+		total += admitted[i]
+	}
+	t.Logf("admitted %d requests for a limit of %d (over-admission: %d)", total, rate.Limit, int64(total)-rate.Limit)
+
+	// Each node may admit requests unknown by its peers for about one gossip interval, and one millisecond is
+	// required per request: the error is bounded by the requests of two nodes during a few intervals.
+	bound := (len(nodes) - 1) * 3 * int(interval/time.Millisecond)
+	is.True(int64(total) >= rate.Limit)
+	is.True(int64(total) <= rate.Limit+int64(bound), "over-admission exceeds %d", bound)
+}
+
+func TestGossipStoreUnreachablePeer(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+	address := listener.Addr().String()
+	is.NoError(listener.Close())
+
+	store, err := gossip.NewStoreWithOptions(gossip.Config{
+		Peers:    gossip.StaticPeers{address},
+		Interval: 10 * time.Millisecond,
+		Secret:   secret,
+	}, limiter.StoreOptions{
+		Prefix: "limiter:gossip:unreachable-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	// Requests are still served with local counters, and updates are sent again on the next round.
+	is.Eventually(func() bool {
+		return store.(limiter.StatsReporter).Stats().Errors >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(8), lctx.Remaining)
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+}
+
+func TestGossipStoreHandler(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	store, err := gossip.NewStoreWithOptions(gossip.Config{
+		Node:   "local",
+		Peers:  gossip.StaticPeers{},
+		Secret: secret,
+	}, limiter.StoreOptions{
+		Prefix: "limiter:gossip:handler-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	server := httptest.NewServer(store.(http.Handler))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	is.NoError(err)
+	is.NoError(response.Body.Close())
+	is.Equal(http.StatusMethodNotAllowed, response.StatusCode)
+
+	response, err = post(server.URL, "{", secret)
+	is.NoError(err)
+	is.NoError(response.Body.Close())
+	is.Equal(http.StatusBadRequest, response.StatusCode)
+
+	lctx, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(10), lctx.Remaining)
+
+	start := time.Now().UnixNano() / int64(rate.Period) * int64(rate.Period)
+	body := `{"node":"remote","entries":[{"key":"limiter:gossip:handler-test:foo","start":` +
+		formatInt(start) + `,"period":` + formatInt(int64(rate.Period)) + `,"counts":{"remote":3}}]}`
+
+	// Messages signed with another secret, or not signed, are rejected.
+	for _, key := range [][]byte{[]byte("other"), nil} {
+		response, err = post(server.URL, body, key)
+		is.NoError(err)
+		is.NoError(response.Body.Close())
+		is.Equal(http.StatusUnauthorized, response.StatusCode)
+	}
+
+	lctx, err = store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(10), lctx.Remaining)
+
+	// Messages are idempotent.
+	for i := 0; i < 2; i++ {
+		response, err = post(server.URL, body, secret)
+		is.NoError(err)
+		is.NoError(response.Body.Close())
+		is.Equal(http.StatusNoContent, response.StatusCode)
+	}
+
+	lctx, err = store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(7), lctx.Remaining)
+}
+
+func TestGossipStoreMaxNewKeys(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	store, err := gossip.NewStoreWithOptions(gossip.Config{
+		Peers:      gossip.StaticPeers{},
+		Secret:     secret,
+		MaxNewKeys: 2,
+	}, limiter.StoreOptions{
+		Prefix: "limiter:gossip:max-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	_, err = store.Get(ctx, "0", rate)
+	is.NoError(err)
+
+	server := httptest.NewServer(store.(http.Handler))
+	defer server.Close()
+
+	start := time.Now().UnixNano() / int64(rate.Period) * int64(rate.Period)
+	entries := []string{}
+	for i := 0; i < 4; i++ {
+		entries = append(entries, `{"key":"limiter:gossip:max-test:`+strconv.Itoa(i)+`","start":`+formatInt(start)+
+			`,"period":`+formatInt(int64(rate.Period))+`,"counts":{"remote":3}}`)
+	}
+	body := `{"node":"remote","entries":[` + strings.Join(entries, ",") + `]}`
+
+	response, err := post(server.URL, body, secret)
+	is.NoError(err)
+	is.NoError(response.Body.Close())
+	is.Equal(http.StatusNoContent, response.StatusCode)
+
+	// Existing windows are always merged, but only two windows are created.
+	expected := []int64{6, 7, 7, 10}
+	for i, remaining := range expected {
+		lctx, err := store.Peek(ctx, strconv.Itoa(i), rate)
+		is.NoError(err)
+		is.Equal(remaining, lctx.Remaining, "key %d", i)
+	}
+	is.Equal(int64(1), store.(limiter.StatsReporter).Stats().Errors)
+}
+
+func TestGossipStoreAdvertise(t *testing.T) {
+	is := require.New(t)
+
+	config := gossip.Config{
+		Address: ":0",
+		Peers:   gossip.StaticPeers{},
+		Secret:  secret,
+	}
+
+	// The listener address can't be used by peers.
+	_, err := gossip.NewStore(config)
+	is.Error(err)
+
+	config.Advertise = "10.0.0.1:7946"
+	store, err := gossip.NewStore(config)
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	is.Equal("10.0.0.1:7946", store.(*gossip.Store).Addr())
+}
+
+func TestGossipStoreSecret(t *testing.T) {
+	is := require.New(t)
+
+	_, err := gossip.NewStore(gossip.Config{
+		Peers: gossip.StaticPeers{},
+	})
+	is.Error(err)
+}
+
+func TestDNSPeers(t *testing.T) {
+	is := require.New(t)
+
+	peers, err := gossip.DNSPeers{Name: "localhost", Port: 7946}.Peers(context.Background())
+	is.NoError(err)
+	is.NotEmpty(peers)
+	for _, peer := range peers {
+		host, port, err := net.SplitHostPort(peer)
+		is.NoError(err)
+		is.Equal("7946", port)
+		is.True(net.ParseIP(host).IsLoopback(), host)
+	}
+}
+
+// clusterPeers is a list of peers which is filled once every node of a cluster has started.
+type clusterPeers struct {
+	mutex     sync.Mutex
+	addresses []string
+}
+
+func (peers *clusterPeers) Peers(ctx context.Context) ([]string, error) {
+	peers.mutex.Lock()
+	defer peers.mutex.Unlock()
+
+	return append([]string(nil), peers.addresses...), nil
+}
+
+// newCluster starts given number of nodes, listening on loopback.
+func newCluster(tb testing.TB, size int, interval time.Duration) []limiter.Store {
+	peers := &clusterPeers{}
+	nodes := make([]limiter.Store, size)
+	addresses := make([]string, size)
+
+	for i := range nodes {
+		store, err := gossip.NewStoreWithOptions(gossip.Config{
+			Address:         "127.0.0.1:0",
+			Peers:           peers,
+			Interval:        interval,
+			RefreshInterval: interval,
+			Secret:          secret,
+		}, limiter.StoreOptions{
+			Prefix: "limiter:gossip:cluster-test",
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		nodes[i] = store
+		addresses[i] = store.(*gossip.Store).Addr()
+	}
+
+	peers.mutex.Lock()
+	peers.addresses = addresses
+	peers.mutex.Unlock()
+
+	return nodes
+}
+
+func closeCluster(tb testing.TB, nodes []limiter.Store) {
+	for _, node := range nodes {
+		tests.CloseStore(tb, node)
+	}
+}
+
+// post sends given gossip message, signed with given secret if it's not empty.
+func post(url string, body string, secret []byte) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		_, _ = mac.Write([]byte(body))
+		request.Header.Set(gossip.SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	return http.DefaultClient.Do(request)
+}
+
+func formatInt(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
@@ -0,0 +1,382 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTimeout is the default timeout of a request to memcached server, when the context has no deadline.
+	DefaultTimeout = time.Second
+
+	// maxConns is the maximum number of connections opened by a client.
+	// Requests wait for an available connection beyond this limit.
+	maxConns = 64
+	// maxValueLength is the maximum length of a counter value, to protect against corrupted responses.
+	maxValueLength = 32
+)
+
+var (
+	// errClientClosed is returned when a request is sent by a closed client.
+	errClientClosed = errors.New("memcached: client is closed")
+	// errMalformedResponse is returned when the server response doesn't follow the text protocol.
+	errMalformedResponse = errors.New("memcached: malformed response")
+)
+
+// item is a counter returned by memcached server.
+type item struct {
+	value int64
+	flags uint32
+	found bool
+}
+
+// conn is a connection to memcached server.
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// client sends requests to memcached server using the text protocol, over a pool of connections.
+type client struct {
+	address string
+	dialer  net.Dialer
+	slots   chan struct{}
+	mutex   sync.Mutex
+	idle    []*conn
+	closed  bool
+}
+
+// newClient returns a client for given server address.
+func newClient(address string) *client {
+	return &client{
+		address: address,
+		dialer:  net.Dialer{Timeout: DefaultTimeout},
+		slots:   make(chan struct{}, maxConns),
+	}
+}
+
+// Get returns the counter stored at given key.
+func (client *client) Get(ctx context.Context, key string) (item, error) {
+	result := item{}
+	err := client.do(ctx, func(conn *conn) error {
+		_, err := conn.writer.WriteString("get " + key + "\r\n")
+		if err == nil {
+			err = conn.writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		result, err = readItem(conn.reader)
+		return err
+	})
+	return result, err
+}
+
+// IncrementAndGet increments the counter stored at given key, and returns its new value with its flags.
+// Both commands are pipelined, so it only requires a single round trip.
+// The counter is not found if it doesn't exist: its flags are zero if it has expired between both commands.
+func (client *client) IncrementAndGet(ctx context.Context, key string, delta uint64) (item, error) {
+	result := item{}
+	err := client.do(ctx, func(conn *conn) error {
+		_, err := conn.writer.WriteString("incr " + key + " " + strconv.FormatUint(delta, 10) + "\r\nget " + key + "\r\n")
+		if err == nil {
+			err = conn.writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		line, err := readLine(conn.reader)
+		if err != nil {
+			return err
+		}
+
+		incremented := false
+		value := int64(0)
+		if !bytes.Equal(line, []byte("NOT_FOUND")) {
+			value, err = strconv.ParseInt(string(line), 10, 64)
+			if err != nil {
+				return responseError(line)
+			}
+			incremented = true
+		}
+
+		// Always consume the get response, to leave the connection in a clean state.
+		result, err = readItem(conn.reader)
+		if err != nil {
+			return err
+		}
+
+		if !incremented {
+			result = item{}
+			return nil
+		}
+
+		// The counter may have been incremented concurrently before our get: our own increment is authoritative.
+		// If it has expired right after our increment, its flags are unknown.
+		result.value = value
+		result.found = true
+		return nil
+	})
+	return result, err
+}
+
+// Add stores a counter at given key, only if it doesn't exist yet.
+// It returns false if the key already exists.
+func (client *client) Add(ctx context.Context, key string, flags uint32, exptime int64, value int64) (bool, error) {
+	stored := false
+	err := client.do(ctx, func(conn *conn) error {
+		data := strconv.FormatInt(value, 10)
+		_, err := conn.writer.WriteString("add " + key + " " + strconv.FormatUint(uint64(flags), 10) + " " +
+			strconv.FormatInt(exptime, 10) + " " + strconv.Itoa(len(data)) + "\r\n" + data + "\r\n")
+		if err == nil {
+			err = conn.writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		line, err := readLine(conn.reader)
+		if err != nil {
+			return err
+		}
+
+		switch string(line) {
+		case "STORED":
+			stored = true
+			return nil
+		case "NOT_STORED":
+			return nil
+		default:
+			return responseError(line)
+		}
+	})
+	return stored, err
+}
+
+// Delete removes the counter stored at given key, if any.
+func (client *client) Delete(ctx context.Context, key string) error {
+	return client.do(ctx, func(conn *conn) error {
+		_, err := conn.writer.WriteString("delete " + key + "\r\n")
+		if err == nil {
+			err = conn.writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		line, err := readLine(conn.reader)
+		if err != nil {
+			return err
+		}
+
+		switch string(line) {
+		case "DELETED", "NOT_FOUND":
+			return nil
+		default:
+			return responseError(line)
+		}
+	})
+}
+
+// Version returns the version of memcached server.
+func (client *client) Version(ctx context.Context) (string, error) {
+	version := ""
+	err := client.do(ctx, func(conn *conn) error {
+		_, err := conn.writer.WriteString("version\r\n")
+		if err == nil {
+			err = conn.writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		line, err := readLine(conn.reader)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(line, []byte("VERSION ")) {
+			return responseError(line)
+		}
+
+		version = string(line[len("VERSION "):])
+		return nil
+	})
+	return version, err
+}
+
+// Close closes every idle connection.
+// Connections in use are closed when they are released.
+func (client *client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.closed = true
+	for _, conn := range client.idle {
+		_ = conn.Close()
+	}
+	client.idle = nil
+
+	return nil
+}
+
+// do executes given handler with a connection from the pool.
+// The connection is discarded if handler fails, since it may have unread data.
+func (client *client) do(ctx context.Context, handler func(conn *conn) error) error {
+	conn, err := client.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+
+	err = conn.SetDeadline(deadline)
+	if err == nil {
+		err = handler(conn)
+	}
+	if err != nil {
+		_ = conn.Close()
+		<-client.slots
+		return err
+	}
+
+	client.release(conn)
+	return nil
+}
+
+// acquire returns an idle connection, or a new one.
+// It waits for a connection to be released if the maximum number of connections is reached.
+func (client *client) acquire(ctx context.Context) (*conn, error) {
+	select {
+	case client.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	client.mutex.Lock()
+	if client.closed {
+		client.mutex.Unlock()
+		<-client.slots
+		return nil, errClientClosed
+	}
+	if n := len(client.idle); n > 0 {
+		conn := client.idle[n-1]
+		client.idle = client.idle[:n-1]
+		client.mutex.Unlock()
+		return conn, nil
+	}
+	client.mutex.Unlock()
+
+	netConn, err := client.dialer.DialContext(ctx, "tcp", client.address)
+	if err != nil {
+		<-client.slots
+		return nil, errors.Wrap(err, "memcached: cannot connect to server")
+	}
+
+	return &conn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}, nil
+}
+
+// release returns given connection to the pool.
+func (client *client) release(conn *conn) {
+	client.mutex.Lock()
+	if client.closed {
+		_ = conn.Close()
+	} else {
+		client.idle = append(client.idle, conn)
+	}
+	client.mutex.Unlock()
+
+	<-client.slots
+}
+
+// readLine reads a response line, without its trailing CRLF.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errMalformedResponse
+	}
+	return line[:len(line)-2], nil
+}
+
+// readItem reads the response of a get command for a single key.
+func readItem(reader *bufio.Reader) (item, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return item{}, err
+	}
+	if bytes.Equal(line, []byte("END")) {
+		return item{}, nil
+	}
+
+	// VALUE <key> <flags> <bytes> [<cas unique>]
+	fields := bytes.Fields(line)
+	if len(fields) < 4 || !bytes.Equal(fields[0], []byte("VALUE")) {
+		return item{}, responseError(line)
+	}
+
+	flags, err := strconv.ParseUint(string(fields[2]), 10, 32)
+	if err != nil {
+		return item{}, errMalformedResponse
+	}
+	length, err := strconv.Atoi(string(fields[3]))
+	if err != nil || length < 0 || length > maxValueLength {
+		return item{}, errMalformedResponse
+	}
+
+	data := make([]byte, length+2)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return item{}, err
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return item{}, errMalformedResponse
+	}
+
+	// Counters created by add may be padded with spaces by incr.
+	value, err := strconv.ParseInt(string(bytes.TrimSpace(data[:length])), 10, 64)
+	if err != nil {
+		return item{}, errMalformedResponse
+	}
+
+	line, err = readLine(reader)
+	if err != nil {
+		return item{}, err
+	}
+	if !bytes.Equal(line, []byte("END")) {
+		return item{}, errMalformedResponse
+	}
+
+	return item{value: value, flags: uint32(flags), found: true}, nil
+}
+
+// responseError returns the error matching given response line.
+func responseError(line []byte) error {
+	switch {
+	case bytes.HasPrefix(line, []byte("CLIENT_ERROR ")), bytes.HasPrefix(line, []byte("SERVER_ERROR ")):
+		return errors.Errorf("memcached: %s", line)
+	case bytes.Equal(line, []byte("ERROR")):
+		return errors.New("memcached: unknown command")
+	default:
+		return errMalformedResponse
+	}
+}
@@ -0,0 +1,247 @@
+package memcached_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeItem is an item stored by a fake memcached server.
+type fakeItem struct {
+	value      []byte
+	flags      uint32
+	expiration time.Time
+}
+
+// fakeServer is an in-process memcached server, implementing the subset of the text protocol used by the store.
+type fakeServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	items    map[string]*fakeItem
+	commands map[string]int
+	wg       sync.WaitGroup
+}
+
+// newFakeServer starts a fake memcached server on a random local port.
+func newFakeServer() (*fakeServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &fakeServer{
+		listener: listener,
+		items:    map[string]*fakeItem{},
+		commands: map[string]int{},
+	}
+
+	server.wg.Add(1)
+	go server.serve()
+
+	return server, nil
+}
+
+// Address returns the address of the server.
+func (server *fakeServer) Address() string {
+	return server.listener.Addr().String()
+}
+
+// Item returns the item stored at given key, if it has not expired.
+func (server *fakeServer) Item(key string) (fakeItem, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	item, ok := server.load(key)
+	if !ok {
+		return fakeItem{}, false
+	}
+	return *item, true
+}
+
+// Commands returns the number of times given command has been received.
+func (server *fakeServer) Commands(name string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.commands[name]
+}
+
+// Close stops the server, and closes every connection.
+func (server *fakeServer) Close() {
+	_ = server.listener.Close()
+	server.wg.Wait()
+}
+
+func (server *fakeServer) serve() {
+	defer server.wg.Done()
+
+	conns := []net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		conns = append(conns, conn)
+
+		server.wg.Add(1)
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeServer) handle(conn net.Conn) {
+	defer server.wg.Done()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+		if len(fields) == 0 {
+			_, _ = writer.WriteString("ERROR\r\n")
+			continue
+		}
+
+		var data []byte
+		if fields[0] == "add" || fields[0] == "set" {
+			if len(fields) != 5 {
+				_, _ = writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+				_ = writer.Flush()
+				continue
+			}
+			length, err := strconv.Atoi(fields[4])
+			if err != nil {
+				return
+			}
+			data = make([]byte, length+2)
+			_, err = io.ReadFull(reader, data)
+			if err != nil {
+				return
+			}
+			data = data[:length]
+		}
+
+		_, _ = writer.WriteString(server.execute(fields, data))
+
+		// Pipelined commands are answered together.
+		if reader.Buffered() == 0 {
+			err = writer.Flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute runs given command, and returns its response.
+func (server *fakeServer) execute(fields []string, data []byte) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.commands[fields[0]]++
+
+	switch fields[0] {
+	case "get":
+		response := ""
+		for _, key := range fields[1:] {
+			item, ok := server.load(key)
+			if ok {
+				response += "VALUE " + key + " " + strconv.FormatUint(uint64(item.flags), 10) + " " +
+					strconv.Itoa(len(item.value)) + "\r\n" + string(item.value) + "\r\n"
+			}
+		}
+		return response + "END\r\n"
+
+	case "add", "set":
+		key := fields[1]
+		flags, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+		exptime, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+		if _, ok := server.load(key); ok && fields[0] == "add" {
+			return "NOT_STORED\r\n"
+		}
+
+		server.items[key] = &fakeItem{
+			value:      data,
+			flags:      uint32(flags),
+			expiration: expirationFromExptime(exptime),
+		}
+		return "STORED\r\n"
+
+	case "incr":
+		item, ok := server.load(fields[1])
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(string(item.value)), 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"
+		}
+		delta, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR invalid numeric delta argument\r\n"
+		}
+
+		item.value = []byte(strconv.FormatUint(value+delta, 10))
+		return string(item.value) + "\r\n"
+
+	case "delete":
+		if _, ok := server.load(fields[1]); !ok {
+			return "NOT_FOUND\r\n"
+		}
+		delete(server.items, fields[1])
+		return "DELETED\r\n"
+
+	case "version":
+		return "VERSION 1.6.0-fake\r\n"
+
+	default:
+		return "ERROR\r\n"
+	}
+}
+
+// load returns the item stored at given key, if it has not expired.
+// WARNING: mutex must be held by the caller.
+func (server *fakeServer) load(key string) (*fakeItem, bool) {
+	item, ok := server.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !item.expiration.IsZero() && !time.Now().Before(item.expiration) {
+		delete(server.items, key)
+		return nil, false
+	}
+	return item, true
+}
+
+// expirationFromExptime returns the expiration matching given memcached expiration time.
+func expirationFromExptime(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime > 30*24*60*60:
+		return time.Unix(exptime, 0)
+	default:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	}
+}
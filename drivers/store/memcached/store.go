@@ -0,0 +1,242 @@
+// Package memcached provides a store backed by a memcached server, using its text protocol.
+package memcached
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+)
+
+const (
+	// maxKeyLength is the maximum length of a key accepted by memcached server.
+	maxKeyLength = 250
+	// maxPrefixLength is the maximum length of a prefix, so the key of a hashed identifier is accepted by memcached
+	// server.
+	maxPrefixLength = maxKeyLength - len(":sha1:") - 2*sha1.Size
+	// maxRelativeExptime is the maximum expiration time, in seconds, that memcached server handles as relative.
+	// A greater expiration time is handled as an absolute Unix timestamp.
+	maxRelativeExptime = 30 * 24 * 60 * 60
+)
+
+// Store is the memcached store.
+//
+// Since memcached doesn't expose the remaining time to live of an item, the expiration of a counter is stored
+// in its flags, as a Unix timestamp in seconds.
+type Store struct {
+	// errors is the number of failed operations on memcached server.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// Prefix used for the key.
+	Prefix string
+	// MaxRetry is the maximum number of retry when a counter is created concurrently.
+	MaxRetry int
+	// client used to communicate with memcached server.
+	client *client
+	// closed is set to one when the store has been closed.
+	closed uint32
+	// closeOnce is used to close the client only once.
+	closeOnce sync.Once
+}
+
+// NewStore returns an instance of memcached store with defaults, using given server address.
+func NewStore(address string) (limiter.Store, error) {
+	return NewStoreWithOptions(address, limiter.StoreOptions{
+		Prefix:   limiter.DefaultPrefix,
+		MaxRetry: limiter.DefaultMaxRetry,
+	})
+}
+
+// NewStoreWithOptions returns an instance of memcached store with options, using given server address.
+// Connections are established lazily, so the server doesn't have to be available yet.
+// The prefix must be a valid memcached key, of at most 204 bytes, so every key is accepted by memcached server.
+func NewStoreWithOptions(address string, options limiter.StoreOptions) (limiter.Store, error) {
+	if address == "" {
+		return nil, errors.New("memcached: server address is required")
+	}
+	if len(options.Prefix) > maxPrefixLength {
+		return nil, errors.Errorf("memcached: prefix is longer than %d bytes", maxPrefixLength)
+	}
+	if !isValidKey(options.Prefix) {
+		return nil, errors.New("memcached: prefix contains whitespaces or control characters")
+	}
+
+	maxRetry := options.MaxRetry
+	if maxRetry <= 0 {
+		maxRetry = limiter.DefaultMaxRetry
+	}
+
+	store := &Store{
+		Prefix:   options.Prefix,
+		MaxRetry: maxRetry,
+		client:   newClient(address),
+	}
+
+	return store, nil
+}
+
+// Get returns the limit for given identifier.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	key = store.key(key)
+	now := time.Now()
+
+	for attempt := 0; attempt <= store.MaxRetry; attempt++ {
+		result, err := store.client.IncrementAndGet(ctx, key, 1)
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return limiter.Context{}, errors.Wrap(err, "memcached: cannot increment counter")
+		}
+		if result.found {
+			return common.GetContextFromState(now, rate, expirationFromFlags(now, rate, result.flags), result.value), nil
+		}
+
+		// Counter doesn't exist yet: try to create it, unless another client has created it in between.
+		expiration, exptime := expirationFromRate(now, rate)
+		stored, err := store.client.Add(ctx, key, uint32(expiration.Unix()), exptime, 1)
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return limiter.Context{}, errors.Wrap(err, "memcached: cannot create counter")
+		}
+		if stored {
+			return common.GetContextFromState(now, rate, expiration, 1), nil
+		}
+	}
+
+	atomic.AddInt64(&store.errors, 1)
+	return limiter.Context{}, errors.Errorf("memcached: cannot increment counter after %d retries", store.MaxRetry)
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	key = store.key(key)
+	now := time.Now()
+
+	result, err := store.client.Get(ctx, key)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return limiter.Context{}, errors.Wrap(err, "memcached: cannot get counter")
+	}
+	if !result.found {
+		return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+	}
+
+	return common.GetContextFromState(now, rate, expirationFromFlags(now, rate, result.flags), result.value), nil
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	key = store.key(key)
+
+	err := store.client.Delete(ctx, key)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return limiter.Context{}, errors.Wrap(err, "memcached: cannot delete counter")
+	}
+
+	now := time.Now()
+	return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+}
+
+// Close closes every connection to memcached server.
+func (store *Store) Close() error {
+	store.closeOnce.Do(func() {
+		atomic.StoreUint32(&store.closed, 1)
+		_ = store.client.Close()
+	})
+	return nil
+}
+
+// Closed returns true if the store has been closed.
+func (store *Store) Closed() bool {
+	return atomic.LoadUint32(&store.closed) != 0
+}
+
+// Ping returns an error if memcached server is unreachable, or if the store has been closed.
+func (store *Store) Ping(ctx context.Context) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+
+	_, err := store.client.Version(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to ping memcached server")
+	}
+	return nil
+}
+
+// Stats returns the number of failed operations on memcached server.
+// The number of keys is unknown, since the memcached server may be shared with other applications.
+func (store *Store) Stats() limiter.StoreStats {
+	return limiter.StoreStats{
+		Keys:    -1,
+		Evicted: -1,
+		Errors:  atomic.LoadInt64(&store.errors),
+	}
+}
+
+// key returns the memcached key for given identifier.
+// Since memcached keys are limited in length and can't contain whitespaces or control characters, any other
+// identifier is hashed.
+func (store *Store) key(key string) string {
+	full := store.Prefix + ":" + key
+	if len(full) <= maxKeyLength && isValidKey(full) {
+		return full
+	}
+
+	hash := sha1.Sum([]byte(key))
+	return store.Prefix + ":sha1:" + hex.EncodeToString(hash[:])
+}
+
+// isValidKey returns true if given key only contains characters accepted by memcached server.
+func isValidKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expirationFromRate returns the expiration of a new counter, and the matching memcached expiration time, which is
+// rounded up to the next second so the counter never expires early.
+func expirationFromRate(now time.Time, rate limiter.Rate) (time.Time, int64) {
+	expiration := now.Add(rate.Period)
+
+	exptime := int64(rate.Period / time.Second)
+	if rate.Period%time.Second > 0 {
+		exptime++
+	}
+	if exptime > maxRelativeExptime {
+		exptime = expiration.Unix() + 1
+	}
+
+	return expiration, exptime
+}
+
+// expirationFromFlags returns the expiration stored in the flags of a counter.
+// Flags are empty if the counter has expired concurrently: it will be renewed for a new period.
+func expirationFromFlags(now time.Time, rate limiter.Rate, flags uint32) time.Time {
+	if flags == 0 {
+		return now.Add(rate.Period)
+	}
+	return time.Unix(int64(flags), 0)
+}
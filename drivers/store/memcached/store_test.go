@@ -0,0 +1,249 @@
+package memcached_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/memcached"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestMemcachedStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	server, err := newFakeServer()
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := memcached.NewStoreWithOptions(server.Address(), limiter.StoreOptions{
+		Prefix: "limiter:memcached:sequential-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestMemcachedStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	server, err := newFakeServer()
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := memcached.NewStoreWithOptions(server.Address(), limiter.StoreOptions{
+		Prefix: "limiter:memcached:concurrent-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestMemcachedStoreCreationRace(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 1000, Period: time.Minute}
+
+	server, err := newFakeServer()
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := memcached.NewStoreWithOptions(server.Address(), limiter.StoreOptions{
+		Prefix: "limiter:memcached:race-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	goroutines := 50
+	start := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := store.Get(ctx, "foo", rate)
+			is.NoError(err)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// Every increment is counted, whichever goroutine has created the counter.
+	lctx, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(1000-goroutines), lctx.Remaining)
+}
+
+func TestMemcachedStoreExpiration(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	server, err := newFakeServer()
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := memcached.NewStoreWithOptions(server.Address(), limiter.StoreOptions{
+		Prefix: "limiter:memcached:expiration-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	first, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	// The expiration is stored in the item flags.
+	item, ok := server.Item("limiter:memcached:expiration-test:foo")
+	is.True(ok)
+	is.Equal(first.Reset, int64(item.flags))
+	is.True(first.Reset-time.Now().Unix() <= 60)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// Reset is reported from the stored expiration, not from the current time.
+	second, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(first.Reset, second.Reset)
+	is.Equal(int64(8), second.Remaining)
+
+	peek, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(first.Reset, peek.Reset)
+
+	// Counters are renewed once expired.
+	short := limiter.Rate{Limit: 10, Period: 500 * time.Millisecond}
+	_, err = store.Get(ctx, "bar", short)
+	is.NoError(err)
+	_, err = store.Get(ctx, "bar", short)
+	is.NoError(err)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	lctx, err := store.Get(ctx, "bar", short)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+}
+
+func TestMemcachedStoreKeys(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	server, err := newFakeServer()
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := memcached.NewStoreWithOptions(server.Address(), limiter.StoreOptions{
+		Prefix: "limiter:memcached:keys-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	// Keys with whitespaces, or longer than memcached limit, are hashed.
+	keys := []string{"foo bar", strings.Repeat("x", 300), "baz\r\nflush_all"}
+	for i, key := range keys {
+		for j := 0; j <= i; j++ {
+			_, err = store.Get(ctx, key, rate)
+			is.NoError(err)
+		}
+	}
+
+	for i, key := range keys {
+		lctx, err := store.Peek(ctx, key, rate)
+		is.NoError(err)
+		is.Equal(int64(10-i-1), lctx.Remaining, strconv.Itoa(i))
+	}
+	is.Equal(0, server.Commands("flush_all"))
+}
+
+func TestMemcachedStorePrefix(t *testing.T) {
+	is := require.New(t)
+
+	// Keys of hashed identifiers must fit in memcached limit, whatever the prefix.
+	_, err := memcached.NewStoreWithOptions("127.0.0.1:11211", limiter.StoreOptions{
+		Prefix: strings.Repeat("x", 205),
+	})
+	is.Error(err)
+
+	_, err = memcached.NewStoreWithOptions("127.0.0.1:11211", limiter.StoreOptions{
+		Prefix: "limiter memcached",
+	})
+	is.Error(err)
+
+	store, err := memcached.NewStoreWithOptions("127.0.0.1:11211", limiter.StoreOptions{
+		Prefix: strings.Repeat("x", 204),
+	})
+	is.NoError(err)
+	tests.CloseStore(t, store)
+}
+
+func TestMemcachedStoreLifecycle(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	server, err := newFakeServer()
+	is.NoError(err)
+
+	store, err := memcached.NewStore(server.Address())
+	is.NoError(err)
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(0), store.(limiter.StatsReporter).Stats().Errors)
+
+	server.Close()
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.Error(err)
+	is.Error(store.(limiter.Pinger).Ping(ctx))
+	is.Equal(int64(1), store.(limiter.StatsReporter).Stats().Errors)
+
+	tests.CloseStore(t, store)
+	is.Equal(limiter.ErrStoreClosed, store.(limiter.Pinger).Ping(ctx))
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.Equal(limiter.ErrStoreClosed, err)
+}
+
+func BenchmarkMemcachedStoreSequentialAccess(b *testing.B) {
+	is := require.New(b)
+
+	server, err := newFakeServer()
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := memcached.NewStoreWithOptions(server.Address(), limiter.StoreOptions{
+		Prefix: "limiter:memcached:sequential-benchmark",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(b, store)
+
+	tests.BenchmarkStoreSequentialAccess(b, store)
+}
+
+func BenchmarkMemcachedStoreConcurrentAccess(b *testing.B) {
+	is := require.New(b)
+
+	server, err := newFakeServer()
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := memcached.NewStoreWithOptions(server.Address(), limiter.StoreOptions{
+		Prefix: "limiter:memcached:concurrent-benchmark",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(b, store)
+
+	tests.BenchmarkStoreConcurrentAccess(b, store)
+}
@@ -3,7 +3,10 @@ package memory
 import (
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/panii/limiter/v3/internal/fasttime"
 )
 
 // Forked from https://github.com/patrickmn/go-cache
@@ -18,9 +21,10 @@ type CacheWrapper struct {
 type cleaner struct {
 	interval time.Duration
 	stop     chan bool
+	once     sync.Once
 }
 
-// Run will periodically delete expired keys from given cache until GC notify that it should stop.
+// Run will periodically delete expired keys from given cache until it's stopped, either by GC or by Close.
 func (cleaner *cleaner) Run(cache *Cache) {
 	ticker := time.NewTicker(cleaner.interval)
 	for {
@@ -34,14 +38,29 @@ func (cleaner *cleaner) Run(cache *Cache) {
 	}
 }
 
+// Stop notifies the cleaner goroutine that it should stop.
+// It's safe to call Stop more than once.
+func (cleaner *cleaner) Stop() {
+	cleaner.once.Do(func() {
+		close(cleaner.stop)
+	})
+}
+
 // stopCleaner is a callback from GC used to stop cleaner goroutine.
 func stopCleaner(wrapper *CacheWrapper) {
-	wrapper.cleaner.stop <- true
+	wrapper.cleaner.Stop()
 	wrapper.cleaner = nil
 }
 
 // startCleaner will start a cleaner goroutine for given cache.
+// The timing wheel only advances once per tick, so the interval is never shorter than wheelTick: cleaning more often
+// wouldn't evict anything sooner, and a ticker firing continuously would keep the goroutines yielding in Increment
+// from being scheduled.
 func startCleaner(cache *Cache, interval time.Duration) {
+	if interval < time.Duration(wheelTick) {
+		interval = time.Duration(wheelTick)
+	}
+
 	cleaner := &cleaner{
 		interval: interval,
 		stop:     make(chan bool),
@@ -51,69 +70,138 @@ func startCleaner(cache *Cache, interval time.Duration) {
 	go cleaner.Run(cache)
 }
 
+// counterRenewing is the expiration of a counter while it's being renewed by another goroutine.
+const counterRenewing = -1
+
+// counterDeleted is the expiration of a counter which has been deleted by the cleaner: it can't be renewed anymore.
+const counterDeleted = -2
+
+// cacheShards is the number of shards used to store counters.
+const cacheShards = 64
+
+// yieldInterval is the interval, in nanoseconds, between two goroutines yielding their processor in Increment.
+// Increments never block, so goroutines hammering the cache would otherwise only be preempted every 10ms by the
+// scheduler, and starve the goroutines waiting for a processor, such as the ones woken up by a timer.
+const yieldInterval = int64(time.Millisecond)
+
 // Counter is a simple counter with an expiration.
+// Its value and its expiration are updated atomically, without any lock on the hot path: the expiration is only
+// swapped to a sentinel value while an expired counter is renewed, or once it has been deleted by the cleaner.
 type Counter struct {
-	mutex      sync.RWMutex
 	value      int64
 	expiration int64
 }
 
 // Value returns the counter current value.
 func (counter *Counter) Value() int64 {
-	counter.mutex.RLock()
-	defer counter.mutex.RUnlock()
-	return counter.value
+	return atomic.LoadInt64(&counter.value)
 }
 
 // Expiration returns the counter expiration.
 func (counter *Counter) Expiration() int64 {
-	counter.mutex.RLock()
-	defer counter.mutex.RUnlock()
-	return counter.expiration
+	for {
+		expiration := atomic.LoadInt64(&counter.expiration)
+		if expiration != counterRenewing {
+			return expiration
+		}
+		runtime.Gosched()
+	}
 }
 
 // Expired returns true if the counter has expired.
 func (counter *Counter) Expired() bool {
-	counter.mutex.RLock()
-	defer counter.mutex.RUnlock()
+	return counter.expired(timestamp())
+}
 
-	return counter.expiration == 0 || time.Now().UnixNano() > counter.expiration
+// expired returns true if the counter has expired at given time, in nanoseconds.
+func (counter *Counter) expired(now int64) bool {
+	expiration := counter.Expiration()
+	return expiration == 0 || now > expiration
 }
 
 // Load returns the value and the expiration of this counter.
 // If the counter is expired, it will use the given expiration.
 func (counter *Counter) Load(expiration int64) (int64, int64) {
-	counter.mutex.RLock()
-	defer counter.mutex.RUnlock()
+	return counter.load(timestamp(), expiration)
+}
 
-	if counter.expiration == 0 || time.Now().UnixNano() > counter.expiration {
-		return 0, expiration
-	}
+// load returns the value and the expiration of this counter at given time, in nanoseconds.
+func (counter *Counter) load(now int64, expiration int64) (int64, int64) {
+	for {
+		current := counter.Expiration()
+		if current == 0 || now > current {
+			return 0, expiration
+		}
 
-	return counter.value, counter.expiration
+		value := atomic.LoadInt64(&counter.value)
+
+		// Make sure the counter has not been renewed while we were reading its value.
+		if atomic.LoadInt64(&counter.expiration) == current {
+			return value, current
+		}
+	}
 }
 
 // Increment increments given value on this counter.
 // If the counter is expired, it will use the given expiration.
 // It returns its current value and expiration.
 func (counter *Counter) Increment(value int64, expiration int64) (int64, int64) {
-	counter.mutex.Lock()
-	defer counter.mutex.Unlock()
+	value, expiration, _ = counter.increment(timestamp(), value, expiration)
+	return value, expiration
+}
 
-	if counter.expiration == 0 || time.Now().UnixNano() > counter.expiration {
-		counter.value = value
-		counter.expiration = expiration
-		return counter.value, counter.expiration
+// increment increments given value on this counter at given time, in nanoseconds.
+// It returns false if the counter has been deleted by the cleaner, and must be loaded again from the cache.
+func (counter *Counter) increment(now int64, value int64, expiration int64) (int64, int64, bool) {
+	for {
+		current := counter.Expiration()
+		if current == counterDeleted {
+			return 0, 0, false
+		}
+
+		if current != 0 && now <= current {
+			result := atomic.AddInt64(&counter.value, value)
+
+			// If the counter has been renewed concurrently, our increment belongs to the new period.
+			renewed := counter.Expiration()
+			return result, renewed, true
+		}
+
+		// Counter has expired: only one goroutine is allowed to renew it.
+		if !atomic.CompareAndSwapInt64(&counter.expiration, current, counterRenewing) {
+			continue
+		}
+
+		atomic.StoreInt64(&counter.value, value)
+		atomic.StoreInt64(&counter.expiration, expiration)
+		return value, expiration, true
 	}
+}
+
+// delete marks this counter as deleted, if it has expired at given time, in nanoseconds.
+// Once deleted, a counter can't be renewed by a goroutine which has loaded it before it was removed from the cache.
+func (counter *Counter) delete(now int64) bool {
+	for {
+		current := counter.Expiration()
+		if current == counterDeleted || (current != 0 && now <= current) {
+			return false
+		}
 
-	counter.value += value
-	return counter.value, counter.expiration
+		if atomic.CompareAndSwapInt64(&counter.expiration, current, counterDeleted) {
+			return true
+		}
+	}
 }
 
 // Cache contains a collection of counters.
 type Cache struct {
-	counters sync.Map
-	cleaner  *cleaner
+	size    int64
+	evicted int64
+	yielded int64
+	closed  uint32
+	shards  [cacheShards]sync.Map
+	cleaner *cleaner
+	wheel   *timingWheel
 }
 
 // NewCache returns a new cache.
@@ -123,6 +211,7 @@ func NewCache(cleanInterval time.Duration) *CacheWrapper {
 	wrapper := &CacheWrapper{Cache: cache}
 
 	if cleanInterval > 0 {
+		cache.wheel = newTimingWheel(timestamp())
 		startCleaner(cache, cleanInterval)
 		runtime.SetFinalizer(wrapper, stopCleaner)
 	}
@@ -134,7 +223,10 @@ func NewCache(cleanInterval time.Duration) *CacheWrapper {
 // Otherwise, it stores and returns the given counter.
 // The loaded result is true if the counter was loaded, false if stored.
 func (cache *Cache) LoadOrStore(key string, counter *Counter) (*Counter, bool) {
-	val, loaded := cache.counters.LoadOrStore(key, counter)
+	val, loaded := cache.shard(key).LoadOrStore(key, counter)
+	if !loaded {
+		atomic.AddInt64(&cache.size, 1)
+	}
 	if val == nil {
 		return counter, false
 	}
@@ -146,7 +238,7 @@ func (cache *Cache) LoadOrStore(key string, counter *Counter) (*Counter, bool) {
 // Load returns the counter stored in the map for a key, or nil if no counter is present.
 // The ok result indicates whether counter was found in the map.
 func (cache *Cache) Load(key string) (*Counter, bool) {
-	val, ok := cache.counters.Load(key)
+	val, ok := cache.shard(key).Load(key)
 	if val == nil || !ok {
 		return nil, false
 	}
@@ -156,18 +248,60 @@ func (cache *Cache) Load(key string) (*Counter, bool) {
 
 // Store sets the counter for a key.
 func (cache *Cache) Store(key string, counter *Counter) {
-	cache.counters.Store(key, counter)
+	shard := cache.shard(key)
+	_, loaded := shard.LoadOrStore(key, counter)
+	if loaded {
+		shard.Store(key, counter)
+	} else {
+		atomic.AddInt64(&cache.size, 1)
+	}
+	cache.schedule(key, counter)
 }
 
 // Delete deletes the value for a key.
 func (cache *Cache) Delete(key string) {
-	cache.counters.Delete(key)
+	_, loaded := cache.shard(key).LoadAndDelete(key)
+	if loaded {
+		atomic.AddInt64(&cache.size, -1)
+	}
+}
+
+// Len returns the number of keys in the cache, including expired keys that have not been cleaned yet.
+func (cache *Cache) Len() int64 {
+	return atomic.LoadInt64(&cache.size)
+}
+
+// Evicted returns the number of expired keys deleted by the cleaner.
+func (cache *Cache) Evicted() int64 {
+	return atomic.LoadInt64(&cache.evicted)
+}
+
+// Close stops the cleaner goroutine, if any.
+// Expired keys are no longer deleted afterward, but the cache remains usable.
+func (cache *Cache) Close() error {
+	atomic.StoreUint32(&cache.closed, 1)
+	if cache.cleaner != nil {
+		cache.cleaner.Stop()
+	}
+	return nil
+}
+
+// Closed returns true if the cache has been closed.
+func (cache *Cache) Closed() bool {
+	return atomic.LoadUint32(&cache.closed) != 0
 }
 
 // Range calls handler sequentially for each key and value present in the cache.
 // If handler returns false, range stops the iteration.
 func (cache *Cache) Range(handler func(key string, counter *Counter)) {
-	cache.counters.Range(func(k interface{}, v interface{}) bool {
+	for i := range cache.shards {
+		cache.rangeShard(i, handler)
+	}
+}
+
+// rangeShard calls handler sequentially for each key and value present in given shard.
+func (cache *Cache) rangeShard(index int, handler func(key string, counter *Counter)) {
+	cache.shards[index].Range(func(k interface{}, v interface{}) bool {
 		if v == nil {
 			return true
 		}
@@ -181,60 +315,155 @@ func (cache *Cache) Range(handler func(key string, counter *Counter)) {
 	})
 }
 
+// shard returns the shard holding given key.
+func (cache *Cache) shard(key string) *sync.Map {
+	// Inlined FNV-1a, to avoid any allocation.
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &cache.shards[hash%cacheShards]
+}
+
 // Increment increments given value on key.
 // If key is undefined or expired, it will create it.
 func (cache *Cache) Increment(key string, value int64, duration time.Duration) (int64, time.Time) {
-	expiration := time.Now().Add(duration).UnixNano()
+	now := timestamp()
+	expiration := now + int64(duration)
+	cache.yield(now)
 
-	// If counter is in cache, try to load it first.
-	counter, loaded := cache.Load(key)
-	if loaded {
-		value, expiration = counter.Increment(value, expiration)
-		return value, time.Unix(0, expiration)
-	}
+	for {
+		// If counter is in cache, try to load it first.
+		counter, loaded := cache.Load(key)
+		if loaded {
+			count, current, ok := counter.increment(now, value, expiration)
+			if ok {
+				return count, time.Unix(0, current)
+			}
+
+			// Counter has been deleted by the cleaner, which is about to remove it from the cache.
+			runtime.Gosched()
+			continue
+		}
 
-	// If it's not in cache, try to atomically create it.
-	// We do that in two step to reduce memory allocation.
-	counter, loaded = cache.LoadOrStore(key, &Counter{
-		mutex:      sync.RWMutex{},
-		value:      value,
-		expiration: expiration,
-	})
-	if loaded {
-		value, expiration = counter.Increment(value, expiration)
+		// If it's not in cache, try to atomically create it.
+		// We do that in two step to reduce memory allocation.
+		// Since the key is retained by the cache, we copy it: it may be backed by a reusable buffer.
+		key = string(append([]byte(nil), key...))
+		counter, loaded = cache.LoadOrStore(key, &Counter{
+			value:      value,
+			expiration: expiration,
+		})
+		if loaded {
+			count, current, ok := counter.increment(now, value, expiration)
+			if ok {
+				return count, time.Unix(0, current)
+			}
+			runtime.Gosched()
+			continue
+		}
+
+		// Otherwise, it has been created, schedule its expiration and return given value.
+		cache.schedule(key, counter)
 		return value, time.Unix(0, expiration)
 	}
-
-	// Otherwise, it has been created, return given value.
-	return value, time.Unix(0, expiration)
 }
 
 // Get returns key's value and expiration.
 func (cache *Cache) Get(key string, duration time.Duration) (int64, time.Time) {
-	expiration := time.Now().Add(duration).UnixNano()
+	now := timestamp()
+	expiration := now + int64(duration)
 
 	counter, ok := cache.Load(key)
 	if !ok {
 		return 0, time.Unix(0, expiration)
 	}
 
-	value, expiration := counter.Load(expiration)
+	value, expiration := counter.load(now, expiration)
 	return value, time.Unix(0, expiration)
 }
 
 // Clean will deleted any expired keys.
 func (cache *Cache) Clean() {
-	cache.Range(func(key string, counter *Counter) {
-		if counter.Expired() {
-			cache.Delete(key)
+	now := timestamp()
+
+	if cache.wheel == nil {
+		cache.Range(func(key string, counter *Counter) {
+			cache.evict(key, counter, now)
+		})
+		return
+	}
+
+	cache.clean(now)
+}
+
+// clean deletes expired keys whose expiration is due on the timing wheel.
+// Counters that have been renewed since they were scheduled are scheduled again with their new expiration.
+func (cache *Cache) clean(now int64) {
+	due := cache.wheel.Advance(now)
+	renewed := due[:0]
+
+	for i := range due {
+		counter, ok := cache.Load(due[i].key)
+		if !ok || counter != due[i].counter {
+			// Counter has been deleted or replaced: it has its own schedule.
+			continue
 		}
-	})
+
+		if cache.evict(due[i].key, counter, now) {
+			continue
+		}
+
+		// Counter has been renewed: read its new expiration before taking the wheel lock again.
+		due[i].expiration = counter.Expiration()
+		renewed = append(renewed, due[i])
+	}
+
+	if len(renewed) > 0 {
+		cache.wheel.AddAll(renewed)
+	}
+}
+
+// evict deletes given counter of key, if it has expired at given time, in nanoseconds.
+// The counter is marked as deleted before it's removed, so a concurrent renewal is either seen here, or retried by
+// the renewing goroutine on a new counter: it's never lost on a counter which is no longer in the cache.
+func (cache *Cache) evict(key string, counter *Counter, now int64) bool {
+	if !counter.delete(now) {
+		return false
+	}
+
+	cache.Delete(key)
+	atomic.AddInt64(&cache.evicted, 1)
+	return true
+}
+
+// schedule registers the expiration of given counter on the timing wheel, if any.
+func (cache *Cache) schedule(key string, counter *Counter) {
+	if cache.wheel != nil {
+		cache.wheel.Add(key, counter)
+	}
 }
 
 // Reset changes the key's value and resets the expiration.
 func (cache *Cache) Reset(key string, duration time.Duration) (int64, time.Time) {
 	cache.Delete(key)
 
-	expiration := time.Now().Add(duration).UnixNano()
+	expiration := timestamp() + int64(duration)
 	return 0, time.Unix(0, expiration)
 }
+
+// yield yields the processor of the first goroutine which increments a counter in each yieldInterval, so runnable
+// goroutines are scheduled as if increments were briefly blocking.
+func (cache *Cache) yield(now int64) {
+	interval := now / yieldInterval
+	previous := atomic.LoadInt64(&cache.yielded)
+	if previous != interval && atomic.CompareAndSwapInt64(&cache.yielded, previous, interval) {
+		runtime.Gosched()
+	}
+}
+
+// timestamp returns the current time, in nanoseconds.
+func timestamp() int64 {
+	return int64(fasttime.Now())
+}
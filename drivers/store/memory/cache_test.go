@@ -1,6 +1,7 @@
 package memory_test
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -80,6 +81,40 @@ func TestCacheIncrementConcurrent(t *testing.T) {
 	is.True(time.Now().Before(expire))
 }
 
+func TestCounterIncrementConcurrent(t *testing.T) {
+	is := require.New(t)
+
+	goroutines := 50
+	ops := 1000
+
+	// An expired counter, whose value must be dropped.
+	counter := &memory.Counter{}
+	counter.Increment(42, time.Now().Add(-time.Second).UnixNano())
+	is.True(counter.Expired())
+
+	// It's renewed by a single goroutine: no increment is lost, whichever goroutine renews it.
+	expiration := time.Now().Add(time.Minute).UnixNano()
+	wg := &sync.WaitGroup{}
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < ops; j++ {
+				_, current := counter.Increment(1, expiration)
+				if current != expiration {
+					t.Errorf("unexpected expiration %d", current)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, current := counter.Load(0)
+	is.Equal(int64(goroutines*ops), value)
+	is.Equal(expiration, current)
+}
+
 func TestCacheGet(t *testing.T) {
 	is := require.New(t)
 
@@ -127,3 +162,51 @@ func TestCacheReset(t *testing.T) {
 	is.Equal(int64(2), x)
 	is.InEpsilon(deleted, expire.UnixNano(), epsilon)
 }
+
+func BenchmarkCacheIncrementSingleKey(b *testing.B) {
+	cache := memory.NewCache(time.Hour)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.Increment("foobar", 1, time.Minute)
+		}
+	})
+}
+
+func BenchmarkCacheIncrementMultipleKeys(b *testing.B) {
+	cache := memory.NewCache(time.Hour)
+
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = "foobar:" + strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Increment(keys[i%len(keys)], 1, time.Minute)
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheGetMultipleKeys(b *testing.B) {
+	cache := memory.NewCache(time.Hour)
+
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = "foobar:" + strconv.Itoa(i)
+		cache.Increment(keys[i], 1, time.Minute)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Get(keys[i%len(keys)], time.Minute)
+			i++
+		}
+	})
+}
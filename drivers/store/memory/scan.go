@@ -0,0 +1,61 @@
+package memory
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/panii/limiter/v3"
+)
+
+// Scan returns the keys of a shard of the cache whose identifier starts with given prefix, and the cursor of the
+// next shard. Expired keys are skipped.
+func (store *Store) Scan(ctx context.Context, prefix string, cursor uint64) ([]limiter.KeyInfo, uint64, error) {
+	if cursor >= cacheShards {
+		return nil, 0, nil
+	}
+
+	now := timestamp()
+	storePrefix := store.Prefix + ":"
+	match := storePrefix + prefix
+
+	keys := []limiter.KeyInfo{}
+	store.cache.rangeShard(int(cursor), func(key string, counter *Counter) {
+		if !strings.HasPrefix(key, match) {
+			return
+		}
+
+		count, expiration := counter.load(now, 0)
+		if expiration == 0 {
+			return
+		}
+
+		keys = append(keys, limiter.KeyInfo{
+			Key:   key[len(storePrefix):],
+			Count: count,
+			TTL:   time.Duration(expiration - now),
+		})
+	})
+
+	next := cursor + 1
+	if next == cacheShards {
+		next = 0
+	}
+
+	return keys, next, nil
+}
+
+// DeletePrefix deletes every key whose identifier starts with given prefix, and returns the number of deleted keys.
+func (store *Store) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	match := store.Prefix + ":" + prefix
+
+	deleted := int64(0)
+	store.cache.Range(func(key string, counter *Counter) {
+		if strings.HasPrefix(key, match) {
+			store.cache.Delete(key)
+			deleted++
+		}
+	})
+
+	return deleted, nil
+}
@@ -0,0 +1,313 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot format:
+//
+//	magic      [4]byte "LMTS"
+//	version    uint8
+//	entries    repeated {
+//	               marker     uint8 (1)
+//	               key        uvarint length, followed by bytes
+//	               value      varint
+//	               expiration varint, in nanoseconds since Unix epoch
+//	           }
+//	end        uint8 (0)
+//	checksum   uint32, big endian CRC-32 (IEEE) of every previous byte
+const (
+	snapshotMagic   = "LMTS"
+	snapshotVersion = 1
+
+	snapshotEntry = 1
+	snapshotEnd   = 0
+
+	// snapshotMaxKeyLength is the maximum key length accepted on restore, to protect against corrupted snapshots.
+	snapshotMaxKeyLength = 1 << 16
+)
+
+var (
+	// ErrInvalidSnapshot is returned when a snapshot is corrupted or doesn't use the snapshot format.
+	ErrInvalidSnapshot = errors.New("memory: invalid snapshot")
+	// ErrUnsupportedSnapshot is returned when a snapshot uses an unknown version of the snapshot format.
+	ErrUnsupportedSnapshot = errors.New("memory: unsupported snapshot version")
+)
+
+// Snapshot writes every counter that has not expired to given writer, using a compact binary format.
+// Counters are written while the store keeps serving requests, so the snapshot is not a point-in-time copy.
+func (store *Store) Snapshot(w io.Writer) error {
+	checksum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(w, checksum))
+	scratch := make([]byte, binary.MaxVarintLen64)
+
+	_, err := writer.WriteString(snapshotMagic)
+	if err != nil {
+		return errors.Wrap(err, "cannot write snapshot header")
+	}
+	err = writer.WriteByte(snapshotVersion)
+	if err != nil {
+		return errors.Wrap(err, "cannot write snapshot header")
+	}
+
+	now := timestamp()
+	store.cache.Range(func(key string, counter *Counter) {
+		if err != nil {
+			return
+		}
+
+		value, expiration := counter.load(now, 0)
+		if expiration == 0 {
+			return
+		}
+
+		err = writer.WriteByte(snapshotEntry)
+		if err == nil {
+			_, err = writer.Write(scratch[:binary.PutUvarint(scratch, uint64(len(key)))])
+		}
+		if err == nil {
+			_, err = writer.WriteString(key)
+		}
+		if err == nil {
+			_, err = writer.Write(scratch[:binary.PutVarint(scratch, value)])
+		}
+		if err == nil {
+			_, err = writer.Write(scratch[:binary.PutVarint(scratch, expiration)])
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot write snapshot entry")
+	}
+
+	err = writer.WriteByte(snapshotEnd)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot write snapshot")
+	}
+
+	binary.BigEndian.PutUint32(scratch, checksum.Sum32())
+	_, err = w.Write(scratch[:4])
+	if err != nil {
+		return errors.Wrap(err, "cannot write snapshot checksum")
+	}
+
+	return nil
+}
+
+// Restore loads counters from a snapshot created with Snapshot.
+// Expired counters are skipped, and restored counters replace existing ones with the same key.
+// Nothing is restored if the snapshot is corrupted.
+func (store *Store) Restore(r io.Reader) error {
+	checksum := crc32.NewIEEE()
+	reader := bufio.NewReader(r)
+	source := &snapshotReader{reader: reader, checksum: checksum}
+
+	header := make([]byte, len(snapshotMagic)+1)
+	_, err := io.ReadFull(source, header)
+	if err != nil {
+		return errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrInvalidSnapshot
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return ErrUnsupportedSnapshot
+	}
+
+	entries := []wheelEntry{}
+	for {
+		marker, err := source.ReadByte()
+		if err != nil {
+			return errors.Wrap(ErrInvalidSnapshot, err.Error())
+		}
+		if marker == snapshotEnd {
+			break
+		}
+		if marker != snapshotEntry {
+			return ErrInvalidSnapshot
+		}
+
+		entry, err := readSnapshotEntry(source)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	expected := checksum.Sum32()
+	footer := make([]byte, 4)
+	_, err = io.ReadFull(reader, footer)
+	if err != nil || binary.BigEndian.Uint32(footer) != expected {
+		return errors.Wrap(ErrInvalidSnapshot, "checksum mismatch")
+	}
+
+	now := timestamp()
+	for i := range entries {
+		if entries[i].counter.expired(now) {
+			continue
+		}
+		store.cache.Store(entries[i].key, entries[i].counter)
+	}
+
+	return nil
+}
+
+// readSnapshotEntry reads a single counter from given snapshot.
+func readSnapshotEntry(source *snapshotReader) (wheelEntry, error) {
+	length, err := binary.ReadUvarint(source)
+	if err != nil || length > snapshotMaxKeyLength {
+		return wheelEntry{}, ErrInvalidSnapshot
+	}
+
+	key := make([]byte, length)
+	_, err = io.ReadFull(source, key)
+	if err != nil {
+		return wheelEntry{}, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+
+	value, err := binary.ReadVarint(source)
+	if err != nil {
+		return wheelEntry{}, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+
+	expiration, err := binary.ReadVarint(source)
+	if err != nil {
+		return wheelEntry{}, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+
+	return wheelEntry{
+		key: string(key),
+		counter: &Counter{
+			value:      value,
+			expiration: expiration,
+		},
+		expiration: expiration,
+	}, nil
+}
+
+// snapshotReader computes the checksum of every byte read from the underlying reader.
+type snapshotReader struct {
+	reader   *bufio.Reader
+	checksum io.Writer
+	scratch  [1]byte
+}
+
+// Read implements io.Reader.
+func (source *snapshotReader) Read(p []byte) (int, error) {
+	n, err := source.reader.Read(p)
+	_, _ = source.checksum.Write(p[:n])
+	return n, err
+}
+
+// ReadByte implements io.ByteReader.
+func (source *snapshotReader) ReadByte() (byte, error) {
+	b, err := source.reader.ReadByte()
+	if err == nil {
+		source.scratch[0] = b
+		_, _ = source.checksum.Write(source.scratch[:])
+	}
+	return b, err
+}
+
+// SnapshotFile writes a snapshot to given path.
+// The snapshot is written to a temporary file first, which is then renamed, so an existing snapshot is never
+// left half-written.
+func (store *Store) SnapshotFile(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "cannot create snapshot file")
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+
+	err = store.Snapshot(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return errors.Wrap(err, "cannot write snapshot file")
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return errors.Wrap(err, "cannot rename snapshot file")
+	}
+
+	return nil
+}
+
+// RestoreFile loads counters from a snapshot written to given path.
+// A missing file is not an error: there is nothing to restore.
+func (store *Store) RestoreFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot open snapshot file")
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return store.Restore(file)
+}
+
+// A snapshotter will periodically write a snapshot of a store to a file.
+type snapshotter struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Run will periodically write a snapshot of given store until it's stopped.
+func (snapshotter *snapshotter) Run(store *Store) {
+	defer close(snapshotter.done)
+
+	ticker := time.NewTicker(snapshotter.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			store.snapshot()
+		case <-snapshotter.stop:
+			return
+		}
+	}
+}
+
+// Stop notifies the snapshotter goroutine that it should stop, and waits until it has returned.
+func (snapshotter *snapshotter) Stop() {
+	close(snapshotter.stop)
+	<-snapshotter.done
+}
+
+// startSnapshotter will start a snapshotter goroutine for given store.
+func startSnapshotter(store *Store, interval time.Duration) {
+	snapshotter := &snapshotter{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	store.snapshotter = snapshotter
+	go snapshotter.Run(store)
+}
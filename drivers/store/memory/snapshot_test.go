@@ -0,0 +1,167 @@
+package memory_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/memory"
+)
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	options := limiter.StoreOptions{
+		Prefix:          "limiter:memory:snapshot-test",
+		CleanUpInterval: 30 * time.Second,
+	}
+	rate := limiter.Rate{
+		Limit:  10,
+		Period: time.Minute,
+	}
+	shortRate := limiter.Rate{
+		Limit:  10,
+		Period: 10 * time.Millisecond,
+	}
+
+	store := memory.NewStoreWithOptions(options).(*memory.Store)
+	for i := 0; i < 3; i++ {
+		_, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	_, err := store.Get(ctx, "bar", rate)
+	is.NoError(err)
+	_, err = store.Get(ctx, "baz", shortRate)
+	is.NoError(err)
+
+	expected, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+
+	time.Sleep(20 * time.Millisecond)
+
+	buffer := &bytes.Buffer{}
+	is.NoError(store.Snapshot(buffer))
+
+	restored := memory.NewStoreWithOptions(options).(*memory.Store)
+	is.NoError(restored.Restore(bytes.NewReader(buffer.Bytes())))
+
+	lctx, err := restored.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(expected, lctx)
+
+	lctx, err = restored.Peek(ctx, "bar", rate)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+
+	// Expired counters are not written.
+	is.Equal(int64(2), restored.Stats().Keys)
+
+	// A corrupted snapshot is rejected without restoring anything.
+	corrupted := append([]byte{}, buffer.Bytes()...)
+	corrupted[len(corrupted)-6] ^= 0xff
+
+	empty := memory.NewStoreWithOptions(options).(*memory.Store)
+	err = empty.Restore(bytes.NewReader(corrupted))
+	is.Equal(memory.ErrInvalidSnapshot, errors.Cause(err))
+	is.Equal(int64(0), empty.Stats().Keys)
+
+	err = empty.Restore(bytes.NewReader(buffer.Bytes()[:len(buffer.Bytes())-4]))
+	is.Equal(memory.ErrInvalidSnapshot, errors.Cause(err))
+
+	err = empty.Restore(bytes.NewReader([]byte("LMTS\x09")))
+	is.Equal(memory.ErrUnsupportedSnapshot, err)
+}
+
+func TestMemoryStoreSnapshotFile(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	directory, err := ioutil.TempDir("", "limiter-snapshot")
+	is.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(directory)
+	}()
+
+	options := limiter.StoreOptions{
+		Prefix:           "limiter:memory:snapshot-file-test",
+		CleanUpInterval:  30 * time.Second,
+		SnapshotPath:     filepath.Join(directory, "limiter.snapshot"),
+		SnapshotInterval: 10 * time.Millisecond,
+	}
+	instance := limiter.New(memory.NewStoreWithOptions(options), limiter.Rate{
+		Limit:  3,
+		Period: time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err = instance.Get(ctx, "foo")
+		is.NoError(err)
+	}
+
+	// Wait for a periodic snapshot.
+	time.Sleep(50 * time.Millisecond)
+	_, err = os.Stat(options.SnapshotPath)
+	is.NoError(err)
+
+	lctx, err := instance.Get(ctx, "foo")
+	is.NoError(err)
+	is.Equal(int64(0), lctx.Remaining)
+
+	// A last snapshot is written on close.
+	is.NoError(instance.Store.(io.Closer).Close())
+
+	instance.Store = memory.NewStoreWithOptions(options)
+	defer func() {
+		_ = instance.Store.(io.Closer).Close()
+	}()
+
+	lctx, err = instance.Get(ctx, "foo")
+	is.NoError(err)
+	is.True(lctx.Reached)
+	is.Equal(int64(0), instance.Store.(limiter.StatsReporter).Stats().Errors)
+}
+
+func TestMemoryStoreWithSnapshot(t *testing.T) {
+	is := require.New(t)
+
+	directory, err := ioutil.TempDir("", "limiter-snapshot")
+	is.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(directory)
+	}()
+
+	options := limiter.StoreOptions{
+		Prefix:          "limiter:memory:with-snapshot-test",
+		CleanUpInterval: 30 * time.Second,
+		SnapshotPath:    filepath.Join(directory, "limiter.snapshot"),
+	}
+
+	// A missing snapshot is a fresh start.
+	store, err := memory.NewStoreWithSnapshot(options)
+	is.NoError(err)
+	is.NoError(store.(io.Closer).Close())
+
+	// A corrupted snapshot is an error.
+	is.NoError(ioutil.WriteFile(options.SnapshotPath, []byte("LMTS\x01garbage"), 0600))
+	_, err = memory.NewStoreWithSnapshot(options)
+	is.Error(err)
+	is.True(errors.Is(err, memory.ErrInvalidSnapshot))
+
+	// Whereas it's only reported by Stats with NewStoreWithOptions.
+	store = memory.NewStoreWithOptions(options)
+	is.Equal(int64(1), store.(limiter.StatsReporter).Stats().Errors)
+	_ = store.(io.Closer).Close()
+
+	_, err = memory.NewStoreWithSnapshot(limiter.StoreOptions{})
+	is.Error(err)
+}
@@ -2,8 +2,12 @@ package memory
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/panii/limiter/v3"
 	"github.com/panii/limiter/v3/drivers/store/common"
 	"github.com/panii/limiter/v3/internal/bytebuffer"
@@ -11,10 +15,19 @@ import (
 
 // Store is the in-memory store.
 type Store struct {
+	// errors is the number of snapshots that could not be written or restored.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
 	// Prefix used for the key.
 	Prefix string
 	// cache used to store values in-memory.
 	cache *CacheWrapper
+	// snapshotPath is the file used to persist counters, if any.
+	snapshotPath string
+	// snapshotter periodically writes counters to snapshotPath, if enabled.
+	snapshotter *snapshotter
+	// closeOnce is used to close the store only once.
+	closeOnce sync.Once
 }
 
 // NewStore creates a new instance of memory store with defaults.
@@ -26,15 +39,65 @@ func NewStore() limiter.Store {
 }
 
 // NewStoreWithOptions creates a new instance of memory store with options.
+// If a snapshot path is given, counters are restored from this file: if it cannot be read, the store starts empty
+// and the failure is reported by Stats. Use NewStoreWithSnapshot to handle this failure instead.
 func NewStoreWithOptions(options limiter.StoreOptions) limiter.Store {
-	return &Store{
-		Prefix: options.Prefix,
-		cache:  NewCache(options.CleanUpInterval),
+	store, err := newStore(options)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+	}
+	store.start(options)
+
+	return store
+}
+
+// NewStoreWithSnapshot creates a new instance of memory store with options, whose counters are restored from the
+// snapshot path. A missing snapshot is a fresh start, but unlike NewStoreWithOptions, an error is returned if the
+// snapshot cannot be read, or is corrupted.
+func NewStoreWithSnapshot(options limiter.StoreOptions) (limiter.Store, error) {
+	if options.SnapshotPath == "" {
+		return nil, errors.New("memory: snapshot path is required")
+	}
+
+	store, err := newStore(options)
+	if err != nil {
+		_ = store.cache.Close()
+		return nil, err
+	}
+	store.start(options)
+
+	return store, nil
+}
+
+// newStore creates a new instance of memory store with options, and restores its counters from the snapshot path,
+// if any. The store is returned even if the snapshot cannot be restored.
+func newStore(options limiter.StoreOptions) (*Store, error) {
+	store := &Store{
+		Prefix:       options.Prefix,
+		cache:        NewCache(options.CleanUpInterval),
+		snapshotPath: options.SnapshotPath,
+	}
+
+	if store.snapshotPath == "" {
+		return store, nil
+	}
+
+	return store, store.RestoreFile(store.snapshotPath)
+}
+
+// start starts the snapshotter goroutine of given store, if enabled.
+func (store *Store) start(options limiter.StoreOptions) {
+	if store.snapshotPath != "" && options.SnapshotInterval > 0 {
+		startSnapshotter(store, options.SnapshotInterval)
 	}
 }
 
 // Get returns the limit for given identifier.
 func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
 	buffer := bytebuffer.New()
 	defer buffer.Close()
 	buffer.Concat(store.Prefix, ":", key)
@@ -45,8 +108,48 @@ func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (lim
 	return lctx, nil
 }
 
+// GetMulti returns the limit of every request, in order.
+func (store *Store) GetMulti(ctx context.Context, requests []limiter.Request) ([]limiter.Context, error) {
+	if store.Closed() {
+		return nil, limiter.ErrStoreClosed
+	}
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	now := time.Now()
+	contexts := make([]limiter.Context, len(requests))
+	for i := range requests {
+		buffer.Reset()
+		buffer.Concat(store.Prefix, ":", requests[i].Key)
+
+		count, expiration := store.cache.Increment(buffer.String(), 1, requests[i].Rate.Period)
+		contexts[i] = common.GetContextFromState(now, requests[i].Rate, expiration, count)
+	}
+
+	return contexts, nil
+}
+
+// Seed adds given number of hits to given identifier, which expires after given TTL if it's created.
+func (store *Store) Seed(ctx context.Context, key string, count int64, ttl time.Duration) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	buffer.Concat(store.Prefix, ":", key)
+
+	store.cache.Increment(buffer.String(), count, ttl)
+	return nil
+}
+
 // Peek returns the limit for given identifier, without modification on current values.
 func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
 	buffer := bytebuffer.New()
 	defer buffer.Close()
 	buffer.Concat(store.Prefix, ":", key)
@@ -57,8 +160,12 @@ func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (li
 	return lctx, nil
 }
 
-// Reset returns the limit for given identifier.
+// Reset returns the limit for given identifier which is set to zero.
 func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
 	buffer := bytebuffer.New()
 	defer buffer.Close()
 	buffer.Concat(store.Prefix, ":", key)
@@ -68,3 +175,54 @@ func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (l
 	lctx := common.GetContextFromState(time.Now(), rate, expiration, count)
 	return lctx, nil
 }
+
+// Close stops the cleaner goroutine used to delete expired keys.
+// It allows a deterministic shutdown, instead of waiting for the garbage collector to stop it.
+// If a snapshot path is configured, a last snapshot is written before returning.
+func (store *Store) Close() error {
+	var err error
+
+	store.closeOnce.Do(func() {
+		if store.snapshotter != nil {
+			store.snapshotter.Stop()
+		}
+		if store.snapshotPath != "" {
+			err = store.snapshot()
+		}
+		_ = store.cache.Close()
+	})
+
+	return err
+}
+
+// Closed returns true if the store has been closed.
+func (store *Store) Closed() bool {
+	return store.cache.Closed()
+}
+
+// Ping returns an error if the store has been closed.
+func (store *Store) Ping(ctx context.Context) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+	return nil
+}
+
+// Stats returns the number of keys held by the store, the number of expired keys removed by the cleaner and the
+// number of snapshots that could not be written or restored.
+func (store *Store) Stats() limiter.StoreStats {
+	return limiter.StoreStats{
+		Keys:    store.cache.Len(),
+		Evicted: store.cache.Evicted(),
+		Errors:  atomic.LoadInt64(&store.errors),
+	}
+}
+
+// snapshot writes counters to the configured snapshot path.
+func (store *Store) snapshot() error {
+	err := store.SnapshotFile(store.snapshotPath)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+	}
+	return err
+}
@@ -1,9 +1,13 @@
 package memory_test
 
 import (
+	"context"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/panii/limiter/v3"
 	"github.com/panii/limiter/v3/drivers/store/memory"
 	"github.com/panii/limiter/v3/drivers/store/tests"
@@ -23,6 +27,34 @@ func TestMemoryStoreConcurrentAccess(t *testing.T) {
 	}))
 }
 
+func TestMemoryStoreAllocations(t *testing.T) {
+	tests.TestStoreAllocations(t, memory.NewStoreWithOptions(limiter.StoreOptions{
+		Prefix:          "limiter:memory:allocations-test",
+		CleanUpInterval: 30 * time.Second,
+	}))
+}
+
+func TestMemoryStoreBatchAccess(t *testing.T) {
+	tests.TestStoreBatchAccess(t, memory.NewStoreWithOptions(limiter.StoreOptions{
+		Prefix:          "limiter:memory:batch-test",
+		CleanUpInterval: 30 * time.Second,
+	}))
+}
+
+func TestMemoryStoreSeed(t *testing.T) {
+	tests.TestStoreSeed(t, memory.NewStoreWithOptions(limiter.StoreOptions{
+		Prefix:          "limiter:memory:seed-test",
+		CleanUpInterval: 30 * time.Second,
+	}))
+}
+
+func TestMemoryStoreScan(t *testing.T) {
+	tests.TestStoreScan(t, memory.NewStoreWithOptions(limiter.StoreOptions{
+		Prefix:          "limiter:memory:scan-test",
+		CleanUpInterval: 30 * time.Second,
+	}))
+}
+
 func BenchmarkMemoryStoreSequentialAccess(b *testing.B) {
 	tests.BenchmarkStoreSequentialAccess(b, memory.NewStoreWithOptions(limiter.StoreOptions{
 		Prefix:          "limiter:memory:sequential-benchmark",
@@ -36,3 +68,49 @@ func BenchmarkMemoryStoreConcurrentAccess(b *testing.B) {
 		CleanUpInterval: 1 * time.Hour,
 	}))
 }
+
+func TestMemoryStoreLifecycle(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	store := memory.NewStoreWithOptions(limiter.StoreOptions{
+		Prefix:          "limiter:memory:lifecycle-test",
+		CleanUpInterval: 10 * time.Millisecond,
+	})
+	instance := limiter.New(store, limiter.Rate{
+		Limit:  10,
+		Period: 50 * time.Millisecond,
+	})
+
+	is.NoError(instance.Healthy(ctx))
+
+	for _, key := range []string{"foo", "bar", "baz"} {
+		_, err := instance.Get(ctx, key)
+		is.NoError(err)
+	}
+
+	reporter, ok := store.(limiter.StatsReporter)
+	is.True(ok)
+	is.Equal(int64(3), reporter.Stats().Keys)
+
+	time.Sleep(250 * time.Millisecond)
+
+	stats := reporter.Stats()
+	is.Equal(int64(0), stats.Keys)
+	is.Equal(int64(3), stats.Evicted)
+
+	closer, ok := store.(io.Closer)
+	is.True(ok)
+	is.NoError(closer.Close())
+	is.NoError(closer.Close())
+	is.Equal(limiter.ErrStoreClosed, instance.Healthy(ctx))
+
+	_, err := instance.Get(ctx, "foo")
+	is.Equal(limiter.ErrStoreClosed, err)
+	_, err = instance.Peek(ctx, "foo")
+	is.Equal(limiter.ErrStoreClosed, err)
+	_, err = instance.Reset(ctx, "foo")
+	is.Equal(limiter.ErrStoreClosed, err)
+	_, err = instance.GetMulti(ctx, []limiter.Request{{Key: "foo"}})
+	is.Equal(limiter.ErrStoreClosed, err)
+}
@@ -0,0 +1,159 @@
+package memory
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// wheelTick is the resolution of the timing wheel.
+	wheelTick = int64(100 * time.Millisecond)
+	// wheelBits is the number of bits used to index slots on each level.
+	wheelBits = 6
+	// wheelSlots is the number of slots on each level.
+	wheelSlots = 1 << wheelBits
+	// wheelMask is used to obtain a slot index from a tick.
+	wheelMask = wheelSlots - 1
+	// wheelLevels is the number of levels of the timing wheel.
+	// With a resolution of 100ms, it covers more than two centuries.
+	wheelLevels = 6
+)
+
+// wheelEntry is a scheduled expiration of a counter.
+// Its expiration is read before the entry is added, so the wheel never waits on a counter being renewed while its
+// mutex is held.
+type wheelEntry struct {
+	key        string
+	counter    *Counter
+	expiration int64
+}
+
+// timingWheel is a hierarchical timing wheel used to schedule counters expiration.
+// It allows the cleaner to only visit counters whose expiration is due, instead of every counter in the cache.
+//
+// Level N holds entries expiring in less than 64^(N+1) ticks. Each time a level has done a full rotation,
+// the matching slot of the next level is cascaded into lower levels.
+type timingWheel struct {
+	mutex   sync.Mutex
+	current int64
+	counts  [wheelLevels]int
+	levels  [wheelLevels][wheelSlots][]wheelEntry
+}
+
+// newTimingWheel returns a new timing wheel starting at given time, in nanoseconds.
+func newTimingWheel(now int64) *timingWheel {
+	return &timingWheel{
+		current: now / wheelTick,
+	}
+}
+
+// Add schedules given counter to be checked once its expiration is due.
+func (wheel *timingWheel) Add(key string, counter *Counter) {
+	entry := wheelEntry{key: key, counter: counter, expiration: counter.Expiration()}
+
+	wheel.mutex.Lock()
+	defer wheel.mutex.Unlock()
+
+	wheel.add(entry)
+}
+
+// AddAll schedules given entries to be checked once their expiration is due.
+// The expiration of each entry must have been read from its counter by the caller.
+func (wheel *timingWheel) AddAll(entries []wheelEntry) {
+	wheel.mutex.Lock()
+	defer wheel.mutex.Unlock()
+
+	for i := range entries {
+		wheel.add(entries[i])
+	}
+}
+
+// Advance moves the wheel forward until given time, in nanoseconds, and returns every entry that is due.
+func (wheel *timingWheel) Advance(now int64) []wheelEntry {
+	wheel.mutex.Lock()
+	defer wheel.mutex.Unlock()
+
+	target := now / wheelTick
+	due := []wheelEntry{}
+
+	for wheel.current < target {
+		// If there is nothing left on the first level, we can skip directly to the end of its rotation.
+		if wheel.counts[0] == 0 {
+			next := wheel.current | wheelMask
+			if next >= target {
+				wheel.current = target
+				break
+			}
+			wheel.current = next
+		}
+
+		wheel.current++
+		wheel.cascade()
+
+		index := wheel.current & wheelMask
+		due = append(due, wheel.levels[0][index]...)
+		wheel.counts[0] -= len(wheel.levels[0][index])
+		wheel.levels[0][index] = nil
+	}
+
+	return due
+}
+
+// Len returns the number of scheduled entries.
+func (wheel *timingWheel) Len() int {
+	wheel.mutex.Lock()
+	defer wheel.mutex.Unlock()
+
+	total := 0
+	for i := range wheel.counts {
+		total += wheel.counts[i]
+	}
+	return total
+}
+
+// add inserts given entry on the level matching its expiration.
+// WARNING: mutex must be held by the caller.
+func (wheel *timingWheel) add(entry wheelEntry) {
+	// Round expiration up to the next tick, so an entry is never due before its counter has expired.
+	tick := (entry.expiration + wheelTick - 1) / wheelTick
+	if tick <= wheel.current {
+		tick = wheel.current + 1
+	}
+
+	delta := tick - wheel.current
+	for level := 0; level < wheelLevels; level++ {
+		shift := uint(level * wheelBits)
+		if delta < int64(1)<<(shift+wheelBits) || level == wheelLevels-1 {
+			if level == wheelLevels-1 && delta >= int64(1)<<(shift+wheelBits) {
+				// Expiration is beyond the wheel horizon: the entry will be rescheduled once it's due.
+				tick = wheel.current + int64(1)<<(shift+wheelBits) - 1
+			}
+			index := (tick >> shift) & wheelMask
+			wheel.levels[level][index] = append(wheel.levels[level][index], entry)
+			wheel.counts[level]++
+			return
+		}
+	}
+}
+
+// cascade moves entries from upper levels to lower levels when a level has done a full rotation.
+// Entries keep the expiration they were scheduled with: a counter renewed since then is rescheduled by the cleaner
+// once it's due.
+// WARNING: mutex must be held by the caller.
+func (wheel *timingWheel) cascade() {
+	for level := 1; level < wheelLevels; level++ {
+		shift := uint(level * wheelBits)
+		if wheel.current&(int64(1)<<shift-1) != 0 {
+			return
+		}
+
+		index := (wheel.current >> shift) & wheelMask
+		entries := wheel.levels[level][index]
+		wheel.levels[level][index] = nil
+		wheel.counts[level] -= len(entries)
+
+		for i := range entries {
+			wheel.add(entries[i])
+		}
+	}
+}
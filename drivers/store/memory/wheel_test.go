@@ -0,0 +1,201 @@
+package memory
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimingWheelAdvance(t *testing.T) {
+	is := require.New(t)
+
+	now := time.Now().UnixNano()
+	wheel := newTimingWheel(now)
+
+	durations := []time.Duration{
+		50 * time.Millisecond,
+		time.Second,
+		10 * time.Second,
+		5 * time.Minute,
+		2 * time.Hour,
+		3 * 24 * time.Hour,
+	}
+
+	for i, duration := range durations {
+		wheel.Add(strconv.Itoa(i), &Counter{
+			value:      1,
+			expiration: now + int64(duration),
+		})
+	}
+	is.Equal(len(durations), wheel.Len())
+
+	for i, duration := range durations {
+		// An entry must never be due before its expiration...
+		due := wheel.Advance(now + int64(duration) - wheelTick)
+		is.Empty(due)
+
+		// ...but it should be due right after.
+		due = wheel.Advance(now + int64(duration) + wheelTick)
+		is.Len(due, 1)
+		is.Equal(strconv.Itoa(i), due[0].key)
+		is.Equal(len(durations)-i-1, wheel.Len())
+	}
+}
+
+func TestTimingWheelAddRenewingCounter(t *testing.T) {
+	is := require.New(t)
+
+	now := time.Now().UnixNano()
+	wheel := newTimingWheel(now)
+
+	// Schedule a counter while it's being renewed: Add waits for its expiration, without holding the wheel lock.
+	counter := &Counter{
+		value:      1,
+		expiration: counterRenewing,
+	}
+	done := make(chan struct{})
+	go func() {
+		wheel.Add("foo", counter)
+		close(done)
+	}()
+
+	wheel.Add("bar", &Counter{
+		value:      1,
+		expiration: now + int64(time.Second),
+	})
+	is.Len(wheel.Advance(now+int64(2*time.Second)), 1)
+
+	atomic.StoreInt64(&counter.expiration, now+int64(time.Minute))
+	<-done
+	is.Equal(1, wheel.Len())
+}
+
+func TestCacheCleanRenewedCounter(t *testing.T) {
+	is := require.New(t)
+
+	now := time.Now().UnixNano()
+	cache := &Cache{wheel: newTimingWheel(now)}
+
+	cache.Store("foo", &Counter{
+		value:      1,
+		expiration: now + int64(time.Second),
+	})
+	cache.Store("bar", &Counter{
+		value:      1,
+		expiration: now + int64(time.Second),
+	})
+
+	// Renew "bar" as if it was incremented after its expiration.
+	counter, ok := cache.Load("bar")
+	is.True(ok)
+	counter.expiration = now + int64(time.Minute)
+
+	cache.clean(now + int64(2*time.Second))
+
+	_, ok = cache.Load("foo")
+	is.False(ok)
+	_, ok = cache.Load("bar")
+	is.True(ok)
+	is.Equal(1, cache.wheel.Len())
+
+	cache.clean(now + int64(2*time.Minute))
+
+	_, ok = cache.Load("bar")
+	is.False(ok)
+	is.Equal(0, cache.wheel.Len())
+}
+
+func TestCacheCleanDeletedCounter(t *testing.T) {
+	is := require.New(t)
+
+	now := time.Now().UnixNano()
+	cache := &Cache{wheel: newTimingWheel(now)}
+	cache.Store("foo", &Counter{
+		value:      5,
+		expiration: now - int64(time.Second),
+	})
+
+	// A goroutine has loaded the expired counter, which is then deleted by the cleaner.
+	counter, ok := cache.Load("foo")
+	is.True(ok)
+	is.True(cache.evict("foo", counter, now))
+	is.False(cache.evict("foo", counter, now))
+
+	// The deleted counter can't be renewed, so the increment goes to a new counter in the cache.
+	_, _, ok = counter.increment(now, 1, now+int64(time.Minute))
+	is.False(ok)
+
+	value, _ := cache.Increment("foo", 1, time.Minute)
+	is.Equal(int64(1), value)
+	value, _ = cache.Get("foo", time.Minute)
+	is.Equal(int64(1), value)
+
+	// A renewed counter isn't deleted.
+	counter, ok = cache.Load("foo")
+	is.True(ok)
+	is.False(cache.evict("foo", counter, timestamp()))
+	is.Equal(int64(1), cache.Evicted())
+}
+
+const (
+	benchmarkCleanKeys     = 1000000
+	benchmarkCleanExpiring = 10000
+)
+
+// BenchmarkCacheCleanRange measures the previous cleanup strategy, which visits every counter of the cache.
+func BenchmarkCacheCleanRange(b *testing.B) {
+	benchmarkCacheClean(b, false, func(cache *Cache, now int64) {
+		cache.Range(func(key string, counter *Counter) {
+			if counter.expired(now) {
+				cache.Delete(key)
+			}
+		})
+	})
+}
+
+// BenchmarkCacheCleanWheel measures the timing wheel cleanup strategy, which only visits counters that are due.
+func BenchmarkCacheCleanWheel(b *testing.B) {
+	benchmarkCacheClean(b, true, func(cache *Cache, now int64) {
+		cache.clean(now)
+	})
+}
+
+// benchmarkCacheClean fills a cache with a million long-lived keys, then measures the cleanup of a batch of
+// expiring keys for each iteration.
+func benchmarkCacheClean(b *testing.B, wheel bool, clean func(cache *Cache, now int64)) {
+	now := time.Now().UnixNano()
+	cache := &Cache{}
+	if wheel {
+		cache.wheel = newTimingWheel(now)
+	}
+
+	for i := 0; i < benchmarkCleanKeys; i++ {
+		cache.Store("long:"+strconv.Itoa(i), &Counter{
+			value:      1,
+			expiration: now + int64(365*24*time.Hour),
+		})
+	}
+
+	keys := make([]string, benchmarkCleanExpiring)
+	for i := range keys {
+		keys[i] = "short:" + strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		expiration := now + int64(i)*wheelTick
+		for j := range keys {
+			cache.Store(keys[j], &Counter{
+				value:      1,
+				expiration: expiration,
+			})
+		}
+		b.StartTimer()
+
+		clean(cache, expiration+wheelTick)
+	}
+}
@@ -0,0 +1,120 @@
+// Package migrate provides tools to move counters from a store to another, without giving fresh quotas to every
+// client: a dual-write store, which keeps the target store up to date while the source store is still used, and
+// Migrate, which seeds the target store with the counters of the source store.
+//
+// A migration usually runs in three steps: serve requests with a dual-write store, run Migrate to seed the counters
+// created before the dual-write, then serve requests with the target store only.
+package migrate
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/panii/limiter/v3"
+)
+
+// DualStore is a store which reads from a primary store, and writes to both a primary and a secondary store.
+type DualStore struct {
+	// errors is the number of failed operations on the secondary store.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// primary is the store used to serve requests.
+	primary limiter.Store
+	// secondary is the store which receives every write.
+	secondary limiter.Store
+	// closeOnce is used to close the stores only once.
+	closeOnce sync.Once
+}
+
+// NewDualStore returns a store which serves requests from primary store, and repeats every write on secondary store.
+// Failures of the secondary store are not returned, but they are reported by Stats.
+func NewDualStore(primary limiter.Store, secondary limiter.Store) limiter.Store {
+	return &DualStore{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+// Get returns the limit for given identifier from the primary store, and increments it on the secondary store.
+func (store *DualStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	lctx, err := store.primary.Get(ctx, key, rate)
+	if err != nil {
+		return lctx, err
+	}
+
+	_, err = store.secondary.Get(ctx, key, rate)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+	}
+
+	return lctx, nil
+}
+
+// Peek returns the limit for given identifier from the primary store, without modification on current values.
+func (store *DualStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.primary.Peek(ctx, key, rate)
+}
+
+// Reset returns the limit for given identifier which is set to zero on both stores.
+func (store *DualStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	lctx, err := store.primary.Reset(ctx, key, rate)
+	if err != nil {
+		return lctx, err
+	}
+
+	_, err = store.secondary.Reset(ctx, key, rate)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+	}
+
+	return lctx, nil
+}
+
+// Close closes both stores, if they implement io.Closer.
+func (store *DualStore) Close() error {
+	var err error
+
+	store.closeOnce.Do(func() {
+		if closer, ok := store.secondary.(io.Closer); ok {
+			err = closer.Close()
+		}
+		if closer, ok := store.primary.(io.Closer); ok {
+			primaryErr := closer.Close()
+			if primaryErr != nil {
+				err = primaryErr
+			}
+		}
+	})
+
+	return err
+}
+
+// Ping returns an error if the primary store is unable to serve requests.
+// The secondary store is not checked, since its failures don't prevent serving requests.
+func (store *DualStore) Ping(ctx context.Context) error {
+	if pinger, ok := store.primary.(limiter.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the primary store, with the failed operations on the secondary store.
+func (store *DualStore) Stats() limiter.StoreStats {
+	stats := limiter.StoreStats{
+		Keys:    -1,
+		Evicted: -1,
+	}
+	if reporter, ok := store.primary.(limiter.StatsReporter); ok {
+		stats = reporter.Stats()
+	}
+
+	errors := atomic.LoadInt64(&store.errors)
+	if stats.Errors > 0 {
+		errors += stats.Errors
+	}
+	stats.Errors = errors
+
+	return stats
+}
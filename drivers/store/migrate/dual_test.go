@@ -0,0 +1,104 @@
+package migrate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/memory"
+	"github.com/panii/limiter/v3/drivers/store/migrate"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestDualStoreSequentialAccess(t *testing.T) {
+	store := migrate.NewDualStore(newMemoryStore(), newMemoryStore())
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestDualStoreConcurrentAccess(t *testing.T) {
+	store := migrate.NewDualStore(newMemoryStore(), newMemoryStore())
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestDualStoreWrites(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	primary := newMemoryStore()
+	secondary := newMemoryStore()
+	store := migrate.NewDualStore(primary, secondary)
+	defer tests.CloseStore(t, store)
+
+	for i := 0; i < 3; i++ {
+		_, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+
+	lctx, err := secondary.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(7), lctx.Remaining)
+
+	// Reads don't touch the secondary store.
+	_, err = store.Peek(ctx, "bar", rate)
+	is.NoError(err)
+
+	stats := secondary.(limiter.StatsReporter).Stats()
+	is.Equal(int64(1), stats.Keys)
+
+	_, err = store.Reset(ctx, "foo", rate)
+	is.NoError(err)
+
+	lctx, err = secondary.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(10), lctx.Remaining)
+}
+
+func TestDualStoreSecondaryFailure(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	store := migrate.NewDualStore(newMemoryStore(), failingStore{})
+	defer tests.CloseStore(t, store)
+
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+
+	_, err = store.Reset(ctx, "foo", rate)
+	is.NoError(err)
+
+	stats := store.(limiter.StatsReporter).Stats()
+	is.Equal(int64(2), stats.Errors)
+}
+
+func newMemoryStore() limiter.Store {
+	return memory.NewStoreWithOptions(limiter.StoreOptions{
+		Prefix:          "limiter:migrate:test",
+		CleanUpInterval: 30 * time.Second,
+	})
+}
+
+// failingStore is a store which is unable to serve requests.
+type failingStore struct{}
+
+func (failingStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return limiter.Context{}, errors.New("connection refused")
+}
+
+func (failingStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return limiter.Context{}, errors.New("connection refused")
+}
+
+func (failingStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return limiter.Context{}, errors.New("connection refused")
+}
@@ -0,0 +1,127 @@
+package migrate
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+)
+
+// Options are options for Migrate.
+type Options struct {
+	// Prefix is the prefix of the identifiers to migrate. Every key is migrated if empty.
+	Prefix string
+	// DryRun computes the progress of the migration without writing on the target store.
+	DryRun bool
+	// Progress is called after each page of keys, and when the migration ends.
+	Progress func(progress Progress)
+}
+
+// Progress is the progress of a migration.
+type Progress struct {
+	// Keys is the number of keys read from the source store.
+	Keys int64
+	// Seeded is the number of keys seeded on the target store.
+	Seeded int64
+	// Skipped is the number of keys already up to date on the target store, or expired.
+	Skipped int64
+	// Hits is the number of hits added on the target store.
+	Hits int64
+	// Done is true when every key has been read.
+	Done bool
+}
+
+// Migrate walks the keys of the source store and seeds the target store with their counts and TTLs.
+// The source store must implement limiter.Scanner.
+//
+// A key is seeded with the hits it misses on the target store to reach its count on the source store, and it expires
+// with its TTL on the source store. Hits are added at once if the target store implements limiter.Seeder, or with
+// one increment each otherwise. Keys whose count is already higher on the target store are skipped: it's
+// safe to run a migration while requests are served by a dual-write store, and to run it several times.
+func Migrate(ctx context.Context, source limiter.Store, target limiter.Store, options Options) (Progress, error) {
+	progress := Progress{}
+
+	scanner, ok := source.(limiter.Scanner)
+	if !ok {
+		return progress, errors.New("source store doesn't support key scanning")
+	}
+
+	cursor := uint64(0)
+	for {
+		keys, next, err := scanner.Scan(ctx, options.Prefix, cursor)
+		if err != nil {
+			return progress, errors.Wrap(err, "unable to scan source store")
+		}
+
+		for _, info := range keys {
+			progress.Keys++
+
+			hits, err := seed(ctx, target, info, options.DryRun)
+			if err != nil {
+				return progress, errors.Wrapf(err, "unable to seed key %q", info.Key)
+			}
+
+			if hits == 0 {
+				progress.Skipped++
+				continue
+			}
+			progress.Seeded++
+			progress.Hits += hits
+		}
+
+		progress.Done = next == 0
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+
+		if progress.Done {
+			return progress, nil
+		}
+		cursor = next
+	}
+}
+
+// seed adds the hits given key misses on the target store to reach its count on the source store, and returns their
+// number.
+func seed(ctx context.Context, target limiter.Store, info limiter.KeyInfo, dryRun bool) (int64, error) {
+	// Stores expire keys with a precision of a millisecond.
+	if info.Count <= 0 || info.TTL < time.Millisecond {
+		return 0, nil
+	}
+
+	// The rate is only used to create the key with the TTL of the source store, and to get the number of missing hits.
+	rate := limiter.Rate{
+		Limit:  info.Count,
+		Period: info.TTL,
+	}
+
+	lctx, err := target.Peek(ctx, info.Key, rate)
+	if err != nil {
+		return 0, err
+	}
+
+	hits := lctx.Remaining
+	if dryRun || hits <= 0 {
+		return hits, nil
+	}
+
+	seeder, ok := target.(limiter.Seeder)
+	if ok {
+		err = seeder.Seed(ctx, info.Key, hits, info.TTL)
+		if err != nil {
+			return 0, err
+		}
+		return hits, nil
+	}
+
+	for i := int64(0); i < hits; i++ {
+		_, err = target.Get(ctx, info.Key, rate)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return hits, nil
+}
@@ -0,0 +1,161 @@
+package migrate_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/migrate"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestMigrate(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	source := newMemoryStore()
+	defer tests.CloseStore(t, source)
+	target := newMemoryStore()
+	defer tests.CloseStore(t, target)
+
+	for i := 0; i < 100; i++ {
+		for j := 0; j <= i%5; j++ {
+			_, err := source.Get(ctx, fmt.Sprintf("user:%d", i), rate)
+			is.NoError(err)
+		}
+	}
+	_, err := source.Get(ctx, "other", rate)
+	is.NoError(err)
+
+	// A key already ahead on the target store is skipped.
+	for j := 0; j < 8; j++ {
+		_, err = target.Get(ctx, "user:0", rate)
+		is.NoError(err)
+	}
+
+	reports := []migrate.Progress{}
+	progress, err := migrate.Migrate(ctx, source, target, migrate.Options{
+		Prefix: "user:",
+		Progress: func(progress migrate.Progress) {
+			reports = append(reports, progress)
+		},
+	})
+	is.NoError(err)
+	is.True(progress.Done)
+	is.Equal(int64(100), progress.Keys)
+	is.Equal(int64(99), progress.Seeded)
+	is.Equal(int64(1), progress.Skipped)
+	is.Equal(int64(299), progress.Hits)
+	is.NotEmpty(reports)
+	is.Equal(progress, reports[len(reports)-1])
+
+	for i := 1; i < 100; i++ {
+		lctx, err := target.Peek(ctx, fmt.Sprintf("user:%d", i), rate)
+		is.NoError(err)
+		is.Equal(rate.Limit-int64(i%5+1), lctx.Remaining)
+		is.True(lctx.Reset <= time.Now().Add(time.Minute).Unix())
+	}
+
+	lctx, err := target.Peek(ctx, "other", rate)
+	is.NoError(err)
+	is.Equal(rate.Limit, lctx.Remaining)
+
+	// Migration is idempotent.
+	progress, err = migrate.Migrate(ctx, source, target, migrate.Options{Prefix: "user:"})
+	is.NoError(err)
+	is.Equal(int64(0), progress.Seeded)
+	is.Equal(int64(100), progress.Skipped)
+}
+
+func TestMigrateSeeder(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	source := newMemoryStore()
+	defer tests.CloseStore(t, source)
+
+	for i := 0; i < 4; i++ {
+		_, err := source.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+
+	// Hits are added at once to a target store implementing limiter.Seeder, and one by one otherwise.
+	seeding := &countingStore{Store: newMemoryStore()}
+	defer tests.CloseStore(t, seeding.Store)
+	incrementing := &countingStore{Store: newMemoryStore()}
+	defer tests.CloseStore(t, incrementing.Store)
+
+	_, err := migrate.Migrate(ctx, source, seedingStore{seeding}, migrate.Options{})
+	is.NoError(err)
+	_, err = migrate.Migrate(ctx, source, incrementing, migrate.Options{})
+	is.NoError(err)
+
+	is.Equal(0, seeding.gets)
+	is.Equal(4, incrementing.gets)
+
+	for _, target := range []limiter.Store{seeding, incrementing} {
+		lctx, err := target.Peek(ctx, "foo", rate)
+		is.NoError(err)
+		is.Equal(int64(6), lctx.Remaining)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	source := newMemoryStore()
+	defer tests.CloseStore(t, source)
+	target := newMemoryStore()
+	defer tests.CloseStore(t, target)
+
+	for i := 0; i < 3; i++ {
+		_, err := source.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+
+	progress, err := migrate.Migrate(ctx, source, target, migrate.Options{DryRun: true})
+	is.NoError(err)
+	is.Equal(int64(1), progress.Seeded)
+	is.Equal(int64(3), progress.Hits)
+
+	stats := target.(limiter.StatsReporter).Stats()
+	is.Equal(int64(0), stats.Keys)
+}
+
+func TestMigrateUnsupportedSource(t *testing.T) {
+	is := require.New(t)
+
+	target := newMemoryStore()
+	defer tests.CloseStore(t, target)
+
+	_, err := migrate.Migrate(context.Background(), failingStore{}, target, migrate.Options{})
+	is.Error(err)
+}
+
+// countingStore is a store counting its calls to Get, which doesn't implement limiter.Seeder.
+type countingStore struct {
+	limiter.Store
+	gets int
+}
+
+func (store *countingStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	store.gets++
+	return store.Store.Get(ctx, key, rate)
+}
+
+// seedingStore is a countingStore implementing limiter.Seeder.
+type seedingStore struct {
+	*countingStore
+}
+
+func (store seedingStore) Seed(ctx context.Context, key string, count int64, ttl time.Duration) error {
+	return store.Store.(limiter.Seeder).Seed(ctx, key, count, ttl)
+}
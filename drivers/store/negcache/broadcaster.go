@@ -0,0 +1,58 @@
+package negcache
+
+import (
+	"context"
+	"sync"
+)
+
+// Broadcaster sends invalidations of a key to every instance sharing a store.
+//
+// The redis package provides a broadcaster using a pub/sub channel.
+type Broadcaster interface {
+	// Publish sends given key to every subscriber, including the ones of this instance.
+	Publish(ctx context.Context, key string) error
+	// Subscribe calls given handler with every key published by any instance, until unsubscribe is called.
+	Subscribe(handler func(key string)) (unsubscribe func(), err error)
+}
+
+// LocalBroadcaster is a broadcaster for stores of a single process.
+type LocalBroadcaster struct {
+	mutex    sync.RWMutex
+	next     int
+	handlers map[int]func(key string)
+}
+
+// NewLocalBroadcaster returns a broadcaster for stores of a single process.
+func NewLocalBroadcaster() *LocalBroadcaster {
+	return &LocalBroadcaster{
+		handlers: map[int]func(key string){},
+	}
+}
+
+// Publish calls every subscribed handler with given key.
+func (broadcaster *LocalBroadcaster) Publish(ctx context.Context, key string) error {
+	broadcaster.mutex.RLock()
+	defer broadcaster.mutex.RUnlock()
+
+	for _, handler := range broadcaster.handlers {
+		handler(key)
+	}
+	return nil
+}
+
+// Subscribe calls given handler with every published key, until unsubscribe is called.
+func (broadcaster *LocalBroadcaster) Subscribe(handler func(key string)) (func(), error) {
+	broadcaster.mutex.Lock()
+	defer broadcaster.mutex.Unlock()
+
+	id := broadcaster.next
+	broadcaster.next++
+	broadcaster.handlers[id] = handler
+
+	return func() {
+		broadcaster.mutex.Lock()
+		defer broadcaster.mutex.Unlock()
+
+		delete(broadcaster.handlers, id)
+	}, nil
+}
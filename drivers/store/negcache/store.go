@@ -0,0 +1,297 @@
+// Package negcache provides a store wrapper which caches denials locally.
+//
+// Once a key has reached its limit, every request is denied until the reset time of its window: there is no need to
+// ask the store again. Denials are cached until their reset time, and a reset of the key on any instance is sent
+// through a Broadcaster, so every instance clears its cached denials.
+package negcache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+)
+
+// Options are options for negative cache store.
+type Options struct {
+	// Broadcaster sends resets to every instance sharing the store.
+	// Without broadcaster, a reset only clears the denials cached by this instance.
+	Broadcaster Broadcaster
+	// CleanUpInterval is the interval between two removals of expired denials.
+	CleanUpInterval time.Duration
+}
+
+// rateKey identifies a rate, since a key may be limited by several rates.
+type rateKey struct {
+	limit  int64
+	period time.Duration
+}
+
+// Store is the negative cache store.
+type Store struct {
+	// errors is the number of failed broadcasts.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// evicted is the number of expired denials removed from the cache.
+	evicted int64
+	// generation is incremented by every invalidation, so a denial returned by the wrapped store before an
+	// invalidation isn't cached after it.
+	generation uint64
+	// closed is set to one when the store has been closed.
+	closed uint32
+	// store is the wrapped store.
+	store limiter.Store
+	// broadcaster sends resets to every instance, if any.
+	broadcaster Broadcaster
+	// unsubscribe stops receiving resets from the broadcaster.
+	unsubscribe func()
+	// mutex is used to access denials.
+	mutex sync.RWMutex
+	// denials contains the cached denials of every key, by rate.
+	denials map[string]map[rateKey]limiter.Context
+	// stop is used to stop the clean up goroutine.
+	stop chan struct{}
+	// done is closed when the clean up goroutine has returned.
+	done chan struct{}
+	// closeOnce is used to close the store only once.
+	closeOnce sync.Once
+}
+
+// NewStore returns an instance of negative cache store wrapping given store, with given broadcaster.
+func NewStore(store limiter.Store, broadcaster Broadcaster) (limiter.Store, error) {
+	return NewStoreWithOptions(store, Options{
+		Broadcaster:     broadcaster,
+		CleanUpInterval: limiter.DefaultCleanUpInterval,
+	})
+}
+
+// NewStoreWithOptions returns an instance of negative cache store wrapping given store, with options.
+// Expired denials are removed every CleanUpInterval, if it's positive.
+func NewStoreWithOptions(store limiter.Store, options Options) (limiter.Store, error) {
+	if store == nil {
+		return nil, errors.New("negcache: store is required")
+	}
+
+	cache := &Store{
+		store:       store,
+		broadcaster: options.Broadcaster,
+		denials:     map[string]map[rateKey]limiter.Context{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if cache.broadcaster != nil {
+		unsubscribe, err := cache.broadcaster.Subscribe(cache.invalidate)
+		if err != nil {
+			return nil, errors.Wrap(err, "negcache: unable to subscribe to resets")
+		}
+		cache.unsubscribe = unsubscribe
+	}
+
+	if options.CleanUpInterval > 0 {
+		go cache.run(options.CleanUpInterval)
+	} else {
+		close(cache.done)
+	}
+
+	return cache, nil
+}
+
+// Get returns the limit for given identifier.
+// A cached denial is returned without asking the wrapped store.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	lctx, ok := store.lookup(key, rate, time.Now())
+	if ok {
+		return lctx, nil
+	}
+
+	generation := atomic.LoadUint64(&store.generation)
+	lctx, err := store.store.Get(ctx, key, rate)
+	if err != nil {
+		return lctx, err
+	}
+
+	if lctx.Reached {
+		store.save(key, rate, lctx, generation)
+	}
+
+	return lctx, nil
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	lctx, ok := store.lookup(key, rate, time.Now())
+	if ok {
+		return lctx, nil
+	}
+
+	return store.store.Peek(ctx, key, rate)
+}
+
+// Reset returns the limit for given identifier which is set to zero, and clears its cached denials on every
+// instance. If the broadcast fails, the counter has been reset, but other instances still deny the key until the
+// reset time of their cached denial.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	lctx, err := store.store.Reset(ctx, key, rate)
+	if err != nil {
+		return lctx, err
+	}
+
+	store.invalidate(key)
+
+	if store.broadcaster != nil {
+		err = store.broadcaster.Publish(ctx, key)
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return lctx, errors.Wrap(err, "negcache: unable to broadcast reset")
+		}
+	}
+
+	return lctx, nil
+}
+
+// Close stops receiving resets, and closes the wrapped store if it implements io.Closer.
+func (store *Store) Close() error {
+	var err error
+
+	store.closeOnce.Do(func() {
+		atomic.StoreUint32(&store.closed, 1)
+		close(store.stop)
+		<-store.done
+
+		if store.unsubscribe != nil {
+			store.unsubscribe()
+		}
+		if closer, ok := store.store.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+
+	return err
+}
+
+// Closed returns true if the store has been closed.
+func (store *Store) Closed() bool {
+	return atomic.LoadUint32(&store.closed) != 0
+}
+
+// Ping returns an error if the wrapped store is unable to serve requests, or if the store has been closed.
+func (store *Store) Ping(ctx context.Context) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+
+	if pinger, ok := store.store.(limiter.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Stats returns the number of keys with cached denials, the number of expired denials removed from the cache, and
+// the number of failed operations on the wrapped store and on the broadcaster.
+func (store *Store) Stats() limiter.StoreStats {
+	store.mutex.RLock()
+	keys := int64(len(store.denials))
+	store.mutex.RUnlock()
+
+	errors := atomic.LoadInt64(&store.errors)
+	if reporter, ok := store.store.(limiter.StatsReporter); ok {
+		errors += reporter.Stats().Errors
+	}
+
+	return limiter.StoreStats{
+		Keys:    keys,
+		Evicted: atomic.LoadInt64(&store.evicted),
+		Errors:  errors,
+	}
+}
+
+// lookup returns the cached denial of given identifier and rate, if it has not expired.
+func (store *Store) lookup(key string, rate limiter.Rate, now time.Time) (limiter.Context, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	lctx, ok := store.denials[key][rateKey{limit: rate.Limit, period: rate.Period}]
+	if !ok || !now.Before(time.Unix(lctx.Reset, 0)) {
+		return limiter.Context{}, false
+	}
+	return lctx, true
+}
+
+// save caches given denial until its reset time, unless a denial has been invalidated since given generation.
+func (store *Store) save(key string, rate limiter.Rate, lctx limiter.Context, generation uint64) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if atomic.LoadUint64(&store.generation) != generation {
+		return
+	}
+
+	denials, ok := store.denials[key]
+	if !ok {
+		denials = map[rateKey]limiter.Context{}
+		store.denials[key] = denials
+	}
+	denials[rateKey{limit: rate.Limit, period: rate.Period}] = lctx
+}
+
+// invalidate removes the cached denials of given identifier.
+func (store *Store) invalidate(key string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	atomic.AddUint64(&store.generation, 1)
+	delete(store.denials, key)
+}
+
+// clean removes expired denials.
+func (store *Store) clean(now time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for key, denials := range store.denials {
+		for rate, lctx := range denials {
+			if !now.Before(time.Unix(lctx.Reset, 0)) {
+				delete(denials, rate)
+				atomic.AddInt64(&store.evicted, 1)
+			}
+		}
+		if len(denials) == 0 {
+			delete(store.denials, key)
+		}
+	}
+}
+
+// run removes expired denials every interval, until the store is closed.
+func (store *Store) run(interval time.Duration) {
+	defer close(store.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			store.clean(now)
+		case <-store.stop:
+			return
+		}
+	}
+}
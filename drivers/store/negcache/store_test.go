@@ -0,0 +1,235 @@
+package negcache_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/memory"
+	"github.com/panii/limiter/v3/drivers/store/negcache"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestNegcacheStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := negcache.NewStore(newCountingStore(), negcache.NewLocalBroadcaster())
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestNegcacheStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := negcache.NewStore(newCountingStore(), negcache.NewLocalBroadcaster())
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestNegcacheStoreDenials(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 3, Period: time.Minute}
+
+	inner := newCountingStore()
+	store, err := negcache.NewStore(inner, nil)
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	for i := 1; i <= 10; i++ {
+		lctx, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+		is.Equal(i > 3, lctx.Reached)
+	}
+
+	// Once denied, the key is no longer sent to the wrapped store.
+	is.Equal(int64(4), inner.Calls())
+
+	lctx, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.True(lctx.Reached)
+	is.Equal(int64(4), inner.Calls())
+
+	// Denials are cached by rate.
+	lctx, err = store.Get(ctx, "foo", limiter.Rate{Limit: 100, Period: time.Minute})
+	is.NoError(err)
+	is.False(lctx.Reached)
+	is.Equal(int64(5), inner.Calls())
+
+	is.Equal(int64(1), store.(limiter.StatsReporter).Stats().Keys)
+}
+
+func TestNegcacheStoreConcurrentReset(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 1, Period: time.Minute}
+
+	inner := newCountingStore()
+	store, err := negcache.NewStore(inner, nil)
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	// The key is reset after the wrapped store has denied it, but before the denial is cached.
+	inner.onGet = func() {
+		inner.onGet = nil
+		_, err := store.Reset(ctx, "foo", rate)
+		is.NoError(err)
+	}
+
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.True(lctx.Reached)
+
+	// The denial hasn't been cached.
+	lctx, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.False(lctx.Reached)
+	is.Equal(int64(3), inner.Calls())
+}
+
+func TestNegcacheStoreExpiration(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 1, Period: 2 * time.Second}
+
+	inner := newCountingStore()
+	store, err := negcache.NewStoreWithOptions(inner, negcache.Options{
+		CleanUpInterval: 100 * time.Millisecond,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	for i := 0; i < 5; i++ {
+		_, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	is.Equal(int64(2), inner.Calls())
+
+	// Denials expire at the reset time of their window.
+	time.Sleep(3 * time.Second)
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.False(lctx.Reached)
+	is.Equal(int64(3), inner.Calls())
+
+	stats := store.(limiter.StatsReporter).Stats()
+	is.Equal(int64(0), stats.Keys)
+	is.Equal(int64(1), stats.Evicted)
+}
+
+func TestNegcacheStoreBroadcast(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 2, Period: time.Minute}
+
+	inner := newCountingStore()
+	broadcaster := negcache.NewLocalBroadcaster()
+
+	first, err := negcache.NewStore(inner, broadcaster)
+	is.NoError(err)
+	defer tests.CloseStore(t, first)
+
+	second, err := negcache.NewStore(inner, broadcaster)
+	is.NoError(err)
+	defer tests.CloseStore(t, second)
+
+	for i := 0; i < 3; i++ {
+		_, err = first.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	lctx, err := second.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.True(lctx.Reached)
+	calls := inner.Calls()
+
+	// A reset on one instance clears the denials cached by every instance.
+	_, err = first.Reset(ctx, "foo", rate)
+	is.NoError(err)
+
+	lctx, err = second.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.False(lctx.Reached)
+	is.Equal(calls+1, inner.Calls())
+}
+
+func TestNegcacheStoreBroadcastError(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 1, Period: time.Minute}
+
+	store, err := negcache.NewStore(newCountingStore(), failingBroadcaster{})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	_, err = store.Reset(ctx, "foo", rate)
+	is.Error(err)
+	is.Equal(int64(1), store.(limiter.StatsReporter).Stats().Errors)
+
+	// The local denial is cleared anyway.
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.False(lctx.Reached)
+}
+
+// countingStore is a memory store which counts the requests it has served.
+type countingStore struct {
+	limiter.Store
+	calls int64
+	// onGet is called after each request served by Get, if it's defined.
+	onGet func()
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{
+		Store: memory.NewStoreWithOptions(limiter.StoreOptions{
+			Prefix:          "limiter:negcache:test",
+			CleanUpInterval: 30 * time.Second,
+		}),
+	}
+}
+
+func (store *countingStore) Calls() int64 {
+	return atomic.LoadInt64(&store.calls)
+}
+
+func (store *countingStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	atomic.AddInt64(&store.calls, 1)
+	lctx, err := store.Store.Get(ctx, key, rate)
+	if store.onGet != nil {
+		store.onGet()
+	}
+	return lctx, err
+}
+
+func (store *countingStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	atomic.AddInt64(&store.calls, 1)
+	return store.Store.Peek(ctx, key, rate)
+}
+
+// failingBroadcaster is a broadcaster which is unable to publish.
+type failingBroadcaster struct{}
+
+func (failingBroadcaster) Publish(ctx context.Context, key string) error {
+	return errors.New("connection refused")
+}
+
+func (failingBroadcaster) Subscribe(handler func(key string)) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	libredis "github.com/go-redis/redis/v8"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+)
+
+// Pipeliner is implemented by redis clients which are able to pipeline commands, such as *libredis.Client,
+// *libredis.ClusterClient and *libredis.Ring.
+type Pipeliner interface {
+	Pipeline() libredis.Pipeliner
+}
+
+// GetMulti returns the limit of every request, in order.
+// If the client implements Pipeliner, every request is sent in a single round trip. Otherwise, requests are sent
+// one by one.
+func (store *Store) GetMulti(ctx context.Context, requests []limiter.Request) ([]limiter.Context, error) {
+	client, ok := store.client.(Pipeliner)
+	if !ok {
+		contexts := make([]limiter.Context, len(requests))
+		for i := range requests {
+			lctx, err := store.Get(ctx, requests[i].Key, requests[i].Rate)
+			if err != nil {
+				return nil, err
+			}
+			contexts[i] = lctx
+		}
+		return contexts, nil
+	}
+
+	cmds := store.pipelineIncr(ctx, client, requests)
+
+	// On a cluster or a ring, only some nodes may have lost their scripts: only their commands are sent again, since
+	// the other ones have already been counted.
+	retries := []int{}
+	for i := range cmds {
+		if cmds[i].Err() != nil && isLuaScriptGone(cmds[i].Err()) {
+			retries = append(retries, i)
+		}
+	}
+	if len(retries) > 0 {
+		err := store.reloadLuaScripts(ctx)
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return nil, err
+		}
+
+		retried := make([]limiter.Request, len(retries))
+		for j, i := range retries {
+			retried[j] = requests[i]
+		}
+		for j, cmd := range store.pipelineIncr(ctx, client, retried) {
+			cmds[retries[j]] = cmd
+		}
+	}
+
+	contexts := make([]limiter.Context, len(requests))
+	for i := range cmds {
+		count, ttl, now, err := parseState(cmds[i])
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return nil, err
+		}
+
+		expiration := now.Add(requests[i].Rate.Period)
+		if ttl > 0 {
+			expiration = now.Add(time.Duration(ttl) * time.Millisecond)
+		}
+
+		contexts[i] = common.GetContextFromState(now, requests[i].Rate, expiration, count)
+	}
+
+	return contexts, nil
+}
+
+// pipelineIncr sends the "incr" lua script for every request in a pipeline.
+// Errors are reported by each command.
+func (store *Store) pipelineIncr(ctx context.Context, client Pipeliner, requests []limiter.Request) []*libredis.Cmd {
+	sha := store.getLuaIncrSHA()
+	pipe := client.Pipeline()
+
+	// Keys are queued until the pipeline is executed: they are built in the same buffer, released afterwards.
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	cmds := make([]*libredis.Cmd, len(requests))
+	for i := range requests {
+		key := store.key(buffer, requests[i].Key)
+		cmds[i] = pipe.EvalSha(ctx, sha, []string{key}, store.incrArgs(requests[i].Rate.Period)...)
+	}
+
+	_, _ = pipe.Exec(ctx)
+	return cmds
+}
+
+// pipelinePeek sends the "peek" lua script for every given redis key in a pipeline.
+// Errors are reported by each command.
+func (store *Store) pipelinePeek(ctx context.Context, client Pipeliner, names []string) []*libredis.Cmd {
+	sha := store.getLuaPeekSHA()
+	pipe := client.Pipeline()
+
+	cmds := make([]*libredis.Cmd, len(names))
+	for i := range names {
+		cmds[i] = pipe.EvalSha(ctx, sha, []string{names[i]})
+	}
+
+	_, _ = pipe.Exec(ctx)
+	return cmds
+}
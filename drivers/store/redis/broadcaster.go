@@ -0,0 +1,74 @@
+package redis
+
+import (
+	"context"
+
+	libredis "github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// DefaultBroadcastChannel is the default pub/sub channel used to broadcast resets.
+const DefaultBroadcastChannel = "limiter:reset"
+
+// PubSubClient is an interface thats allows to use a redis cluster or a redis single client seamlessly for pub/sub.
+type PubSubClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *libredis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *libredis.PubSub
+}
+
+// Broadcaster sends keys to every instance through a redis pub/sub channel, such as resets for the negcache store.
+//
+// Pub/sub delivery is at most once: keys published while a subscriber is disconnected are lost.
+type Broadcaster struct {
+	// client used to communicate with redis server.
+	client PubSubClient
+	// channel used to publish keys.
+	channel string
+}
+
+// NewBroadcaster returns a broadcaster using given pub/sub channel, or DefaultBroadcastChannel if it's empty.
+func NewBroadcaster(client PubSubClient, channel string) *Broadcaster {
+	if channel == "" {
+		channel = DefaultBroadcastChannel
+	}
+
+	return &Broadcaster{
+		client:  client,
+		channel: channel,
+	}
+}
+
+// Publish sends given key to every subscriber.
+func (broadcaster *Broadcaster) Publish(ctx context.Context, key string) error {
+	err := broadcaster.client.Publish(ctx, broadcaster.channel, key).Err()
+	if err != nil {
+		return errors.Wrap(err, "unable to publish on redis channel")
+	}
+	return nil
+}
+
+// Subscribe calls given handler with every key published on the channel, until unsubscribe is called.
+// The subscription is confirmed by redis server before returning.
+func (broadcaster *Broadcaster) Subscribe(handler func(key string)) (func(), error) {
+	ctx := context.Background()
+
+	pubsub := broadcaster.client.Subscribe(ctx, broadcaster.channel)
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		_ = pubsub.Close()
+		return nil, errors.Wrap(err, "unable to subscribe to redis channel")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for message := range pubsub.Channel() {
+			handler(message.Payload)
+		}
+	}()
+
+	return func() {
+		_ = pubsub.Close()
+		<-done
+	}, nil
+}
@@ -0,0 +1,60 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/negcache"
+	"github.com/panii/limiter/v3/drivers/store/redis"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestRedisBroadcaster(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 1, Period: time.Minute}
+
+	client, err := newRedisClient()
+	is.NoError(err)
+	is.NotNil(client)
+
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:broadcaster-test",
+	})
+	is.NoError(err)
+
+	var broadcaster negcache.Broadcaster = redis.NewBroadcaster(client, "limiter:redis:broadcaster-test")
+
+	first, err := negcache.NewStore(store, broadcaster)
+	is.NoError(err)
+	defer tests.CloseStore(t, first)
+
+	second, err := negcache.NewStore(store, broadcaster)
+	is.NoError(err)
+	defer tests.CloseStore(t, second)
+
+	_, err = first.Reset(ctx, "foo", rate)
+	is.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = second.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+
+	lctx, err := second.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.True(lctx.Reached)
+
+	// The reset is received by the second instance through the redis channel.
+	_, err = first.Reset(ctx, "foo", rate)
+	is.NoError(err)
+
+	is.Eventually(func() bool {
+		lctx, err := second.Peek(ctx, "foo", rate)
+		return err == nil && !lctx.Reached
+	}, time.Second, 10*time.Millisecond)
+}
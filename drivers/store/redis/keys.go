@@ -0,0 +1,41 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+)
+
+// key returns the redis key of given identifier, built in given pooled buffer.
+//
+// With the default layout, keys are built as "prefix:identifier".
+// With hash tags, keys are built as "prefix:{identifier}": Redis Cluster only hashes the content of the first hash
+// tag to find the slot of a key, so the slot of a key only depends on its identifier, whatever the prefix, and every
+// key of an identifier is stored in the same slot. The prefix can't contain any brace, otherwise every key would be
+// stored in the same slot: it's rejected by NewStoreWithOptions.
+func (store *Store) key(buffer *bytebuffer.ByteBuffer, identifier string) string {
+	// The key is appended to the buffer, so several keys can be built in the same buffer: each one is only valid
+	// until the buffer is closed.
+	start := len(buffer.Bytes())
+	if !store.HashTag {
+		buffer.Concat(store.Prefix, ":", identifier)
+	} else {
+		buffer.Concat(store.Prefix, ":{", hashTag(identifier), "}")
+	}
+
+	return buffer.String()[start:]
+}
+
+// hashTag returns the content of the hash tag of given identifier.
+// An empty hash tag, or a closing brace which would end it early, is ignored by Redis Cluster: such identifiers
+// are replaced by their SHA-1 digest.
+func hashTag(identifier string) string {
+	if identifier != "" && !strings.Contains(identifier, "}") {
+		return identifier
+	}
+
+	hash := sha1.Sum([]byte(identifier))
+	return "sha1:" + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,106 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+	"github.com/panii/limiter/v3/internal/race"
+)
+
+func TestStoreKeyLayout(t *testing.T) {
+	is := require.New(t)
+
+	store := &Store{Prefix: "limiter"}
+	is.Equal("limiter:foo", buildKey(store, "foo"))
+	is.Equal("limiter:192.168.1.1", buildKey(store, "192.168.1.1"))
+
+	store.HashTag = true
+	is.Equal("limiter:{foo}", buildKey(store, "foo"))
+	is.Equal("limiter:{192.168.1.1}", buildKey(store, "192.168.1.1"))
+}
+
+func TestStoreKeyAllocations(t *testing.T) {
+	if race.Enabled {
+		t.Skip("allocations are not reliable with the race detector")
+	}
+	is := require.New(t)
+
+	for _, store := range []*Store{{Prefix: "limiter"}, {Prefix: "limiter", HashTag: true}} {
+		allocs := testing.AllocsPerRun(100, func() {
+			buffer := bytebuffer.New()
+			_ = store.key(buffer, "192.168.1.1")
+			buffer.Close()
+		})
+		is.Zero(allocs)
+	}
+
+	// Keys built in the same buffer are not overwritten by the next ones.
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	store := &Store{Prefix: "limiter"}
+	keys := []string{store.key(buffer, "foo"), store.key(buffer, "bar")}
+	is.Equal([]string{"limiter:foo", "limiter:bar"}, keys)
+}
+
+func TestStoreKeySlots(t *testing.T) {
+	is := require.New(t)
+
+	store := &Store{Prefix: "limiter", HashTag: true}
+	identifiers := []string{"foo", "192.168.1.1", "2001:db8::1", "", "}foo", "a{b}c", "{}", "user:42"}
+
+	// The slot of a key only depends on its identifier.
+	for _, identifier := range identifiers {
+		slot := keySlot(buildKey(store, identifier))
+		for _, prefix := range []string{"", "second", "limiter:minute", "app:limiter"} {
+			other := &Store{Prefix: prefix, HashTag: true}
+			is.Equal(slot, keySlot(buildKey(other, identifier)), "identifier %q", identifier)
+		}
+	}
+
+	// Different identifiers are still spread over slots.
+	is.NotEqual(keySlot(buildKey(store, "foo")), keySlot(buildKey(store, "bar")))
+}
+
+// keySlot returns the Redis Cluster slot of given key.
+func keySlot(key string) uint16 {
+	for i := 0; i < len(key); i++ {
+		if key[i] != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j > i+1 {
+					key = key[i+1 : j]
+				}
+				return crc16(key) % 16384
+			}
+		}
+		break
+	}
+	return crc16(key) % 16384
+}
+
+// crc16 returns the CRC-16/XMODEM checksum of given key, as used by Redis Cluster.
+func crc16(key string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// buildKey returns the redis key of given identifier, copied out of its pooled buffer.
+func buildKey(store *Store, identifier string) string {
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	return string(append([]byte(nil), store.key(buffer, identifier)...))
+}
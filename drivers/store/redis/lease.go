@@ -0,0 +1,532 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+)
+
+const (
+	// DefaultMaxLease is the default maximum number of units leased at once for a key.
+	DefaultMaxLease = 100
+	// DefaultLeaseInterval is the default maximum duration of a lease.
+	DefaultLeaseInterval = time.Second
+)
+
+// LeaseOptions are options for lease store.
+type LeaseOptions struct {
+	// MaxLease is the maximum number of units leased at once for a key.
+	// It's also the bound of over-admission per instance and key, see LeaseStore.
+	MaxLease int64
+	// LeaseInterval is the maximum duration of a lease: unused units of a lease are given back to redis once it
+	// has elapsed, so an idle instance doesn't hold units needed by other instances.
+	// Lease sizes adapt so a lease lasts about this duration.
+	LeaseInterval time.Duration
+	// StoreOptions are the options of the underlying redis store.
+	StoreOptions limiter.StoreOptions
+}
+
+// LeaseStore is a redis store which leases units of a counter to serve requests locally.
+//
+// Instead of incrementing the counter on every request, an instance increments it by N at once, and then serves the
+// next N requests for this key from memory. Each leased unit is numbered by the counter, so a request is allowed
+// only if its unit is within the limit: leasing doesn't allow more requests than the redis store does.
+//
+// A lease ends with its window, or after LeaseInterval. Unused units of an ended lease are given back to the counter
+// by a timer, unless its window has rolled over, and the lease is removed at the end of its window. The size of the
+// next lease adapts to the traffic of the key: it doubles when a lease is used in less than half of LeaseInterval,
+// and it shrinks to the number of units used otherwise.
+// Once a request has been denied, next requests are denied locally until the lease ends.
+//
+// Over-admission only happens when a counter is lost before the end of its window, such as after a Reset on another
+// instance or a failover of the redis server: units already leased by other instances are still used. It's bounded
+// by MaxLease units per instance and key. Besides, a lease may be used for one network round trip after its window
+// has ended on the redis server, since its expiration is computed when the response is received.
+type LeaseStore struct {
+	// errors is the number of failed operations on redis server.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// closed is set to one when the store has been closed.
+	closed uint32
+	// Prefix used for the key.
+	Prefix string
+	// store is used to run lua scripts on redis server.
+	store *Store
+	// maxLease is the maximum number of units leased at once.
+	maxLease int64
+	// interval is the maximum duration of a lease.
+	interval time.Duration
+	// mutex is used to access leases.
+	mutex sync.Mutex
+	// leases contains the lease of every key.
+	leases map[string]*lease
+	// closeOnce is used to close the store only once.
+	closeOnce sync.Once
+}
+
+// lease contains units of a counter leased by this instance.
+type lease struct {
+	mutex sync.Mutex
+	// removed is true once the lease has been removed from the store.
+	removed bool
+	// pending is closed once the redis commands renewing the lease, or giving back its unused units, have completed.
+	pending chan struct{}
+	// timer ends the lease at its deadline, and removes it at the end of its window.
+	timer *time.Timer
+	// size is the number of units of the next lease.
+	size int64
+	// count is the value of the counter returned by redis for this lease, which is the number of its last unit.
+	count int64
+	// granted is the number of units of this lease.
+	granted int64
+	// used is the number of units used by this instance.
+	used int64
+	// start is the time this lease has been taken.
+	start time.Time
+	// deadline is the time this lease ends.
+	deadline time.Time
+	// expiration is the end of the window of the counter, on the local clock.
+	expiration time.Time
+	// skew is the offset of the clock of redis server, with ServerTime.
+	skew time.Duration
+}
+
+// NewLeaseStore returns an instance of lease store with defaults.
+func NewLeaseStore(client Client) (limiter.Store, error) {
+	return NewLeaseStoreWithOptions(client, LeaseOptions{
+		StoreOptions: limiter.StoreOptions{
+			Prefix:          limiter.DefaultPrefix,
+			CleanUpInterval: limiter.DefaultCleanUpInterval,
+			MaxRetry:        limiter.DefaultMaxRetry,
+		},
+	})
+}
+
+// NewLeaseStoreWithOptions returns an instance of lease store with options.
+// Zero values use the defaults.
+func NewLeaseStoreWithOptions(client Client, options LeaseOptions) (limiter.Store, error) {
+	if options.MaxLease <= 0 {
+		options.MaxLease = DefaultMaxLease
+	}
+	if options.LeaseInterval <= 0 {
+		options.LeaseInterval = DefaultLeaseInterval
+	}
+
+	store, err := NewStoreWithOptions(client, options.StoreOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseStore := &LeaseStore{
+		Prefix:   options.StoreOptions.Prefix,
+		store:    store.(*Store),
+		maxLease: options.MaxLease,
+		interval: options.LeaseInterval,
+		leases:   map[string]*lease{},
+	}
+
+	return leaseStore, nil
+}
+
+// Get returns the limit for given identifier.
+func (store *LeaseStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	for {
+		entry := store.lock(key)
+
+		now := time.Now()
+		if now.Before(entry.deadline) {
+			if entry.used < entry.granted {
+				entry.used++
+				lctx := common.GetContextFromState(now, rate, entry.expiration.Add(entry.skew),
+					entry.count-entry.granted+entry.used)
+				entry.mutex.Unlock()
+				return lctx, nil
+			}
+			if entry.count > rate.Limit {
+				lctx := common.GetContextFromState(now, rate, entry.expiration.Add(entry.skew), entry.count+1)
+				entry.mutex.Unlock()
+				return lctx, nil
+			}
+		}
+
+		if entry.pending == nil {
+			return store.renew(ctx, key, entry, rate, now)
+		}
+
+		// Another request is renewing this lease: wait for the new lease instead of taking another one.
+		pending := entry.pending
+		entry.mutex.Unlock()
+
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			return limiter.Context{}, ctx.Err()
+		}
+	}
+}
+
+// renew gives back unused units of the lease of given identifier, and takes a new lease.
+// Redis commands are sent without holding the mutex of the lease: concurrent requests wait for them to complete.
+// WARNING: the mutex of the lease must be held by the caller, and it's released.
+func (store *LeaseStore) renew(ctx context.Context, key string, entry *lease, rate limiter.Rate,
+	now time.Time) (limiter.Context, error) {
+
+	unused, maxTTL := entry.giveBack(now)
+	size := entry.next(now, rate, store.maxLease, store.interval)
+
+	pending := make(chan struct{})
+	entry.pending = pending
+	entry.mutex.Unlock()
+
+	var count, ttl int64
+	var serverNow time.Time
+
+	err := store.release(ctx, key, unused, maxTTL)
+	if err == nil {
+		count, ttl, serverNow, err = store.take(ctx, key, size, rate.Period)
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.pending = nil
+	close(pending)
+
+	if err != nil {
+		return limiter.Context{}, err
+	}
+
+	// Leases are bookkept on the local clock, and contexts are shifted to the clock of redis server.
+	now = time.Now()
+	expiration := now.Add(rate.Period)
+	if ttl > 0 {
+		expiration = now.Add(time.Duration(ttl) * time.Millisecond)
+	}
+
+	entry.count = count
+	entry.granted = size
+	entry.used = 1
+	entry.start = now
+	entry.expiration = expiration
+	entry.skew = 0
+	if store.store.ServerTime {
+		entry.skew = serverNow.Sub(now)
+	}
+	entry.deadline = now.Add(store.interval)
+	if entry.deadline.After(expiration) {
+		entry.deadline = expiration
+	}
+	store.schedule(key, entry, entry.deadline)
+
+	return common.GetContextFromState(now, rate, expiration.Add(entry.skew), count-size+1), nil
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+// Units leased by this instance but not used yet are not counted.
+func (store *LeaseStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	cmd := store.store.evalSHA(ctx, store.store.getLuaPeekSHA, []string{store.store.key(buffer, key)})
+	count, ttl, now, err := parseState(cmd)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return limiter.Context{}, err
+	}
+
+	expiration := now.Add(rate.Period)
+	if ttl > 0 {
+		expiration = now.Add(time.Duration(ttl) * time.Millisecond)
+	}
+
+	store.mutex.Lock()
+	entry, ok := store.leases[key]
+	store.mutex.Unlock()
+
+	if ok {
+		entry.mutex.Lock()
+		if time.Now().Before(entry.expiration) {
+			count -= entry.granted - entry.used
+		}
+		entry.mutex.Unlock()
+	}
+
+	return common.GetContextFromState(now, rate, expiration, count), nil
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+// Units leased by other instances are still used by them, until their lease ends.
+func (store *LeaseStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	store.mutex.Lock()
+	entry, ok := store.leases[key]
+	if ok {
+		delete(store.leases, key)
+	}
+	store.mutex.Unlock()
+
+	if ok {
+		entry.mutex.Lock()
+		entry.removed = true
+		entry.mutex.Unlock()
+	}
+
+	return store.store.Reset(ctx, key, rate)
+}
+
+// Close gives back unused units of every lease, and stops their timers.
+// The store doesn't own its client, so it's up to the caller to close it.
+func (store *LeaseStore) Close() error {
+	var err error
+
+	store.closeOnce.Do(func() {
+		atomic.StoreUint32(&store.closed, 1)
+		err = store.releaseAll(context.Background())
+	})
+
+	return err
+}
+
+// Closed returns true if the store has been closed.
+func (store *LeaseStore) Closed() bool {
+	return atomic.LoadUint32(&store.closed) != 0
+}
+
+// Ping returns an error if redis server is unreachable, or if the store has been closed.
+func (store *LeaseStore) Ping(ctx context.Context) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+	return store.store.Ping(ctx)
+}
+
+// Stats returns the number of keys leased by this instance and the number of failed operations on redis server.
+func (store *LeaseStore) Stats() limiter.StoreStats {
+	store.mutex.Lock()
+	keys := int64(len(store.leases))
+	store.mutex.Unlock()
+
+	return limiter.StoreStats{
+		Keys:    keys,
+		Evicted: -1,
+		Errors:  atomic.LoadInt64(&store.errors) + store.store.Stats().Errors,
+	}
+}
+
+// lock returns the locked lease of given identifier, creating it if needed.
+func (store *LeaseStore) lock(key string) *lease {
+	for {
+		store.mutex.Lock()
+		entry, ok := store.leases[key]
+		if !ok {
+			entry = &lease{size: 1}
+			store.leases[key] = entry
+		}
+		store.mutex.Unlock()
+
+		entry.mutex.Lock()
+		if !entry.removed {
+			return entry
+		}
+		entry.mutex.Unlock()
+	}
+}
+
+// take increments the counter of given identifier by given number of units, and returns its state.
+func (store *LeaseStore) take(ctx context.Context, key string, size int64,
+	period time.Duration) (int64, int64, time.Time, error) {
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	cmd := store.store.evalSHA(ctx, store.store.getLuaIncrSHA, []string{store.store.key(buffer, key)},
+		size, period.Milliseconds())
+	count, ttl, now, err := parseState(cmd)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+	}
+
+	return count, ttl, now, err
+}
+
+// release gives back given number of unused units of a lease of given identifier, unless the window of its counter
+// has rolled over, which is detected with given maximum TTL, in milliseconds.
+func (store *LeaseStore) release(ctx context.Context, key string, unused int64, maxTTL int64) error {
+	if unused <= 0 {
+		return nil
+	}
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	err := store.store.evalSHA(ctx, store.store.getLuaReleaseSHA, []string{store.store.key(buffer, key)},
+		unused, maxTTL).Err()
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return errors.Wrap(err, "an error has occurred with redis command")
+	}
+
+	return nil
+}
+
+// releaseAll gives back unused units of every lease, and stops their timers.
+func (store *LeaseStore) releaseAll(ctx context.Context) error {
+	store.mutex.Lock()
+	keys := make([]string, 0, len(store.leases))
+	entries := make([]*lease, 0, len(store.leases))
+	for key, entry := range store.leases {
+		keys = append(keys, key)
+		entries = append(entries, entry)
+	}
+	store.mutex.Unlock()
+
+	var err error
+	now := time.Now()
+
+	for i, entry := range entries {
+		entry.mutex.Lock()
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		unused, maxTTL := entry.giveBack(now)
+		entry.mutex.Unlock()
+
+		releaseErr := store.release(ctx, keys[i], unused, maxTTL)
+		if releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}
+
+	return err
+}
+
+// schedule arms the timer of the lease of given identifier, which ends it at given time.
+// WARNING: the mutex of the lease must be held by the caller.
+func (store *LeaseStore) schedule(key string, entry *lease, at time.Time) {
+	delay := time.Until(at)
+	if entry.timer == nil {
+		entry.timer = time.AfterFunc(delay, func() {
+			store.end(key, entry)
+		})
+		return
+	}
+	entry.timer.Reset(delay)
+}
+
+// end is called by the timer of the lease of given identifier.
+// Once the lease has ended, its unused units are given back, and it's scheduled again at the end of the window of
+// its counter, when it's removed.
+func (store *LeaseStore) end(key string, entry *lease) {
+	if store.Closed() {
+		return
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	// A lease being renewed is scheduled again once renewed.
+	if entry.removed || entry.pending != nil {
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(entry.deadline):
+		store.schedule(key, entry, entry.deadline)
+		return
+	case !now.Before(entry.expiration):
+		store.mutex.Lock()
+		if store.leases[key] == entry {
+			delete(store.leases, key)
+		}
+		store.mutex.Unlock()
+		entry.removed = true
+		return
+	}
+
+	unused, maxTTL := entry.giveBack(now)
+	if unused > 0 {
+		pending := make(chan struct{})
+		entry.pending = pending
+		entry.mutex.Unlock()
+
+		_ = store.release(context.Background(), key, unused, maxTTL)
+
+		entry.mutex.Lock()
+		entry.pending = nil
+		close(pending)
+	}
+
+	store.schedule(key, entry, entry.expiration)
+}
+
+// giveBack marks the unused units of the lease as given back, unless its window has ended, and returns their number
+// and the maximum TTL, in milliseconds, of a counter in the same window.
+// WARNING: the mutex of the lease must be held by the caller.
+func (entry *lease) giveBack(now time.Time) (int64, int64) {
+	unused := entry.granted - entry.used
+	if unused <= 0 || !now.Before(entry.expiration) {
+		return 0, 0
+	}
+
+	// A counter of a later window has a TTL greater than the remaining time of this window by about a period:
+	// half a period is a safe bound to only release units in this window.
+	remaining := entry.expiration.Sub(now)
+	period := entry.expiration.Sub(entry.start)
+
+	entry.granted = entry.used
+	return unused, (remaining + period/2).Milliseconds()
+}
+
+// next adapts the size of the lease to the traffic of its key, and returns the number of units to lease.
+// WARNING: the mutex of the lease must be held by the caller.
+func (entry *lease) next(now time.Time, rate limiter.Rate, maxLease int64, interval time.Duration) int64 {
+	inWindow := now.Before(entry.expiration)
+
+	if inWindow && entry.granted > 0 {
+		if entry.used >= entry.granted && now.Sub(entry.start) < interval/2 {
+			entry.size *= 2
+		} else if entry.used < entry.size {
+			entry.size = entry.used
+		}
+	}
+
+	if entry.size > maxLease {
+		entry.size = maxLease
+	}
+	if entry.size < 1 {
+		entry.size = 1
+	}
+
+	// Don't lease more units than remaining in the window, so other instances get their share.
+	size := entry.size
+	if size > rate.Limit {
+		size = rate.Limit
+	}
+	if inWindow && rate.Limit-entry.count < size {
+		size = rate.Limit - entry.count
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	return size
+}
@@ -0,0 +1,272 @@
+package redis_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	libredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/redis"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestLeaseStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := redis.NewLeaseStoreWithOptions(newFakeClient(), redis.LeaseOptions{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:redis:lease-sequential-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestLeaseStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := redis.NewLeaseStoreWithOptions(newFakeClient(), redis.LeaseOptions{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:redis:lease-concurrent-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestLeaseStoreRoundTrips(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 100000, Period: time.Minute}
+
+	client := newFakeClient()
+	store, err := redis.NewLeaseStoreWithOptions(client, redis.LeaseOptions{
+		MaxLease: 64,
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:redis:lease-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	for i := 1; i <= 1000; i++ {
+		lctx, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+		is.Equal(int64(100000-i), lctx.Remaining)
+	}
+
+	// Leases grow from 1 to 64 units: 1+2+...+32 = 63, then 64 units per round trip.
+	is.Equal(6+15, client.Evals())
+
+	lctx, err := store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(100000-1000), lctx.Remaining)
+	is.Equal(int64(1), store.(limiter.StatsReporter).Stats().Keys)
+}
+
+func TestLeaseStoreRelease(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 1000, Period: time.Minute}
+
+	client := newFakeClient()
+	store, err := redis.NewLeaseStoreWithOptions(client, redis.LeaseOptions{
+		LeaseInterval: 50 * time.Millisecond,
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:redis:lease-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	for i := 0; i < 20; i++ {
+		_, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	is.True(client.Value("limiter:redis:lease-test:foo") > 20)
+
+	// Unused units are given back once the lease has ended.
+	time.Sleep(150 * time.Millisecond)
+	is.Equal(int64(20), client.Value("limiter:redis:lease-test:foo"))
+
+	// The next lease is sized on the units used by the previous one: 16 units leased, 5 used.
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(25), client.Value("limiter:redis:lease-test:foo"))
+
+	tests.CloseStore(t, store)
+	is.Equal(int64(21), client.Value("limiter:redis:lease-test:foo"))
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.Equal(limiter.ErrStoreClosed, err)
+}
+
+func TestLeaseStoreRenewal(t *testing.T) {
+	is := require.New(t)
+	rate := limiter.Rate{Limit: 1000, Period: time.Minute}
+
+	client := &slowClient{fakeClient: newFakeClient(), release: make(chan struct{})}
+	store, err := redis.NewLeaseStoreWithOptions(client, redis.LeaseOptions{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:redis:lease-test",
+		},
+	})
+	is.NoError(err)
+
+	done := make(chan error)
+	go func() {
+		_, err := store.Get(context.Background(), "foo", rate)
+		done <- err
+	}()
+
+	// The lease isn't locked while it's renewed: other requests wait for it, until their context is done.
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = store.Get(ctx, "foo", rate)
+	is.Equal(context.DeadlineExceeded, err)
+
+	close(client.release)
+	is.NoError(<-done)
+	tests.CloseStore(t, store)
+}
+
+func TestLeaseStoreWindow(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 1000, Period: 100 * time.Millisecond}
+
+	store, err := redis.NewLeaseStoreWithOptions(newFakeClient(), redis.LeaseOptions{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:redis:lease-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	for i := 0; i < 20; i++ {
+		_, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+
+	// Leases are removed at the end of their window, and leased units are not used afterwards.
+	time.Sleep(120 * time.Millisecond)
+	is.Equal(int64(0), store.(limiter.StatsReporter).Stats().Keys)
+
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(999), lctx.Remaining)
+}
+
+func TestLeaseStoreInstances(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 500, Period: time.Minute}
+
+	client := newFakeClient()
+	stores := make([]limiter.Store, 4)
+	for i := range stores {
+		store, err := redis.NewLeaseStoreWithOptions(client, redis.LeaseOptions{
+			MaxLease: 32,
+			StoreOptions: limiter.StoreOptions{
+				Prefix: "limiter:redis:lease-test",
+			},
+		})
+		is.NoError(err)
+		defer tests.CloseStore(t, store)
+		stores[i] = store
+	}
+
+	allowed := int64(0)
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := range stores {
+		wg.Add(1)
+		go func(store limiter.Store) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				lctx, err := store.Get(ctx, "foo", rate)
+				is.NoError(err)
+				if !lctx.Reached {
+					mutex.Lock()
+					allowed++
+					mutex.Unlock()
+				}
+			}
+		}(stores[i])
+	}
+	wg.Wait()
+
+	// Leasing never allows more requests than the limit.
+	is.True(allowed <= rate.Limit, "%d requests allowed", allowed)
+	is.True(allowed > rate.Limit-4*32, "%d requests allowed", allowed)
+}
+
+func TestLeaseStoreOverAdmission(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 100, Period: time.Minute}
+	maxLease := int64(16)
+
+	client := newFakeClient()
+	options := redis.LeaseOptions{
+		MaxLease: maxLease,
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:redis:lease-test",
+		},
+	}
+
+	first, err := redis.NewLeaseStoreWithOptions(client, options)
+	is.NoError(err)
+	defer tests.CloseStore(t, first)
+
+	second, err := redis.NewLeaseStoreWithOptions(client, options)
+	is.NoError(err)
+	defer tests.CloseStore(t, second)
+
+	allowed := int64(0)
+	get := func(store limiter.Store) {
+		lctx, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+		if !lctx.Reached {
+			allowed++
+		}
+	}
+
+	for i := 0; i < 60; i++ {
+		get(first)
+	}
+
+	// A reset on another instance doesn't revoke units leased by the first one: they are over-admitted.
+	_, err = second.Reset(ctx, "foo", rate)
+	is.NoError(err)
+
+	for i := 0; i < 200; i++ {
+		get(first)
+		get(second)
+	}
+
+	is.True(allowed > rate.Limit)
+	is.True(allowed <= 60+rate.Limit+maxLease, "%d requests allowed", allowed)
+}
+
+// slowClient is a fake redis client whose scripts wait until release is closed.
+type slowClient struct {
+	*fakeClient
+	release chan struct{}
+}
+
+func (client *slowClient) EvalSha(ctx context.Context, sha string, keys []string,
+	args ...interface{}) *libredis.Cmd {
+
+	<-client.release
+	return client.fakeClient.EvalSha(ctx, sha, keys, args...)
+}
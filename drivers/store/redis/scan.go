@@ -0,0 +1,172 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	libredis "github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+)
+
+// scanCount is the number of keys requested by each SCAN command.
+const scanCount = 1000
+
+// ScanClient is implemented by redis clients which are able to iterate over keys, such as *libredis.Client.
+//
+// On Redis Cluster, SCAN only iterates over the keys of a single node: create a store for each master node
+// to scan every key.
+type ScanClient interface {
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *libredis.ScanCmd
+}
+
+// Scan returns a page of the keys whose identifier starts with given prefix, and the cursor of the next page, using
+// SCAN with a MATCH pattern. It requires a client implementing ScanClient.
+//
+// With hash tags, identifiers containing a closing brace are stored as a digest: they are returned as such, and
+// they can't be matched by a prefix.
+func (store *Store) Scan(ctx context.Context, prefix string, cursor uint64) ([]limiter.KeyInfo, uint64, error) {
+	client, ok := store.client.(ScanClient)
+	if !ok {
+		return nil, 0, errors.New("redis client doesn't support SCAN")
+	}
+
+	names, next, err := client.Scan(ctx, cursor, store.pattern(prefix), scanCount).Result()
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return nil, 0, errors.Wrap(err, "unable to scan redis keys")
+	}
+
+	cmds, err := store.peekAll(ctx, names)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return nil, 0, err
+	}
+
+	keys := make([]limiter.KeyInfo, 0, len(names))
+	for i, name := range names {
+		count, ttl, _, err := parseState(cmds[i])
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return nil, 0, err
+		}
+		if count == 0 && ttl == 0 {
+			// Key has expired since the scan.
+			continue
+		}
+
+		keys = append(keys, limiter.KeyInfo{
+			Key:   store.identifier(name),
+			Count: count,
+			TTL:   time.Duration(ttl) * time.Millisecond,
+		})
+	}
+
+	return keys, next, nil
+}
+
+// peekAll sends the "peek" lua script for every given redis key.
+// If the client implements Pipeliner, every key is peeked in a single round trip. Otherwise, keys are peeked one by
+// one.
+func (store *Store) peekAll(ctx context.Context, names []string) ([]*libredis.Cmd, error) {
+	client, ok := store.client.(Pipeliner)
+	if !ok {
+		cmds := make([]*libredis.Cmd, len(names))
+		for i := range names {
+			cmds[i] = store.evalSHA(ctx, store.getLuaPeekSHA, []string{names[i]})
+		}
+		return cmds, nil
+	}
+
+	cmds := store.pipelinePeek(ctx, client, names)
+
+	// Peeking doesn't change counters: every command is sent again if a node has lost its scripts.
+	for i := range cmds {
+		if cmds[i].Err() != nil && isLuaScriptGone(cmds[i].Err()) {
+			err := store.reloadLuaScripts(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return store.pipelinePeek(ctx, client, names), nil
+		}
+	}
+
+	return cmds, nil
+}
+
+// DeletePrefix deletes every key whose identifier starts with given prefix, and returns the number of deleted keys.
+// It requires a client implementing ScanClient.
+func (store *Store) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	client, ok := store.client.(ScanClient)
+	if !ok {
+		return 0, errors.New("redis client doesn't support SCAN")
+	}
+
+	pattern := store.pattern(prefix)
+	deleted := int64(0)
+	cursor := uint64(0)
+
+	for {
+		names, next, err := client.Scan(ctx, cursor, pattern, scanCount).Result()
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return deleted, errors.Wrap(err, "unable to scan redis keys")
+		}
+
+		// Keys are deleted one by one, since keys of a batch may be stored in different slots on Redis Cluster.
+		for _, name := range names {
+			count, err := store.client.Del(ctx, name).Result()
+			if err != nil {
+				atomic.AddInt64(&store.errors, 1)
+				return deleted, errors.Wrap(err, "unable to delete redis key")
+			}
+			deleted += count
+		}
+
+		if next == 0 {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+// pattern returns the SCAN pattern matching the keys whose identifier starts with given prefix.
+func (store *Store) pattern(prefix string) string {
+	builder := strings.Builder{}
+	builder.WriteString(escapePattern(store.Prefix))
+	builder.WriteByte(':')
+	if store.HashTag {
+		builder.WriteByte('{')
+	}
+	builder.WriteString(escapePattern(prefix))
+	builder.WriteByte('*')
+	return builder.String()
+}
+
+// identifier returns the identifier of given redis key, which is the reverse of key.
+func (store *Store) identifier(name string) string {
+	identifier := strings.TrimPrefix(name, store.Prefix+":")
+	if store.HashTag {
+		identifier = strings.TrimPrefix(identifier, "{")
+		if end := strings.IndexByte(identifier, '}'); end >= 0 {
+			identifier = identifier[:end]
+		}
+	}
+	return identifier
+}
+
+// escapePattern escapes special characters of a redis glob-style pattern.
+func escapePattern(value string) string {
+	builder := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '*', '?', '[', ']', '\\':
+			builder.WriteByte('\\')
+		}
+		builder.WriteByte(value[i])
+	}
+	return builder.String()
+}
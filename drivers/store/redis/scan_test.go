@@ -0,0 +1,73 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/redis"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestRedisStoreScanLayouts(t *testing.T) {
+	for _, hashTag := range []bool{false, true} {
+		is := require.New(t)
+
+		store, err := redis.NewStoreWithOptions(newFakeClient(), limiter.StoreOptions{
+			Prefix:  "limiter:redis:scan[test]",
+			HashTag: hashTag,
+		})
+		is.NoError(err)
+
+		tests.TestStoreScan(t, store)
+	}
+}
+
+func TestRedisStoreScanPipeline(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	client := &pipelineClient{fakeClient: newFakeClient(), lost: map[string]bool{}}
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:scan-pipeline-test",
+	})
+	is.NoError(err)
+
+	tests.TestStoreScan(t, store)
+
+	for _, key := range []string{"pipeline-a", "pipeline-b", "pipeline-c"} {
+		_, err = store.Get(ctx, key, rate)
+		is.NoError(err)
+	}
+
+	// Every key of a page is peeked in a single round trip, even if a node has lost its scripts.
+	client.Lose("limiter:redis:scan-pipeline-test:pipeline-b")
+	execs := client.execs
+
+	keys, next, err := store.(limiter.Scanner).Scan(ctx, "pipeline-", 0)
+	is.NoError(err)
+	is.Zero(next)
+	is.Len(keys, 3)
+	for i := range keys {
+		is.Equal(int64(1), keys[i].Count, keys[i].Key)
+	}
+	is.Equal(execs+2, client.execs)
+}
+
+func TestRedisStoreScanUnsupported(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	store, err := redis.NewStore(struct{ redis.Client }{newFakeClient()})
+	is.NoError(err)
+
+	_, _, err = store.(limiter.Scanner).Scan(ctx, "", 0)
+	is.Error(err)
+
+	_, err = store.(limiter.Scanner).DeletePrefix(ctx, "")
+	is.Error(err)
+}
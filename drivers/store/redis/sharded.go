@@ -0,0 +1,254 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+)
+
+// Shard is a redis server holding a part of the keys of a sharded store.
+type Shard struct {
+	// Name identifies the shard for consistent hashing, such as the server address.
+	// It must be unique and stable: renaming a shard moves its keys to other shards.
+	Name string
+	// Client used to communicate with the redis server of this shard.
+	Client Client
+}
+
+// shard is a shard with its own store, which loads lua scripts on its redis server.
+type shard struct {
+	name  string
+	seed  uint64
+	store *Store
+}
+
+// ShardedStore is a redis store which spreads keys over several redis servers.
+//
+// Keys are routed with rendezvous hashing: each key goes to the shard with the highest score for this key.
+// Adding a shard only moves the keys for which the new shard has the highest score, which is about 1/N of the keys
+// with N shards, and removing a shard only moves its own keys.
+type ShardedStore struct {
+	// Prefix used for the key.
+	Prefix string
+	// options are used to create the store of a new shard.
+	options limiter.StoreOptions
+	// mutex serializes changes of shards.
+	mutex sync.Mutex
+	// shards contains a []*shard, replaced on every change so routing is lock-free.
+	shards atomic.Value
+}
+
+// NewShardedStore returns an instance of sharded redis store with defaults.
+func NewShardedStore(shards []Shard) (limiter.Store, error) {
+	return NewShardedStoreWithOptions(shards, limiter.StoreOptions{
+		Prefix:          limiter.DefaultPrefix,
+		CleanUpInterval: limiter.DefaultCleanUpInterval,
+		MaxRetry:        limiter.DefaultMaxRetry,
+	})
+}
+
+// NewShardedStoreWithOptions returns an instance of sharded redis store with options.
+// Lua scripts are loaded on every shard.
+func NewShardedStoreWithOptions(shards []Shard, options limiter.StoreOptions) (limiter.Store, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("at least one redis shard is required")
+	}
+
+	store := &ShardedStore{
+		Prefix:  options.Prefix,
+		options: options,
+	}
+	store.shards.Store([]*shard{})
+
+	for i := range shards {
+		err := store.AddShard(shards[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// AddShard adds a redis server to the store, and loads lua scripts on it.
+// Counters of the keys moved to this shard start from zero.
+func (store *ShardedStore) AddShard(value Shard) error {
+	if value.Name == "" || value.Client == nil {
+		return errors.New("a redis shard requires a name and a client")
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current := store.load()
+	for i := range current {
+		if current[i].name == value.Name {
+			return errors.Errorf("redis shard %q already exists", value.Name)
+		}
+	}
+
+	shardStore, err := NewStoreWithOptions(value.Client, store.options)
+	if err != nil {
+		return errors.Wrapf(err, "cannot add redis shard %q", value.Name)
+	}
+
+	next := make([]*shard, 0, len(current)+1)
+	next = append(next, current...)
+	next = append(next, &shard{
+		name:  value.Name,
+		seed:  hashString(value.Name),
+		store: shardStore.(*Store),
+	})
+	store.shards.Store(next)
+
+	return nil
+}
+
+// RemoveShard removes a redis server from the store.
+// Its keys are moved to the remaining shards, and start from zero.
+func (store *ShardedStore) RemoveShard(name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current := store.load()
+	next := make([]*shard, 0, len(current))
+	for i := range current {
+		if current[i].name != name {
+			next = append(next, current[i])
+		}
+	}
+
+	if len(next) == len(current) {
+		return errors.Errorf("redis shard %q doesn't exist", name)
+	}
+	if len(next) == 0 {
+		return errors.New("cannot remove the last redis shard")
+	}
+
+	store.shards.Store(next)
+	return nil
+}
+
+// ShardFor returns the name of the shard holding given identifier.
+func (store *ShardedStore) ShardFor(key string) string {
+	return store.route(key).name
+}
+
+// Get returns the limit for given identifier.
+func (store *ShardedStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.route(key).store.Get(ctx, key, rate)
+}
+
+// GetMulti returns the limit of every request, in order.
+// Requests are grouped by shard, so each shard is called once.
+func (store *ShardedStore) GetMulti(ctx context.Context, requests []limiter.Request) ([]limiter.Context, error) {
+	groups := map[*shard][]int{}
+	for i := range requests {
+		target := store.route(requests[i].Key)
+		groups[target] = append(groups[target], i)
+	}
+
+	contexts := make([]limiter.Context, len(requests))
+	for target, indexes := range groups {
+		batch := make([]limiter.Request, len(indexes))
+		for i, index := range indexes {
+			batch[i] = requests[index]
+		}
+
+		results, err := target.store.GetMulti(ctx, batch)
+		if err != nil {
+			return nil, errors.Wrapf(err, "redis shard %q", target.name)
+		}
+
+		for i, index := range indexes {
+			contexts[index] = results[i]
+		}
+	}
+
+	return contexts, nil
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *ShardedStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.route(key).store.Peek(ctx, key, rate)
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+func (store *ShardedStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.route(key).store.Reset(ctx, key, rate)
+}
+
+// Ping returns an error if any redis server is unreachable.
+func (store *ShardedStore) Ping(ctx context.Context) error {
+	shards := store.load()
+	for i := range shards {
+		err := shards[i].store.Ping(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "redis shard %q", shards[i].name)
+		}
+	}
+	return nil
+}
+
+// Stats returns the number of failed operations on every redis server.
+func (store *ShardedStore) Stats() limiter.StoreStats {
+	stats := limiter.StoreStats{
+		Keys:    -1,
+		Evicted: -1,
+	}
+
+	shards := store.load()
+	for i := range shards {
+		stats.Errors += shards[i].store.Stats().Errors
+	}
+
+	return stats
+}
+
+// load returns the current shards.
+func (store *ShardedStore) load() []*shard {
+	return store.shards.Load().([]*shard)
+}
+
+// route returns the shard with the highest score for given identifier.
+func (store *ShardedStore) route(key string) *shard {
+	shards := store.load()
+	hash := hashString(store.Prefix + ":" + key)
+
+	best := shards[0]
+	bestScore := mixHash(hash ^ best.seed)
+	for i := 1; i < len(shards); i++ {
+		score := mixHash(hash ^ shards[i].seed)
+		if score > bestScore || (score == bestScore && shards[i].name < best.name) {
+			best = shards[i]
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+// hashString returns the 64-bit FNV-1a hash of given string.
+func hashString(value string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(value); i++ {
+		hash ^= uint64(value[i])
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// mixHash scrambles the bits of given hash, using the SplitMix64 finalizer, so scores of a key are independent
+// between shards.
+func mixHash(hash uint64) uint64 {
+	hash ^= hash >> 30
+	hash *= 0xbf58476d1ce4e5b9
+	hash ^= hash >> 27
+	hash *= 0x94d049bb133111eb
+	hash ^= hash >> 31
+	return hash
+}
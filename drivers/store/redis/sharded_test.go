@@ -0,0 +1,477 @@
+package redis_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	libredis "github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/redis"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestShardedStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := redis.NewShardedStoreWithOptions(newFakeShards(3), limiter.StoreOptions{
+		Prefix: "limiter:redis:sharded-sequential-test",
+	})
+	is.NoError(err)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestShardedStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := redis.NewShardedStoreWithOptions(newFakeShards(3), limiter.StoreOptions{
+		Prefix: "limiter:redis:sharded-concurrent-test",
+	})
+	is.NoError(err)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestShardedStoreBatchAccess(t *testing.T) {
+	is := require.New(t)
+
+	store, err := redis.NewShardedStoreWithOptions(newFakeShards(3), limiter.StoreOptions{
+		Prefix: "limiter:redis:sharded-batch-test",
+	})
+	is.NoError(err)
+
+	tests.TestStoreBatchAccess(t, store)
+}
+
+func TestShardedStoreDistribution(t *testing.T) {
+	is := require.New(t)
+
+	shards := newFakeShards(4)
+	store, err := redis.NewShardedStore(shards)
+	is.NoError(err)
+	sharded := store.(*redis.ShardedStore)
+
+	keys := 20000
+	counts := map[string]int{}
+	for i := 0; i < keys; i++ {
+		counts[sharded.ShardFor("192.168.0."+strconv.Itoa(i))]++
+	}
+
+	is.Len(counts, len(shards))
+	for name, count := range counts {
+		ratio := float64(count) / float64(keys)
+		is.True(ratio > 0.2 && ratio < 0.3, "shard %s holds %.2f of keys", name, ratio)
+	}
+}
+
+func TestShardedStoreRemapping(t *testing.T) {
+	is := require.New(t)
+
+	store, err := redis.NewShardedStore(newFakeShards(4))
+	is.NoError(err)
+	sharded := store.(*redis.ShardedStore)
+
+	keys := 20000
+	before := make([]string, keys)
+	for i := range before {
+		before[i] = sharded.ShardFor(strconv.Itoa(i))
+	}
+
+	is.NoError(sharded.AddShard(redis.Shard{Name: "shard-4", Client: newFakeClient()}))
+	is.Error(sharded.AddShard(redis.Shard{Name: "shard-4", Client: newFakeClient()}))
+
+	// Only keys moved to the new shard are remapped.
+	moved := 0
+	for i := range before {
+		after := sharded.ShardFor(strconv.Itoa(i))
+		if after != before[i] {
+			is.Equal("shard-4", after)
+			moved++
+		}
+	}
+	ratio := float64(moved) / float64(keys)
+	is.True(ratio > 0.15 && ratio < 0.25, "%.2f of keys have been moved", ratio)
+
+	// Removing the new shard restores the previous routing.
+	is.NoError(sharded.RemoveShard("shard-4"))
+	is.Error(sharded.RemoveShard("shard-4"))
+	for i := range before {
+		is.Equal(before[i], sharded.ShardFor(strconv.Itoa(i)))
+	}
+}
+
+func TestShardedStoreScriptReload(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	shards := newFakeShards(3)
+	store, err := redis.NewShardedStore(shards)
+	is.NoError(err)
+	sharded := store.(*redis.ShardedStore)
+
+	clients := map[string]*fakeClient{}
+	for i := range shards {
+		client := shards[i].Client.(*fakeClient)
+		is.Equal(3, client.ScriptLoads())
+		clients[shards[i].Name] = client
+	}
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	// Simulate a restart of the shard holding "foo", which loses its scripts.
+	target := sharded.ShardFor("foo")
+	clients[target].FlushScripts()
+
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(8), lctx.Remaining)
+
+	for name, client := range clients {
+		if name == target {
+			is.Equal(6, client.ScriptLoads(), name)
+		} else {
+			is.Equal(3, client.ScriptLoads(), name)
+		}
+	}
+
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+	is.Equal(int64(0), store.(limiter.StatsReporter).Stats().Errors)
+}
+
+func TestShardedStoreOptions(t *testing.T) {
+	is := require.New(t)
+
+	_, err := redis.NewShardedStore(nil)
+	is.Error(err)
+
+	_, err = redis.NewShardedStore([]redis.Shard{{Name: "", Client: newFakeClient()}})
+	is.Error(err)
+
+	_, err = redis.NewShardedStore([]redis.Shard{
+		{Name: "shard", Client: newFakeClient()},
+		{Name: "shard", Client: newFakeClient()},
+	})
+	is.Error(err)
+
+	store, err := redis.NewShardedStore(newFakeShards(1))
+	is.NoError(err)
+	is.Error(store.(*redis.ShardedStore).RemoveShard("shard-0"))
+}
+
+func newFakeShards(count int) []redis.Shard {
+	shards := make([]redis.Shard, count)
+	for i := range shards {
+		shards[i] = redis.Shard{
+			Name:   fmt.Sprintf("shard-%d", i),
+			Client: newFakeClient(),
+		}
+	}
+	return shards
+}
+
+// fakeEntry is a value stored by a fake redis client.
+type fakeEntry struct {
+	value      int64
+	expiration time.Time
+}
+
+// fakeClient is an in-memory redis client, which implements the lua scripts used by the store.
+type fakeClient struct {
+	mutex       sync.Mutex
+	entries     map[string]*fakeEntry
+	scripts     map[string]string
+	scriptLoads int
+	evals       int
+	offset      time.Duration
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		entries: map[string]*fakeEntry{},
+		scripts: map[string]string{},
+	}
+}
+
+// ScriptLoads returns the number of scripts loaded on this client.
+func (client *fakeClient) ScriptLoads() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.scriptLoads
+}
+
+// Evals returns the number of scripts evaluated on this client.
+func (client *fakeClient) Evals() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.evals
+}
+
+// Value returns the value stored at given key, or zero.
+func (client *fakeClient) Value(key string) int64 {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	entry, ok := client.load(key)
+	if !ok {
+		return 0
+	}
+	return entry.value
+}
+
+// SetClock shifts the clock of this client, as a redis server on a skewed host.
+func (client *fakeClient) SetClock(offset time.Duration) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.offset = offset
+}
+
+// FlushScripts removes every loaded script, as redis does on restart.
+func (client *fakeClient) FlushScripts() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.scripts = map[string]string{}
+}
+
+func (client *fakeClient) Get(ctx context.Context, key string) *libredis.StringCmd {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	entry, ok := client.load(key)
+	if !ok {
+		return libredis.NewStringResult("", libredis.Nil)
+	}
+	return libredis.NewStringResult(strconv.FormatInt(entry.value, 10), nil)
+}
+
+func (client *fakeClient) Set(ctx context.Context, key string, value interface{},
+	expiration time.Duration) *libredis.StatusCmd {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.store(key, toInt64(value), expiration)
+	return libredis.NewStatusResult("OK", nil)
+}
+
+func (client *fakeClient) Watch(ctx context.Context, handler func(*libredis.Tx) error, keys ...string) error {
+	return errors.New("transactions are not supported")
+}
+
+func (client *fakeClient) Del(ctx context.Context, keys ...string) *libredis.IntCmd {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	deleted := int64(0)
+	for _, key := range keys {
+		if _, ok := client.load(key); ok {
+			delete(client.entries, key)
+			deleted++
+		}
+	}
+	return libredis.NewIntResult(deleted, nil)
+}
+
+func (client *fakeClient) SetNX(ctx context.Context, key string, value interface{},
+	expiration time.Duration) *libredis.BoolCmd {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if _, ok := client.load(key); ok {
+		return libredis.NewBoolResult(false, nil)
+	}
+	client.store(key, toInt64(value), expiration)
+	return libredis.NewBoolResult(true, nil)
+}
+
+func (client *fakeClient) EvalSha(ctx context.Context, sha string, keys []string,
+	args ...interface{}) *libredis.Cmd {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	script, ok := client.scripts[sha]
+	if !ok {
+		return libredis.NewCmdResult(nil, errors.New("NOSCRIPT No matching script. Please use EVAL."))
+	}
+	client.evals++
+
+	result := client.eval(script, keys[0], args)
+	if strings.Contains(script, `redis.call("time")`) {
+		now := time.Now().Add(client.offset)
+		result = append(result, now.Unix(), int64(now.Nanosecond()/1000))
+	}
+	if len(result) == 1 {
+		return libredis.NewCmdResult(result[0], nil)
+	}
+	return libredis.NewCmdResult(result, nil)
+}
+
+// eval executes given lua script of the store.
+// WARNING: mutex must be held by the caller.
+func (client *fakeClient) eval(script string, key string, args []interface{}) []interface{} {
+	if strings.Contains(script, "decrby") {
+		count := toInt64(args[0])
+		entry, ok := client.load(key)
+		if !ok || client.pttl(entry) < 0 || client.pttl(entry) > toInt64(args[1]) {
+			return []interface{}{int64(0)}
+		}
+		if entry.value < count {
+			count = entry.value
+		}
+		entry.value -= count
+		return []interface{}{count}
+	}
+	if strings.Contains(script, `redis.call("del"`) {
+		delete(client.entries, key)
+		return []interface{}{int64(0), int64(0)}
+	}
+	if !strings.Contains(script, "incrby") {
+		entry, ok := client.load(key)
+		if !ok {
+			return []interface{}{int64(0), int64(0)}
+		}
+		return []interface{}{entry.value, client.pttl(entry)}
+	}
+
+	count := toInt64(args[0])
+	ttl := toInt64(args[1])
+
+	entry, ok := client.load(key)
+	if !ok {
+		client.store(key, count, time.Duration(ttl)*time.Millisecond)
+		return []interface{}{count, ttl}
+	}
+
+	entry.value += count
+	return []interface{}{entry.value, client.pttl(entry)}
+}
+
+func (client *fakeClient) ScriptLoad(ctx context.Context, script string) *libredis.StringCmd {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	hash := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(hash[:])
+	client.scripts[sha] = script
+	client.scriptLoads++
+
+	return libredis.NewStringResult(sha, nil)
+}
+
+func (client *fakeClient) Scan(ctx context.Context, cursor uint64, match string,
+	count int64) *libredis.ScanCmd {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	names := make([]string, 0, len(client.entries))
+	for name := range client.entries {
+		if _, ok := client.load(name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	keys := []string{}
+	next := uint64(0)
+	for i := int(cursor); i < len(names); i++ {
+		if int64(i)-int64(cursor) >= count {
+			next = uint64(i)
+			break
+		}
+		if globMatch(match, names[i]) {
+			keys = append(keys, names[i])
+		}
+	}
+
+	return libredis.NewScanCmdResult(keys, next, nil)
+}
+
+func (client *fakeClient) Ping(ctx context.Context) *libredis.StatusCmd {
+	return libredis.NewStatusResult("PONG", nil)
+}
+
+// load returns the entry stored at given key, if it has not expired.
+// WARNING: mutex must be held by the caller.
+func (client *fakeClient) load(key string) (*fakeEntry, bool) {
+	entry, ok := client.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !entry.expiration.IsZero() && !time.Now().Before(entry.expiration) {
+		delete(client.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// store sets the entry stored at given key.
+// The key is copied, since the store builds it in a pooled buffer.
+// WARNING: mutex must be held by the caller.
+func (client *fakeClient) store(key string, value int64, expiration time.Duration) {
+	entry := &fakeEntry{value: value}
+	if expiration > 0 {
+		entry.expiration = time.Now().Add(expiration)
+	}
+	client.entries[string(append([]byte(nil), key...))] = entry
+}
+
+// pttl returns the remaining time to live of given entry, in milliseconds, as redis PTTL command.
+func (client *fakeClient) pttl(entry *fakeEntry) int64 {
+	if entry.expiration.IsZero() {
+		return -1
+	}
+	return int64(time.Until(entry.expiration) / time.Millisecond)
+}
+
+// globMatch returns true if given name matches given redis pattern, which only supports "*" and escapes.
+func globMatch(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if globMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '\\':
+			pattern = pattern[1:]
+		}
+		if len(name) == 0 || name[0] != pattern[0] {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+func toInt64(value interface{}) int64 {
+	switch value := value.(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	default:
+		panic(fmt.Sprintf("unexpected type %T", value))
+	}
+}
@@ -2,7 +2,6 @@ package redis
 
 import (
 	"context"
-	"fmt"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -13,35 +12,25 @@ import (
 
 	"github.com/panii/limiter/v3"
 	"github.com/panii/limiter/v3/drivers/store/common"
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+	"github.com/panii/limiter/v3/internal/luascript"
 )
 
 const (
-	luaIncrScript = `
-local key = KEYS[1]
-local count = tonumber(ARGV[1])
-local ttl = tonumber(ARGV[2])
-local ret = redis.call("incrby", key, ARGV[1])
-if ret == count then
-	if ttl > 0 then
-		redis.call("pexpire", key, ARGV[2])
-	end
-	return {ret, ttl}
-end
-ttl = redis.call("pttl", key)
-return {ret, ttl}
-`
-	luaPeekScript = `
-local key = KEYS[1]
-local v = redis.call("get", key)
-if v == false then
-	return {0, 0}
-end
-local ttl = redis.call("pttl", key)
-return {tonumber(v), ttl}
-`
+	luaIncrScript      = luascript.Incr
+	luaPeekScript      = luascript.Peek
+	luaIncrTimeScript  = luascript.IncrTime
+	luaPeekTimeScript  = luascript.PeekTime
+	luaResetTimeScript = luascript.ResetTime
+	luaReleaseScript   = luascript.Release
 )
 
+// maxCachedArgs is the maximum number of periods whose "incr" lua script arguments are cached.
+const maxCachedArgs = 64
+
 // Client is an interface thats allows to use a redis cluster or a redis single client seamlessly.
+// Keys given to a client are built in pooled buffers: they are only valid until the call returns, or until a
+// pipeline is executed, and must be copied to be retained.
 type Client interface {
 	Get(ctx context.Context, key string) *libredis.StringCmd
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *libredis.StatusCmd
@@ -52,16 +41,30 @@ type Client interface {
 	ScriptLoad(ctx context.Context, script string) *libredis.StringCmd
 }
 
+// pinger is implemented by clients which are able to ping redis server, such as go-redis clients.
+type pinger interface {
+	Ping(ctx context.Context) *libredis.StatusCmd
+}
+
 // Store is the redis store.
 type Store struct {
+	// errors is the number of failed operations on redis server.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
 	// Prefix used for the key.
 	Prefix string
 	// MaxRetry is the maximum number of retry under race conditions.
 	// Deprecated: this option is no longer required since all operations are atomic now.
 	MaxRetry int
+	// HashTag wraps the identifier of every key in a hash tag, so every key of an identifier is stored in the same
+	// slot on Redis Cluster.
+	HashTag bool
+	// ServerTime makes lua scripts return the time of redis server, which is used instead of the local clock to
+	// compute expirations.
+	ServerTime bool
 	// client used to communicate with redis server.
 	client Client
-	// luaMutex is a mutex used to avoid concurrent access on luaIncrSHA and luaPeekSHA.
+	// luaMutex is a mutex used to avoid concurrent access on lua scripts SHA.
 	luaMutex sync.RWMutex
 	// luaLoaded is used for CAS and reduce pressure on luaMutex.
 	luaLoaded uint32
@@ -69,6 +72,14 @@ type Store struct {
 	luaIncrSHA string
 	// luaPeekSHA is the SHA of peek and expire key script.
 	luaPeekSHA string
+	// luaReleaseSHA is the SHA of release leased units script.
+	luaReleaseSHA string
+	// luaResetSHA is the SHA of delete key script, only loaded with ServerTime.
+	luaResetSHA string
+	// argsMutex is a mutex used to avoid concurrent updates of argsCache.
+	argsMutex sync.Mutex
+	// argsCache holds the arguments of "incr" lua script for each period, as a map[time.Duration][]interface{}.
+	argsCache atomic.Value
 }
 
 // NewStore returns an instance of redis store with defaults.
@@ -82,10 +93,16 @@ func NewStore(client Client) (limiter.Store, error) {
 
 // NewStoreWithOptions returns an instance of redis store with options.
 func NewStoreWithOptions(client Client, options limiter.StoreOptions) (limiter.Store, error) {
+	if options.HashTag && strings.ContainsAny(options.Prefix, "{}") {
+		return nil, errors.New("prefix cannot contain any brace with hash tags")
+	}
+
 	store := &Store{
-		client:   client,
-		Prefix:   options.Prefix,
-		MaxRetry: options.MaxRetry,
+		client:     client,
+		Prefix:     options.Prefix,
+		MaxRetry:   options.MaxRetry,
+		HashTag:    options.HashTag,
+		ServerTime: options.ServerTime,
 	}
 
 	err := store.preloadLuaScripts(context.Background())
@@ -102,52 +119,51 @@ func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (lim
 		rate = rateTemp.(limiter.Rate)
 	}
 
-	key = fmt.Sprintf("%s:%s", store.Prefix, key)
-	cmd := store.evalSHA(ctx, store.getLuaIncrSHA, []string{key}, 1, rate.Period.Milliseconds())
-	count, ttl, err := parseCountAndTTL(cmd)
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	key = store.key(buffer, key)
+	cmd := store.evalSHA(ctx, store.getLuaIncrSHA, []string{key}, store.incrArgs(rate.Period)...)
+	count, ttl, now, err := parseState(cmd)
 	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
 		return limiter.Context{}, err
 	}
 
-	now := time.Now()
 	expiration := now.Add(rate.Period)
 	if ttl > 0 {
 		expiration = now.Add(time.Duration(ttl) * time.Millisecond)
 	}
-	//fmt.Println("ttl", ttl)
-	//fmt.Println("rate.Limit", rate.Limit)
-
-	// if llimt := ctx.Value(fmt.Sprintf("limit%dInt", rate.Limit)); llimt != nil {
-	// rate.Limit = llimt.(int64)
-	// }
-
-	// fmt.Println("rate.Limit", rate.Limit)
-	// if llimt := ctx.Value("limit1Int"); llimt != nil {
-	// 	fmt.Println("limit1Int", llimt)
-	// }
-	// if llimt := ctx.Value("limit2Int"); llimt != nil {
-	// 	fmt.Println("limit2Int", llimt)
-	// }
-	// if llimt := ctx.Value("limit3Int"); llimt != nil {
-	// 	fmt.Println("limit3Int", llimt)
-	// }
-	// if llimt := ctx.Value("limit4Int"); llimt != nil {
-	// 	fmt.Println("limit4Int", llimt)
-	// }
 
 	return common.GetContextFromState(now, rate, expiration, count), nil
 }
 
+// Seed adds given number of hits to given identifier, which expires after given TTL if it's created.
+func (store *Store) Seed(ctx context.Context, key string, count int64, ttl time.Duration) error {
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	cmd := store.evalSHA(ctx, store.getLuaIncrSHA, []string{store.key(buffer, key)}, count, ttl.Milliseconds())
+	if cmd.Err() != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return cmd.Err()
+	}
+	return nil
+}
+
 // Peek returns the limit for given identifier, without modification on current values.
 func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
-	key = fmt.Sprintf("%s:%s", store.Prefix, key)
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	key = store.key(buffer, key)
 	cmd := store.evalSHA(ctx, store.getLuaPeekSHA, []string{key})
-	count, ttl, err := parseCountAndTTL(cmd)
+	count, ttl, now, err := parseState(cmd)
 	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
 		return limiter.Context{}, err
 	}
 
-	now := time.Now()
 	expiration := now.Add(rate.Period)
 	if ttl > 0 {
 		expiration = now.Add(time.Duration(ttl) * time.Millisecond)
@@ -158,20 +174,87 @@ func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (li
 
 // Reset returns the limit for given identifier which is set to zero.
 func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
-	key = fmt.Sprintf("%s:%s", store.Prefix, key)
-	_, err := store.client.Del(ctx, key).Result()
-	if err != nil {
-		return limiter.Context{}, err
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+
+	key = store.key(buffer, key)
+
+	now := time.Now()
+	if store.ServerTime {
+		var err error
+		_, _, now, err = parseState(store.evalSHA(ctx, store.getLuaResetSHA, []string{key}))
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return limiter.Context{}, err
+		}
+	} else {
+		_, err := store.client.Del(ctx, key).Result()
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return limiter.Context{}, err
+		}
 	}
 
 	count := int64(0)
-	now := time.Now()
 	expiration := now.Add(rate.Period)
 
 	return common.GetContextFromState(now, rate, expiration, count), nil
 }
 
-// preloadLuaScripts preloads the "incr" and "peek" lua scripts.
+// Ping returns an error if redis server is unreachable. Clients without Ping method are not checked.
+// The store doesn't own its client, so it's up to the caller to close it.
+func (store *Store) Ping(ctx context.Context) error {
+	client, ok := store.client.(pinger)
+	if !ok {
+		return nil
+	}
+
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		return errors.Wrap(err, "unable to ping redis server")
+	}
+	return nil
+}
+
+// Stats returns the number of failed operations on redis server.
+// The number of keys is unknown, since the redis database may be shared with other applications.
+func (store *Store) Stats() limiter.StoreStats {
+	return limiter.StoreStats{
+		Keys:    -1,
+		Evicted: -1,
+		Errors:  atomic.LoadInt64(&store.errors),
+	}
+}
+
+// incrArgs returns the arguments of "incr" lua script for given period.
+// Boxing an integer in an interface allocates, and a store only handles a few periods: arguments are cached in a
+// copy-on-write map, which is read without lock.
+func (store *Store) incrArgs(period time.Duration) []interface{} {
+	cache, _ := store.argsCache.Load().(map[time.Duration][]interface{})
+	if args, ok := cache[period]; ok {
+		return args
+	}
+
+	args := []interface{}{1, period.Milliseconds()}
+	if len(cache) >= maxCachedArgs {
+		return args
+	}
+
+	store.argsMutex.Lock()
+	defer store.argsMutex.Unlock()
+
+	cache, _ = store.argsCache.Load().(map[time.Duration][]interface{})
+	next := make(map[time.Duration][]interface{}, len(cache)+1)
+	for key, value := range cache {
+		next[key] = value
+	}
+	next[period] = args
+	store.argsCache.Store(next)
+
+	return args
+}
+
+// preloadLuaScripts preloads the "incr", "peek" and "release" lua scripts.
 func (store *Store) preloadLuaScripts(ctx context.Context) error {
 	// Verify if we need to load lua scripts.
 	// Inspired by sync.Once.
@@ -181,7 +264,7 @@ func (store *Store) preloadLuaScripts(ctx context.Context) error {
 	return nil
 }
 
-// reloadLuaScripts forces a reload of "incr" and "peek" lua scripts.
+// reloadLuaScripts forces a reload of "incr", "peek" and "release" lua scripts.
 func (store *Store) reloadLuaScripts(ctx context.Context) error {
 	// Reset lua scripts loaded state.
 	// Inspired by sync.Once.
@@ -189,7 +272,7 @@ func (store *Store) reloadLuaScripts(ctx context.Context) error {
 	return store.loadLuaScripts(ctx)
 }
 
-// loadLuaScripts load "incr" and "peek" lua scripts.
+// loadLuaScripts load "incr", "peek" and "release" lua scripts, and "reset" lua script with ServerTime.
 // WARNING: Please use preloadLuaScripts or reloadLuaScripts, instead of this one.
 func (store *Store) loadLuaScripts(ctx context.Context) error {
 	store.luaMutex.Lock()
@@ -200,18 +283,36 @@ func (store *Store) loadLuaScripts(ctx context.Context) error {
 		return nil
 	}
 
-	luaIncrSHA, err := store.client.ScriptLoad(ctx, luaIncrScript).Result()
+	incrScript, peekScript := luaIncrScript, luaPeekScript
+	if store.ServerTime {
+		incrScript, peekScript = luaIncrTimeScript, luaPeekTimeScript
+	}
+
+	luaIncrSHA, err := store.client.ScriptLoad(ctx, incrScript).Result()
 	if err != nil {
 		return errors.Wrap(err, `failed to load "incr" lua script`)
 	}
 
-	luaPeekSHA, err := store.client.ScriptLoad(ctx, luaPeekScript).Result()
+	luaPeekSHA, err := store.client.ScriptLoad(ctx, peekScript).Result()
 	if err != nil {
 		return errors.Wrap(err, `failed to load "peek" lua script`)
 	}
 
+	luaReleaseSHA, err := store.client.ScriptLoad(ctx, luaReleaseScript).Result()
+	if err != nil {
+		return errors.Wrap(err, `failed to load "release" lua script`)
+	}
+
+	if store.ServerTime {
+		store.luaResetSHA, err = store.client.ScriptLoad(ctx, luaResetTimeScript).Result()
+		if err != nil {
+			return errors.Wrap(err, `failed to load "reset" lua script`)
+		}
+	}
+
 	store.luaIncrSHA = luaIncrSHA
 	store.luaPeekSHA = luaPeekSHA
+	store.luaReleaseSHA = luaReleaseSHA
 
 	atomic.StoreUint32(&store.luaLoaded, 1)
 
@@ -232,6 +333,20 @@ func (store *Store) getLuaPeekSHA() string {
 	return store.luaPeekSHA
 }
 
+// getLuaReleaseSHA returns a "thread-safe" value for luaReleaseSHA.
+func (store *Store) getLuaReleaseSHA() string {
+	store.luaMutex.RLock()
+	defer store.luaMutex.RUnlock()
+	return store.luaReleaseSHA
+}
+
+// getLuaResetSHA returns a "thread-safe" value for luaResetSHA.
+func (store *Store) getLuaResetSHA() string {
+	store.luaMutex.RLock()
+	defer store.luaMutex.RUnlock()
+	return store.luaResetSHA
+}
+
 // evalSHA eval the redis lua sha and load the scripts if missing.
 func (store *Store) evalSHA(ctx context.Context, getSha func() string,
 	keys []string, args ...interface{}) *libredis.Cmd {
@@ -257,23 +372,34 @@ func isLuaScriptGone(err error) bool {
 	return strings.HasPrefix(err.Error(), "NOSCRIPT")
 }
 
-// parseCountAndTTL parse count and ttl from lua script output.
-func parseCountAndTTL(cmd *libredis.Cmd) (int64, int64, error) {
+// parseState parse count, ttl and time from lua script output.
+// The time is the time of redis server if the script returns it, or the local time otherwise.
+func parseState(cmd *libredis.Cmd) (int64, int64, time.Time, error) {
 	result, err := cmd.Result()
 	if err != nil {
-		return 0, 0, errors.Wrap(err, "an error has occurred with redis command")
+		return 0, 0, time.Time{}, errors.Wrap(err, "an error has occurred with redis command")
 	}
 
 	fields, ok := result.([]interface{})
-	if !ok || len(fields) != 2 {
-		return 0, 0, errors.New("two elements in result were expected")
+	if !ok || (len(fields) != 2 && len(fields) != 4) {
+		return 0, 0, time.Time{}, errors.New("two or four elements in result were expected")
 	}
 
 	count, ok1 := fields[0].(int64)
 	ttl, ok2 := fields[1].(int64)
 	if !ok1 || !ok2 {
-		return 0, 0, errors.New("type of the count and/or ttl should be number")
+		return 0, 0, time.Time{}, errors.New("type of the count and/or ttl should be number")
+	}
+
+	if len(fields) == 2 {
+		return count, ttl, time.Now(), nil
+	}
+
+	seconds, ok1 := fields[2].(int64)
+	microseconds, ok2 := fields[3].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, time.Time{}, errors.New("type of the time should be number")
 	}
 
-	return count, ttl, nil
+	return count, ttl, time.Unix(seconds, microseconds*int64(time.Microsecond)), nil
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	libredis "github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 
 	"github.com/panii/limiter/v3"
@@ -46,6 +47,113 @@ func TestRedisStoreConcurrentAccess(t *testing.T) {
 	tests.TestStoreConcurrentAccess(t, store)
 }
 
+func TestRedisStoreBatchAccess(t *testing.T) {
+	is := require.New(t)
+
+	client, err := newRedisClient()
+	is.NoError(err)
+	is.NotNil(client)
+
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:batch-test",
+	})
+	is.NoError(err)
+	is.NotNil(store)
+
+	tests.TestStoreBatchAccess(t, store)
+}
+
+func TestRedisStoreSeed(t *testing.T) {
+	is := require.New(t)
+
+	store, err := redis.NewStoreWithOptions(newFakeClient(), limiter.StoreOptions{
+		Prefix: "limiter:redis:seed-test",
+	})
+	is.NoError(err)
+
+	tests.TestStoreSeed(t, store)
+}
+
+func TestRedisStorePing(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	client := newFakeClient()
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:ping-test",
+	})
+	is.NoError(err)
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+
+	// Custom clients don't have to implement Ping.
+	store, err = redis.NewStoreWithOptions(struct{ redis.Client }{client}, limiter.StoreOptions{
+		Prefix: "limiter:redis:ping-test",
+	})
+	is.NoError(err)
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+}
+
+func TestRedisStoreBatchScriptReload(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	client := &pipelineClient{fakeClient: newFakeClient(), lost: map[string]bool{}}
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:batch-reload-test",
+	})
+	is.NoError(err)
+
+	requests := []limiter.Request{{Key: "a", Rate: rate}, {Key: "b", Rate: rate}, {Key: "c", Rate: rate}}
+	_, err = store.(limiter.BatchStore).GetMulti(ctx, requests)
+	is.NoError(err)
+
+	// Only the node holding "b" has lost its scripts: other counters are not incremented twice.
+	client.Lose("limiter:redis:batch-reload-test:b")
+
+	contexts, err := store.(limiter.BatchStore).GetMulti(ctx, requests)
+	is.NoError(err)
+	for i := range contexts {
+		is.Equal(int64(8), contexts[i].Remaining, requests[i].Key)
+	}
+	is.Equal(int64(2), client.Value("limiter:redis:batch-reload-test:a"))
+	is.Equal(int64(2), client.Value("limiter:redis:batch-reload-test:b"))
+	is.Equal(int64(2), client.Value("limiter:redis:batch-reload-test:c"))
+}
+
+func TestRedisStoreScan(t *testing.T) {
+	is := require.New(t)
+
+	client, err := newRedisClient()
+	is.NoError(err)
+	is.NotNil(client)
+
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:scan-test",
+	})
+	is.NoError(err)
+	is.NotNil(store)
+
+	tests.TestStoreScan(t, store)
+}
+
+func TestRedisStoreServerTimeSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	client, err := newRedisClient()
+	is.NoError(err)
+	is.NotNil(client)
+
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix:     "limiter:redis:server-time-sequential-test",
+		ServerTime: true,
+	})
+	is.NoError(err)
+	is.NotNil(store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
 func TestRedisClientExpiration(t *testing.T) {
 	is := require.New(t)
 
@@ -92,6 +200,81 @@ func TestRedisClientExpiration(t *testing.T) {
 	is.Greater(actual, expected)
 }
 
+func TestRedisStoreLifecycle(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	client, err := newRedisClient()
+	is.NoError(err)
+	is.NotNil(client)
+
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:lifecycle-test",
+	})
+	is.NoError(err)
+	is.NotNil(store)
+
+	instance := limiter.New(store, limiter.Rate{
+		Limit:  10,
+		Period: time.Minute,
+	})
+	is.NoError(instance.Healthy(ctx))
+
+	reporter, ok := store.(limiter.StatsReporter)
+	is.True(ok)
+	is.Equal(int64(0), reporter.Stats().Errors)
+
+	is.NoError(client.Close())
+	is.Error(instance.Healthy(ctx))
+
+	_, err = instance.Get(ctx, "foo")
+	is.Error(err)
+	is.Equal(int64(1), reporter.Stats().Errors)
+}
+
+// Both single and cluster clients can be used by the store.
+var (
+	_ redis.Client = (*libredis.Client)(nil)
+	_ redis.Client = (*libredis.ClusterClient)(nil)
+)
+
+func TestRedisStoreHashTag(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	client := newFakeClient()
+	store, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix:  "limiter:redis:hash-tag-test",
+		HashTag: true,
+	})
+	is.NoError(err)
+
+	_, err = store.Get(ctx, "192.168.1.1", rate)
+	is.NoError(err)
+
+	value, err := client.Get(ctx, "limiter:redis:hash-tag-test:{192.168.1.1}").Result()
+	is.NoError(err)
+	is.Equal("1", value)
+
+	lctx, err := store.Peek(ctx, "192.168.1.1", rate)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+
+	_, err = store.Reset(ctx, "192.168.1.1", rate)
+	is.NoError(err)
+
+	_, err = client.Get(ctx, "limiter:redis:hash-tag-test:{192.168.1.1}").Result()
+	is.Equal(libredis.Nil, err)
+
+	// A brace in the prefix would store every key in the same slot.
+	_, err = redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix:  "limiter:{redis}",
+		HashTag: true,
+	})
+	is.Error(err)
+}
+
 func BenchmarkRedisStoreSequentialAccess(b *testing.B) {
 	is := require.New(b)
 
@@ -138,3 +321,59 @@ func newRedisClient() (*libredis.Client, error) {
 	client := libredis.NewClient(opt)
 	return client, nil
 }
+
+// pipelineClient is a fake redis client with pipelines, whose keys can be held by nodes which have lost their
+// scripts, as on a cluster.
+type pipelineClient struct {
+	*fakeClient
+	lost  map[string]bool
+	execs int
+}
+
+// Lose makes the node holding given key lose its scripts, until they are loaded again.
+func (client *pipelineClient) Lose(key string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.lost[key] = true
+}
+
+func (client *pipelineClient) ScriptLoad(ctx context.Context, script string) *libredis.StringCmd {
+	client.mutex.Lock()
+	client.lost = map[string]bool{}
+	client.mutex.Unlock()
+
+	return client.fakeClient.ScriptLoad(ctx, script)
+}
+
+func (client *pipelineClient) Pipeline() libredis.Pipeliner {
+	return &fakePipeline{client: client}
+}
+
+// fakePipeline is a pipeline whose commands are executed as soon as they are queued.
+// Only the methods used by the store are implemented.
+type fakePipeline struct {
+	libredis.Pipeliner
+	client *pipelineClient
+}
+
+func (pipe *fakePipeline) EvalSha(ctx context.Context, sha string, keys []string,
+	args ...interface{}) *libredis.Cmd {
+
+	pipe.client.mutex.Lock()
+	lost := pipe.client.lost[keys[0]]
+	pipe.client.mutex.Unlock()
+
+	if lost {
+		return libredis.NewCmdResult(nil, errors.New("NOSCRIPT No matching script. Please use EVAL."))
+	}
+	return pipe.client.EvalSha(ctx, sha, keys, args...)
+}
+
+func (pipe *fakePipeline) Exec(ctx context.Context) ([]libredis.Cmder, error) {
+	pipe.client.mutex.Lock()
+	pipe.client.execs++
+	pipe.client.mutex.Unlock()
+
+	return nil, nil
+}
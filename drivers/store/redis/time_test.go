@@ -0,0 +1,92 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/redis"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestRedisStoreServerTime(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+	skew := time.Hour
+
+	client := newFakeClient()
+	client.SetClock(skew)
+
+	local, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix: "limiter:redis:time-test",
+	})
+	is.NoError(err)
+
+	server, err := redis.NewStoreWithOptions(client, limiter.StoreOptions{
+		Prefix:     "limiter:redis:time-test",
+		ServerTime: true,
+	})
+	is.NoError(err)
+	is.Equal(3+4, client.ScriptLoads())
+
+	reset := time.Now().Add(rate.Period).Unix()
+	serverReset := time.Now().Add(skew + rate.Period).Unix()
+
+	// Contexts are based on the clock of the redis server.
+	lctx, err := server.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+	is.InDelta(serverReset, lctx.Reset, 1)
+
+	lctx, err = server.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+	is.InDelta(serverReset, lctx.Reset, 1)
+
+	lctx, err = local.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(8), lctx.Remaining)
+	is.InDelta(reset, lctx.Reset, 1)
+
+	lctx, err = server.Reset(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(10), lctx.Remaining)
+	is.InDelta(serverReset, lctx.Reset, 1)
+
+	lctx, err = local.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(10), lctx.Remaining)
+}
+
+func TestLeaseStoreServerTime(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 100, Period: time.Minute}
+	skew := -time.Hour
+
+	client := newFakeClient()
+	client.SetClock(skew)
+
+	store, err := redis.NewLeaseStoreWithOptions(client, redis.LeaseOptions{
+		StoreOptions: limiter.StoreOptions{
+			Prefix:     "limiter:redis:time-test",
+			ServerTime: true,
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	serverReset := time.Now().Add(skew + rate.Period).Unix()
+
+	// Units served locally are based on the clock of the redis server too.
+	for i := 1; i <= 10; i++ {
+		lctx, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+		is.Equal(int64(100-i), lctx.Remaining)
+		is.InDelta(serverReset, lctx.Reset, 1)
+	}
+}
@@ -0,0 +1,673 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTimeout is the default timeout of a request to redis server, when the context has no earlier deadline.
+	DefaultTimeout = time.Second
+	// DefaultPoolSize is the default maximum number of connections opened by a client.
+	// Requests wait for an available connection beyond this limit.
+	DefaultPoolSize = 64
+
+	// maxStateLength is the maximum number of integers returned by a lua script.
+	maxStateLength = 4
+	// maxNestingLevel is the maximum nesting level of an aggregate reply, to protect against corrupted replies.
+	maxNestingLevel = 8
+)
+
+var (
+	// errClientClosed is returned when a request is sent by a closed client.
+	errClientClosed = errors.New("resp: client is closed")
+	// errMalformedReply is returned when the server reply doesn't follow the RESP protocol.
+	errMalformedReply = errors.New("resp: malformed reply")
+)
+
+// Error is an error reply sent by redis server, such as "NOSCRIPT No matching script".
+// The connection remains usable after an error reply.
+type Error string
+
+// Error returns the message of the error reply.
+func (err Error) Error() string {
+	return string(err)
+}
+
+// script is a lua script, evaluated by its SHA1 digest once it has been cached by redis server.
+type script struct {
+	source string
+	sha    string
+}
+
+// newScript returns a script for given lua source.
+func newScript(source string) *script {
+	hash := sha1.Sum([]byte(source))
+	return &script{
+		source: source,
+		sha:    hex.EncodeToString(hash[:]),
+	}
+}
+
+// call is the evaluation of a lua script on a single key.
+type call struct {
+	// key is the identifier of the key, without its prefix.
+	key string
+	// args are the arguments of the script.
+	args [2]int64
+	// nargs is the number of arguments of the script.
+	nargs int
+	// state holds the integers returned by the script.
+	state [maxStateLength]int64
+	// n is the number of integers returned by the script.
+	n int
+	// err is the error reply of the script, if any.
+	err error
+}
+
+// conn is a connection to redis server.
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// scratch is a buffer used to format integers without allocations.
+	scratch []byte
+}
+
+// client sends requests to redis server using the RESP protocol, over a pool of connections.
+type client struct {
+	address string
+	options Options
+	dialer  net.Dialer
+	slots   chan struct{}
+	mutex   sync.Mutex
+	idle    []*conn
+	closed  bool
+}
+
+// newClient returns a client for given server address.
+func newClient(address string, options Options) *client {
+	return &client{
+		address: address,
+		options: options,
+		dialer:  net.Dialer{Timeout: options.DialTimeout},
+		slots:   make(chan struct{}, options.PoolSize),
+	}
+}
+
+// Eval evaluates given script for every call, in a single round trip.
+// Scripts are sent with EVALSHA, then with EVAL if they are not cached by redis server.
+// Error replies are reported by each call.
+func (client *client) Eval(ctx context.Context, script *script, prefix string, calls []call) error {
+	conn, err := client.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = conn.eval(script, prefix, calls)
+	client.release(conn, err)
+	return err
+}
+
+// Del removes given key, if any.
+func (client *client) Del(ctx context.Context, prefix string, key string) error {
+	conn, err := client.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn.writeArray(2)
+	conn.writeBulk("DEL")
+	conn.writeKey(prefix, key)
+	err = conn.writer.Flush()
+	if err == nil {
+		_, err = conn.readInteger()
+	}
+
+	client.release(conn, err)
+	return err
+}
+
+// Ping sends a PING command.
+func (client *client) Ping(ctx context.Context) error {
+	conn, err := client.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn.writeArray(1)
+	conn.writeBulk("PING")
+	err = conn.writer.Flush()
+	if err == nil {
+		err = conn.readStatus("PONG")
+	}
+
+	client.release(conn, err)
+	return err
+}
+
+// Close closes every idle connection.
+// Connections in use are closed when they are released.
+func (client *client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.closed = true
+	for _, conn := range client.idle {
+		_ = conn.Close()
+	}
+	client.idle = nil
+
+	return nil
+}
+
+// acquire returns an idle connection, or a new one, with a deadline from given context and the client timeout.
+// It waits for a connection to be released if the maximum number of connections is reached.
+func (client *client) acquire(ctx context.Context) (*conn, error) {
+	select {
+	case client.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	deadline := time.Now().Add(client.options.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	client.mutex.Lock()
+	if client.closed {
+		client.mutex.Unlock()
+		<-client.slots
+		return nil, errClientClosed
+	}
+	if n := len(client.idle); n > 0 {
+		conn := client.idle[n-1]
+		client.idle = client.idle[:n-1]
+		client.mutex.Unlock()
+
+		err := conn.SetDeadline(deadline)
+		if err != nil {
+			_ = conn.Close()
+			<-client.slots
+			return nil, err
+		}
+		return conn, nil
+	}
+	client.mutex.Unlock()
+
+	conn, err := client.dial(ctx, deadline)
+	if err != nil {
+		<-client.slots
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// dial opens a new connection, and sends the HELLO, AUTH and SELECT commands required by the client options.
+func (client *client) dial(ctx context.Context, deadline time.Time) (*conn, error) {
+	netConn, err := client.dialer.DialContext(ctx, "tcp", client.address)
+	if err != nil {
+		return nil, errors.Wrap(err, "resp: cannot connect to server")
+	}
+
+	conn := &conn{
+		Conn:    netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+		scratch: make([]byte, 0, 32),
+	}
+
+	err = conn.SetDeadline(deadline)
+	if err == nil {
+		err = conn.handshake(client.options)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// release returns given connection to the pool, unless given error may have left unread data on the connection.
+func (client *client) release(conn *conn, err error) {
+	if err != nil && !isReplyError(err) {
+		_ = conn.Close()
+		<-client.slots
+		return
+	}
+
+	client.mutex.Lock()
+	if client.closed {
+		_ = conn.Close()
+	} else {
+		client.idle = append(client.idle, conn)
+	}
+	client.mutex.Unlock()
+
+	<-client.slots
+}
+
+// handshake sends the commands pipelined on a new connection, then reads their replies.
+func (conn *conn) handshake(options Options) error {
+	commands := 0
+
+	if options.Protocol == 3 {
+		conn.writeArray(hello3Length(options))
+		conn.writeBulk("HELLO")
+		conn.writeBulk("3")
+		if options.Password != "" {
+			username := options.Username
+			if username == "" {
+				username = "default"
+			}
+			conn.writeBulk("AUTH")
+			conn.writeBulk(username)
+			conn.writeBulk(options.Password)
+		}
+		commands++
+	} else if options.Password != "" {
+		if options.Username != "" {
+			conn.writeArray(3)
+			conn.writeBulk("AUTH")
+			conn.writeBulk(options.Username)
+		} else {
+			conn.writeArray(2)
+			conn.writeBulk("AUTH")
+		}
+		conn.writeBulk(options.Password)
+		commands++
+	}
+
+	if options.DB != 0 {
+		conn.writeArray(2)
+		conn.writeBulk("SELECT")
+		conn.writeInteger(int64(options.DB))
+		commands++
+	}
+
+	if commands == 0 {
+		return nil
+	}
+
+	err := conn.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Read every reply, but report the first error.
+	var first error
+	for i := 0; i < commands; i++ {
+		kind, line, err := conn.readHeader()
+		if err == nil {
+			err = conn.skip(kind, line, 0)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+		if err != nil && !isReplyError(err) {
+			break
+		}
+	}
+	if first != nil {
+		return errors.Wrap(first, "resp: cannot initialize connection")
+	}
+
+	return nil
+}
+
+// eval writes the evaluation of every call, then reads their replies.
+// Calls whose script isn't cached by redis server are evaluated again, with the script source.
+func (conn *conn) eval(script *script, prefix string, calls []call) error {
+	for i := range calls {
+		conn.writeEval(script, false, prefix, &calls[i])
+	}
+	err := conn.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	missing := 0
+	for i := range calls {
+		err = conn.readState(&calls[i])
+		if err != nil {
+			return err
+		}
+		if isScriptMissing(calls[i].err) {
+			missing++
+		}
+	}
+	if missing == 0 {
+		return nil
+	}
+
+	for i := range calls {
+		if isScriptMissing(calls[i].err) {
+			conn.writeEval(script, true, prefix, &calls[i])
+		}
+	}
+	err = conn.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	for i := range calls {
+		if isScriptMissing(calls[i].err) {
+			err = conn.readState(&calls[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeEval writes an EVALSHA command for given call, or an EVAL command with the script source.
+func (conn *conn) writeEval(script *script, source bool, prefix string, call *call) {
+	conn.writeArray(4 + call.nargs)
+	if source {
+		conn.writeBulk("EVAL")
+		conn.writeBulk(script.source)
+	} else {
+		conn.writeBulk("EVALSHA")
+		conn.writeBulk(script.sha)
+	}
+	conn.writeBulk("1")
+	conn.writeKey(prefix, call.key)
+	for i := 0; i < call.nargs; i++ {
+		conn.writeInteger(call.args[i])
+	}
+}
+
+// writeArray writes the header of an array of given length.
+func (conn *conn) writeArray(length int) {
+	conn.writeHeader('*', int64(length))
+}
+
+// writeBulk writes given bulk string.
+func (conn *conn) writeBulk(value string) {
+	conn.writeHeader('$', int64(len(value)))
+	_, _ = conn.writer.WriteString(value)
+	_, _ = conn.writer.WriteString("\r\n")
+}
+
+// writeKey writes the bulk string of given key, joined with its prefix, without building the key.
+func (conn *conn) writeKey(prefix string, key string) {
+	conn.writeHeader('$', int64(len(prefix)+1+len(key)))
+	_, _ = conn.writer.WriteString(prefix)
+	_ = conn.writer.WriteByte(':')
+	_, _ = conn.writer.WriteString(key)
+	_, _ = conn.writer.WriteString("\r\n")
+}
+
+// writeInteger writes given integer as a bulk string.
+func (conn *conn) writeInteger(value int64) {
+	// The value and its length are both formatted in the scratch buffer.
+	conn.scratch = strconv.AppendInt(conn.scratch[:0], value, 10)
+	n := len(conn.scratch)
+	conn.scratch = strconv.AppendInt(conn.scratch, int64(n), 10)
+
+	_ = conn.writer.WriteByte('$')
+	_, _ = conn.writer.Write(conn.scratch[n:])
+	_, _ = conn.writer.WriteString("\r\n")
+	_, _ = conn.writer.Write(conn.scratch[:n])
+	_, _ = conn.writer.WriteString("\r\n")
+}
+
+// writeHeader writes a type prefix followed by given length.
+// Write errors are reported by the flush of the writer.
+func (conn *conn) writeHeader(kind byte, length int64) {
+	_ = conn.writer.WriteByte(kind)
+	conn.scratch = strconv.AppendInt(conn.scratch[:0], length, 10)
+	_, _ = conn.writer.Write(conn.scratch)
+	_, _ = conn.writer.WriteString("\r\n")
+}
+
+// readState reads the integers returned by a lua script into given call.
+// An error reply is reported by the call, since the connection remains usable.
+func (conn *conn) readState(call *call) error {
+	call.n = 0
+	call.err = nil
+
+	kind, line, err := conn.readHeader()
+	if isReplyError(err) {
+		call.err = err
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if kind != '*' && kind != '~' {
+		return errMalformedReply
+	}
+
+	length, ok := parseInteger(line)
+	if !ok || length < 0 || length > maxStateLength {
+		return errMalformedReply
+	}
+
+	for i := 0; i < int(length); i++ {
+		value, err := conn.readInteger()
+		if err != nil {
+			if isReplyError(err) {
+				return errMalformedReply
+			}
+			return err
+		}
+		call.state[i] = value
+	}
+	call.n = int(length)
+
+	return nil
+}
+
+// readInteger reads an integer reply.
+func (conn *conn) readInteger() (int64, error) {
+	kind, line, err := conn.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	if kind != ':' {
+		return 0, errMalformedReply
+	}
+
+	value, ok := parseInteger(line)
+	if !ok {
+		return 0, errMalformedReply
+	}
+	return value, nil
+}
+
+// readStatus reads a simple string reply, which must match given status.
+func (conn *conn) readStatus(status string) error {
+	kind, line, err := conn.readHeader()
+	if err != nil {
+		return err
+	}
+	if kind != '+' || string(line) != status {
+		return errMalformedReply
+	}
+	return nil
+}
+
+// readHeader reads the type and the first line of a reply.
+// Error replies are returned as Error, attributes and push messages are skipped.
+func (conn *conn) readHeader() (byte, []byte, error) {
+	for {
+		line, err := readLine(conn.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(line) == 0 {
+			return 0, nil, errMalformedReply
+		}
+
+		kind := line[0]
+		line = line[1:]
+
+		switch kind {
+		case '-':
+			return 0, nil, Error(line)
+		case '!':
+			message, err := conn.readBlob(line)
+			if err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, Error(message)
+		case '|':
+			// Attributes precede the reply they describe.
+			err = conn.skip(kind, line, 0)
+		case '>':
+			// Push messages are out of band: they are only sent with client tracking or pub/sub.
+			err = conn.skip(kind, line, 0)
+		default:
+			return kind, line, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// skip reads and discards the rest of a reply whose header has been read.
+func (conn *conn) skip(kind byte, line []byte, level int) error {
+	if level > maxNestingLevel {
+		return errMalformedReply
+	}
+
+	switch kind {
+	case '+', ':', ',', '#', '_', '(':
+		return nil
+	case '$', '=', '!':
+		_, err := conn.readBlob(line)
+		return err
+	case '*', '~', '>', '%', '|':
+		length, ok := parseInteger(line)
+		if !ok {
+			return errMalformedReply
+		}
+		if kind == '%' || kind == '|' {
+			length *= 2
+		}
+		for i := int64(0); i < length; i++ {
+			line, err := readLine(conn.reader)
+			if err != nil {
+				return err
+			}
+			if len(line) == 0 {
+				return errMalformedReply
+			}
+			if line[0] == '-' {
+				continue
+			}
+			err = conn.skip(line[0], line[1:], level+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errMalformedReply
+	}
+}
+
+// readBlob reads the content of a blob reply of given length line.
+// A null blob, of length -1, is returned as an empty slice.
+func (conn *conn) readBlob(line []byte) ([]byte, error) {
+	length, ok := parseInteger(line)
+	if !ok || length < -1 {
+		return nil, errMalformedReply
+	}
+	if length == -1 {
+		return nil, nil
+	}
+
+	data := make([]byte, length+2)
+	_, err := io.ReadFull(conn.reader, data)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return nil, errMalformedReply
+	}
+	return data[:length], nil
+}
+
+// readLine reads a reply line, without its trailing CRLF.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errMalformedReply
+	}
+	return line[:len(line)-2], nil
+}
+
+// parseInteger parses a signed decimal integer, without converting it to a string.
+func parseInteger(line []byte) (int64, bool) {
+	if len(line) == 0 {
+		return 0, false
+	}
+
+	negative := line[0] == '-'
+	if negative {
+		line = line[1:]
+		if len(line) == 0 {
+			return 0, false
+		}
+	}
+
+	value := int64(0)
+	for _, char := range line {
+		if char < '0' || char > '9' {
+			return 0, false
+		}
+		digit := int64(char - '0')
+		if value > (math.MaxInt64-digit)/10 {
+			return 0, false
+		}
+		value = value*10 + digit
+	}
+
+	if negative {
+		return -value, true
+	}
+	return value, true
+}
+
+// hello3Length returns the length of the HELLO command for given options.
+func hello3Length(options Options) int {
+	if options.Password != "" {
+		return 5
+	}
+	return 2
+}
+
+// isReplyError returns true if given error is an error reply of redis server.
+func isReplyError(err error) bool {
+	_, ok := err.(Error)
+	return ok
+}
+
+// isScriptMissing returns true if given error is a missing lua script on redis server.
+func isScriptMissing(err error) bool {
+	reply, ok := err.(Error)
+	return ok && strings.HasPrefix(string(reply), "NOSCRIPT")
+}
@@ -0,0 +1,393 @@
+package resp_test
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeEntry is a counter stored by a fake redis server.
+type fakeEntry struct {
+	value      int64
+	expiration time.Time
+}
+
+// fakeServer is an in-process redis server, implementing the subset of RESP2 and RESP3 used by the store.
+// Lua scripts are not interpreted: their semantics are emulated from their source.
+type fakeServer struct {
+	listener net.Listener
+	password string
+	mutex    sync.Mutex
+	entries  map[string]*fakeEntry
+	scripts  map[string]string
+	commands map[string]int
+	offset   time.Duration
+	wg       sync.WaitGroup
+}
+
+// newFakeServer starts a fake redis server on a random local port.
+// Clients must authenticate with given password, unless it's empty.
+func newFakeServer(password string) (*fakeServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &fakeServer{
+		listener: listener,
+		password: password,
+		entries:  map[string]*fakeEntry{},
+		scripts:  map[string]string{},
+		commands: map[string]int{},
+	}
+
+	server.wg.Add(1)
+	go server.serve()
+
+	return server, nil
+}
+
+// Address returns the address of the server.
+func (server *fakeServer) Address() string {
+	return server.listener.Addr().String()
+}
+
+// Value returns the counter stored at given key, if it has not expired.
+func (server *fakeServer) Value(key string) (int64, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	entry, ok := server.load(key)
+	if !ok {
+		return 0, false
+	}
+	return entry.value, true
+}
+
+// Commands returns the number of times given command has been received.
+func (server *fakeServer) Commands(name string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.commands[name]
+}
+
+// FlushScripts removes every cached script, like SCRIPT FLUSH.
+func (server *fakeServer) FlushScripts() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.scripts = map[string]string{}
+}
+
+// SetClock shifts the clock returned to lua scripts by given offset.
+func (server *fakeServer) SetClock(offset time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.offset = offset
+}
+
+// Close stops the server, and closes every connection.
+func (server *fakeServer) Close() {
+	_ = server.listener.Close()
+	server.wg.Wait()
+}
+
+func (server *fakeServer) serve() {
+	defer server.wg.Done()
+
+	conns := []net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		conns = append(conns, conn)
+
+		server.wg.Add(1)
+		go server.handle(conn)
+	}
+}
+
+// fakeSession is the state of a connection to a fake redis server.
+type fakeSession struct {
+	protocol      int
+	authenticated bool
+}
+
+func (server *fakeServer) handle(conn net.Conn) {
+	defer server.wg.Done()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	session := &fakeSession{
+		protocol:      2,
+		authenticated: server.password == "",
+	}
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		_, _ = writer.WriteString(server.execute(session, args))
+
+		// Pipelined commands are answered together.
+		if reader.Buffered() == 0 {
+			err = writer.Flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	length, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, length)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+
+	return args, nil
+}
+
+// execute runs given command, and returns its reply.
+func (server *fakeServer) execute(session *fakeSession, args []string) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+
+	name := strings.ToUpper(args[0])
+	server.commands[name]++
+
+	if name == "HELLO" {
+		return server.hello(session, args)
+	}
+	if name == "AUTH" {
+		if args[len(args)-1] != server.password {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		session.authenticated = true
+		return "+OK\r\n"
+	}
+	if !session.authenticated {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	switch name {
+	case "PING":
+		return "+PONG\r\n"
+
+	case "SELECT":
+		return "+OK\r\n"
+
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := server.load(key); ok {
+				delete(server.entries, key)
+				deleted++
+			}
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n"
+
+	case "EVAL", "EVALSHA":
+		if len(args) < 4 || args[2] != "1" {
+			return "-ERR wrong number of arguments\r\n"
+		}
+
+		source := args[1]
+		if name == "EVALSHA" {
+			var ok bool
+			source, ok = server.scripts[args[1]]
+			if !ok {
+				return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+			}
+		} else {
+			hash := sha1.Sum([]byte(source))
+			server.scripts[hex.EncodeToString(hash[:])] = source
+		}
+
+		return server.eval(source, args[3], args[4:])
+
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+// hello negotiates the protocol version, and authenticates the session if required.
+func (server *fakeServer) hello(session *fakeSession, args []string) string {
+	if len(args) < 2 || (args[1] != "2" && args[1] != "3") {
+		return "-NOPROTO unsupported protocol version\r\n"
+	}
+	if len(args) == 5 && strings.ToUpper(args[2]) == "AUTH" {
+		if args[4] != server.password {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		session.authenticated = true
+	}
+	if !session.authenticated {
+		return "-NOAUTH HELLO must be called with the client already authenticated.\r\n"
+	}
+
+	session.protocol, _ = strconv.Atoi(args[1])
+	if session.protocol == 3 {
+		return "%3\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$10\r\n7.0.0-fake\r\n$5\r\nproto\r\n:3\r\n"
+	}
+	return "*6\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$10\r\n7.0.0-fake\r\n$5\r\nproto\r\n:2\r\n"
+}
+
+// eval emulates the lua script of given source on given key.
+// WARNING: mutex must be held by the caller.
+func (server *fakeServer) eval(source string, key string, argv []string) string {
+	now := time.Now().Add(server.offset)
+
+	values := []int64{}
+	switch {
+	case strings.Contains(source, `"del"`):
+		delete(server.entries, key)
+		values = append(values, 0, 0)
+
+	case strings.Contains(source, `"incrby"`):
+		if len(argv) != 2 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+		count, err1 := strconv.ParseInt(argv[0], 10, 64)
+		ttl, err2 := strconv.ParseInt(argv[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+
+		entry, ok := server.load(key)
+		if !ok {
+			entry = &fakeEntry{}
+			if ttl > 0 {
+				entry.expiration = now.Add(time.Duration(ttl) * time.Millisecond)
+			}
+			server.entries[key] = entry
+		}
+		entry.value += count
+		values = append(values, entry.value, server.pttl(entry, now))
+
+	default:
+		entry, ok := server.load(key)
+		if !ok {
+			values = append(values, 0, 0)
+		} else {
+			values = append(values, entry.value, server.pttl(entry, now))
+		}
+	}
+
+	if strings.Contains(source, `redis.call("time")`) {
+		values = append(values, now.Unix(), int64(now.Nanosecond()/1000))
+	}
+
+	reply := "*" + strconv.Itoa(len(values)) + "\r\n"
+	for _, value := range values {
+		reply += ":" + strconv.FormatInt(value, 10) + "\r\n"
+	}
+	return reply
+}
+
+// pttl returns the remaining time to live of given entry, in milliseconds, or -1 if it doesn't expire.
+func (server *fakeServer) pttl(entry *fakeEntry, now time.Time) int64 {
+	if entry.expiration.IsZero() {
+		return -1
+	}
+	return int64(entry.expiration.Sub(now) / time.Millisecond)
+}
+
+// load returns the counter stored at given key, if it has not expired.
+// WARNING: mutex must be held by the caller.
+func (server *fakeServer) load(key string) (*fakeEntry, bool) {
+	entry, ok := server.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !entry.expiration.IsZero() && !time.Now().Add(server.offset).Before(entry.expiration) {
+		delete(server.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// newStaticServer starts a server on a random local port, which replies given reply to every read of a single
+// connection, without allocation. Commands must be sent one by one.
+func newStaticServer(reply string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		data := []byte(reply)
+		buffer := make([]byte, 4096)
+		for {
+			_, err = conn.Read(buffer)
+			if err == nil {
+				_, err = conn.Write(data)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return listener, nil
+}
@@ -0,0 +1,290 @@
+// Package resp provides a redis store with its own minimal client, speaking RESP2 or RESP3 directly, for
+// applications which don't want to depend on go-redis.
+//
+// Keys and lua scripts are the same as the redis store with its default key layout, so both stores can share the
+// same counters. Hash tags (StoreOptions.HashTag) aren't supported.
+package resp
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+	"github.com/panii/limiter/v3/internal/luascript"
+)
+
+// Options are options for the resp store.
+type Options struct {
+	// Username is the username sent with AUTH, for redis ACLs.
+	Username string
+	// Password is the password sent with AUTH. Connections are not authenticated if empty.
+	Password string
+	// DB is the database selected with SELECT.
+	DB int
+	// Protocol is the version of the protocol, 2 or 3. RESP3 is negotiated with HELLO, and requires redis 6.
+	// RESP2 is used if zero.
+	Protocol int
+	// PoolSize is the maximum number of connections. DefaultPoolSize is used if zero.
+	PoolSize int
+	// DialTimeout is the timeout to establish a connection. DefaultTimeout is used if zero.
+	DialTimeout time.Duration
+	// Timeout is the timeout of a request, when the context has no earlier deadline. DefaultTimeout is used if zero.
+	Timeout time.Duration
+	// StoreOptions are the options of the store: only Prefix and ServerTime are used, and HashTag is rejected.
+	StoreOptions limiter.StoreOptions
+}
+
+// Store is the resp store.
+type Store struct {
+	// errors is the number of failed operations on redis server.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// Prefix used for the key.
+	Prefix string
+	// ServerTime makes lua scripts return the time of redis server, which is used instead of the local clock to
+	// compute expirations.
+	ServerTime bool
+	// client used to communicate with redis server.
+	client *client
+	// incr is the "incr" lua script.
+	incr *script
+	// peek is the "peek" lua script.
+	peek *script
+	// reset is the "reset" lua script, only used with ServerTime.
+	reset *script
+	// closed is set to one when the store has been closed.
+	closed uint32
+	// closeOnce is used to close the client only once.
+	closeOnce sync.Once
+}
+
+// NewStore returns an instance of resp store with defaults, using given server address.
+func NewStore(address string) (limiter.Store, error) {
+	return NewStoreWithOptions(address, Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: limiter.DefaultPrefix,
+		},
+	})
+}
+
+// NewStoreWithOptions returns an instance of resp store with options, using given server address.
+// Connections are established lazily, so the server doesn't have to be available yet.
+func NewStoreWithOptions(address string, options Options) (limiter.Store, error) {
+	if address == "" {
+		return nil, errors.New("resp: server address is required")
+	}
+	if options.Protocol != 0 && options.Protocol != 2 && options.Protocol != 3 {
+		return nil, errors.Errorf("resp: unsupported protocol version %d", options.Protocol)
+	}
+	if options.StoreOptions.HashTag {
+		return nil, errors.New("resp: hash tags are not supported")
+	}
+
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultPoolSize
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = DefaultTimeout
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+
+	store := &Store{
+		Prefix:     options.StoreOptions.Prefix,
+		ServerTime: options.StoreOptions.ServerTime,
+		client:     newClient(address, options),
+		incr:       newScript(luascript.Incr),
+		peek:       newScript(luascript.Peek),
+		reset:      newScript(luascript.ResetTime),
+	}
+	if store.ServerTime {
+		store.incr = newScript(luascript.IncrTime)
+		store.peek = newScript(luascript.PeekTime)
+	}
+
+	return store, nil
+}
+
+// Get returns the limit for given identifier.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	calls := [1]call{{key: key, args: [2]int64{1, rate.Period.Milliseconds()}, nargs: 2}}
+	err := store.eval(ctx, store.incr, calls[:])
+	if err != nil {
+		return limiter.Context{}, err
+	}
+
+	return store.context(&calls[0], rate)
+}
+
+// GetMulti returns the limit of every request, in order, in a single round trip.
+func (store *Store) GetMulti(ctx context.Context, requests []limiter.Request) ([]limiter.Context, error) {
+	if store.Closed() {
+		return nil, limiter.ErrStoreClosed
+	}
+
+	calls := make([]call, len(requests))
+	for i := range requests {
+		calls[i] = call{key: requests[i].Key, args: [2]int64{1, requests[i].Rate.Period.Milliseconds()}, nargs: 2}
+	}
+
+	err := store.eval(ctx, store.incr, calls)
+	if err != nil {
+		return nil, err
+	}
+
+	contexts := make([]limiter.Context, len(requests))
+	for i := range calls {
+		contexts[i], err = store.context(&calls[i], requests[i].Rate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return contexts, nil
+}
+
+// Seed adds given number of hits to given identifier, which expires after given TTL if it's created.
+func (store *Store) Seed(ctx context.Context, key string, count int64, ttl time.Duration) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+
+	calls := [1]call{{key: key, args: [2]int64{count, ttl.Milliseconds()}, nargs: 2}}
+	return store.eval(ctx, store.incr, calls[:])
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	calls := [1]call{{key: key}}
+	err := store.eval(ctx, store.peek, calls[:])
+	if err != nil {
+		return limiter.Context{}, err
+	}
+
+	return store.context(&calls[0], rate)
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	now := time.Now()
+	if store.ServerTime {
+		calls := [1]call{{key: key}}
+		err := store.eval(ctx, store.reset, calls[:])
+		if err != nil {
+			return limiter.Context{}, err
+		}
+
+		_, _, now, err = store.state(&calls[0])
+		if err != nil {
+			return limiter.Context{}, err
+		}
+	} else {
+		err := store.client.Del(ctx, store.Prefix, key)
+		if err != nil {
+			atomic.AddInt64(&store.errors, 1)
+			return limiter.Context{}, errors.Wrap(err, "resp: cannot delete counter")
+		}
+	}
+
+	return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+}
+
+// Close closes every connection to redis server.
+func (store *Store) Close() error {
+	store.closeOnce.Do(func() {
+		atomic.StoreUint32(&store.closed, 1)
+		_ = store.client.Close()
+	})
+	return nil
+}
+
+// Closed returns true if the store has been closed.
+func (store *Store) Closed() bool {
+	return atomic.LoadUint32(&store.closed) != 0
+}
+
+// Ping returns an error if redis server is unreachable, or if the store has been closed.
+func (store *Store) Ping(ctx context.Context) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+
+	err := store.client.Ping(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to ping redis server")
+	}
+	return nil
+}
+
+// Stats returns the number of failed operations on redis server.
+// The number of keys is unknown, since the redis database may be shared with other applications.
+func (store *Store) Stats() limiter.StoreStats {
+	return limiter.StoreStats{
+		Keys:    -1,
+		Evicted: -1,
+		Errors:  atomic.LoadInt64(&store.errors),
+	}
+}
+
+// eval evaluates given script for every call.
+func (store *Store) eval(ctx context.Context, script *script, calls []call) error {
+	err := store.client.Eval(ctx, script, store.Prefix, calls)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return errors.Wrap(err, "resp: cannot evaluate lua script")
+	}
+	return nil
+}
+
+// context returns the context of given evaluated call.
+func (store *Store) context(call *call, rate limiter.Rate) (limiter.Context, error) {
+	count, ttl, now, err := store.state(call)
+	if err != nil {
+		return limiter.Context{}, err
+	}
+
+	expiration := now.Add(rate.Period)
+	if ttl > 0 {
+		expiration = now.Add(time.Duration(ttl) * time.Millisecond)
+	}
+
+	return common.GetContextFromState(now, rate, expiration, count), nil
+}
+
+// state returns the count, ttl and time returned by given evaluated call.
+// The time is the time of redis server if the script returns it, or the local time otherwise.
+func (store *Store) state(call *call) (int64, int64, time.Time, error) {
+	if call.err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return 0, 0, time.Time{}, errors.Wrap(call.err, "an error has occurred with redis command")
+	}
+
+	switch call.n {
+	case 2:
+		return call.state[0], call.state[1], time.Now(), nil
+	case 4:
+		now := time.Unix(call.state[2], call.state[3]*int64(time.Microsecond))
+		return call.state[0], call.state[1], now, nil
+	default:
+		atomic.AddInt64(&store.errors, 1)
+		return 0, 0, time.Time{}, errors.New("two or four elements in result were expected")
+	}
+}
@@ -0,0 +1,310 @@
+package resp_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/resp"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestRespStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	server, err := newFakeServer("")
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:sequential-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestRespStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	server, err := newFakeServer("")
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:concurrent-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestRespStoreBatchAccess(t *testing.T) {
+	is := require.New(t)
+
+	server, err := newFakeServer("")
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:batch-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreBatchAccess(t, store)
+}
+
+func TestRespStoreSeed(t *testing.T) {
+	is := require.New(t)
+
+	server, err := newFakeServer("")
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:seed-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSeed(t, store)
+}
+
+func TestRespStoreAllocations(t *testing.T) {
+	is := require.New(t)
+
+	// The fake server allocates to parse commands: a server replying a constant state isolates the client.
+	server, err := newStaticServer("*2\r\n:1\r\n:60000\r\n")
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := resp.NewStoreWithOptions(server.Addr().String(), resp.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:allocations-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreAllocations(t, store)
+}
+
+func TestRespStoreScriptCache(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	server, err := newFakeServer("")
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:script-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	// The script is sent once, then evaluated by its digest.
+	for i := 0; i < 3; i++ {
+		_, err = store.Get(ctx, "foo", rate)
+		is.NoError(err)
+	}
+	is.Equal(1, server.Commands("EVAL"))
+	is.Equal(3, server.Commands("EVALSHA"))
+
+	server.FlushScripts()
+
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.Equal(int64(6), lctx.Remaining)
+	is.Equal(2, server.Commands("EVAL"))
+
+	// Keys are the same as the redis store.
+	value, ok := server.Value("limiter:resp:script-test:foo")
+	is.True(ok)
+	is.Equal(int64(4), value)
+}
+
+func TestRespStoreHandshake(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	server, err := newFakeServer("secret")
+	is.NoError(err)
+	defer server.Close()
+
+	for _, protocol := range []int{2, 3} {
+		store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+			Password: "secret",
+			DB:       1,
+			Protocol: protocol,
+			StoreOptions: limiter.StoreOptions{
+				Prefix: "limiter:resp:handshake-test",
+			},
+		})
+		is.NoError(err)
+
+		is.NoError(store.(limiter.Pinger).Ping(ctx))
+
+		_, err = store.Reset(ctx, "foo", rate)
+		is.NoError(err)
+
+		lctx, err := store.Get(ctx, "foo", rate)
+		is.NoError(err)
+		is.Equal(int64(9), lctx.Remaining)
+
+		tests.CloseStore(t, store)
+	}
+	is.Equal(1, server.Commands("HELLO"))
+	is.Equal(1, server.Commands("AUTH"))
+	is.Equal(2, server.Commands("SELECT"))
+
+	store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+		Password: "wrong",
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:handshake-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	err = store.(limiter.Pinger).Ping(ctx)
+	is.Error(err)
+	is.Contains(err.Error(), "WRONGPASS")
+
+	_, err = resp.NewStoreWithOptions(server.Address(), resp.Options{Protocol: 4})
+	is.Error(err)
+
+	_, err = resp.NewStoreWithOptions(server.Address(), resp.Options{
+		StoreOptions: limiter.StoreOptions{HashTag: true},
+	})
+	is.Error(err)
+}
+
+func TestRespStoreServerTime(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	server, err := newFakeServer("")
+	is.NoError(err)
+	defer server.Close()
+	server.SetClock(time.Hour)
+
+	store, err := resp.NewStoreWithOptions(server.Address(), resp.Options{
+		StoreOptions: limiter.StoreOptions{
+			Prefix:     "limiter:resp:time-test",
+			ServerTime: true,
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	expected := time.Now().Add(time.Hour + time.Minute).Unix()
+
+	lctx, err := store.Get(ctx, "foo", rate)
+	is.NoError(err)
+	is.InDelta(expected, lctx.Reset, 1)
+
+	lctx, err = store.Peek(ctx, "foo", rate)
+	is.NoError(err)
+	is.InDelta(expected, lctx.Reset, 1)
+
+	lctx, err = store.Reset(ctx, "foo", rate)
+	is.NoError(err)
+	is.InDelta(expected, lctx.Reset, 1)
+	is.Equal(0, server.Commands("DEL"))
+
+	_, ok := server.Value("limiter:resp:time-test:foo")
+	is.False(ok)
+}
+
+func TestRespStoreTimeout(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	// A server which accepts connections, but never replies.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoError(err)
+
+	accepted := []net.Conn{}
+	mutex := sync.Mutex{}
+	defer func() {
+		_ = listener.Close()
+		mutex.Lock()
+		for _, conn := range accepted {
+			_ = conn.Close()
+		}
+		mutex.Unlock()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			accepted = append(accepted, conn)
+			mutex.Unlock()
+		}
+	}()
+
+	store, err := resp.NewStoreWithOptions(listener.Addr().String(), resp.Options{
+		Timeout: 50 * time.Millisecond,
+		StoreOptions: limiter.StoreOptions{
+			Prefix: "limiter:resp:timeout-test",
+		},
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	start := time.Now()
+	_, err = store.Get(ctx, "foo", rate)
+	is.Error(err)
+	is.True(time.Since(start) < time.Second)
+
+	is.Equal(int64(1), store.(limiter.StatsReporter).Stats().Errors)
+}
+
+func TestRespStoreClosed(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	server, err := newFakeServer("")
+	is.NoError(err)
+	defer server.Close()
+
+	store, err := resp.NewStore(server.Address())
+	is.NoError(err)
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.NoError(err)
+
+	tests.CloseStore(t, store)
+
+	_, err = store.Get(ctx, "foo", rate)
+	is.Equal(limiter.ErrStoreClosed, err)
+	is.Equal(limiter.ErrStoreClosed, store.(limiter.Pinger).Ping(ctx))
+}
@@ -0,0 +1,13 @@
+// Package shm provides a store backed by a memory-mapped file, so that every process on the same host shares
+// the same counters. It's only available on Linux.
+//
+// Counters are kept in a fixed-size open addressing hash table, updated with atomic operations: no lock is
+// shared between processes, except while an expired counter is renewed. A slot is locked with the PID of its owner:
+// if this process has crashed, other processes unlock it.
+//
+// A slot is found by the SipHash of its key, seeded randomly when the file is created, and identified by the length
+// and the first 64 bytes of its key. Longer keys which only differ after their first 64 bytes are identified by their
+// hash alone.
+//
+// Files created by an older version of this package must be removed, since the layout of their slots has changed.
+package shm
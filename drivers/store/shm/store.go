@@ -0,0 +1,289 @@
+//go:build linux
+// +build linux
+
+package shm
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+	"github.com/panii/limiter/v3/internal/fasttime"
+)
+
+// DefaultSlots is the default number of slots of a shared-memory table, which can hold about a million keys, in a
+// file of 208 MiB.
+const DefaultSlots = 1 << 21
+
+// Store is the shared-memory store.
+type Store struct {
+	// Prefix used for the key.
+	Prefix string
+	// file is the memory-mapped file.
+	file *os.File
+	// table holds the counters.
+	table *table
+	// closed is used to close the store only once.
+	closed uint32
+	// mutex prevents the table to be unmapped while it's used.
+	mutex sync.RWMutex
+}
+
+// NewStore returns an instance of shared-memory store with defaults, using given file.
+func NewStore(path string) (limiter.Store, error) {
+	return NewStoreWithOptions(path, DefaultSlots, limiter.StoreOptions{
+		Prefix: limiter.DefaultPrefix,
+	})
+}
+
+// NewStoreWithOptions returns an instance of shared-memory store with options, using given file.
+// The file is created with given number of slots, rounded up to a power of two, if it doesn't exist yet.
+// Otherwise, its number of slots is preserved, so every process sharing this file uses the same table.
+func NewStoreWithOptions(path string, slots int, options limiter.StoreOptions) (limiter.Store, error) {
+	if slots <= 0 {
+		return nil, errors.Errorf("shm: invalid number of slots %d", slots)
+	}
+	size := 1
+	for size < slots {
+		size <<= 1
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "shm: cannot open file")
+	}
+
+	data, err := mapFile(file, size)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	table, err := openTable(data)
+	if err != nil {
+		_ = syscall.Munmap(data)
+		_ = file.Close()
+		return nil, err
+	}
+
+	store := &Store{
+		Prefix: options.Prefix,
+		file:   file,
+		table:  table,
+	}
+
+	return store, nil
+}
+
+// mapFile maps given file in memory, and initializes its table if it's empty, or if its header has never been written.
+// An exclusive lock prevents two processes to initialize the same file concurrently.
+func mapFile(file *os.File, slots int) ([]byte, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return nil, errors.Wrap(err, "shm: cannot lock file")
+	}
+	defer func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "shm: cannot stat file")
+	}
+
+	size := info.Size()
+	created := size == 0
+	if !created {
+		// A process may have crashed after allocating the file, before writing its header.
+		created, err = uninitialized(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if created {
+		size = int64(tableSize(slots))
+		err = file.Truncate(0)
+		if err == nil {
+			err = file.Truncate(size)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "shm: cannot allocate file")
+		}
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "shm: cannot map file")
+	}
+
+	if created {
+		err = initTable(data, slots)
+		if err != nil {
+			_ = syscall.Munmap(data)
+			_ = file.Truncate(0)
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// uninitialized returns true if the magic of the table header of given file has never been written: it's written
+// last by initTable.
+func uninitialized(file *os.File) (bool, error) {
+	magic := make([]byte, len(tableMagic))
+	_, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, errors.Wrap(err, "shm: cannot read file")
+	}
+
+	for i := range magic {
+		if magic[i] != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Get returns the limit for given identifier.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.table == nil {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	buffer.Concat(store.Prefix, ":", key)
+
+	now := int64(fasttime.Now())
+	slot, err := store.table.acquire(buffer.String(), now)
+	if err != nil {
+		return limiter.Context{}, err
+	}
+
+	count, expiration := slot.increment(now, 1, now+int64(rate.Period))
+
+	lctx := common.GetContextFromState(time.Unix(0, now), rate, time.Unix(0, expiration), count)
+	return lctx, nil
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.table == nil {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	buffer.Concat(store.Prefix, ":", key)
+
+	now := int64(fasttime.Now())
+	count, expiration := int64(0), now+int64(rate.Period)
+
+	slot := store.table.lookup(buffer.String())
+	if slot != nil {
+		count, expiration = slot.load(now, expiration)
+	}
+
+	lctx := common.GetContextFromState(time.Unix(0, now), rate, time.Unix(0, expiration), count)
+	return lctx, nil
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.table == nil {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	buffer := bytebuffer.New()
+	defer buffer.Close()
+	buffer.Concat(store.Prefix, ":", key)
+
+	now := int64(fasttime.Now())
+
+	slot := store.table.lookup(buffer.String())
+	if slot != nil {
+		slot.reset(now)
+	}
+
+	lctx := common.GetContextFromState(time.Unix(0, now), rate, time.Unix(0, now+int64(rate.Period)), 0)
+	return lctx, nil
+}
+
+// Close unmaps the shared-memory table. Counters are kept in the file for other processes.
+func (store *Store) Close() error {
+	if !atomic.CompareAndSwapUint32(&store.closed, 0, 1) {
+		return nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	data := store.table.data
+	store.table = nil
+
+	err := syscall.Munmap(data)
+	if err != nil {
+		_ = store.file.Close()
+		return errors.Wrap(err, "shm: cannot unmap file")
+	}
+
+	return store.file.Close()
+}
+
+// Ping returns an error if the store has been closed.
+func (store *Store) Ping(ctx context.Context) error {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return limiter.ErrStoreClosed
+	}
+	return nil
+}
+
+// Stats returns the number of keys that have not expired yet.
+// It has to visit every slot of the table.
+func (store *Store) Stats() limiter.StoreStats {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	stats := limiter.StoreStats{
+		Keys:    -1,
+		Evicted: -1,
+		Errors:  -1,
+	}
+	if store.table == nil {
+		return stats
+	}
+
+	now := int64(fasttime.Now())
+	stats.Keys = 0
+	for i := range store.table.slots {
+		slot := &store.table.slots[i]
+		if atomic.LoadUint64(&slot.tag) == 0 {
+			continue
+		}
+		expiration := atomic.LoadInt64(&slot.expiration)
+		if expiration == slotRenewing || now <= expiration {
+			stats.Keys++
+		}
+	}
+
+	return stats
+}
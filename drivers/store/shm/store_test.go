@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package shm_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/shm"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+func TestSharedMemoryStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := shm.NewStoreWithOptions(path, 1024, limiter.StoreOptions{
+		Prefix: "limiter:shm:sequential-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreSequentialAccess(t, store)
+}
+
+func TestSharedMemoryStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := shm.NewStoreWithOptions(path, 1024, limiter.StoreOptions{
+		Prefix: "limiter:shm:concurrent-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	tests.TestStoreConcurrentAccess(t, store)
+}
+
+func TestSharedMemoryStoreUninitializedFile(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	// A process has crashed after allocating the file, before writing its header.
+	path := tempFile(t)
+	defer removeTempFile(path)
+	is.NoError(ioutil.WriteFile(path, make([]byte, 4096), 0600))
+
+	store, err := shm.NewStoreWithOptions(path, 16, limiter.StoreOptions{
+		Prefix: "limiter:shm:uninitialized-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	lctx, err := store.Get(ctx, "foo", limiter.Rate{Limit: 10, Period: time.Minute})
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+}
+
+func TestSharedMemoryStoreTableFull(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	store, err := shm.NewStoreWithOptions(path, 3, limiter.StoreOptions{
+		Prefix: "limiter:shm:full-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+	for i := 0; i < 4; i++ {
+		_, err = store.Get(ctx, strconv.Itoa(i), rate)
+		is.NoError(err)
+	}
+
+	_, err = store.Get(ctx, "4", rate)
+	is.Equal(shm.ErrTableFull, err)
+
+	// Existing keys are still available.
+	lctx, err := store.Get(ctx, "0", rate)
+	is.NoError(err)
+	is.Equal(int64(8), lctx.Remaining)
+	is.Equal(int64(4), store.(limiter.StatsReporter).Stats().Keys)
+}
+
+const (
+	childPathEnv = "LIMITER_SHM_CHILD_PATH"
+	childOps     = 500
+	childCount   = 4
+)
+
+// TestSharedMemoryStoreMultipleProcesses verifies that counters are shared between processes.
+func TestSharedMemoryStoreMultipleProcesses(t *testing.T) {
+	if os.Getenv(childPathEnv) != "" {
+		t.Skip("running as a child process")
+	}
+
+	is := require.New(t)
+	ctx := context.Background()
+	path := tempFile(t)
+	defer removeTempFile(path)
+
+	children := make([]*exec.Cmd, childCount)
+	for i := range children {
+		children[i] = exec.Command(os.Args[0], "-test.run=TestSharedMemoryStoreChild")
+		children[i].Env = append(os.Environ(), childPathEnv+"="+path)
+		is.NoError(children[i].Start())
+	}
+	for i := range children {
+		is.NoError(children[i].Wait())
+	}
+
+	store, err := shm.NewStoreWithOptions(path, 1024, limiter.StoreOptions{
+		Prefix: "limiter:shm:process-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	lctx, err := store.Peek(ctx, "foo", childRate())
+	is.NoError(err)
+	is.Equal(int64(childRate().Limit-childOps*childCount), lctx.Remaining)
+}
+
+// TestSharedMemoryStoreChild is executed by child processes of TestSharedMemoryStoreMultipleProcesses.
+func TestSharedMemoryStoreChild(t *testing.T) {
+	path := os.Getenv(childPathEnv)
+	if path == "" {
+		t.Skip("not running as a child process")
+	}
+
+	is := require.New(t)
+	ctx := context.Background()
+
+	store, err := shm.NewStoreWithOptions(path, 1024, limiter.StoreOptions{
+		Prefix: "limiter:shm:process-test",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	for i := 0; i < childOps; i++ {
+		_, err = store.Get(ctx, "foo", childRate())
+		is.NoError(err)
+	}
+}
+
+func BenchmarkSharedMemoryStoreSequentialAccess(b *testing.B) {
+	is := require.New(b)
+
+	path := tempFile(b)
+	defer removeTempFile(path)
+
+	store, err := shm.NewStoreWithOptions(path, 1024, limiter.StoreOptions{
+		Prefix: "limiter:shm:sequential-benchmark",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(b, store)
+
+	tests.BenchmarkStoreSequentialAccess(b, store)
+}
+
+func BenchmarkSharedMemoryStoreConcurrentAccess(b *testing.B) {
+	is := require.New(b)
+
+	path := tempFile(b)
+	defer removeTempFile(path)
+
+	store, err := shm.NewStoreWithOptions(path, 1024, limiter.StoreOptions{
+		Prefix: "limiter:shm:concurrent-benchmark",
+	})
+	is.NoError(err)
+	defer tests.CloseStore(b, store)
+
+	tests.BenchmarkStoreConcurrentAccess(b, store)
+}
+
+func childRate() limiter.Rate {
+	return limiter.Rate{
+		Limit:  100000,
+		Period: time.Minute,
+	}
+}
+
+func tempFile(tb testing.TB) string {
+	directory, err := ioutil.TempDir("", "limiter-shm")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return filepath.Join(directory, "limiter.shm")
+}
+
+func removeTempFile(path string) {
+	_ = os.RemoveAll(filepath.Dir(path))
+}
@@ -0,0 +1,411 @@
+//go:build linux
+// +build linux
+
+package shm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// headerSize is the size of the table header, at the beginning of the file.
+	headerSize = 64
+	// slotSize is the size of a slot.
+	slotSize = int(unsafe.Sizeof(slot{}))
+	// tableMagic identifies a file created by this package.
+	tableMagic = "LMTSHM"
+	// tableVersion is the version of the table layout.
+	tableVersion = 3
+	// seedOffset is the offset of the hash seed in the table header.
+	seedOffset = 24
+	// slotKeyWords is the number of 64-bit words of a key kept in its slot.
+	slotKeyWords = 8
+
+	// maxProbe is the maximum number of slots visited to find a key.
+	maxProbe = 256
+	// slotRenewing is the expiration of a slot while it's being renewed, reset or reclaimed.
+	slotRenewing = -1
+	// reclaimDelay is the delay after its expiration before a slot can be reused by another key.
+	reclaimDelay = int64(time.Minute)
+	// maxSpin is the number of attempts before the owner of a locked slot is checked, and the slot is unlocked if
+	// this process has crashed.
+	maxSpin = 1 << 20
+	// tagPending is set on the tag of a slot while its key is written.
+	tagPending = uint64(1) << 63
+)
+
+// ErrTableFull is returned when there is no slot left for a new key.
+var ErrTableFull = errors.New("shm: table is full")
+
+// pid is the process identifier stored in the slots locked by this process.
+var pid = uint64(os.Getpid())
+
+// slot holds a counter, identified by its key: its length and its first bytes are compared, and the rest of a
+// longer key is only identified by the keyed hash of the whole key.
+// Every field is accessed with atomic operations, since it's shared with other processes.
+// The owner of a slot is the PID of the process which has locked it, either while renewing it or while writing its
+// key, and zero otherwise.
+type slot struct {
+	tag        uint64
+	expiration int64
+	value      int64
+	length     uint64
+	owner      uint64
+	key        [slotKeyWords]uint64
+}
+
+// table is an open addressing hash table on a memory-mapped region.
+type table struct {
+	data  []byte
+	slots []slot
+	mask  uint64
+	// seed is the key of the hash function, generated randomly for each file.
+	seed [2]uint64
+}
+
+// initTable writes a table header on given region, with a random hash seed.
+// The magic is written last, so a header without magic is incomplete.
+func initTable(data []byte, slots int) error {
+	_, err := rand.Read(data[seedOffset : seedOffset+16])
+	if err != nil {
+		return errors.Wrap(err, "shm: cannot generate hash seed")
+	}
+
+	binary.LittleEndian.PutUint32(data[8:], tableVersion)
+	binary.LittleEndian.PutUint64(data[16:], uint64(slots))
+	copy(data, tableMagic)
+	return nil
+}
+
+// openTable returns the table stored on given region.
+func openTable(data []byte) (*table, error) {
+	if len(data) < headerSize || string(data[:len(tableMagic)]) != tableMagic {
+		return nil, errors.New("shm: file is not a shared-memory table")
+	}
+	if binary.LittleEndian.Uint32(data[8:]) != tableVersion {
+		return nil, errors.New("shm: unsupported table version")
+	}
+
+	slots := binary.LittleEndian.Uint64(data[16:])
+	if slots == 0 || slots&(slots-1) != 0 || uint64(len(data)) < tableSize(int(slots)) {
+		return nil, errors.New("shm: corrupted table header")
+	}
+
+	return &table{
+		data:  data,
+		slots: (*[1 << 40]slot)(unsafe.Pointer(&data[headerSize]))[:slots:slots],
+		mask:  slots - 1,
+		seed: [2]uint64{
+			binary.LittleEndian.Uint64(data[seedOffset:]),
+			binary.LittleEndian.Uint64(data[seedOffset+8:]),
+		},
+	}, nil
+}
+
+// tableSize returns the size of a table with given number of slots.
+func tableSize(slots int) uint64 {
+	return uint64(headerSize) + uint64(slots)*uint64(slotSize)
+}
+
+// hash returns the tag of given key, using SipHash-2-4 keyed with the seed of the table, so that colliding keys
+// can't be chosen by a client. Zero is reserved for empty slots, and tagPending for slots being written.
+func (table *table) hash(key string) uint64 {
+	tag := siphash(table.seed[0], table.seed[1], key) &^ tagPending
+	if tag == 0 {
+		tag = 1
+	}
+	return tag
+}
+
+// lookup returns the slot of given key, or nil if it doesn't exist.
+func (table *table) lookup(key string) *slot {
+	tag := table.hash(key)
+	index := tag & table.mask
+	for probe := uint64(0); probe < maxProbe && probe <= table.mask; probe++ {
+		slot := &table.slots[(index+probe)&table.mask]
+		current := slot.loadTag()
+		if current == tag && slot.matches(key) {
+			return slot
+		}
+		if current == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// acquire returns the slot of given key, and creates it if required.
+// An empty slot is used for a new key, unless an earlier slot on the probe sequence has expired long enough ago to be
+// reclaimed.
+func (table *table) acquire(key string, now int64) (*slot, error) {
+	tag := table.hash(key)
+	index := tag & table.mask
+
+	for {
+		var candidate *slot
+		var candidateExpiration int64
+		retry := false
+
+		for probe := uint64(0); probe < maxProbe && probe <= table.mask; probe++ {
+			slot := &table.slots[(index+probe)&table.mask]
+			expiration := slot.loadExpiration()
+
+			current := slot.loadTag()
+			if current == tag && slot.matches(key) {
+				return slot, nil
+			}
+
+			if current == 0 {
+				if candidate != nil {
+					if candidate.reclaim(candidateExpiration, tag, key) {
+						return candidate, nil
+					}
+					retry = true
+					break
+				}
+
+				if atomic.CompareAndSwapUint64(&slot.tag, 0, tag|tagPending) {
+					atomic.StoreUint64(&slot.owner, pid)
+					slot.storeKey(key)
+					atomic.StoreUint64(&slot.owner, 0)
+					atomic.StoreUint64(&slot.tag, tag)
+					return slot, nil
+				}
+				if slot.loadTag() == tag && slot.matches(key) {
+					return slot, nil
+				}
+				continue
+			}
+
+			// A slot that has never been incremented is not a candidate: its owner is about to use it.
+			if candidate == nil && expiration != 0 && now-expiration > reclaimDelay {
+				candidate = slot
+				candidateExpiration = expiration
+			}
+		}
+
+		if retry {
+			continue
+		}
+
+		if candidate != nil && candidate.reclaim(candidateExpiration, tag, key) {
+			return candidate, nil
+		}
+		if candidate != nil {
+			continue
+		}
+
+		return nil, ErrTableFull
+	}
+}
+
+// loadTag returns the slot tag, waiting for any key being written.
+func (slot *slot) loadTag() uint64 {
+	for spin := 0; ; spin++ {
+		tag := atomic.LoadUint64(&slot.tag)
+		if tag&tagPending == 0 {
+			return tag
+		}
+		if spin >= maxSpin {
+			// If the process writing this key has crashed, unlock it: a partial key won't match.
+			if !slot.locked() {
+				atomic.CompareAndSwapUint64(&slot.tag, tag, tag&^tagPending)
+			}
+			spin = 0
+		}
+		runtime.Gosched()
+	}
+}
+
+// matches returns true if the key of this slot is given key.
+func (slot *slot) matches(key string) bool {
+	if atomic.LoadUint64(&slot.length) != uint64(len(key)) {
+		return false
+	}
+	for i := 0; i < slotKeyWords && i*8 < len(key); i++ {
+		if atomic.LoadUint64(&slot.key[i]) != keyWord(key, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// storeKey writes given key on this slot. Its length is written last, so a partial key never matches.
+func (slot *slot) storeKey(key string) {
+	atomic.StoreUint64(&slot.length, 0)
+	for i := 0; i < slotKeyWords; i++ {
+		atomic.StoreUint64(&slot.key[i], keyWord(key, i))
+	}
+	atomic.StoreUint64(&slot.length, uint64(len(key)))
+}
+
+// keyWord returns the given 64-bit word of given key, padded with zeros.
+func keyWord(key string, index int) uint64 {
+	word := uint64(0)
+	for i := 0; i < 8 && index*8+i < len(key); i++ {
+		word |= uint64(key[index*8+i]) << (8 * uint(i))
+	}
+	return word
+}
+
+// loadExpiration returns the slot expiration, waiting for any renewal in progress.
+func (slot *slot) loadExpiration() int64 {
+	for spin := 0; ; spin++ {
+		expiration := atomic.LoadInt64(&slot.expiration)
+		if expiration != slotRenewing {
+			return expiration
+		}
+		if spin >= maxSpin {
+			// If the process renewing this slot has crashed, unlock it as expired.
+			if !slot.locked() {
+				atomic.CompareAndSwapInt64(&slot.expiration, slotRenewing, 0)
+			}
+			spin = 0
+		}
+		runtime.Gosched()
+	}
+}
+
+// locked returns true if the owner of this slot is a running process.
+// A slot without owner has been locked by a process which has crashed before storing its PID, or it's about to be
+// unlocked: it's never locked for long by a running process. PIDs are only meaningful in the same PID namespace, so
+// processes sharing a file must run in the same one.
+func (slot *slot) locked() bool {
+	owner := atomic.LoadUint64(&slot.owner)
+	if owner == 0 {
+		return false
+	}
+
+	err := syscall.Kill(int(owner), 0)
+	if err == syscall.ESRCH {
+		atomic.CompareAndSwapUint64(&slot.owner, owner, 0)
+		return false
+	}
+	return true
+}
+
+// reclaim reuses an expired slot for another key.
+func (slot *slot) reclaim(expiration int64, tag uint64, key string) bool {
+	if !atomic.CompareAndSwapInt64(&slot.expiration, expiration, slotRenewing) {
+		return false
+	}
+	atomic.StoreUint64(&slot.owner, pid)
+	atomic.StoreUint64(&slot.tag, tag|tagPending)
+	slot.storeKey(key)
+	atomic.StoreUint64(&slot.tag, tag)
+	atomic.StoreInt64(&slot.value, 0)
+	atomic.StoreUint64(&slot.owner, 0)
+	atomic.StoreInt64(&slot.expiration, 0)
+	return true
+}
+
+// load returns the value and the expiration of this slot at given time, in nanoseconds.
+// If the slot is expired, it will use the given expiration.
+func (slot *slot) load(now int64, expiration int64) (int64, int64) {
+	for {
+		current := slot.loadExpiration()
+		if current == 0 || now > current {
+			return 0, expiration
+		}
+
+		value := atomic.LoadInt64(&slot.value)
+		if atomic.LoadInt64(&slot.expiration) == current {
+			return value, current
+		}
+	}
+}
+
+// increment increments given value on this slot at given time, in nanoseconds.
+// If the slot is expired, it will use the given expiration.
+func (slot *slot) increment(now int64, value int64, expiration int64) (int64, int64) {
+	for {
+		current := slot.loadExpiration()
+
+		if current != 0 && now <= current {
+			result := atomic.AddInt64(&slot.value, value)
+			return result, slot.loadExpiration()
+		}
+
+		if !atomic.CompareAndSwapInt64(&slot.expiration, current, slotRenewing) {
+			continue
+		}
+
+		atomic.StoreUint64(&slot.owner, pid)
+		atomic.StoreInt64(&slot.value, value)
+		atomic.StoreUint64(&slot.owner, 0)
+		atomic.StoreInt64(&slot.expiration, expiration)
+		return value, expiration
+	}
+}
+
+// reset expires this slot at given time, in nanoseconds.
+func (slot *slot) reset(now int64) {
+	for {
+		current := slot.loadExpiration()
+		if atomic.CompareAndSwapInt64(&slot.expiration, current, slotRenewing) {
+			atomic.StoreUint64(&slot.owner, pid)
+			atomic.StoreInt64(&slot.value, 0)
+			atomic.StoreUint64(&slot.owner, 0)
+			atomic.StoreInt64(&slot.expiration, now)
+			return
+		}
+	}
+}
+
+// siphash returns the SipHash-2-4 of given data, with given key.
+func siphash(k0 uint64, k1 uint64, data string) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(data)
+	for ; len(data) >= 8; data = data[8:] {
+		m := keyWord(data, 0)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	m := keyWord(data, 0) | uint64(length)<<56
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package shm
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSiphash(t *testing.T) {
+	is := require.New(t)
+
+	// Reference vector of SipHash-2-4, with key 00..0f and message 00..0e.
+	key := make([]byte, 16)
+	data := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	is.Equal(uint64(0xa129ca6149be45e5), siphash(keyWord(string(key), 0), keyWord(string(key), 1), string(data)))
+}
+
+func TestTableKeyCollision(t *testing.T) {
+	is := require.New(t)
+
+	data := make([]byte, tableSize(16))
+	is.NoError(initTable(data, 16))
+	table, err := openTable(data)
+	is.NoError(err)
+
+	long := strings.Repeat("x", 100)
+	scenarios := []struct {
+		key   string
+		other string
+	}{
+		{key: "limiter:foo", other: "limiter:bar"},
+		{key: "limiter:foo", other: "limiter:foo2"},
+		{key: long + "1", other: long[:90] + "y1"},
+	}
+
+	for _, scenario := range scenarios {
+		// The key of another slot has the same tag, as if their hashes collided.
+		tag := table.hash(scenario.key)
+		other := &table.slots[tag&table.mask]
+		other.tag = tag
+		other.storeKey(scenario.other)
+
+		is.Nil(table.lookup(scenario.key), scenario.key)
+
+		acquired, err := table.acquire(scenario.key, 1)
+		is.NoError(err)
+		is.True(acquired != other, scenario.key)
+		is.True(acquired == table.lookup(scenario.key), scenario.key)
+		is.True(other.matches(scenario.other), scenario.other)
+
+		for i := range table.slots {
+			table.slots[i] = slot{}
+		}
+	}
+}
+
+func TestSlotCrashedOwner(t *testing.T) {
+	is := require.New(t)
+
+	// A process which has exited is not running anymore.
+	command := exec.Command("true")
+	is.NoError(command.Run())
+	crashed := uint64(command.ProcessState.Pid())
+
+	slot := &slot{expiration: slotRenewing, owner: pid}
+	is.True(slot.locked())
+
+	slot.owner = crashed
+	is.False(slot.locked())
+	is.Equal(int64(0), slot.loadExpiration())
+
+	slot.tag = 42 | tagPending
+	slot.owner = crashed
+	is.Equal(uint64(42), slot.loadTag())
+}
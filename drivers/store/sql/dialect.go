@@ -0,0 +1,113 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// Dialect contains the statements used by the store for a database engine.
+//
+// Counters are stored in the limiter_counters table, with the expiration in nanoseconds since Unix epoch.
+type Dialect struct {
+	// Name is the name of the database engine.
+	Name string
+	// Schema contains the statements creating the counters table.
+	// They must be idempotent, since they are executed by Migrate on every startup.
+	Schema []string
+	// Increment atomically creates or increments a counter, and renews it if it has expired.
+	// Its arguments are the key, the expiration of a new counter and the current time.
+	Increment string
+	// Returning is true if Increment returns the counter value and expiration.
+	// Otherwise, Select is executed after Increment in the same transaction.
+	Returning bool
+	// Select returns the value and the expiration of a counter.
+	// Its argument is the key.
+	Select string
+	// Delete removes a counter.
+	// Its argument is the key.
+	Delete string
+	// Purge removes every expired counter.
+	// Its argument is the current time.
+	Purge string
+}
+
+// Postgres is the dialect for PostgreSQL 9.5 and later.
+var Postgres = Dialect{
+	Name: "postgres",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS limiter_counters (
+	key_name VARCHAR(255) NOT NULL PRIMARY KEY,
+	hits BIGINT NOT NULL,
+	expiration BIGINT NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS limiter_counters_expiration ON limiter_counters (expiration)`,
+	},
+	Increment: `INSERT INTO limiter_counters (key_name, hits, expiration) VALUES ($1, 1, $2)
+ON CONFLICT (key_name) DO UPDATE SET
+	hits = CASE WHEN limiter_counters.expiration < $3 THEN 1 ELSE limiter_counters.hits + 1 END,
+	expiration = CASE WHEN limiter_counters.expiration < $3 THEN EXCLUDED.expiration ELSE limiter_counters.expiration END
+RETURNING hits, expiration`,
+	Returning: true,
+	Select:    `SELECT hits, expiration FROM limiter_counters WHERE key_name = $1`,
+	Delete:    `DELETE FROM limiter_counters WHERE key_name = $1`,
+	Purge:     `DELETE FROM limiter_counters WHERE expiration < $1`,
+}
+
+// MySQL is the dialect for MySQL 5.7 and later, using InnoDB.
+//
+// Assignments of ON DUPLICATE KEY UPDATE are evaluated from left to right, so the expiration is renewed when hits
+// has just been reset: hits is never equal to one after an increment of an existing counter.
+var MySQL = Dialect{
+	Name: "mysql",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS limiter_counters (
+	key_name VARCHAR(255) NOT NULL PRIMARY KEY,
+	hits BIGINT NOT NULL,
+	expiration BIGINT NOT NULL,
+	INDEX limiter_counters_expiration (expiration)
+) ENGINE=InnoDB`,
+	},
+	Increment: `INSERT INTO limiter_counters (key_name, hits, expiration) VALUES (?, 1, ?)
+ON DUPLICATE KEY UPDATE
+	hits = IF(expiration < ?, 1, hits + 1),
+	expiration = IF(hits = 1, VALUES(expiration), expiration)`,
+	Returning: false,
+	Select:    `SELECT hits, expiration FROM limiter_counters WHERE key_name = ?`,
+	Delete:    `DELETE FROM limiter_counters WHERE key_name = ?`,
+	Purge:     `DELETE FROM limiter_counters WHERE expiration < ?`,
+}
+
+// SQLite is the dialect for SQLite 3.35 and later.
+var SQLite = Dialect{
+	Name: "sqlite",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS limiter_counters (
+	key_name TEXT NOT NULL PRIMARY KEY,
+	hits INTEGER NOT NULL,
+	expiration INTEGER NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS limiter_counters_expiration ON limiter_counters (expiration)`,
+	},
+	Increment: `INSERT INTO limiter_counters (key_name, hits, expiration) VALUES (?1, 1, ?2)
+ON CONFLICT (key_name) DO UPDATE SET
+	hits = CASE WHEN limiter_counters.expiration < ?3 THEN 1 ELSE limiter_counters.hits + 1 END,
+	expiration = CASE WHEN limiter_counters.expiration < ?3 THEN excluded.expiration ELSE limiter_counters.expiration END
+RETURNING hits, expiration`,
+	Returning: true,
+	Select:    `SELECT hits, expiration FROM limiter_counters WHERE key_name = ?1`,
+	Delete:    `DELETE FROM limiter_counters WHERE key_name = ?1`,
+	Purge:     `DELETE FROM limiter_counters WHERE expiration < ?1`,
+}
+
+// Migrate creates the counters table, and its indexes, if they don't exist yet.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	for _, statement := range dialect.Schema {
+		_, err := db.ExecContext(ctx, statement)
+		if err != nil {
+			return errors.Wrapf(err, "sql: cannot migrate %s schema", dialect.Name)
+		}
+	}
+	return nil
+}
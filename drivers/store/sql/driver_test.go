@@ -0,0 +1,206 @@
+package sql_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	sqlstore "github.com/panii/limiter/v3/drivers/store/sql"
+)
+
+// fakeDriverCount is used to register a fake driver with a unique name for each test.
+var fakeDriverCount int64
+
+// fakeCounter is a row of the counters table.
+type fakeCounter struct {
+	hits       int64
+	expiration int64
+}
+
+// fakeDriver is a database/sql driver which executes the statements of a dialect on an in-memory table,
+// and records every statement it receives.
+type fakeDriver struct {
+	dialect    sqlstore.Dialect
+	mutex      sync.Mutex
+	counters   map[string]*fakeCounter
+	statements []string
+}
+
+// openFakeDatabase returns a database using a new fake driver for given dialect.
+func openFakeDatabase(dialect sqlstore.Dialect) (*sql.DB, *fakeDriver) {
+	fake := &fakeDriver{
+		dialect:  dialect,
+		counters: map[string]*fakeCounter{},
+	}
+
+	name := "limiter-fake-" + strconv.FormatInt(atomic.AddInt64(&fakeDriverCount, 1), 10)
+	sql.Register(name, fake)
+
+	db, err := sql.Open(name, "")
+	if err != nil {
+		panic(err)
+	}
+	return db, fake
+}
+
+// Statements returns every statement received by the driver.
+func (fake *fakeDriver) Statements() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return append([]string(nil), fake.statements...)
+}
+
+// Open implements driver.Driver.
+func (fake *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{driver: fake}, nil
+}
+
+// execute runs given statement on the in-memory table, and returns the resulting rows, if any.
+func (fake *fakeDriver) execute(query string, args []driver.NamedValue) ([][]driver.Value, int64, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.statements = append(fake.statements, query)
+
+	for _, statement := range fake.dialect.Schema {
+		if query == statement {
+			return nil, 0, nil
+		}
+	}
+
+	switch query {
+	case fake.dialect.Increment:
+		key, expiration, now := args[0].Value.(string), args[1].Value.(int64), args[2].Value.(int64)
+		counter, ok := fake.counters[key]
+		if !ok {
+			counter = &fakeCounter{hits: 0, expiration: expiration}
+			fake.counters[key] = counter
+		}
+		if counter.expiration < now {
+			counter.hits = 0
+			counter.expiration = expiration
+		}
+		counter.hits++
+		if !fake.dialect.Returning {
+			return nil, 1, nil
+		}
+		return [][]driver.Value{{counter.hits, counter.expiration}}, 1, nil
+
+	case fake.dialect.Select:
+		counter, ok := fake.counters[args[0].Value.(string)]
+		if !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{counter.hits, counter.expiration}}, 0, nil
+
+	case fake.dialect.Delete:
+		key := args[0].Value.(string)
+		if _, ok := fake.counters[key]; !ok {
+			return nil, 0, nil
+		}
+		delete(fake.counters, key)
+		return nil, 1, nil
+
+	case fake.dialect.Purge:
+		removed := int64(0)
+		for key, counter := range fake.counters {
+			if counter.expiration < args[0].Value.(int64) {
+				delete(fake.counters, key)
+				removed++
+			}
+		}
+		return nil, removed, nil
+
+	case "BEGIN", "COMMIT", "ROLLBACK":
+		return nil, 0, nil
+
+	default:
+		return nil, 0, errors.Errorf("unexpected statement: %s", query)
+	}
+}
+
+// fakeConn is a connection of a fake driver.
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+// Prepare implements driver.Conn.
+func (conn *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+// Close implements driver.Conn.
+func (conn *fakeConn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn.
+func (conn *fakeConn) Begin() (driver.Tx, error) {
+	_, _, err := conn.driver.execute("BEGIN", nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Commit implements driver.Tx.
+func (conn *fakeConn) Commit() error {
+	_, _, err := conn.driver.execute("COMMIT", nil)
+	return err
+}
+
+// Rollback implements driver.Tx.
+func (conn *fakeConn) Rollback() error {
+	_, _, err := conn.driver.execute("ROLLBACK", nil)
+	return err
+}
+
+// ExecContext implements driver.ExecerContext.
+func (conn *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, affected, err := conn.driver.execute(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+// QueryContext implements driver.QueryerContext.
+func (conn *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, _, err := conn.driver.execute(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+// fakeRows are the rows returned by a fake driver.
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+// Columns implements driver.Rows.
+func (rows *fakeRows) Columns() []string {
+	return []string{"hits", "expiration"}
+}
+
+// Close implements driver.Rows.
+func (rows *fakeRows) Close() error {
+	return nil
+}
+
+// Next implements driver.Rows.
+func (rows *fakeRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
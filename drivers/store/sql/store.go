@@ -0,0 +1,259 @@
+// Package sql provides a store backed by a relational database, using database/sql.
+// Postgres, MySQL and SQLite are supported through dialects.
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/common"
+)
+
+// Store is the database store.
+type Store struct {
+	// errors is the number of failed operations on the database.
+	// It's the first field to guarantee a 64-bit alignment for atomic operations.
+	errors int64
+	// evicted is the number of expired counters removed by the purge.
+	evicted int64
+	// closed is set to one when the store has been closed.
+	closed uint32
+	// Prefix used for the key.
+	Prefix string
+	// db is the database holding counters.
+	db *sql.DB
+	// dialect contains the statements for the database engine.
+	dialect Dialect
+	// stop is used to stop the purge goroutine.
+	stop chan struct{}
+	// done is closed when the purge goroutine has returned.
+	done chan struct{}
+	// closeOnce is used to stop the purge goroutine only once.
+	closeOnce sync.Once
+}
+
+// NewStore returns an instance of database store with defaults.
+// The counters table must have been created with Migrate.
+func NewStore(db *sql.DB, dialect Dialect) (limiter.Store, error) {
+	return NewStoreWithOptions(db, dialect, limiter.StoreOptions{
+		Prefix:          limiter.DefaultPrefix,
+		CleanUpInterval: limiter.DefaultCleanUpInterval,
+	})
+}
+
+// NewStoreWithOptions returns an instance of database store with options.
+// Expired counters are purged every CleanUpInterval, if it's positive.
+func NewStoreWithOptions(db *sql.DB, dialect Dialect, options limiter.StoreOptions) (limiter.Store, error) {
+	if db == nil {
+		return nil, errors.New("sql: database is required")
+	}
+	if dialect.Increment == "" || dialect.Select == "" || dialect.Delete == "" || dialect.Purge == "" {
+		return nil, errors.Errorf("sql: dialect %q is incomplete", dialect.Name)
+	}
+
+	store := &Store{
+		Prefix:  options.Prefix,
+		db:      db,
+		dialect: dialect,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if options.CleanUpInterval > 0 {
+		go store.run(options.CleanUpInterval)
+	} else {
+		close(store.done)
+	}
+
+	return store, nil
+}
+
+// Get returns the limit for given identifier.
+func (store *Store) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	key = store.key(key)
+	now := time.Now()
+
+	count, expiration, err := store.increment(ctx, key, now.Add(rate.Period).UnixNano(), now.UnixNano())
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return limiter.Context{}, errors.Wrap(err, "sql: cannot increment counter")
+	}
+
+	return common.GetContextFromState(now, rate, time.Unix(0, expiration), count), nil
+}
+
+// Peek returns the limit for given identifier, without modification on current values.
+func (store *Store) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	key = store.key(key)
+	now := time.Now()
+	count := int64(0)
+	expiration := now.Add(rate.Period)
+
+	value, current, err := scanCounter(store.db.QueryRowContext(ctx, store.dialect.Select, key))
+	if err != nil && err != sql.ErrNoRows {
+		atomic.AddInt64(&store.errors, 1)
+		return limiter.Context{}, errors.Wrap(err, "sql: cannot select counter")
+	}
+	if err == nil && now.UnixNano() <= current {
+		count = value
+		expiration = time.Unix(0, current)
+	}
+
+	return common.GetContextFromState(now, rate, expiration, count), nil
+}
+
+// Reset returns the limit for given identifier which is set to zero.
+func (store *Store) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	if store.Closed() {
+		return limiter.Context{}, limiter.ErrStoreClosed
+	}
+
+	key = store.key(key)
+
+	_, err := store.db.ExecContext(ctx, store.dialect.Delete, key)
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return limiter.Context{}, errors.Wrap(err, "sql: cannot delete counter")
+	}
+
+	now := time.Now()
+	return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+}
+
+// Purge removes every expired counter from the database, and returns the number of removed counters.
+func (store *Store) Purge(ctx context.Context) (int64, error) {
+	result, err := store.db.ExecContext(ctx, store.dialect.Purge, time.Now().UnixNano())
+	if err != nil {
+		atomic.AddInt64(&store.errors, 1)
+		return 0, errors.Wrap(err, "sql: cannot purge expired counters")
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		// The driver doesn't report affected rows: counters have been removed anyway.
+		return 0, nil
+	}
+
+	atomic.AddInt64(&store.evicted, removed)
+	return removed, nil
+}
+
+// Close stops the purge goroutine.
+// The database is owned by the caller, and is not closed.
+func (store *Store) Close() error {
+	store.closeOnce.Do(func() {
+		atomic.StoreUint32(&store.closed, 1)
+		close(store.stop)
+		<-store.done
+	})
+	return nil
+}
+
+// Closed returns true if the store has been closed.
+func (store *Store) Closed() bool {
+	return atomic.LoadUint32(&store.closed) != 0
+}
+
+// Ping returns an error if the database is unreachable, or if the store has been closed.
+func (store *Store) Ping(ctx context.Context) error {
+	if store.Closed() {
+		return limiter.ErrStoreClosed
+	}
+
+	err := store.db.PingContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to ping database")
+	}
+	return nil
+}
+
+// Stats returns the number of counters removed by the purge and the number of failed operations on the database.
+// The number of keys is unknown, since counting rows of a large table is expensive.
+func (store *Store) Stats() limiter.StoreStats {
+	return limiter.StoreStats{
+		Keys:    -1,
+		Evicted: atomic.LoadInt64(&store.evicted),
+		Errors:  atomic.LoadInt64(&store.errors),
+	}
+}
+
+// increment creates or increments a counter, and returns its value and expiration.
+func (store *Store) increment(ctx context.Context, key string, expiration int64, now int64) (int64, int64, error) {
+	if store.dialect.Returning {
+		return scanCounter(store.db.QueryRowContext(ctx, store.dialect.Increment, key, expiration, now))
+	}
+
+	// The counter is locked by the upsert until the transaction ends, so the select reads our own increment.
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, store.dialect.Increment, key, expiration, now)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	}
+
+	value, current, err := scanCounter(tx.QueryRowContext(ctx, store.dialect.Select, key))
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return value, current, nil
+}
+
+// key returns the counter key for given identifier.
+func (store *Store) key(key string) string {
+	return store.Prefix + ":" + key
+}
+
+// run purges expired counters periodically until the store is closed.
+func (store *Store) run(interval time.Duration) {
+	defer close(store.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, _ = store.Purge(context.Background())
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+// scanCounter returns the value and the expiration of a counter from given row.
+func scanCounter(row *sql.Row) (int64, int64, error) {
+	value := int64(0)
+	expiration := int64(0)
+
+	err := row.Scan(&value, &expiration)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return value, expiration, nil
+}
@@ -0,0 +1,169 @@
+package sql_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	sqlstore "github.com/panii/limiter/v3/drivers/store/sql"
+	"github.com/panii/limiter/v3/drivers/store/tests"
+)
+
+var dialects = []sqlstore.Dialect{
+	sqlstore.Postgres,
+	sqlstore.MySQL,
+	sqlstore.SQLite,
+}
+
+func TestSQLStoreSequentialAccess(t *testing.T) {
+	is := require.New(t)
+
+	for _, dialect := range dialects {
+		db, _ := openFakeDatabase(dialect)
+
+		store, err := sqlstore.NewStoreWithOptions(db, dialect, limiter.StoreOptions{
+			Prefix:          "limiter:sql:sequential-test",
+			CleanUpInterval: 30 * time.Second,
+		})
+		is.NoError(err, dialect.Name)
+
+		tests.TestStoreSequentialAccess(t, store)
+
+		tests.CloseStore(t, store)
+		is.NoError(db.Close(), dialect.Name)
+	}
+}
+
+func TestSQLStoreConcurrentAccess(t *testing.T) {
+	is := require.New(t)
+
+	for _, dialect := range dialects {
+		db, _ := openFakeDatabase(dialect)
+
+		store, err := sqlstore.NewStoreWithOptions(db, dialect, limiter.StoreOptions{
+			Prefix:          "limiter:sql:concurrent-test",
+			CleanUpInterval: 30 * time.Second,
+		})
+		is.NoError(err, dialect.Name)
+
+		tests.TestStoreConcurrentAccess(t, store)
+
+		tests.CloseStore(t, store)
+		is.NoError(db.Close(), dialect.Name)
+	}
+}
+
+func TestSQLStoreStatements(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+	rate := limiter.Rate{Limit: 10, Period: time.Minute}
+
+	for _, dialect := range dialects {
+		db, fake := openFakeDatabase(dialect)
+
+		is.NoError(sqlstore.Migrate(ctx, db, dialect), dialect.Name)
+		is.Equal(dialect.Schema, fake.Statements(), dialect.Name)
+
+		store, err := sqlstore.NewStoreWithOptions(db, dialect, limiter.StoreOptions{
+			Prefix: "limiter:sql:statements-test",
+		})
+		is.NoError(err, dialect.Name)
+
+		offset := len(fake.Statements())
+		_, err = store.Get(ctx, "foo", rate)
+		is.NoError(err, dialect.Name)
+
+		if dialect.Returning {
+			is.Equal([]string{dialect.Increment}, fake.Statements()[offset:], dialect.Name)
+		} else {
+			expected := []string{"BEGIN", dialect.Increment, dialect.Select, "COMMIT"}
+			is.Equal(expected, fake.Statements()[offset:], dialect.Name)
+		}
+
+		offset = len(fake.Statements())
+		_, err = store.Peek(ctx, "foo", rate)
+		is.NoError(err, dialect.Name)
+		_, err = store.Reset(ctx, "foo", rate)
+		is.NoError(err, dialect.Name)
+		is.Equal([]string{dialect.Select, dialect.Delete}, fake.Statements()[offset:], dialect.Name)
+
+		tests.CloseStore(t, store)
+		is.NoError(db.Close(), dialect.Name)
+	}
+}
+
+func TestSQLStorePurge(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	db, fake := openFakeDatabase(sqlstore.Postgres)
+	defer db.Close()
+
+	store, err := sqlstore.NewStoreWithOptions(db, sqlstore.Postgres, limiter.StoreOptions{
+		Prefix:          "limiter:sql:purge-test",
+		CleanUpInterval: 20 * time.Millisecond,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(t, store)
+
+	_, err = store.Get(ctx, "short", limiter.Rate{Limit: 10, Period: 10 * time.Millisecond})
+	is.NoError(err)
+	_, err = store.Get(ctx, "long", limiter.Rate{Limit: 10, Period: time.Minute})
+	is.NoError(err)
+
+	is.Eventually(func() bool {
+		return store.(limiter.StatsReporter).Stats().Evicted == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	is.Contains(fake.Statements(), sqlstore.Postgres.Purge)
+
+	lctx, err := store.Peek(ctx, "long", limiter.Rate{Limit: 10, Period: time.Minute})
+	is.NoError(err)
+	is.Equal(int64(9), lctx.Remaining)
+}
+
+func TestSQLStoreLifecycle(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	db, _ := openFakeDatabase(sqlstore.SQLite)
+	defer db.Close()
+
+	store, err := sqlstore.NewStore(db, sqlstore.SQLite)
+	is.NoError(err)
+	is.NoError(store.(limiter.Pinger).Ping(ctx))
+
+	stats := store.(limiter.StatsReporter).Stats()
+	is.Equal(int64(-1), stats.Keys)
+	is.Equal(int64(0), stats.Errors)
+
+	_, err = store.Get(ctx, "unknown", limiter.Rate{Limit: 10, Period: time.Minute})
+	is.NoError(err)
+
+	_, err = sqlstore.NewStore(db, sqlstore.Dialect{Name: "incomplete"})
+	is.Error(err)
+
+	tests.CloseStore(t, store)
+	is.Equal(limiter.ErrStoreClosed, store.(limiter.Pinger).Ping(ctx))
+
+	_, err = store.Get(ctx, "foo", limiter.Rate{Limit: 10, Period: time.Minute})
+	is.Equal(limiter.ErrStoreClosed, err)
+}
+
+func BenchmarkSQLStoreSequentialAccess(b *testing.B) {
+	is := require.New(b)
+
+	db, _ := openFakeDatabase(sqlstore.Postgres)
+	defer db.Close()
+
+	store, err := sqlstore.NewStoreWithOptions(db, sqlstore.Postgres, limiter.StoreOptions{
+		Prefix:          "limiter:sql:sequential-benchmark",
+		CleanUpInterval: 30 * time.Second,
+	})
+	is.NoError(err)
+	defer tests.CloseStore(b, store)
+
+	tests.BenchmarkStoreSequentialAccess(b, store)
+}
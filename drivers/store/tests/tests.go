@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"io"
 	"sync"
 	"testing"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/internal/race"
 )
 
 // TestStoreSequentialAccess verify that store works as expected with a sequential access.
@@ -143,6 +145,171 @@ func TestStoreConcurrentAccess(t *testing.T, store limiter.Store) {
 	wg.Wait()
 }
 
+// TestStoreBatchAccess verify that store works as expected with batches of requests.
+func TestStoreBatchAccess(t *testing.T, store limiter.Store) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	instance := limiter.New(store, limiter.Rate{
+		Limit:  2,
+		Period: time.Minute,
+	})
+
+	other := limiter.Rate{
+		Limit:  10,
+		Period: time.Minute,
+	}
+
+	for _, key := range []string{"batch-foo", "batch-bar", "batch-baz"} {
+		_, err := instance.Reset(ctx, key)
+		is.NoError(err)
+	}
+
+	requests := []limiter.Request{
+		{Key: "batch-foo"},
+		{Key: "batch-bar"},
+		{Key: "batch-foo"},
+		{Key: "batch-baz", Rate: other},
+	}
+
+	contexts, err := instance.GetMulti(ctx, requests)
+	is.NoError(err)
+	is.Len(contexts, len(requests))
+
+	is.Equal(int64(2), contexts[0].Limit)
+	is.Equal(int64(1), contexts[0].Remaining)
+	is.Equal(int64(1), contexts[1].Remaining)
+	is.Equal(int64(0), contexts[2].Remaining)
+	is.False(contexts[2].Reached)
+	is.Equal(int64(10), contexts[3].Limit)
+	is.Equal(int64(9), contexts[3].Remaining)
+
+	for i := range contexts {
+		is.True((contexts[i].Reset - time.Now().Unix()) <= 60)
+	}
+
+	contexts, err = instance.GetMulti(ctx, requests)
+	is.NoError(err)
+	is.True(contexts[0].Reached)
+	is.Equal(int64(0), contexts[1].Remaining)
+	is.False(contexts[1].Reached)
+	is.True(contexts[2].Reached)
+	is.Equal(int64(8), contexts[3].Remaining)
+
+	lctx, err := instance.Peek(ctx, "batch-foo")
+	is.NoError(err)
+	is.True(lctx.Reached)
+
+	contexts, err = instance.GetMulti(ctx, nil)
+	is.NoError(err)
+	is.Len(contexts, 0)
+}
+
+// TestStoreSeed verify that store works as expected when several hits are added at once.
+func TestStoreSeed(t *testing.T, store limiter.Store) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	seeder, ok := store.(limiter.Seeder)
+	is.True(ok)
+
+	rate := limiter.Rate{
+		Limit:  10,
+		Period: time.Minute,
+	}
+
+	_, err := store.Reset(ctx, "seed-foo", rate)
+	is.NoError(err)
+
+	// A new key expires after given TTL, instead of the rate period.
+	is.NoError(seeder.Seed(ctx, "seed-foo", 3, 30*time.Second))
+
+	lctx, err := store.Peek(ctx, "seed-foo", rate)
+	is.NoError(err)
+	is.Equal(int64(7), lctx.Remaining)
+	is.True(lctx.Reset <= time.Now().Add(31*time.Second).Unix())
+
+	// The expiration of an existing key is kept.
+	is.NoError(seeder.Seed(ctx, "seed-foo", 2, time.Hour))
+
+	lctx, err = store.Get(ctx, "seed-foo", rate)
+	is.NoError(err)
+	is.Equal(int64(4), lctx.Remaining)
+	is.True(lctx.Reset <= time.Now().Add(31*time.Second).Unix())
+}
+
+// TestStoreScan verify that store works as expected when its keys are scanned.
+func TestStoreScan(t *testing.T, store limiter.Store) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	scanner, ok := store.(limiter.Scanner)
+	is.True(ok)
+
+	_, err := scanner.DeletePrefix(ctx, "scan-")
+	is.NoError(err)
+
+	rate := limiter.Rate{
+		Limit:  10,
+		Period: time.Minute,
+	}
+
+	hits := map[string]int64{
+		"scan-a:1":   3,
+		"scan-a:2":   1,
+		"scan-a*:1":  1,
+		"scan-b:1":   2,
+		"scan-other": 1,
+	}
+	for key, count := range hits {
+		for i := int64(0); i < count; i++ {
+			_, err := store.Get(ctx, key, rate)
+			is.NoError(err)
+		}
+	}
+
+	scan := func(prefix string) map[string]limiter.KeyInfo {
+		keys := map[string]limiter.KeyInfo{}
+		cursor := uint64(0)
+		for {
+			page, next, err := scanner.Scan(ctx, prefix, cursor)
+			is.NoError(err)
+			for i := range page {
+				keys[page[i].Key] = page[i]
+			}
+			if next == 0 {
+				return keys
+			}
+			cursor = next
+		}
+	}
+
+	keys := scan("scan-a:")
+	is.Len(keys, 2)
+	is.Equal(int64(3), keys["scan-a:1"].Count)
+	is.Equal(int64(1), keys["scan-a:2"].Count)
+	is.True(keys["scan-a:1"].TTL > 0 && keys["scan-a:1"].TTL <= time.Minute)
+
+	keys = scan("scan-")
+	is.Len(keys, len(hits))
+
+	// Special characters of the prefix are matched literally.
+	keys = scan("scan-a*")
+	is.Len(keys, 1)
+	is.Equal(int64(1), keys["scan-a*:1"].Count)
+
+	deleted, err := scanner.DeletePrefix(ctx, "scan-a:")
+	is.NoError(err)
+	is.Equal(int64(2), deleted)
+
+	is.Len(scan("scan-a:"), 0)
+	is.Len(scan("scan-"), len(hits)-2)
+
+	lctx, err := store.Peek(ctx, "scan-a:1", rate)
+	is.NoError(err)
+	is.Equal(int64(10), lctx.Remaining)
+}
+
 // BenchmarkStoreSequentialAccess executes a benchmark against a store without parallel setting.
 func BenchmarkStoreSequentialAccess(b *testing.B, store limiter.Store) {
 	ctx := context.Background()
@@ -174,3 +341,40 @@ func BenchmarkStoreConcurrentAccess(b *testing.B, store limiter.Store) {
 		}
 	})
 }
+
+// TestStoreAllocations verify that store doesn't allocate memory to get or peek an existing key.
+func TestStoreAllocations(t *testing.T, store limiter.Store) {
+	if race.Enabled {
+		t.Skip("allocations are not reliable with the race detector")
+	}
+	is := require.New(t)
+	ctx := context.Background()
+
+	rate := limiter.Rate{
+		Limit:  1000000,
+		Period: time.Minute,
+	}
+
+	_, err := store.Get(ctx, "allocs", rate)
+	is.NoError(err)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err = store.Get(ctx, "allocs", rate)
+	})
+	is.NoError(err)
+	is.Zero(allocs)
+
+	allocs = testing.AllocsPerRun(100, func() {
+		_, err = store.Peek(ctx, "allocs", rate)
+	})
+	is.NoError(err)
+	is.Zero(allocs)
+}
+
+// CloseStore closes given store, which must implement io.Closer, and fails the test on error.
+func CloseStore(tb testing.TB, store limiter.Store) {
+	err := store.(io.Closer).Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package bytebuffer
 
 import (
+	"strconv"
 	"sync"
 	"unsafe"
 )
@@ -28,6 +29,11 @@ func (buffer *ByteBuffer) String() string {
 	return *(*string)(unsafe.Pointer(&buffer.blob)) // nolint: gosec
 }
 
+// Reset empties blob content, keeping its capacity.
+func (buffer *ByteBuffer) Reset() {
+	buffer.blob = buffer.blob[:0]
+}
+
 // Concat appends given arguments to blob content
 func (buffer *ByteBuffer) Concat(args ...string) {
 	for i := range args {
@@ -35,6 +41,11 @@ func (buffer *ByteBuffer) Concat(args ...string) {
 	}
 }
 
+// AppendInt appends the decimal representation of given integer to blob content.
+func (buffer *ByteBuffer) AppendInt(value int64) {
+	buffer.blob = strconv.AppendInt(buffer.blob, value, 10)
+}
+
 // Close recycles underlying resources of encoder.
 func (buffer *ByteBuffer) Close() {
 	// Proper usage of a sync.Pool requires each entry to have approximately
@@ -10,12 +10,12 @@ import (
 // Forked from https://github.com/sethvargo/go-limiter
 
 //go:noescape
-//go:linkname walltime runtime.walltime
-func walltime() (int64, int32)
+//go:linkname now time.now
+func now() (sec int64, nsec int32, mono int64)
 
-// Now returns a monotonic clock value. The actual value will differ across
-// systems, but that's okay because we generally only care about the deltas.
+// Now returns the current wallclock time, in nanoseconds since Unix epoch.
+// Unlike time.Now(), it doesn't build a time.Time value.
 func Now() uint64 {
-	x, y := walltime()
-	return uint64(x)*1e9 + uint64(y)
+	sec, nsec, _ := now()
+	return uint64(sec)*1e9 + uint64(nsec)
 }
@@ -0,0 +1,46 @@
+// Package headers writes the rate limit headers of a limiter context on a net/http header, with few allocations.
+package headers
+
+import (
+	"net/http"
+	"net/textproto"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/internal/bytebuffer"
+)
+
+// Names are the canonical names of the rate limit headers.
+type Names struct {
+	Limit     string
+	Remaining string
+	Reset     string
+}
+
+// NewNames returns the canonical names of given headers, so they don't have to be canonicalized on every request.
+func NewNames(limit string, remaining string, reset string) Names {
+	return Names{
+		Limit:     textproto.CanonicalMIMEHeaderKey(limit),
+		Remaining: textproto.CanonicalMIMEHeaderKey(remaining),
+		Reset:     textproto.CanonicalMIMEHeaderKey(reset),
+	}
+}
+
+// Set sets the rate limit headers of given context, replacing any existing value.
+//
+// Values are formatted in a single string, and stored in a single array: it only requires two allocations,
+// instead of two per header with strconv.FormatInt and http.Header.Set.
+func Set(header http.Header, names Names, lctx limiter.Context) {
+	buffer := bytebuffer.New()
+	buffer.AppendInt(lctx.Limit)
+	limit := len(buffer.Bytes())
+	buffer.AppendInt(lctx.Remaining)
+	remaining := len(buffer.Bytes())
+	buffer.AppendInt(lctx.Reset)
+	blob := string(buffer.Bytes())
+	buffer.Close()
+
+	values := &[3]string{blob[:limit], blob[limit:remaining], blob[remaining:]}
+	header[names.Limit] = values[0:1:1]
+	header[names.Remaining] = values[1:2:2]
+	header[names.Reset] = values[2:3:3]
+}
@@ -0,0 +1,90 @@
+// Package luascript provides the lua scripts evaluated by redis stores.
+//
+// Every script operates on a single key, KEYS[1], and returns a count and a TTL in milliseconds, followed by the
+// time of redis server for the "Time" variants.
+package luascript
+
+const (
+	// Incr increments a key by ARGV[1], sets its expiration to ARGV[2] milliseconds if it has been created,
+	// and returns its count and TTL in milliseconds.
+	Incr = `
+local key = KEYS[1]
+local count = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local ret = redis.call("incrby", key, ARGV[1])
+if ret == count then
+	if ttl > 0 then
+		redis.call("pexpire", key, ARGV[2])
+	end
+	return {ret, ttl}
+end
+ttl = redis.call("pttl", key)
+return {ret, ttl}
+`
+
+	// Peek returns the count of a key and its TTL in milliseconds, or zeros if it doesn't exist.
+	Peek = `
+local key = KEYS[1]
+local v = redis.call("get", key)
+if v == false then
+	return {0, 0}
+end
+local ttl = redis.call("pttl", key)
+return {tonumber(v), ttl}
+`
+
+	// IncrTime is Incr, which also returns the time of redis server, in seconds and microseconds.
+	IncrTime = `
+redis.replicate_commands()
+local key = KEYS[1]
+local count = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local now = redis.call("time")
+local ret = redis.call("incrby", key, ARGV[1])
+if ret == count then
+	if ttl > 0 then
+		redis.call("pexpire", key, ARGV[2])
+	end
+	return {ret, ttl, tonumber(now[1]), tonumber(now[2])}
+end
+ttl = redis.call("pttl", key)
+return {ret, ttl, tonumber(now[1]), tonumber(now[2])}
+`
+
+	// PeekTime is Peek, which also returns the time of redis server, in seconds and microseconds.
+	PeekTime = `
+local key = KEYS[1]
+local now = redis.call("time")
+local v = redis.call("get", key)
+if v == false then
+	return {0, 0, tonumber(now[1]), tonumber(now[2])}
+end
+local ttl = redis.call("pttl", key)
+return {tonumber(v), ttl, tonumber(now[1]), tonumber(now[2])}
+`
+
+	// ResetTime deletes a key, and returns zeros with the time of redis server, in seconds and microseconds.
+	ResetTime = `
+redis.replicate_commands()
+local now = redis.call("time")
+redis.call("del", KEYS[1])
+return {0, 0, tonumber(now[1]), tonumber(now[2])}
+`
+
+	// Release decrements a key by ARGV[1], without going below zero, if its TTL is at most ARGV[2] milliseconds.
+	// It returns the number of released units.
+	Release = `
+local key = KEYS[1]
+local count = tonumber(ARGV[1])
+local ttl = redis.call("pttl", key)
+if ttl < 0 or ttl > tonumber(ARGV[2]) then
+	return 0
+end
+local v = tonumber(redis.call("get", key))
+if v < count then
+	count = v
+end
+redis.call("decrby", key, count)
+return count
+`
+)
@@ -0,0 +1,9 @@
+//go:build !race
+// +build !race
+
+// Package race reports whether the race detector is enabled, since it changes the number of allocations, for
+// example by dropping items of a sync.Pool.
+package race
+
+// Enabled is true if the race detector is enabled.
+const Enabled = false
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package race
+
+// Enabled is true if the race detector is enabled.
+const Enabled = true
@@ -0,0 +1,282 @@
+package limiter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// IPAccess is the decision of the allow and deny lists of a limiter for an IP address.
+type IPAccess int
+
+const (
+	// IPLimited is the decision for an IP address which is in none of the lists: it's rate limited.
+	IPLimited IPAccess = iota
+	// IPAllowed is the decision for an IP address of the allowlist: it's never rate limited.
+	IPAllowed
+	// IPDenied is the decision for an IP address of the denylist: it's always rejected.
+	IPDenied
+)
+
+// IPList is a set of networks, looked up with a binary radix tree.
+// It's safe for concurrent use: the tree is immutable, and replaced atomically when the list is reloaded.
+type IPList struct {
+	// path is the file of the list, if it has been loaded from a file.
+	path string
+	// tree is the current *ipTree.
+	tree atomic.Value
+	// mutex serializes reloads.
+	mutex sync.Mutex
+}
+
+// NewIPList returns a list of given networks.
+func NewIPList(networks []*net.IPNet) (*IPList, error) {
+	list := &IPList{}
+	err := list.Set(networks)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// NewIPListFromFile returns a list of the networks of given file, which can be reloaded with Reload.
+// The file has one network per line, in CIDR notation or as a single IP address. Empty lines and comments starting
+// with "#" are ignored.
+func NewIPListFromFile(path string) (*IPList, error) {
+	list := &IPList{path: path}
+	err := list.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Set replaces the networks of the list.
+func (list *IPList) Set(networks []*net.IPNet) error {
+	tree, err := newIPTree(networks)
+	if err != nil {
+		return err
+	}
+
+	list.mutex.Lock()
+	list.tree.Store(tree)
+	list.mutex.Unlock()
+
+	return nil
+}
+
+// Reload replaces the networks of the list with the content of its file.
+// The list is left unchanged if the file can't be read or parsed.
+func (list *IPList) Reload() error {
+	if list.path == "" {
+		return errors.New("limiter: ip list has not been loaded from a file")
+	}
+
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	file, err := os.Open(list.path)
+	if err != nil {
+		return errors.Wrap(err, "limiter: cannot open ip list")
+	}
+	defer file.Close()
+
+	networks, err := readNetworks(file)
+	if err != nil {
+		return errors.Wrapf(err, "limiter: cannot read ip list %s", list.path)
+	}
+
+	tree, err := newIPTree(networks)
+	if err != nil {
+		return err
+	}
+
+	list.tree.Store(tree)
+	return nil
+}
+
+// Contains returns true if given IP address belongs to a network of the list.
+// A nil list contains no address.
+func (list *IPList) Contains(ip net.IP) bool {
+	if list == nil {
+		return false
+	}
+
+	tree, ok := list.tree.Load().(*ipTree)
+	if !ok {
+		return false
+	}
+	return tree.contains(ip)
+}
+
+// Len returns the number of networks of the list.
+func (list *IPList) Len() int {
+	if list == nil {
+		return 0
+	}
+
+	tree, ok := list.tree.Load().(*ipTree)
+	if !ok {
+		return 0
+	}
+	return tree.size
+}
+
+// readNetworks parses the networks of a list, one per line.
+func readNetworks(reader io.Reader) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	scanner := bufio.NewScanner(reader)
+
+	for line := 1; scanner.Scan(); line++ {
+		value := scanner.Text()
+		if i := strings.IndexByte(value, '#'); i >= 0 {
+			value = value[:i]
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		networks = append(networks, network)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+// parseNetwork parses a network in CIDR notation, or a single IP address.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.IndexByte(value, '/') >= 0 {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.Errorf("invalid network %q", value)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.Errorf("invalid network %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// v4InV6Prefix is the prefix of IPv4 addresses in their 16-byte representation.
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
+
+// ipNode is a node of an ipTree.
+type ipNode struct {
+	// children are the indexes of the nodes for bits 0 and 1, or zero if missing.
+	children [2]int32
+	// terminal is true if the path to this node is a network of the list.
+	terminal bool
+}
+
+// ipTree is a binary radix tree of networks, whose addresses are in their 16-byte representation.
+// Nodes are stored in a slice, the root being the first one.
+type ipTree struct {
+	nodes []ipNode
+	size  int
+}
+
+// newIPTree returns a tree of given networks.
+func newIPTree(networks []*net.IPNet) (*ipTree, error) {
+	tree := &ipTree{nodes: make([]ipNode, 1, 1+len(networks)*8)}
+
+	for _, network := range networks {
+		if network == nil {
+			continue
+		}
+
+		ones, bits := network.Mask.Size()
+		ip := network.IP
+		switch {
+		case bits == 8*net.IPv4len && ip.To4() != nil:
+			ip = ip.To4()
+			ones += 8 * len(v4InV6Prefix)
+		case bits == 8*net.IPv6len && len(ip) == net.IPv6len:
+		default:
+			return nil, errors.Errorf("limiter: invalid network %s", network)
+		}
+
+		tree.insert(ip, ones)
+		tree.size++
+	}
+
+	return tree, nil
+}
+
+// insert adds the network of given address and prefix length.
+func (tree *ipTree) insert(ip net.IP, ones int) {
+	node := int32(0)
+	for i := 0; i < ones; i++ {
+		if tree.nodes[node].terminal {
+			// A larger network already contains this one.
+			return
+		}
+
+		bit := ipBit(ip, i)
+		next := tree.nodes[node].children[bit]
+		if next == 0 {
+			tree.nodes = append(tree.nodes, ipNode{})
+			next = int32(len(tree.nodes) - 1)
+			tree.nodes[node].children[bit] = next
+		}
+		node = next
+	}
+
+	// Smaller networks are now unreachable.
+	tree.nodes[node].terminal = true
+	tree.nodes[node].children = [2]int32{}
+}
+
+// contains returns true if given address belongs to a network of the tree.
+func (tree *ipTree) contains(ip net.IP) bool {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return false
+	}
+
+	node := int32(0)
+	for i := 0; i < 8*net.IPv6len; i++ {
+		if tree.nodes[node].terminal {
+			return true
+		}
+
+		node = tree.nodes[node].children[ipBit(ip, i)]
+		if node == 0 {
+			return false
+		}
+	}
+
+	return tree.nodes[node].terminal
+}
+
+// ipBit returns the bit of given index of an address in its 16-byte representation, without converting it.
+func ipBit(ip net.IP, i int) int {
+	var b byte
+	switch {
+	case len(ip) == net.IPv6len:
+		b = ip[i/8]
+	case i < 8*len(v4InV6Prefix):
+		b = v4InV6Prefix[i/8]
+	default:
+		b = ip[i/8-len(v4InV6Prefix)]
+	}
+	return int(b>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,130 @@
+package limiter_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+)
+
+func TestIPList(t *testing.T) {
+	is := require.New(t)
+
+	list, err := limiter.NewIPList([]*net.IPNet{
+		parseCIDR(is, "192.168.0.0/16"),
+		parseCIDR(is, "192.168.1.0/24"),
+		parseCIDR(is, "10.1.2.3/32"),
+		parseCIDR(is, "2001:db8::/32"),
+	})
+	is.NoError(err)
+	is.Equal(4, list.Len())
+
+	scenarios := []struct {
+		ip       string
+		expected bool
+	}{
+		{ip: "192.168.0.1", expected: true},
+		{ip: "192.168.1.1", expected: true},
+		{ip: "192.168.255.255", expected: true},
+		{ip: "192.169.0.1", expected: false},
+		{ip: "10.1.2.3", expected: true},
+		{ip: "10.1.2.4", expected: false},
+		{ip: "2001:db8:cafe::1", expected: true},
+		{ip: "2001:db9::1", expected: false},
+		{ip: "::ffff:192.168.0.1", expected: true},
+		{ip: "c0a8::1", expected: false},
+	}
+
+	for _, scenario := range scenarios {
+		ip := net.ParseIP(scenario.ip)
+		is.Equal(scenario.expected, list.Contains(ip), scenario.ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			is.Equal(scenario.expected, list.Contains(ip4), scenario.ip)
+		}
+	}
+
+	is.False(list.Contains(nil))
+	is.Error(list.Reload())
+
+	var empty *limiter.IPList
+	is.False(empty.Contains(net.ParseIP("192.168.0.1")))
+
+	_, err = limiter.NewIPList([]*net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.IPMask{0xff, 0, 0xff, 0}}})
+	is.Error(err)
+}
+
+func TestIPListFromFile(t *testing.T) {
+	is := require.New(t)
+
+	dir, err := ioutil.TempDir("", "limiter-iplist")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "denylist.txt")
+	err = ioutil.WriteFile(path, []byte("# Hostile networks\n203.0.113.0/24\n\n2001:db8::1 # single address\n"), 0600)
+	is.NoError(err)
+
+	list, err := limiter.NewIPListFromFile(path)
+	is.NoError(err)
+	is.Equal(2, list.Len())
+	is.True(list.Contains(net.ParseIP("203.0.113.7")))
+	is.True(list.Contains(net.ParseIP("2001:db8::1")))
+	is.False(list.Contains(net.ParseIP("2001:db8::2")))
+
+	err = ioutil.WriteFile(path, []byte("198.51.100.0/24\n"), 0600)
+	is.NoError(err)
+	is.NoError(list.Reload())
+	is.False(list.Contains(net.ParseIP("203.0.113.7")))
+	is.True(list.Contains(net.ParseIP("198.51.100.7")))
+
+	// An invalid file leaves the list unchanged.
+	err = ioutil.WriteFile(path, []byte("198.51.100.0/24\nnot-a-network\n"), 0600)
+	is.NoError(err)
+	err = list.Reload()
+	is.Error(err)
+	is.Contains(err.Error(), "line 2")
+	is.True(list.Contains(net.ParseIP("198.51.100.7")))
+
+	_, err = limiter.NewIPListFromFile(filepath.Join(dir, "missing.txt"))
+	is.Error(err)
+}
+
+func TestLimiterCheckRequest(t *testing.T) {
+	is := require.New(t)
+
+	allowlist, err := limiter.NewIPList([]*net.IPNet{parseCIDR(is, "10.0.0.0/8")})
+	is.NoError(err)
+	denylist, err := limiter.NewIPList([]*net.IPNet{parseCIDR(is, "10.6.6.0/24")})
+	is.NoError(err)
+
+	instance := New(limiter.WithAllowlist(allowlist), limiter.WithDenylist(denylist))
+
+	scenarios := []struct {
+		remoteAddr string
+		expected   limiter.IPAccess
+	}{
+		{remoteAddr: "8.8.8.8:8888", expected: limiter.IPLimited},
+		{remoteAddr: "10.0.0.1:8888", expected: limiter.IPAllowed},
+		{remoteAddr: "10.6.6.6:8888", expected: limiter.IPDenied},
+	}
+
+	for _, scenario := range scenarios {
+		request := &http.Request{Header: http.Header{}, RemoteAddr: scenario.remoteAddr}
+		is.Equal(scenario.expected, instance.CheckRequest(request), scenario.remoteAddr)
+	}
+
+	request := &http.Request{Header: http.Header{}, RemoteAddr: "10.6.6.6:8888"}
+	is.Equal(limiter.IPLimited, New().CheckRequest(request))
+}
+
+func parseCIDR(is *require.Assertions, value string) *net.IPNet {
+	_, network, err := net.ParseCIDR(value)
+	is.NoError(err)
+	return network
+}
@@ -49,6 +49,34 @@ func (limiter *Limiter) Get(ctx context.Context, key string) (Context, error) {
 	return limiter.Store.Get(ctx, key, limiter.Rate)
 }
 
+// GetMulti returns the limit of every request, in order.
+// A request without rate uses the rate of the limiter. Stores that don't implement BatchStore are called once per
+// request.
+func (limiter *Limiter) GetMulti(ctx context.Context, requests []Request) ([]Context, error) {
+	batch := make([]Request, len(requests))
+	for i := range requests {
+		batch[i] = requests[i]
+		if batch[i].Rate.Period == 0 {
+			batch[i].Rate = limiter.Rate
+		}
+	}
+
+	if store, ok := limiter.Store.(BatchStore); ok {
+		return store.GetMulti(ctx, batch)
+	}
+
+	contexts := make([]Context, len(batch))
+	for i := range batch {
+		lctx, err := limiter.Store.Get(ctx, batch[i].Key, batch[i].Rate)
+		if err != nil {
+			return nil, err
+		}
+		contexts[i] = lctx
+	}
+
+	return contexts, nil
+}
+
 // Peek returns the limit for given identifier, without modification on current values.
 func (limiter *Limiter) Peek(ctx context.Context, key string) (Context, error) {
 	return limiter.Store.Peek(ctx, key, limiter.Rate)
@@ -58,3 +86,13 @@ func (limiter *Limiter) Peek(ctx context.Context, key string) (Context, error) {
 func (limiter *Limiter) Reset(ctx context.Context, key string) (Context, error) {
 	return limiter.Store.Reset(ctx, key, limiter.Rate)
 }
+
+// Healthy returns an error if the underlying store is unable to serve requests.
+// Stores that don't implement Pinger are always considered healthy.
+func (limiter *Limiter) Healthy(ctx context.Context) error {
+	pinger, ok := limiter.Store.(Pinger)
+	if !ok {
+		return nil
+	}
+	return pinger.Ping(ctx)
+}
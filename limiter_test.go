@@ -1,10 +1,12 @@
 package limiter_test
 
 import (
+	"testing"
 	"time"
 
 	"github.com/panii/limiter/v3"
 	"github.com/panii/limiter/v3/drivers/store/memory"
+	"github.com/panii/limiter/v3/drivers/store/tests"
 )
 
 func New(options ...limiter.Option) *limiter.Limiter {
@@ -15,3 +17,8 @@ func New(options ...limiter.Option) *limiter.Limiter {
 	}
 	return limiter.New(store, rate, options...)
 }
+
+func TestLimiterGetMulti(t *testing.T) {
+	// Stores without batch support are called once per request.
+	tests.TestStoreBatchAccess(t, struct{ limiter.Store }{memory.NewStore()})
+}
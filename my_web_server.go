@@ -18,8 +18,9 @@ var START_TIME string
 func main() {
 	START_TIME = time.Now().Add(time.Hour * 8).Format("2006-01-02 15:04:05")
 	
-	indexHandler := indexLimiterHandler()
+	indexHandler, limiters := indexLimiterHandler()
 	http.Handle("/rate_check/do", indexHandler)
+	http.Handle("/rate_check/ready", readyHandler(limiters...))
 	http.HandleFunc("/rate_check/version", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("START_TIME", START_TIME)
 		w.Write([]byte("0.1"))
@@ -37,7 +38,21 @@ func index(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func indexLimiterHandler() http.Handler {
+// readyHandler serves readiness probes: it fails as soon as one of the limiters store is unhealthy.
+func readyHandler(limiters ...*limiter.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, instance := range limiters {
+			err := instance.Healthy(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ready"))
+	})
+}
+
+func indexLimiterHandler() (http.Handler, []*limiter.Limiter) {
 
 	secondRate := limiter.Rate{Id: "second"}
 	minuteRate := limiter.Rate{Id: "minute"}
@@ -98,5 +113,5 @@ func indexLimiterHandler() http.Handler {
 	handler = mhttp.NewMiddleware(minuteLimit).Handler(handler)
 	handler = mhttp.NewMiddleware(secondLimit).Handler(handler)
 
-	return handler
+	return handler, []*limiter.Limiter{secondLimit, minuteLimit, hourLimit, dayLimit}
 }
@@ -3,9 +3,17 @@ package limiter
 import (
 	"net"
 	"net/http"
+	"net/textproto"
 	"strings"
 )
 
+const (
+	// XForwardedForHeader is the de-facto standard forwarding header, and the default ForwardedHeader.
+	XForwardedForHeader = "X-Forwarded-For"
+	// ForwardedHeader is the standard forwarding header, defined by RFC 7239.
+	ForwardedHeader = "Forwarded"
+)
+
 var (
 	// DefaultIPv4Mask defines the default IPv4 mask used to obtain user IP.
 	DefaultIPv4Mask = net.CIDRMask(32, 32)
@@ -28,24 +36,87 @@ func (limiter *Limiter) GetIPKey(r *http.Request) string {
 	return limiter.GetIPWithMask(r).String()
 }
 
+// GetIPFromHeaders returns the IP address of a request sent by given peer, like GetIP, for servers which don't
+// build an http.Request (e.g. fasthttp). Header values are returned by given function, in order.
+func (limiter *Limiter) GetIPFromHeaders(remoteIP net.IP, values func(name string) []string) net.IP {
+	return resolveIP(remoteIP, values, limiter.Options)
+}
+
+// MaskIP returns given IP address masked with IPv4Mask or IPv6Mask of the limiter.
+func (limiter *Limiter) MaskIP(ip net.IP) net.IP {
+	return maskIP(ip, limiter.Options)
+}
+
+// CheckIP returns the decision of the allow and deny lists for given IP address.
+func (limiter *Limiter) CheckIP(ip net.IP) IPAccess {
+	if limiter.Options.Denylist.Contains(ip) {
+		return IPDenied
+	}
+	if limiter.Options.Allowlist.Contains(ip) {
+		return IPAllowed
+	}
+	return IPLimited
+}
+
+// CheckRequest returns the decision of the allow and deny lists for the IP address of given request.
+// The IP address isn't looked up if the limiter has no list.
+func (limiter *Limiter) CheckRequest(r *http.Request) IPAccess {
+	if limiter.Options.Allowlist == nil && limiter.Options.Denylist == nil {
+		return IPLimited
+	}
+	return limiter.CheckIP(limiter.GetIP(r))
+}
+
 // GetIP returns IP address from request.
 // If options is defined and TrustForwardHeader is true, it will lookup IP in
-// X-Forwarded-For and X-Real-IP headers.
+// ClientIPHeader, ForwardedHeader (X-Forwarded-For by default) and X-Real-IP headers.
+// If options defines TrustedProxies, these headers are only used if the request comes from a trusted proxy, and
+// the IP is the first untrusted hop, walking ForwardedHeader from the right: unlike the leftmost hop, it can't be
+// spoofed by the client. X-Real-IP is then only used if it's the ClientIPHeader.
 func GetIP(r *http.Request, options ...Options) net.IP {
-	if len(options) >= 1 && options[0].TrustForwardHeader {
-		ip := r.Header.Get("X-Forwarded-For")
-		if ip != "" {
-			parts := strings.SplitN(ip, ",", 2)
-			part := strings.TrimSpace(parts[0])
-			return net.ParseIP(part)
+	remoteIP := getRemoteIP(r)
+	if len(options) == 0 {
+		return remoteIP
+	}
+
+	return resolveIP(remoteIP, func(name string) []string {
+		return r.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	}, options[0])
+}
+
+// resolveIP returns the user IP of a request sent by given peer, whose header values are returned by given function.
+func resolveIP(remoteIP net.IP, values func(name string) []string, options Options) net.IP {
+	if len(options.TrustedProxies) > 0 {
+		if !isTrustedProxy(remoteIP, options.TrustedProxies) {
+			return remoteIP
 		}
+		return getProxiedIP(remoteIP, values, options)
+	}
 
-		ip = strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if options.TrustForwardHeader {
+		if options.ClientIPHeader != "" {
+			ip := parseHop(firstValue(values(options.ClientIPHeader)))
+			if ip != nil {
+				return ip
+			}
+		}
+
+		hops := getHops(values, options)
+		if len(hops) > 0 {
+			return parseHop(hops[0])
+		}
+
+		ip := strings.TrimSpace(firstValue(values("X-Real-IP")))
 		if ip != "" {
 			return net.ParseIP(ip)
 		}
 	}
 
+	return remoteIP
+}
+
+// getRemoteIP returns the IP address of the peer of given request.
+func getRemoteIP(r *http.Request) net.IP {
 	remoteAddr := strings.TrimSpace(r.RemoteAddr)
 	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -55,18 +126,197 @@ func GetIP(r *http.Request, options ...Options) net.IP {
 	return net.ParseIP(host)
 }
 
+// getProxiedIP returns IP address from the forwarding headers of a request sent by a trusted proxy.
+// Only ForwardedHeader is walked: other forwarding headers may have been sent by the client, and passed through
+// untouched by the proxies.
+func getProxiedIP(remoteIP net.IP, values func(name string) []string, options Options) net.IP {
+	if options.ClientIPHeader != "" {
+		ip := parseHop(firstValue(values(options.ClientIPHeader)))
+		if ip != nil {
+			return ip
+		}
+	}
+
+	hops := getHops(values, options)
+	if len(hops) > 0 {
+		return walkHops(remoteIP, hops, options.TrustedProxies)
+	}
+
+	return remoteIP
+}
+
+// getHops returns the hops of ForwardedHeader, from the client to the last proxy. Multiple header lines are
+// combined in order.
+func getHops(values func(name string) []string, options Options) []string {
+	if strings.EqualFold(options.ForwardedHeader, ForwardedHeader) {
+		return getForwardedFor(values(ForwardedHeader))
+	}
+
+	header := options.ForwardedHeader
+	if header == "" {
+		header = XForwardedForHeader
+	}
+
+	hops := []string{}
+	for _, value := range values(header) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	return hops
+}
+
+// firstValue returns the first of given header values, or an empty string.
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// walkHops returns the first untrusted hop, walking given hops from the right.
+// If a hop can't be parsed (e.g. "unknown" or an obfuscated identifier), the address of the proxy which has
+// forwarded it is returned. If every hop is trusted, the leftmost one is returned.
+func walkHops(remoteIP net.IP, hops []string, proxies []*net.IPNet) net.IP {
+	ip := remoteIP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			return ip
+		}
+
+		ip = hop
+		if !isTrustedProxy(ip, proxies) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+// isTrustedProxy returns true if given IP address belongs to a trusted network.
+func isTrustedProxy(ip net.IP, proxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop parses the IP address of a hop, which may be quoted, followed by a port, or wrapped in brackets for an
+// IPv6 address, such as "192.0.2.60", "192.0.2.60:4711" or "[2001:db8:cafe::17]:4711".
+// It returns nil if the hop isn't an IP address.
+func parseHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if len(hop) >= 2 && hop[0] == '"' && hop[len(hop)-1] == '"' {
+		hop = hop[1 : len(hop)-1]
+	}
+
+	if strings.HasPrefix(hop, "[") {
+		end := strings.IndexByte(hop, ']')
+		if end < 0 {
+			return nil
+		}
+		return net.ParseIP(hop[1:end])
+	}
+
+	ip := net.ParseIP(hop)
+	if ip != nil {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(hop)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// getForwardedFor returns the "for" parameter of every element of given Forwarded headers, as defined by RFC 7239,
+// in order. Elements without "for" parameter are returned as empty hops.
+func getForwardedFor(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			if strings.TrimSpace(element) == "" {
+				continue
+			}
+
+			hop := ""
+			for _, pair := range splitQuoted(element, ';') {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hop = unquote(pair[4:])
+					break
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits given value around given separator, except inside quoted strings.
+func splitQuoted(value string, separator byte) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case quoted && value[i] == '\\':
+			i++
+		case value[i] == '"':
+			quoted = !quoted
+		case !quoted && value[i] == separator:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
+
+// unquote returns the content of given quoted string, without its escape characters.
+// Tokens are returned unchanged.
+func unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+
+	value = value[1 : len(value)-1]
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+
+	builder := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		builder.WriteByte(value[i])
+	}
+	return builder.String()
+}
+
 // GetIPWithMask returns IP address from request by applying a mask.
 func GetIPWithMask(r *http.Request, options ...Options) net.IP {
 	if len(options) == 0 {
 		return GetIP(r)
 	}
 
-	ip := GetIP(r, options[0])
+	return maskIP(GetIP(r, options[0]), options[0])
+}
+
+// maskIP returns given IP address masked with IPv4Mask or IPv6Mask of given options.
+func maskIP(ip net.IP, options Options) net.IP {
 	if ip.To4() != nil {
-		return ip.Mask(options[0].IPv4Mask)
+		return ip.Mask(options.IPv4Mask)
 	}
 	if ip.To16() != nil {
-		return ip.Mask(options[0].IPv6Mask)
+		return ip.Mask(options.IPv6Mask)
 	}
 	return ip
 }
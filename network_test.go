@@ -235,3 +235,183 @@ func TestGetIPKey(t *testing.T) {
 		is.Equal(scenario.expected, key, message)
 	}
 }
+
+func TestGetIPTrustedProxies(t *testing.T) {
+	is := require.New(t)
+
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	is.NoError(err)
+	_, proxies6, err := net.ParseCIDR("fd00::/8")
+	is.NoError(err)
+
+	limiter1 := New(limiter.WithTrustedProxies([]*net.IPNet{proxies, proxies6}))
+	limiter2 := New(
+		limiter.WithTrustedProxies([]*net.IPNet{proxies}),
+		limiter.WithClientIPHeader("CF-Connecting-IP"),
+	)
+	limiter3 := New(limiter.WithTrustForwardHeader(true), limiter.WithClientIPHeader("True-Client-IP"))
+	limiter4 := New(
+		limiter.WithTrustedProxies([]*net.IPNet{proxies, proxies6}),
+		limiter.WithForwardedHeader(limiter.ForwardedHeader),
+	)
+	limiter5 := New(limiter.WithTrustForwardHeader(true), limiter.WithForwardedHeader(limiter.ForwardedHeader))
+	limiter6 := New(limiter.WithTrustedProxies([]*net.IPNet{proxies}), limiter.WithClientIPHeader("X-Real-IP"))
+
+	newRequest := func(remoteAddr string, headers ...string) *http.Request {
+		request := &http.Request{
+			URL:        &url.URL{Path: "/"},
+			Header:     http.Header{},
+			RemoteAddr: remoteAddr,
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Add(headers[i], headers[i+1])
+		}
+		return request
+	}
+
+	scenarios := []struct {
+		request  *http.Request
+		limiter  *limiter.Limiter
+		expected net.IP
+	}{
+		{
+			//
+			// Scenario #1 : X-Forwarded-For from an untrusted peer.
+			//
+			request:  newRequest("8.8.8.8:8888", "X-Forwarded-For", "9.9.9.9"),
+			limiter:  limiter1,
+			expected: net.ParseIP("8.8.8.8").To4(),
+		},
+		{
+			//
+			// Scenario #2 : X-Forwarded-For spoofed by the client, from a trusted proxy.
+			//
+			request:  newRequest("10.0.0.1:8888", "X-Forwarded-For", "1.1.1.1, 9.9.9.9"),
+			limiter:  limiter1,
+			expected: net.ParseIP("9.9.9.9").To4(),
+		},
+		{
+			//
+			// Scenario #3 : X-Forwarded-For through a chain of trusted proxies, on multiple lines.
+			//
+			request: newRequest("10.0.0.1:8888",
+				"X-Forwarded-For", "1.1.1.1, 9.9.9.9",
+				"X-Forwarded-For", "10.0.0.2, 10.0.0.3"),
+			limiter:  limiter1,
+			expected: net.ParseIP("9.9.9.9").To4(),
+		},
+		{
+			//
+			// Scenario #4 : X-Forwarded-For with only trusted proxies.
+			//
+			request:  newRequest("10.0.0.1:8888", "X-Forwarded-For", "10.0.0.3, 10.0.0.2"),
+			limiter:  limiter1,
+			expected: net.ParseIP("10.0.0.3").To4(),
+		},
+		{
+			//
+			// Scenario #5 : X-Forwarded-For with an unknown hop.
+			//
+			request:  newRequest("10.0.0.1:8888", "X-Forwarded-For", "9.9.9.9, unknown, 10.0.0.2"),
+			limiter:  limiter1,
+			expected: net.ParseIP("10.0.0.2").To4(),
+		},
+		{
+			//
+			// Scenario #6 : Forwarded with a quoted IPv6 address and a port.
+			//
+			request: newRequest("[fd00::1]:8888",
+				"Forwarded", `for=1.1.1.1, For="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2`),
+			limiter:  limiter4,
+			expected: net.ParseIP("2001:db8:cafe::17"),
+		},
+		{
+			//
+			// Scenario #7 : Forwarded sent by the client is ignored when proxies append to X-Forwarded-For.
+			//
+			request: newRequest("10.0.0.1:8888",
+				"Forwarded", "for=1.2.3.4",
+				"X-Forwarded-For", "203.0.113.7"),
+			limiter:  limiter1,
+			expected: net.ParseIP("203.0.113.7").To4(),
+		},
+		{
+			//
+			// Scenario #8 : Forwarded with an obfuscated identifier.
+			//
+			request:  newRequest("10.0.0.1:8888", "Forwarded", "for=_hidden;proto=http"),
+			limiter:  limiter4,
+			expected: net.ParseIP("10.0.0.1").To4(),
+		},
+		{
+			//
+			// Scenario #9 : X-Real-IP from a trusted proxy, which isn't configured.
+			//
+			request:  newRequest("10.0.0.1:8888", "X-Real-IP", "6.6.6.6"),
+			limiter:  limiter1,
+			expected: net.ParseIP("10.0.0.1").To4(),
+		},
+		{
+			//
+			// Scenario #10 : Custom header from a trusted proxy.
+			//
+			request: newRequest("10.0.0.1:8888",
+				"CF-Connecting-IP", "5.5.5.5",
+				"X-Forwarded-For", "9.9.9.9"),
+			limiter:  limiter2,
+			expected: net.ParseIP("5.5.5.5").To4(),
+		},
+		{
+			//
+			// Scenario #11 : Custom header from an untrusted peer.
+			//
+			request:  newRequest("8.8.8.8:8888", "CF-Connecting-IP", "5.5.5.5"),
+			limiter:  limiter2,
+			expected: net.ParseIP("8.8.8.8").To4(),
+		},
+		{
+			//
+			// Scenario #12 : Custom header without trusted proxies.
+			//
+			request: newRequest("8.8.8.8:8888",
+				"True-Client-IP", "5.5.5.5",
+				"X-Forwarded-For", "9.9.9.9"),
+			limiter:  limiter3,
+			expected: net.ParseIP("5.5.5.5").To4(),
+		},
+		{
+			//
+			// Scenario #13 : Forwarded without trusted proxies.
+			//
+			request:  newRequest("8.8.8.8:8888", "Forwarded", `for="[2001:db8::1]", for=9.9.9.9`),
+			limiter:  limiter5,
+			expected: net.ParseIP("2001:db8::1"),
+		},
+		{
+			//
+			// Scenario #14 : X-Real-IP from a trusted proxy, which is configured.
+			//
+			request: newRequest("10.0.0.1:8888",
+				"X-Real-IP", "6.6.6.6",
+				"X-Forwarded-For", "9.9.9.9"),
+			limiter:  limiter6,
+			expected: net.ParseIP("6.6.6.6").To4(),
+		},
+		{
+			//
+			// Scenario #15 : X-Forwarded-For sent by the client is ignored when proxies append to Forwarded.
+			//
+			request: newRequest("10.0.0.1:8888",
+				"Forwarded", "for=203.0.113.7",
+				"X-Forwarded-For", "1.2.3.4"),
+			limiter:  limiter4,
+			expected: net.ParseIP("203.0.113.7").To4(),
+		},
+	}
+
+	for i, scenario := range scenarios {
+		message := fmt.Sprintf("Scenario #%d", (i + 1))
+		ip := scenario.limiter.GetIPWithMask(scenario.request)
+		is.Equal(scenario.expected, ip, message)
+	}
+}
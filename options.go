@@ -15,6 +15,28 @@ type Options struct {
 	IPv6Mask net.IPMask
 	// TrustForwardHeader enable parsing of X-Real-IP and X-Forwarded-For headers to obtain user IP.
 	TrustForwardHeader bool
+	// TrustedProxies are the networks of the proxies whose forwarding headers are trusted.
+	// If defined, forwarding headers are only parsed when the request comes from a trusted proxy, and the user IP is
+	// the first untrusted hop, walking ForwardedHeader from the right.
+	TrustedProxies []*net.IPNet
+	// ForwardedHeader is the forwarding header which trusted proxies append to: XForwardedForHeader or
+	// ForwardedHeader. Other forwarding headers are ignored. XForwardedForHeader is used if empty.
+	ForwardedHeader string
+	// ClientIPHeader is a header holding the user IP, set by a trusted proxy such as a CDN (e.g. CF-Connecting-IP,
+	// True-Client-IP or X-Real-IP). It takes precedence over ForwardedHeader.
+	ClientIPHeader string
+	// Allowlist are the networks which are never rate limited.
+	Allowlist *IPList
+	// Denylist are the networks which are always rejected. It takes precedence over Allowlist.
+	Denylist *IPList
+	// IPv4Prefixes are the prefix levels of IPv4 addresses, such as /32 and /24, which are all checked by
+	// GetIPPrefixes instead of the masked address.
+	IPv4Prefixes []PrefixRate
+	// IPv6Prefixes are the prefix levels of IPv6 addresses, such as /64, /56 and /48, which are all checked by
+	// GetIPPrefixes instead of the masked address.
+	// Prefix levels of both families are also used by gin and fasthttp middlewares, unless they have a custom
+	// KeyGetter.
+	IPv6Prefixes []PrefixRate
 }
 
 // WithIPv4Mask will configure the limiter to use given mask for IPv4 address.
@@ -37,3 +59,59 @@ func WithTrustForwardHeader(enable bool) Option {
 		o.TrustForwardHeader = enable
 	}
 }
+
+// WithTrustedProxies will configure the limiter to trust forwarding headers of requests coming from given networks,
+// and to obtain user IP from the first untrusted hop of these headers.
+func WithTrustedProxies(proxies []*net.IPNet) Option {
+	return func(o *Options) {
+		o.TrustedProxies = proxies
+	}
+}
+
+// WithForwardedHeader will configure the limiter to walk given forwarding header, which trusted proxies append to:
+// XForwardedForHeader or ForwardedHeader.
+func WithForwardedHeader(header string) Option {
+	return func(o *Options) {
+		o.ForwardedHeader = header
+	}
+}
+
+// WithClientIPHeader will configure the limiter to obtain user IP from given header, when forwarding headers are
+// trusted.
+func WithClientIPHeader(header string) Option {
+	return func(o *Options) {
+		o.ClientIPHeader = header
+	}
+}
+
+// WithAllowlist will configure the limiter to never rate limit IP addresses of given list.
+func WithAllowlist(list *IPList) Option {
+	return func(o *Options) {
+		o.Allowlist = list
+	}
+}
+
+// WithDenylist will configure the limiter to reject IP addresses of given list.
+func WithDenylist(list *IPList) Option {
+	return func(o *Options) {
+		o.Denylist = list
+	}
+}
+
+// WithIPv4Prefixes will configure the limiter to check given prefix levels of IPv4 addresses, each with its own rate.
+// It panics if a prefix length is greater than 32.
+func WithIPv4Prefixes(levels ...PrefixRate) Option {
+	checkPrefixes(levels, 8*net.IPv4len)
+	return func(o *Options) {
+		o.IPv4Prefixes = levels
+	}
+}
+
+// WithIPv6Prefixes will configure the limiter to check given prefix levels of IPv6 addresses, each with its own rate.
+// It panics if a prefix length is greater than 128.
+func WithIPv6Prefixes(levels ...PrefixRate) Option {
+	checkPrefixes(levels, 8*net.IPv6len)
+	return func(o *Options) {
+		o.IPv6Prefixes = levels
+	}
+}
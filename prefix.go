@@ -0,0 +1,99 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// PrefixRate is the rate of every network of a prefix length.
+type PrefixRate struct {
+	// Bits is the prefix length, such as 64 for /64 IPv6 networks or 24 for /24 IPv4 networks.
+	Bits int
+	// Rate is the rate of each network.
+	Rate Rate
+}
+
+// HasPrefixes returns true if the limiter defines prefix levels for the family of given IP address.
+func (limiter *Limiter) HasPrefixes(ip net.IP) bool {
+	return len(limiter.prefixes(ip)) > 0
+}
+
+// GetIPPrefixes increments the counters of every prefix level of given IP address, and returns the most restrictive
+// context: a reached limit with the latest reset, or else the lowest remaining count.
+// The key of a level is its network in CIDR notation, such as "2001:db8:cafe::/48", so levels don't share counters.
+// Without prefix level, the IP address masked with IPv4Mask or IPv6Mask is limited with the rate of the limiter.
+func (limiter *Limiter) GetIPPrefixes(ctx context.Context, ip net.IP) (Context, error) {
+	levels := limiter.prefixes(ip)
+	if len(levels) == 0 {
+		return limiter.Get(ctx, maskIP(ip, limiter.Options).String())
+	}
+
+	requests := make([]Request, len(levels))
+	for i := range levels {
+		requests[i] = Request{
+			Key:  prefixKey(ip, levels[i].Bits),
+			Rate: levels[i].Rate,
+		}
+	}
+
+	contexts, err := limiter.GetMulti(ctx, requests)
+	if err != nil {
+		return Context{}, err
+	}
+
+	return mostRestrictive(contexts), nil
+}
+
+// prefixes returns the prefix levels of the family of given IP address.
+func (limiter *Limiter) prefixes(ip net.IP) []PrefixRate {
+	if ip.To4() != nil {
+		return limiter.Options.IPv4Prefixes
+	}
+	if len(ip) == net.IPv6len {
+		return limiter.Options.IPv6Prefixes
+	}
+	return nil
+}
+
+// prefixKey returns the network of given prefix length which contains given IP address, in CIDR notation.
+func prefixKey(ip net.IP, bits int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(bits, 8*net.IPv4len)
+		return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+	}
+
+	mask := net.CIDRMask(bits, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// mostRestrictive returns the most restrictive of given contexts: a reached limit with the latest reset, or else the
+// lowest remaining count.
+func mostRestrictive(contexts []Context) Context {
+	result := contexts[0]
+	for _, context := range contexts[1:] {
+		switch {
+		case context.Reached != result.Reached:
+			if context.Reached {
+				result = context
+			}
+		case context.Reached:
+			if context.Reset > result.Reset {
+				result = context
+			}
+		case context.Remaining < result.Remaining,
+			context.Remaining == result.Remaining && context.Reset > result.Reset:
+			result = context
+		}
+	}
+	return result
+}
+
+// checkPrefixes panics if a prefix length is out of range, since it would merge every network in a single key.
+func checkPrefixes(levels []PrefixRate, size int) {
+	for _, level := range levels {
+		if level.Bits < 0 || level.Bits > size {
+			panic(fmt.Sprintf("limiter: invalid prefix length /%d, which must be between /0 and /%d", level.Bits, size))
+		}
+	}
+}
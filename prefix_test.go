@@ -0,0 +1,112 @@
+package limiter_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panii/limiter/v3"
+	"github.com/panii/limiter/v3/drivers/store/memory"
+)
+
+func TestLimiterGetIPPrefixes(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	instance := limiter.New(memory.NewStore(), limiter.Rate{Limit: 1, Period: time.Minute},
+		limiter.WithIPv6Prefixes(
+			limiter.PrefixRate{Bits: 64, Rate: limiter.Rate{Limit: 2, Period: time.Minute}},
+			limiter.PrefixRate{Bits: 56, Rate: limiter.Rate{Limit: 3, Period: time.Minute}},
+			limiter.PrefixRate{Bits: 48, Rate: limiter.Rate{Limit: 5, Period: time.Hour}},
+		),
+	)
+
+	// The /64 network is the most restrictive.
+	ip := net.ParseIP("2001:db8:cafe:1::1")
+	is.True(instance.HasPrefixes(ip))
+
+	lctx, err := instance.GetIPPrefixes(ctx, ip)
+	is.NoError(err)
+	is.Equal(int64(2), lctx.Limit)
+	is.Equal(int64(1), lctx.Remaining)
+
+	// Rotating addresses inside the /64 network doesn't evade it.
+	lctx, err = instance.GetIPPrefixes(ctx, net.ParseIP("2001:db8:cafe:1::2"))
+	is.NoError(err)
+	is.Equal(int64(2), lctx.Limit)
+	is.Equal(int64(0), lctx.Remaining)
+	is.False(lctx.Reached)
+
+	lctx, err = instance.GetIPPrefixes(ctx, net.ParseIP("2001:db8:cafe:1::3"))
+	is.NoError(err)
+	is.Equal(int64(2), lctx.Limit)
+	is.True(lctx.Reached)
+
+	// Another /64 network of the same /56 network is limited by the /56 network.
+	lctx, err = instance.GetIPPrefixes(ctx, net.ParseIP("2001:db8:cafe:2::1"))
+	is.NoError(err)
+	is.Equal(int64(3), lctx.Limit)
+	is.True(lctx.Reached)
+
+	// Another /56 network of the same /48 network is limited by the /48 network, whose reset is the latest.
+	lctx, err = instance.GetIPPrefixes(ctx, net.ParseIP("2001:db8:cafe:100::1"))
+	is.NoError(err)
+	is.Equal(int64(5), lctx.Limit)
+	is.Equal(int64(0), lctx.Remaining)
+	is.False(lctx.Reached)
+
+	lctx, err = instance.GetIPPrefixes(ctx, net.ParseIP("2001:db8:cafe:200::1"))
+	is.NoError(err)
+	is.Equal(int64(5), lctx.Limit)
+	is.True(lctx.Reached)
+
+	// Counters are kept by network.
+	lctx, err = instance.Store.Peek(ctx, "2001:db8:cafe::/48", limiter.Rate{Limit: 10, Period: time.Hour})
+	is.NoError(err)
+	is.Equal(int64(4), lctx.Remaining)
+
+	// IPv4 addresses without prefix levels are limited with the rate of the limiter.
+	ip = net.ParseIP("192.0.2.1")
+	is.False(instance.HasPrefixes(ip))
+
+	lctx, err = instance.GetIPPrefixes(ctx, ip)
+	is.NoError(err)
+	is.Equal(int64(1), lctx.Limit)
+	is.Equal(int64(0), lctx.Remaining)
+}
+
+func TestLimiterGetIPv4Prefixes(t *testing.T) {
+	is := require.New(t)
+	ctx := context.Background()
+
+	instance := New(limiter.WithIPv4Prefixes(
+		limiter.PrefixRate{Bits: 32, Rate: limiter.Rate{Limit: 2, Period: time.Minute}},
+		limiter.PrefixRate{Bits: 24, Rate: limiter.Rate{Limit: 3, Period: time.Minute}},
+	))
+
+	scenarios := []struct {
+		ip      string
+		limit   int64
+		reached bool
+	}{
+		{ip: "192.0.2.1", limit: 2, reached: false},
+		{ip: "192.0.2.1", limit: 2, reached: false},
+		{ip: "192.0.2.1", limit: 2, reached: true},
+		{ip: "::ffff:192.0.2.2", limit: 3, reached: true},
+		{ip: "192.0.3.1", limit: 2, reached: false},
+	}
+
+	for i, scenario := range scenarios {
+		lctx, err := instance.GetIPPrefixes(ctx, net.ParseIP(scenario.ip))
+		is.NoError(err)
+		is.Equal(scenario.limit, lctx.Limit, "Scenario #%d", i+1)
+		is.Equal(scenario.reached, lctx.Reached, "Scenario #%d", i+1)
+	}
+
+	is.Panics(func() {
+		limiter.WithIPv4Prefixes(limiter.PrefixRate{Bits: 33})
+	})
+}
@@ -3,8 +3,13 @@ package limiter
 import (
 	"context"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// ErrStoreClosed is returned by a store that has been closed.
+var ErrStoreClosed = errors.New("limiter: store is closed")
+
 // Store is the common interface for limiter stores.
 type Store interface {
 	// Get returns the limit for given identifier.
@@ -15,6 +20,71 @@ type Store interface {
 	Reset(ctx context.Context, key string, rate Rate) (Context, error)
 }
 
+// Request is a limit check of an identifier with a rate, in a batch.
+type Request struct {
+	// Key is the identifier.
+	Key string
+	// Rate is the rate of the identifier.
+	Rate Rate
+}
+
+// BatchStore is implemented by stores which are able to check several limits at once.
+type BatchStore interface {
+	// GetMulti returns the limit of every request, in order.
+	GetMulti(ctx context.Context, requests []Request) ([]Context, error)
+}
+
+// KeyInfo is the state of a key returned by a Scanner.
+type KeyInfo struct {
+	// Key is the identifier, without the prefix of the store.
+	Key string
+	// Count is the current value of the counter.
+	Count int64
+	// TTL is the remaining duration of the current window.
+	TTL time.Duration
+}
+
+// Scanner is implemented by stores which are able to enumerate their keys.
+type Scanner interface {
+	// Scan returns a page of the keys whose identifier starts with given prefix, and the cursor of the next page.
+	// A scan starts with a zero cursor, and ends when the returned cursor is zero. Keys created or deleted during a
+	// scan may be missed, and a page may be empty before the end of the scan.
+	Scan(ctx context.Context, prefix string, cursor uint64) ([]KeyInfo, uint64, error)
+	// DeletePrefix deletes every key whose identifier starts with given prefix, and returns the number of deleted
+	// keys.
+	DeletePrefix(ctx context.Context, prefix string) (int64, error)
+}
+
+// Seeder is implemented by stores which are able to add several hits to an identifier at once.
+type Seeder interface {
+	// Seed adds given number of hits to given identifier, which expires after given TTL if it's created.
+	// The expiration of an existing identifier is kept.
+	Seed(ctx context.Context, key string, count int64, ttl time.Duration) error
+}
+
+// Pinger is implemented by stores which are able to check the availability of their backend.
+type Pinger interface {
+	// Ping returns an error if the store is unable to serve requests.
+	Ping(ctx context.Context) error
+}
+
+// StatsReporter is implemented by stores which are able to report statistics about their state.
+type StatsReporter interface {
+	// Stats returns a snapshot of the store statistics.
+	Stats() StoreStats
+}
+
+// StoreStats are statistics reported by a store.
+// A field is negative when it's not supported by the store.
+type StoreStats struct {
+	// Keys is the number of keys held by the store.
+	Keys int64
+	// Evicted is the number of expired keys removed by the store.
+	Evicted int64
+	// Errors is the number of operations that have failed on the store backend.
+	Errors int64
+}
+
 // StoreOptions are options for store.
 type StoreOptions struct {
 	// Prefix is the prefix to use for the key.
@@ -29,4 +99,27 @@ type StoreOptions struct {
 	// reduce performance and increase lock contention.
 	// Setting this to a high value will maximum throughput, but will increase the memory footprint.
 	CleanUpInterval time.Duration
+
+	// SnapshotPath is the file used to persist counters across restarts on memory store.
+	// Counters are restored from this file on startup, and written to it when the store is closed.
+	SnapshotPath string
+
+	// SnapshotInterval is the interval between two snapshots written to SnapshotPath on memory store.
+	// Setting this to zero will only write a snapshot when the store is closed.
+	SnapshotInterval time.Duration
+
+	// HashTag wraps the identifier of every key in a hash tag on redis store, as "prefix:{identifier}", so every key
+	// of an identifier is stored in the same slot on Redis Cluster.
+	// It's required by scripts which use several keys per identifier, but it changes every key: counters of the
+	// previous layout are ignored. The prefix can't contain any brace.
+	HashTag bool
+
+	// SyncInterval is the interval between two flushes of the write-ahead log to disk on file store.
+	// Setting this to zero will flush the log on every write, which is durable but much slower.
+	SyncInterval time.Duration
+
+	// ServerTime makes lua scripts on redis store use the time of the redis server, instead of the local clock,
+	// so every instance computes the same expirations even with skewed clocks.
+	// Scripts call TIME before writing, so it requires script effects replication (Redis 3.2 or later).
+	ServerTime bool
 }